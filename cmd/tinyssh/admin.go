@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dollarkillerx/tinyssh/internal/config"
+)
+
+// adminRequest sends a request to the admin API configured in cfg and returns
+// the response body, failing on non-2xx statuses.
+func adminRequest(cfg *config.Config, method, path string, body io.Reader) ([]byte, error) {
+	if cfg.AdminListen == "" {
+		return nil, errors.New("admin_listen is not configured")
+	}
+
+	base := "http://" + cfg.AdminListen
+	transport := &http.Transport{}
+	if strings.HasPrefix(cfg.AdminListen, "/") {
+		base = "http://unix"
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", cfg.AdminListen)
+		}
+	}
+	client := &http.Client{Transport: transport, Timeout: 10 * time.Second}
+
+	req, err := http.NewRequest(method, base+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.AdminToken != "" {
+		req.Header.Set("Authorization", "Bearer "+cfg.AdminToken)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("admin api: %w", err)
+	}
+	defer resp.Body.Close()
+
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("admin api: %w", err)
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("admin api: %s: %s", resp.Status, strings.TrimSpace(string(raw)))
+	}
+	return raw, nil
+}
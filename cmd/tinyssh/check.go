@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"maps"
+	"os"
+	"os/exec"
+	"slices"
+
+	"github.com/dollarkillerx/tinyssh/internal/config"
+	"github.com/dollarkillerx/tinyssh/internal/server"
+)
+
+// runCheck implements "tinyssh check": it loads the configuration as the
+// server would, then checks the files and programs it refers to, and exits
+// non-zero if anything is wrong. It is meant for CI and for checking a
+// change before restarting or reloading the server.
+func runCheck(args []string) int {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	configPath := fs.String("config", "config.json", "path to configuration file")
+	quiet := fs.Bool("q", false, "print nothing when the configuration is valid")
+	override := overrides{}
+	fs.BoolFunc("strict", "reject unknown configuration fields", override.setStrict)
+	_ = fs.Parse(args)
+
+	cfg, err := config.LoadWith(*configPath, override)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", *configPath, err)
+		return 1
+	}
+	problems := checkReferences(cfg)
+	for _, problem := range problems {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", *configPath, problem)
+	}
+	if len(problems) > 0 {
+		return 1
+	}
+	if !*quiet {
+		fmt.Printf("%s: configuration is valid\n", *configPath)
+	}
+	return 0
+}
+
+// checkReferences reports problems with the host keys, certificates, other
+// files and programs cfg refers to, which loading it does not open.
+func checkReferences(cfg *config.Config) []error {
+	var problems []error
+	if err := server.CheckHostKeys(cfg); err != nil {
+		problems = append(problems, fmt.Errorf("host keys: %w", err))
+	}
+	return append(problems, checkFiles(cfg)...)
+}
+
+// checkFiles is checkReferences without the host keys.
+func checkFiles(cfg *config.Config) []error {
+	var problems []error
+	if _, err := exec.LookPath(cfg.Shell); err != nil {
+		problems = append(problems, fmt.Errorf("shell: %w", err))
+	}
+	for _, user := range cfg.Users {
+		if len(user.RunAsWrapper) == 0 {
+			continue
+		}
+		if _, err := exec.LookPath(user.RunAsWrapper[0]); err != nil {
+			problems = append(problems, fmt.Errorf("user %s run_as_wrapper: %w", user.Username, err))
+		}
+	}
+
+	checkKeyPair := func(field, cert, key string) {
+		if cert == "" {
+			return
+		}
+		if _, err := tls.LoadX509KeyPair(cert, key); err != nil {
+			problems = append(problems, fmt.Errorf("%s: %w", field, err))
+		}
+	}
+	for _, l := range cfg.SSHListeners() {
+		checkKeyPair("listener "+l.Address+" tls_cert/tls_key", l.TLSCert, l.TLSKey)
+	}
+	checkKeyPair("vhost tls_cert/tls_key", cfg.VHost.TLSCert, cfg.VHost.TLSKey)
+	checkKeyPair("web_terminal tls_cert/tls_key", cfg.WebTerminal.TLSCert, cfg.WebTerminal.TLSKey)
+
+	for _, name := range slices.Sorted(maps.Keys(cfg.Upstreams)) {
+		if path := cfg.Upstreams[name].IdentityFile; path != "" {
+			if _, err := os.ReadFile(path); err != nil {
+				problems = append(problems, fmt.Errorf("upstream %s identity_file: %w", name, err))
+			}
+		}
+	}
+	if cfg.GeoIP.Database != "" {
+		if _, err := os.Stat(cfg.GeoIP.Database); err != nil {
+			problems = append(problems, fmt.Errorf("geoip database: %w", err))
+		}
+	}
+	return problems
+}
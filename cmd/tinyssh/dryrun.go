@@ -0,0 +1,29 @@
+package main
+
+import (
+	"log/slog"
+
+	"github.com/dollarkillerx/tinyssh/internal/config"
+	"github.com/dollarkillerx/tinyssh/internal/server"
+)
+
+// dryRun implements -dry-run: with the configuration already loaded, it
+// checks the programs and files cfg refers to and goes through the rest
+// of the startup with server.DryRun, logging what would happen. It returns
+// the exit status.
+func dryRun(cfg *config.Config, logger *slog.Logger) int {
+	failed := false
+	for _, problem := range checkFiles(cfg) {
+		logger.Error("dry run", "err", problem)
+		failed = true
+	}
+	if err := server.DryRun(cfg, logger); err != nil {
+		logger.Error("dry run", "err", err)
+		failed = true
+	}
+	if failed {
+		return 1
+	}
+	logger.Info("dry run succeeded", "shell", cfg.Shell, "users", len(cfg.Users))
+	return 0
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/yaml.v3"
+
+	"github.com/dollarkillerx/tinyssh/internal/config"
+)
+
+// importHeader heads YAML output of "tinyssh import-openssh".
+const importHeader = `Converted from %s by "tinyssh import-openssh".
+tinyssh only supports password authentication: users with an
+authorized_keys file were given random passwords and their keys were not
+imported.`
+
+// runImportOpenSSH implements "tinyssh import-openssh": it translates an
+// sshd_config and the authorized_keys files of its users into a tinyssh
+// configuration printed on stdout. Anything it cannot carry over is
+// reported on stderr.
+func runImportOpenSSH(args []string) int {
+	fs := flag.NewFlagSet("import-openssh", flag.ExitOnError)
+	sshdConfig := fs.String("sshd-config", "/etc/ssh/sshd_config", "path to sshd_config")
+	usersFlag := fs.String("users", "", "comma-separated users to import (default: every user in /etc/passwd with an authorized_keys file)")
+	keysFile := fs.String("authorized-keys", ".ssh/authorized_keys", "AuthorizedKeysFile pattern, relative to the home directory; %h, %u and %% are expanded")
+	format := fs.String("format", "yaml", "output format (yaml, json)")
+	_ = fs.Parse(args)
+
+	// Directives tinyssh cannot honour are dropped with a warning rather
+	// than failing, since "PasswordAuthentication no" is common in the
+	// configurations being migrated.
+	doc, err := config.ReadDocument(*sshdConfig, func(err error) {
+		fmt.Fprintln(os.Stderr, "skipped:", err)
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", *sshdConfig, err)
+		return 1
+	}
+	var names []string
+	if *usersFlag != "" {
+		names = strings.Split(*usersFlag, ",")
+	} else if names, err = readPasswd("/etc/passwd"); err != nil {
+		fmt.Fprintln(os.Stderr, "read users:", err)
+		return 1
+	}
+
+	users, _ := doc["users"].([]any)
+	existing := make(map[string]bool)
+	for _, u := range users {
+		if entry, ok := u.(map[string]any); ok {
+			name, _ := entry["username"].(string)
+			existing[name] = true
+		}
+	}
+	for _, name := range names {
+		if existing[name] {
+			continue
+		}
+		account, err := user.Lookup(name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "user %s: %v\n", name, err)
+			continue
+		}
+		path := expandKeysFile(*keysFile, name, account.HomeDir)
+		raw, err := os.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) && *usersFlag == "" {
+			continue
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "user %s: %v\n", name, err)
+			continue
+		}
+		entry, warnings := importUser(name, raw)
+		for _, warning := range warnings {
+			fmt.Fprintf(os.Stderr, "user %s: %s: %s\n", name, path, warning)
+		}
+		users = append(users, entry)
+	}
+	if len(users) == 0 {
+		fmt.Fprintln(os.Stderr, "no users found; add them to the users list before starting tinyssh")
+	} else {
+		doc["users"] = users
+	}
+
+	raw, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "encode config:", err)
+		return 1
+	}
+	switch *format {
+	case "json":
+		fmt.Println(string(raw))
+	case "yaml":
+		var node yaml.Node
+		if err := yaml.Unmarshal(raw, &node); err != nil {
+			fmt.Fprintln(os.Stderr, "encode config:", err)
+			return 1
+		}
+		blockStyle(&node)
+		node.HeadComment = fmt.Sprintf(importHeader, *sshdConfig)
+		enc := yaml.NewEncoder(os.Stdout)
+		enc.SetIndent(2)
+		if err := enc.Encode(&node); err != nil {
+			fmt.Fprintln(os.Stderr, "encode config:", err)
+			return 1
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "unknown format %q\n", *format)
+		return 2
+	}
+	return 0
+}
+
+// importUser builds the user entry for an account with the authorized_keys
+// file raw. Key options tinyssh has a counterpart for become user settings;
+// the rest are returned as warnings, as are keys whose options differ from
+// the first key's, since tinyssh settings apply to the whole account.
+func importUser(name string, raw []byte) (map[string]any, []string) {
+	entry := map[string]any{"username": name, "password": rand.Text()}
+	var warnings []string
+	var first map[string]any
+	for n := 0; len(raw) > 0; n++ {
+		_, _, options, rest, err := ssh.ParseAuthorizedKey(raw)
+		if err != nil {
+			// ParseAuthorizedKey only fails once no valid line is left.
+			break
+		}
+		raw = rest
+		settings, ignored := keyOptions(options)
+		for _, option := range ignored {
+			warnings = append(warnings, fmt.Sprintf("key %d: option %s is not supported", n+1, option))
+		}
+		if first == nil {
+			first = settings
+			continue
+		}
+		if !reflect.DeepEqual(first, settings) {
+			warnings = append(warnings, fmt.Sprintf("key %d: options differ from the first key, which were used", n+1))
+		}
+	}
+	for key, value := range first {
+		entry[key] = value
+	}
+	return entry, warnings
+}
+
+// keyOptions translates authorized_keys options into user settings and
+// returns the options it could not translate.
+func keyOptions(options []string) (map[string]any, []string) {
+	settings := make(map[string]any)
+	var ignored []string
+	restrict, forwarding := false, false
+	for _, option := range options {
+		name, value, _ := strings.Cut(option, "=")
+		value = strings.Trim(value, `"`)
+		switch strings.ToLower(name) {
+		case "restrict":
+			restrict = true
+		case "port-forwarding":
+			forwarding = true
+		case "no-port-forwarding":
+			settings["allow_tcp_forwarding"] = config.ForwardingNone
+		case "permitopen":
+			settings["permit_open"] = append(anyList(settings["permit_open"]), value)
+		case "permitlisten":
+			settings["permit_listen"] = append(anyList(settings["permit_listen"]), value)
+		case "command":
+			if value != "internal-sftp" {
+				ignored = append(ignored, option)
+				continue
+			}
+			settings["sftp_only"] = true
+		case "no-agent-forwarding", "no-x11-forwarding", "no-user-rc":
+			// tinyssh offers no agent or X11 forwarding and runs no rc files.
+		default:
+			ignored = append(ignored, option)
+		}
+	}
+	if restrict && !forwarding {
+		settings["allow_tcp_forwarding"] = config.ForwardingNone
+	}
+	return settings, ignored
+}
+
+func anyList(value any) []any {
+	list, _ := value.([]any)
+	return list
+}
+
+// expandKeysFile expands the AuthorizedKeysFile tokens in pattern for the
+// account and makes it absolute, relative to home as sshd does.
+func expandKeysFile(pattern, username, home string) string {
+	path := strings.NewReplacer("%%", "%", "%h", home, "%u", username).Replace(pattern)
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(home, path)
+	}
+	return path
+}
+
+// readPasswd lists the account names in a passwd(5) file in file order.
+func readPasswd(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var names []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		name, _, ok := strings.Cut(scanner.Text(), ":")
+		if ok && name != "" && !strings.HasPrefix(name, "#") {
+			names = append(names, name)
+		}
+	}
+	return names, scanner.Err()
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+
+	"github.com/dollarkillerx/tinyssh/internal/config"
+	"github.com/dollarkillerx/tinyssh/internal/server"
+)
+
+// starterConfig is the configuration "tinyssh init" writes: only what a
+// working server needs, leaving every other option to its default.
+type starterConfig struct {
+	ListenAddress string        `json:"listen_address" yaml:"listen_address" toml:"listen_address"`
+	HostKeyPaths  []string      `json:"host_key_paths" yaml:"host_key_paths" toml:"host_key_paths"`
+	Users         []starterUser `json:"users" yaml:"users" toml:"users"`
+}
+
+type starterUser struct {
+	Username string `json:"username" yaml:"username" toml:"username"`
+	Password string `json:"password" yaml:"password" toml:"password"`
+}
+
+// runInit implements "tinyssh init": it writes a starter configuration
+// with one user and a random password, generates the host keys and prints
+// what is needed to log in. An existing configuration is never replaced.
+func runInit(args []string) int {
+	fs := flag.NewFlagSet("init", flag.ExitOnError)
+	configPath := fs.String("config", "config.json", "path of the configuration file to create (.json, .yaml or .toml)")
+	listen := fs.String("listen", ":2222", "listen address")
+	username := fs.String("user", defaultUsername(), "name of the first user")
+	_ = fs.Parse(args)
+
+	starter := starterConfig{
+		ListenAddress: *listen,
+		HostKeyPaths:  []string{"ssh_host_ed25519_key", "ssh_host_ecdsa_key"},
+		Users:         []starterUser{{Username: *username, Password: rand.Text()}},
+	}
+	raw, err := encodeStarter(*configPath, starter)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "encode config:", err)
+		return 1
+	}
+	if err := os.MkdirAll(filepath.Dir(*configPath), 0700); err != nil {
+		fmt.Fprintln(os.Stderr, "create config directory:", err)
+		return 1
+	}
+	// The file holds the password, so only the owner may read it.
+	f, err := os.OpenFile(*configPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if errors.Is(err, os.ErrExist) {
+		fmt.Fprintf(os.Stderr, "%s already exists; remove it or choose another path with -config\n", *configPath)
+		return 1
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "create config:", err)
+		return 1
+	}
+	_, err = f.Write(raw)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "write config:", err)
+		return 1
+	}
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", *configPath, err)
+		return 1
+	}
+	fingerprints, err := server.GenerateHostKeys(cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "generate host keys:", err)
+		return 1
+	}
+
+	fmt.Printf("Created %s.\n\n", *configPath)
+	for i, path := range cfg.HostKeyPaths {
+		fmt.Printf("Host key %s\n  %s\n", path, fingerprints[i])
+	}
+	fmt.Printf("\nUser:     %s\nPassword: %s\n", *username, starter.Users[0].Password)
+	fmt.Println("The password is not shown again; it can be changed in the configuration file.")
+	fmt.Printf("\nStart the server with:\n  tinyssh -config %s\n", *configPath)
+	return 0
+}
+
+// encodeStarter encodes cfg in the format of the file at path.
+func encodeStarter(path string, cfg starterConfig) ([]byte, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		var buf bytes.Buffer
+		enc := yaml.NewEncoder(&buf)
+		enc.SetIndent(2)
+		err := enc.Encode(cfg)
+		return buf.Bytes(), err
+	case ".toml":
+		var buf bytes.Buffer
+		err := toml.NewEncoder(&buf).Encode(cfg)
+		return buf.Bytes(), err
+	case ".json":
+		raw, err := json.MarshalIndent(cfg, "", "  ")
+		return append(raw, '\n'), err
+	}
+	return nil, fmt.Errorf("unsupported format %q", filepath.Ext(path))
+}
+
+// defaultUsername is the name of the user running tinyssh, so that a plain
+// "ssh -p 2222 host" logs in, or "admin" if it is unknown.
+func defaultUsername() string {
+	if u, err := user.Current(); err == nil && u.Username != "" && !strings.ContainsAny(u.Username, `\ `) {
+		return u.Username
+	}
+	return "admin"
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/dollarkillerx/tinyssh/internal/config"
+	"github.com/dollarkillerx/tinyssh/internal/server"
+)
+
+// runLogLevel implements "tinyssh log-level": it prints the log level of a
+// running server through its admin API, or sets it when one is given.
+func runLogLevel(args []string) int {
+	fs := flag.NewFlagSet("log-level", flag.ExitOnError)
+	configPath := fs.String("config", "config.json", "path to JSON configuration file")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: tinyssh log-level [-config config.json] [debug | info | warn | error]")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() > 1 {
+		fs.Usage()
+		return 2
+	}
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "load config:", err)
+		return 1
+	}
+
+	method, body := http.MethodGet, []byte(nil)
+	if fs.NArg() == 1 {
+		method = http.MethodPut
+		body, _ = json.Marshal(server.LogLevel{Level: fs.Arg(0)})
+	}
+	raw, err := adminRequest(cfg, method, "/log-level", bytes.NewReader(body))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	var level server.LogLevel
+	if err := json.Unmarshal(raw, &level); err != nil {
+		fmt.Fprintln(os.Stderr, "decode log level:", err)
+		return 1
+	}
+	fmt.Println(level.Level)
+	return 0
+}
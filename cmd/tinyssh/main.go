@@ -2,47 +2,279 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
+	"io"
 	"log/slog"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 
 	"github.com/dollarkillerx/tinyssh/internal/config"
+	"github.com/dollarkillerx/tinyssh/internal/logging"
 	"github.com/dollarkillerx/tinyssh/internal/server"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "check":
+			os.Exit(runCheck(os.Args[2:]))
+		case "print-config":
+			os.Exit(runPrintConfig(os.Args[2:]))
+		case "schema":
+			os.Exit(runSchema(os.Args[2:]))
+		case "tunnels":
+			os.Exit(runTunnels(os.Args[2:]))
+		case "init":
+			os.Exit(runInit(os.Args[2:]))
+		case "import-openssh":
+			os.Exit(runImportOpenSSH(os.Args[2:]))
+		case "reservations":
+			os.Exit(runReservations(os.Args[2:]))
+		case "replay":
+			os.Exit(runReplay(os.Args[2:]))
+		case "log-level":
+			os.Exit(runLogLevel(os.Args[2:]))
+		case "verify-log":
+			os.Exit(runVerifyLog(os.Args[2:]))
+		}
+	}
+
 	var (
-		configPath = flag.String("config", "config.json", "path to JSON configuration file")
+		configPath = flag.String("config", "config.json", "path or https:// or s3:// URL of the configuration file")
 		logLevel   = flag.String("log-level", "info", "log level (debug, info, warn, error)")
+		logFormat  = flag.String("log-format", "text", "log format (text, json, ecs, cef, cowrie)")
+		logFile    = flag.String("log-file", "", "append logs to this file instead of standard output")
+		stdio      = flag.Bool("stdio", false, "serve one connection on stdin/stdout and exit (inetd, ProxyCommand)")
+		dryRunFlag = flag.Bool("dry-run", false, "load the configuration and host keys, check the shell and listening addresses, report and exit")
+		override   = overrides{}
 	)
+	override.register(flag.CommandLine)
 	flag.Parse()
 
-	cfg, err := config.Load(*configPath)
+	// With settings given as flags, a missing default config file is not
+	// an error: tinyssh -listen :2222 -user dev:pass runs without one.
+	if len(override) > 0 && !flagSet(flag.CommandLine, "config") {
+		if _, err := os.Stat(*configPath); errors.Is(err, os.ErrNotExist) {
+			*configPath = ""
+		}
+	}
+	cfg, err := config.LoadWith(*configPath, override)
 	if err != nil {
 		slog.Error("load config", "err", err)
 		os.Exit(1)
 	}
 
-	level := parseLevel(*logLevel)
-	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: level}))
+	// level can be changed while running, with SIGUSR2 or the admin API.
+	baseLevel := parseLevel(*logLevel)
+	level := new(slog.LevelVar)
+	level.Set(baseLevel)
+	// In stdio mode stdout carries the SSH stream, so logs go to stderr.
+	logOutput := os.Stdout
+	if *stdio {
+		logOutput = os.Stderr
+	}
+	var logWriter io.Writer = logOutput
+	var rotating *logging.RotatingFile
+	switch {
+	case *logFile != "" && cfg.Log.Rotate.Enabled():
+		rotating, err = logging.OpenRotatingFile(*logFile, cfg.Log.Rotate)
+		if err != nil {
+			slog.Error("log setup", "err", err)
+			os.Exit(1)
+		}
+		defer rotating.Close()
+		logWriter = rotating
+	case *logFile != "":
+		f, err := os.OpenFile(*logFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			slog.Error("log setup", "err", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		logWriter = f
+	}
+	handler, err := logging.NewHandler(logWriter, *logFormat, level)
+	if err != nil {
+		slog.Error("log setup", "err", err)
+		os.Exit(1)
+	}
+	if cfg.Log.Syslog.Enabled() {
+		syslog, err := logging.NewSyslogHandler(cfg.Log.Syslog, level)
+		if err != nil {
+			slog.Error("log setup", "err", err)
+			os.Exit(1)
+		}
+		handler = logging.Fanout(handler, syslog)
+	}
+	// logClosers flush the audit events still buffered for the event
+	// buses and the database; os.Exit skips deferred calls, so closeLogs
+	// is called before exiting.
+	var logClosers []io.Closer
+	closeLogs := func() {
+		for _, c := range logClosers {
+			if err := c.Close(); err != nil {
+				slog.Error("close log", "err", err)
+			}
+		}
+	}
+	if cfg.Log.NATS.Enabled() || cfg.Log.Kafka.Enabled() {
+		publish, err := logging.NewPublishHandler(cfg.Log)
+		if err != nil {
+			slog.Error("log setup", "err", err)
+			os.Exit(1)
+		}
+		logClosers = append(logClosers, publish)
+		handler = logging.Fanout(handler, publish)
+	}
+	if cfg.Log.SQLite.Enabled() {
+		db, err := logging.NewSQLiteHandler(cfg.Log.SQLite)
+		if err != nil {
+			slog.Error("log setup", "err", err)
+			os.Exit(1)
+		}
+		logClosers = append(logClosers, db)
+		handler = logging.Fanout(handler, db)
+	}
+	var chain *logging.ChainHandler
+	if cfg.Log.Chain.Enabled() {
+		chain, err = logging.NewChainHandler(cfg.Log.Chain)
+		if err != nil {
+			slog.Error("log setup", "err", err)
+			os.Exit(1)
+		}
+		logClosers = append(logClosers, chain)
+		handler = logging.Fanout(handler, chain)
+	}
+	logger := slog.New(handler)
+	if cfg.Log.Rotate.Enabled() && *logFile == "" {
+		logger.Warn("log.rotate has no effect without -log-file")
+	}
+
+	if *dryRunFlag {
+		os.Exit(dryRun(cfg, logger))
+	}
 
 	srv, err := server.New(cfg, logger)
 	if err != nil {
 		logger.Error("init server", "err", err)
 		os.Exit(1)
 	}
+	if chain != nil {
+		chain.SetSigner(srv.AuditSigner)
+	}
+	if rotating != nil {
+		rotating.SetOnRotate(srv.UploadLog)
+	}
+	srv.SetLogLevel(level)
 
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
 
-	if err := srv.Run(ctx); err != nil {
+	if *stdio {
+		err := srv.ServeStdio(ctx)
+		closeLogs()
+		if err != nil {
+			logger.Warn("connection ended", "err", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	var reloadMu sync.Mutex
+	current := cfg
+	// reload applies the config files, or only users_file if usersOnly is
+	// set, and returns the configuration in effect afterwards. The new
+	// configuration is checked as "tinyssh check" does before it is
+	// applied; one that fails to load, fails the checks or cannot be
+	// applied is logged and the previous one stays in effect.
+	reload := func(trigger string, usersOnly bool) *config.Config {
+		reloadMu.Lock()
+		defer reloadMu.Unlock()
+		logger.Info("reloading configuration", "trigger", trigger, "users_only", usersOnly)
+		var next *config.Config
+		var err error
+		if usersOnly {
+			next, err = current.ReloadUsers()
+		} else {
+			next, err = config.LoadWith(*configPath, override)
+		}
+		if err == nil {
+			err = errors.Join(checkReferences(next)...)
+		}
+		if err == nil {
+			err = srv.Reload(next)
+		}
+		if err != nil {
+			logger.Error("configuration rejected, keeping the previous one", "trigger", trigger, "err", err)
+			return current
+		}
+		current = next
+		return current
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			reload("sighup", false)
+			if err := srv.ReloadHostKeys(); err != nil {
+				logger.Error("reload host keys", "err", err)
+			}
+		}
+	}()
+	usr2 := make(chan os.Signal, 1)
+	notifyToggleDebug(usr2)
+	go func() {
+		// SIGUSR2 turns debug logging on, and off again back to -log-level.
+		for range usr2 {
+			prev, next := level.Level(), slog.LevelDebug
+			if prev == slog.LevelDebug {
+				next = max(baseLevel, slog.LevelInfo)
+			}
+			level.Set(next)
+			logger.Warn("log level changed", "from", prev.String(), "to", next.String(), "trigger", "sigusr2")
+		}
+	}()
+	usr1 := make(chan os.Signal, 1)
+	notifyReloadUsers(usr1)
+	go func() {
+		for range usr1 {
+			reload("sigusr1", true)
+		}
+	}()
+	if cfg.RemoteSource() != "" {
+		go pollConfig(ctx, cfg, func(usersOnly bool) *config.Config { return reload("poll", usersOnly) }, logger)
+	} else if cfg.WatchConfig {
+		go func() {
+			reloadFiles := func(usersOnly bool) *config.Config { return reload("file change", usersOnly) }
+			if err := watchConfig(ctx, cfg, reloadFiles, logger); err != nil {
+				logger.Error("watch config", "err", err)
+			}
+		}()
+	}
+
+	err = srv.Run(ctx)
+	if err != nil {
 		logger.Error("server stopped", "err", err)
+	}
+	closeLogs()
+	if err != nil {
 		os.Exit(1)
 	}
 }
 
+// flagSet reports whether the flag name was given on the command line.
+func flagSet(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		set = set || f.Name == name
+	})
+	return set
+}
+
 func parseLevel(level string) slog.Level {
 	switch level {
 	case "debug":
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// overrides collects the configuration given on the command line, in the
+// generic document form that config.LoadWith merges over the file.
+type overrides map[string]any
+
+// register adds the override flags to fs.
+func (o overrides) register(fs *flag.FlagSet) {
+	fs.Func("listen", "listen address, e.g. :2222 (listen_address)", o.setter("listen_address"))
+	fs.Func("host-key", "host key file (host_key_path)", o.setter("host_key_path"))
+	fs.Func("shell", "shell to run for sessions (shell)", o.setter("shell"))
+	fs.Func("users-file", "file of additional users (users_file)", o.setter("users_file"))
+	fs.Func("user", "add a user as `name:password`; may be repeated", o.addUser)
+	fs.BoolFunc("strict", "reject unknown configuration fields (strict)", o.setStrict)
+	fs.Func("set", "set any configuration field as `key=value`, the value being JSON or a plain string; may be repeated", o.set)
+}
+
+// setter returns a flag function that sets key to the flag's value.
+func (o overrides) setter(key string) func(string) error {
+	return func(value string) error {
+		o[key] = value
+		return nil
+	}
+}
+
+// setStrict sets strict to the boolean value.
+func (o overrides) setStrict(value string) error {
+	strict, err := strconv.ParseBool(value)
+	if err != nil {
+		return err
+	}
+	o["strict"] = strict
+	return nil
+}
+
+// addUser appends a user given as name:password.
+func (o overrides) addUser(value string) error {
+	name, password, ok := strings.Cut(value, ":")
+	if !ok || name == "" || password == "" {
+		return errors.New("want name:password")
+	}
+	users, _ := o["users"].([]any)
+	o["users"] = append(users, map[string]any{"username": name, "password": password})
+	return nil
+}
+
+// set sets the field named by key, which may name nested fields with dots
+// (e.g. web_terminal.listen), to value parsed as JSON, or as a string if
+// it is not valid JSON.
+func (o overrides) set(value string) error {
+	key, raw, ok := strings.Cut(value, "=")
+	if !ok || key == "" {
+		return errors.New("want key=value")
+	}
+	var parsed any
+	if err := json.Unmarshal([]byte(raw), &parsed); err != nil {
+		parsed = raw
+	}
+	doc := map[string]any(o)
+	parts := strings.Split(key, ".")
+	for _, part := range parts[:len(parts)-1] {
+		next, ok := doc[part].(map[string]any)
+		if !ok {
+			if _, exists := doc[part]; exists {
+				return fmt.Errorf("%s is not an object", part)
+			}
+			next = make(map[string]any)
+			doc[part] = next
+		}
+		doc = next
+	}
+	doc[parts[len(parts)-1]] = parsed
+	return nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/dollarkillerx/tinyssh/internal/config"
+)
+
+// pollConfig fetches the remote configuration of cfg, and its users_file
+// if that is remote too, every config_poll_interval seconds and calls
+// reload when one changed, until ctx is cancelled. Requests are
+// conditional, so an unchanged configuration costs a 304 response. reload
+// returns the configuration in effect afterwards, whose interval is used
+// from then on.
+func pollConfig(ctx context.Context, cfg *config.Config, reload func(usersOnly bool) *config.Config, logger *slog.Logger) {
+	location := cfg.RemoteSource()
+	if cfg.ConfigPollInterval <= 0 {
+		return
+	}
+	logger.Info("polling configuration", "url", location, "interval", cfg.ConfigPollInterval)
+	for cfg.ConfigPollInterval > 0 {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Duration(cfg.ConfigPollInterval) * time.Second):
+		}
+		changed, err := config.RemoteChanged(location)
+		if err != nil {
+			logger.Warn("poll config", "url", location, "err", err)
+			continue
+		}
+		if changed {
+			cfg = reload(false)
+			continue
+		}
+		if !config.IsRemote(cfg.UsersFile) {
+			continue
+		}
+		changed, err = config.RemoteChanged(cfg.UsersFile)
+		if err != nil {
+			logger.Warn("poll users file", "url", cfg.UsersFile, "err", err)
+			continue
+		}
+		if changed {
+			cfg = reload(true)
+		}
+	}
+}
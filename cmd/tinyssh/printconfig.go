@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/dollarkillerx/tinyssh/internal/config"
+)
+
+// runPrintConfig implements "tinyssh print-config": it prints the
+// configuration the server would run with, after merging fragments and
+// applying defaults, with secrets redacted.
+func runPrintConfig(args []string) int {
+	fs := flag.NewFlagSet("print-config", flag.ExitOnError)
+	configPath := fs.String("config", "config.json", "path to configuration file")
+	format := fs.String("format", "json", "output format (json, yaml)")
+	_ = fs.Parse(args)
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "load config:", err)
+		return 1
+	}
+	raw, err := json.MarshalIndent(cfg.Redacted(), "", "  ")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "encode config:", err)
+		return 1
+	}
+
+	switch *format {
+	case "json":
+		fmt.Println(string(raw))
+	case "yaml":
+		// JSON is YAML, so parsing it keeps the JSON field names and order;
+		// only the flow style needs clearing for block output.
+		var doc yaml.Node
+		if err := yaml.Unmarshal(raw, &doc); err != nil {
+			fmt.Fprintln(os.Stderr, "encode config:", err)
+			return 1
+		}
+		blockStyle(&doc)
+		enc := yaml.NewEncoder(os.Stdout)
+		enc.SetIndent(2)
+		if err := enc.Encode(&doc); err != nil {
+			fmt.Fprintln(os.Stderr, "encode config:", err)
+			return 1
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "unknown format %q\n", *format)
+		return 2
+	}
+	return 0
+}
+
+// blockStyle resets the style of node and its children so they are written
+// in YAML block style, quoting strings only where needed.
+func blockStyle(node *yaml.Node) {
+	node.Style = 0
+	for _, child := range node.Content {
+		blockStyle(child)
+	}
+}
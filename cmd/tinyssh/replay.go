@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dollarkillerx/tinyssh/internal/config"
+)
+
+// replayEvent is output recorded at offset from the start of a session.
+type replayEvent struct {
+	at   time.Duration
+	data []byte
+}
+
+// runReplay implements "tinyssh replay": it plays a session recording
+// back on the terminal with its original timing, or faster with -speed.
+// -seek writes everything before a point at once and plays from there,
+// and -idle-limit shortens long pauses.
+func runReplay(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	speed := fs.Float64("speed", 1, "playback speed factor, e.g. 2 for twice as fast")
+	seek := fs.Duration("seek", 0, "start playing at this offset, e.g. 1m30s")
+	idleLimit := fs.Duration("idle-limit", 0, "cap pauses between outputs at this duration; 0 keeps them")
+	identity := fs.String("identity", "", "age identity file for encrypted (.age) recordings; defaults to "+ageKeyFileEnv)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: tinyssh replay [flags] recording.cast | recording.typescript | recording.timing [.age]")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 || *speed <= 0 {
+		fs.Usage()
+		return 2
+	}
+
+	if *identity != "" {
+		_ = os.Setenv(ageKeyFileEnv, *identity)
+	}
+	events, err := readRecording(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "read recording:", err)
+		return 1
+	}
+
+	// Ctrl-C stops playback between writes and ends the line, so the
+	// prompt does not land in the middle of the replayed screen.
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	out := bufio.NewWriter(os.Stdout)
+	var prev time.Duration
+	for _, event := range events {
+		if event.at > *seek {
+			_ = out.Flush()
+			delay := event.at - max(prev, *seek)
+			if *idleLimit > 0 {
+				delay = min(delay, *idleLimit)
+			}
+			select {
+			case <-interrupt:
+				fmt.Println()
+				return 130
+			case <-time.After(time.Duration(float64(delay) / *speed)):
+			}
+		}
+		prev = event.at
+		if _, err := out.Write(event.data); err != nil {
+			return 1
+		}
+	}
+	_ = out.Flush()
+	return 0
+}
+
+// ageKeyFileEnv names the age identity file that decrypts recordings, as
+// it does configuration files.
+const ageKeyFileEnv = "TINYSSH_AGE_KEY_FILE"
+
+// readRecording reads the output events of an asciicast v2 file or of a
+// typescript and timing file pair, given either one of the pair. Files
+// encrypted with age end in .age.
+func readRecording(path string) ([]replayEvent, error) {
+	plain, suffix := path, ""
+	if strings.HasSuffix(path, ".age") {
+		plain, suffix = strings.TrimSuffix(path, ".age"), ".age"
+	}
+	switch {
+	case strings.HasSuffix(plain, ".typescript"):
+		return readScriptRecording(path, strings.TrimSuffix(plain, ".typescript")+".timing"+suffix)
+	case strings.HasSuffix(plain, ".timing"):
+		return readScriptRecording(strings.TrimSuffix(plain, ".timing")+".typescript"+suffix, path)
+	}
+	return readAsciicast(path)
+}
+
+// readRecordingFile returns the contents of a recording file, decrypted
+// if it ends in .age.
+func readRecordingFile(path string) ([]byte, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil || !strings.HasSuffix(path, ".age") {
+		return raw, err
+	}
+	plain, err := config.DecryptAge(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%s: decrypt: %w", path, err)
+	}
+	return plain, nil
+}
+
+// readAsciicast reads the "o" events of an asciicast v2 file.
+func readAsciicast(path string) ([]replayEvent, error) {
+	raw, err := readRecordingFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	scanner.Buffer(nil, 16<<20)
+	if !scanner.Scan() {
+		return nil, cmp.Or(scanner.Err(), errors.New("empty recording"))
+	}
+	var header struct {
+		Version int `json:"version"`
+	}
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil || header.Version != 2 {
+		return nil, errors.New("not an asciicast v2 recording")
+	}
+	var events []replayEvent
+	for line := 2; scanner.Scan(); line++ {
+		var event []any
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		if len(event) != 3 {
+			return nil, fmt.Errorf("line %d: want [time, code, data]", line)
+		}
+		at, ok1 := event[0].(float64)
+		code, ok2 := event[1].(string)
+		data, ok3 := event[2].(string)
+		if !ok1 || !ok2 || !ok3 {
+			return nil, fmt.Errorf("line %d: want [time, code, data]", line)
+		}
+		if code == "o" {
+			events = append(events, replayEvent{at: time.Duration(at * float64(time.Second)), data: []byte(data)})
+		}
+	}
+	return events, scanner.Err()
+}
+
+// readScriptRecording reads a typescript with its timing file, whose lines
+// give the delay before and the size of each write.
+func readScriptRecording(typescriptPath, timingPath string) ([]replayEvent, error) {
+	typescript, err := readRecordingFile(typescriptPath)
+	if err != nil {
+		return nil, err
+	}
+	timing, err := readRecordingFile(timingPath)
+	if err != nil {
+		return nil, err
+	}
+
+	output := bufio.NewReader(bytes.NewReader(typescript))
+	// The first line is the "Script started on" header.
+	if _, err := output.ReadString('\n'); err != nil {
+		return nil, fmt.Errorf("%s: %w", typescriptPath, err)
+	}
+	var events []replayEvent
+	var at time.Duration
+	scanner := bufio.NewScanner(bytes.NewReader(timing))
+	for line := 1; scanner.Scan(); line++ {
+		delay, size, ok := strings.Cut(strings.TrimSpace(scanner.Text()), " ")
+		seconds, err1 := strconv.ParseFloat(delay, 64)
+		n, err2 := strconv.Atoi(size)
+		if !ok || err1 != nil || err2 != nil || n < 0 {
+			return nil, fmt.Errorf("%s: line %d: want \"delay bytes\"", timingPath, line)
+		}
+		data := make([]byte, n)
+		if _, err := io.ReadFull(output, data); err != nil {
+			return nil, fmt.Errorf("%s: %w", typescriptPath, err)
+		}
+		at += time.Duration(seconds * float64(time.Second))
+		events = append(events, replayEvent{at: at, data: data})
+	}
+	return events, scanner.Err()
+}
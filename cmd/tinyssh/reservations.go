@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dollarkillerx/tinyssh/internal/config"
+	"github.com/dollarkillerx/tinyssh/internal/server"
+)
+
+// runReservations implements "tinyssh reservations": it lists the named
+// remote-forward reservations of a running server, or removes one with
+// -delete.
+func runReservations(args []string) int {
+	fs := flag.NewFlagSet("reservations", flag.ExitOnError)
+	configPath := fs.String("config", "config.json", "path to JSON configuration file")
+	asJSON := fs.Bool("json", false, "print raw JSON")
+	remove := fs.String("delete", "", "remove the named reservation")
+	_ = fs.Parse(args)
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "load config:", err)
+		return 1
+	}
+
+	if *remove != "" {
+		if _, err := adminRequest(cfg, http.MethodDelete, "/reservations/"+url.PathEscape(*remove), nil); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+	}
+
+	raw, err := adminRequest(cfg, http.MethodGet, "/reservations", nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if *asJSON {
+		_, _ = os.Stdout.Write(raw)
+		return 0
+	}
+
+	var reservations []server.Reservation
+	if err := json.Unmarshal(raw, &reservations); err != nil {
+		fmt.Fprintln(os.Stderr, "decode reservations:", err)
+		return 1
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tUSER\tPORT\tACTIVE\tLAST USED")
+	for _, r := range reservations {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%t\t%s\n", r.Name, r.User, r.Port, r.Active, r.LastUsed.Format(time.RFC3339))
+	}
+	_ = tw.Flush()
+	return 0
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/dollarkillerx/tinyssh/internal/config"
+)
+
+// runSchema implements "tinyssh schema": it prints the JSON Schema of the
+// configuration file.
+func runSchema(args []string) int {
+	if len(args) > 0 {
+		fmt.Fprintln(os.Stderr, "usage: tinyssh schema")
+		return 2
+	}
+	raw, err := json.MarshalIndent(config.Schema(), "", "  ")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "encode schema:", err)
+		return 1
+	}
+	fmt.Println(string(raw))
+	return 0
+}
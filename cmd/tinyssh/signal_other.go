@@ -0,0 +1,13 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// notifyReloadUsers does nothing: there is no SIGUSR1 here, so users_file
+// is only reloaded with the rest of the configuration.
+func notifyReloadUsers(c chan<- os.Signal) {}
+
+// notifyToggleDebug does nothing: there is no SIGUSR2 here, so the log
+// level is changed through the admin API.
+func notifyToggleDebug(c chan<- os.Signal) {}
@@ -0,0 +1,19 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyReloadUsers relays SIGUSR1, which reloads users_file alone, to c.
+func notifyReloadUsers(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR1)
+}
+
+// notifyToggleDebug relays SIGUSR2, which toggles debug logging, to c.
+func notifyToggleDebug(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR2)
+}
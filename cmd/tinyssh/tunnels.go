@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"text/tabwriter"
+
+	"github.com/dollarkillerx/tinyssh/internal/config"
+	"github.com/dollarkillerx/tinyssh/internal/server"
+)
+
+// runTunnels implements "tinyssh tunnels": it lists the active forwards of a
+// running server through its admin API.
+func runTunnels(args []string) int {
+	fs := flag.NewFlagSet("tunnels", flag.ExitOnError)
+	configPath := fs.String("config", "config.json", "path to JSON configuration file")
+	asJSON := fs.Bool("json", false, "print raw JSON")
+	_ = fs.Parse(args)
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "load config:", err)
+		return 1
+	}
+
+	raw, err := adminRequest(cfg, http.MethodGet, "/tunnels", nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if *asJSON {
+		_, _ = os.Stdout.Write(raw)
+		return 0
+	}
+
+	var tunnels []server.TunnelInfo
+	if err := json.Unmarshal(raw, &tunnels); err != nil {
+		fmt.Fprintln(os.Stderr, "decode tunnels:", err)
+		return 1
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tKIND\tUSER\tREMOTE\tTARGET\tAGE\tIN\tOUT")
+	for _, t := range tunnels {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\t%d\t%d\n", t.ID, t.Kind, t.User, t.Remote, t.Target, t.Age, t.BytesIn, t.BytesOut)
+	}
+	_ = tw.Flush()
+	return 0
+}
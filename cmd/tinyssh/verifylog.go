@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/dollarkillerx/tinyssh/internal/logging"
+)
+
+// runVerifyLog implements "tinyssh verify-log": it checks that a
+// tamper-evident audit log (log.chain) is an unbroken hash chain and that
+// its anchors are validly signed, by the host keys in -keys if given.
+func runVerifyLog(args []string) int {
+	fs := flag.NewFlagSet("verify-log", flag.ExitOnError)
+	keysPath := fs.String("keys", "", "file of trusted host public keys (.pub or authorized_keys format); anchors signed by other keys fail")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: tinyssh verify-log [-keys host_key.pub] audit.log")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	var trusted []ssh.PublicKey
+	if *keysPath != "" {
+		raw, err := os.ReadFile(*keysPath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "read keys:", err)
+			return 1
+		}
+		for len(bytes.TrimSpace(raw)) > 0 {
+			key, _, _, rest, err := ssh.ParseAuthorizedKey(raw)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "read keys:", err)
+				return 1
+			}
+			trusted = append(trusted, key)
+			raw = rest
+		}
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer f.Close()
+	report, err := logging.VerifyChain(f, trusted)
+	if err != nil {
+		fmt.Printf("FAIL: %v (records %d to %d verified before it)\n", err, report.First, report.Last)
+		return 1
+	}
+	if report.Last == 0 {
+		fmt.Println("empty log")
+		return 0
+	}
+	fmt.Printf("records %d to %d chained, %d anchors\n", report.First, report.Last, report.Anchors)
+	for _, key := range report.Keys {
+		fmt.Println("signed by", key)
+	}
+	status := 0
+	if report.First != 1 {
+		fmt.Printf("WARNING: the chain starts at record %d; earlier records are not in this file\n", report.First)
+	}
+	switch {
+	case report.Anchors == 0:
+		fmt.Println("WARNING: no anchors; the log could have been rewritten as a whole")
+		status = 1
+	case report.Anchored < report.Last:
+		fmt.Printf("WARNING: records after %d are not anchored yet and could be removed without trace\n", report.Anchored)
+	default:
+		fmt.Println("OK")
+	}
+	return status
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+
+	"github.com/dollarkillerx/tinyssh/internal/config"
+)
+
+// configWatchDelay is how long the config files must stay quiet before a
+// change is applied, so that an editor saving a file (often a write, a
+// rename and a chmod) causes one reload.
+const configWatchDelay = 500 * time.Millisecond
+
+// watchConfig calls reload whenever a file of cfg changes, until ctx is
+// cancelled, with usersOnly set if only users_file changed. Editors often
+// replace a file instead of writing to it, so the directories holding the
+// files are watched rather than the files. reload returns the
+// configuration in effect afterwards, whose files are watched from then on.
+func watchConfig(ctx context.Context, cfg *config.Config, reload func(usersOnly bool) *config.Config, logger *slog.Logger) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("watch config: %w", err)
+	}
+	defer watcher.Close()
+
+	watched := make(map[string]bool)
+	watch := func(cfg *config.Config) {
+		for _, dir := range cfg.WatchDirs() {
+			if watched[dir] {
+				continue
+			}
+			// Directories that do not exist yet, such as an absent conf.d,
+			// are picked up after the reload their creation triggers.
+			if err := watcher.Add(dir); err != nil {
+				logger.Debug("watch config directory", "dir", dir, "err", err)
+				continue
+			}
+			watched[dir] = true
+		}
+	}
+	watch(cfg)
+	logger.Info("watching configuration", "dirs", cfg.WatchDirs())
+
+	var settle <-chan time.Time
+	usersOnly := true
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if event.Op == fsnotify.Chmod || !cfg.IsSource(event.Name) {
+				continue
+			}
+			logger.Debug("config file changed", "file", event.Name, "op", event.Op.String())
+			usersOnly = usersOnly && cfg.IsUsersFile(event.Name)
+			settle = time.After(configWatchDelay)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			logger.Warn("watch config", "err", err)
+		case <-settle:
+			settle = nil
+			cfg = reload(usersOnly)
+			usersOnly = true
+			watch(cfg)
+		}
+	}
+}
@@ -3,8 +3,37 @@ module github.com/dollarkillerx/tinyssh
 go 1.25.0
 
 require (
+	filippo.io/age v1.2.1
+	github.com/BurntSushi/toml v1.5.0
 	github.com/creack/pty v1.1.23
-	golang.org/x/crypto v0.21.0
+	github.com/fsnotify/fsnotify v1.9.0
+	github.com/google/go-tpm v0.9.0
+	github.com/miekg/pkcs11 v1.1.2
+	github.com/nats-io/nats.go v1.53.1
+	github.com/oschwald/maxminddb-golang/v2 v2.5.0
+	github.com/pkg/sftp v1.13.6
+	github.com/segmentio/kafka-go v0.4.51
+	golang.org/x/crypto v0.55.0
+	golang.org/x/sys v0.47.0
+	golang.org/x/time v0.5.0
+	gopkg.in/yaml.v3 v3.0.1
+	modernc.org/sqlite v1.59.0
 )
 
-require golang.org/x/sys v0.18.0 // indirect
+require (
+	github.com/dustin/go-humanize v1.0.1 // indirect
+	github.com/google/uuid v1.6.0 // indirect
+	github.com/klauspost/compress v1.18.5 // indirect
+	github.com/kr/fs v0.1.0 // indirect
+	github.com/mattn/go-isatty v0.0.24 // indirect
+	github.com/nats-io/nkeys v0.4.15 // indirect
+	github.com/nats-io/nuid v1.0.1 // indirect
+	github.com/ncruces/go-strftime v1.0.0 // indirect
+	github.com/pierrec/lz4/v4 v4.1.15 // indirect
+	github.com/remyoudompheng/bigfft v0.0.0-20230129092748-24d4a6f8daec // indirect
+	golang.org/x/net v0.57.0 // indirect
+	golang.org/x/text v0.41.0 // indirect
+	modernc.org/libc v1.75.7 // indirect
+	modernc.org/mathutil v1.7.1 // indirect
+	modernc.org/memory v1.12.1 // indirect
+)
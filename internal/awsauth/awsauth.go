@@ -0,0 +1,197 @@
+// Package awsauth implements the parts of AWS authentication tinyssh uses
+// without the AWS SDK: credentials from the environment or the EC2
+// instance role, and SigV4 request signing.
+package awsauth
+
+import (
+	"cmp"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// imdsEndpoint is the EC2 instance metadata service, used for role
+// credentials when none are set in the environment.
+const imdsEndpoint = "http://169.254.169.254"
+
+var imdsClient = &http.Client{Timeout: 2 * time.Second}
+
+// Credentials authenticate requests to AWS.
+type Credentials struct {
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+}
+
+// FetchCredentials reads static credentials from the environment, or the
+// instance role's temporary credentials from IMDSv2. It also returns when
+// they should be fetched again.
+func FetchCredentials(ctx context.Context) (Credentials, time.Time, error) {
+	if id := os.Getenv("AWS_ACCESS_KEY_ID"); id != "" {
+		creds := Credentials{
+			AccessKey:    id,
+			SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		}
+		// Environment credentials are re-read hourly in case they rotate.
+		return creds, time.Now().Add(time.Hour), nil
+	}
+
+	var token string
+	header := http.Header{"X-Aws-Ec2-Metadata-Token-Ttl-Seconds": {"21600"}}
+	if err := imdsCall(ctx, http.MethodPut, "/latest/api/token", header, &token); err != nil {
+		return Credentials{}, time.Time{}, fmt.Errorf("no AWS_ACCESS_KEY_ID and no instance metadata: %w", err)
+	}
+	header = http.Header{"X-Aws-Ec2-Metadata-Token": {token}}
+	var role string
+	if err := imdsCall(ctx, http.MethodGet, "/latest/meta-data/iam/security-credentials/", header, &role); err != nil {
+		return Credentials{}, time.Time{}, fmt.Errorf("instance role: %w", err)
+	}
+	role, _, _ = strings.Cut(strings.TrimSpace(role), "\n")
+	if role == "" {
+		return Credentials{}, time.Time{}, errors.New("instance has no IAM role")
+	}
+	var doc string
+	if err := imdsCall(ctx, http.MethodGet, "/latest/meta-data/iam/security-credentials/"+role, header, &doc); err != nil {
+		return Credentials{}, time.Time{}, fmt.Errorf("instance role %s: %w", role, err)
+	}
+	var reply struct {
+		AccessKeyID     string `json:"AccessKeyId"`
+		SecretAccessKey string
+		Token           string
+		Expiration      time.Time
+	}
+	if err := json.Unmarshal([]byte(doc), &reply); err != nil {
+		return Credentials{}, time.Time{}, fmt.Errorf("instance role %s: %w", role, err)
+	}
+	return Credentials{
+		AccessKey:    reply.AccessKeyID,
+		SecretKey:    reply.SecretAccessKey,
+		SessionToken: reply.Token,
+	}, reply.Expiration, nil
+}
+
+func imdsCall(ctx context.Context, method, path string, header http.Header, out *string) error {
+	req, err := http.NewRequestWithContext(ctx, method, imdsEndpoint+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header = header
+	resp, err := imdsClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(resp.Status)
+	}
+	var b strings.Builder
+	if _, err := io.Copy(&b, io.LimitReader(resp.Body, 64<<10)); err != nil {
+		return err
+	}
+	*out = b.String()
+	return nil
+}
+
+// Sign adds SigV4 authentication headers for a request of method to u with
+// body. Every header already set is signed. The path of u must be escaped
+// as SigV4 expects (see EscapePath); query strings are not supported.
+func Sign(header http.Header, method string, u *url.URL, body []byte, creds Credentials, region, service string, now time.Time) {
+	bodyHash := sha256.Sum256(body)
+	SignHash(header, method, u, hex.EncodeToString(bodyHash[:]), creds, region, service, now)
+}
+
+// SignHash is Sign for a body given by its hex-encoded SHA-256 hash, so
+// that large bodies can be streamed.
+func SignHash(header http.Header, method string, u *url.URL, bodyHash string, creds Credentials, region, service string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	header.Set("Host", u.Host)
+	header.Set("X-Amz-Date", amzDate)
+	header.Set("X-Amz-Content-Sha256", bodyHash)
+	if creds.SessionToken != "" {
+		header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, strings.ToLower(name))
+	}
+	slices.Sort(names)
+	var canonical strings.Builder
+	for _, name := range names {
+		canonical.WriteString(name + ":" + strings.TrimSpace(header.Get(name)) + "\n")
+	}
+	signed := strings.Join(names, ";")
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	request := strings.Join([]string{
+		method, path, "", canonical.String(), signed, bodyHash,
+	}, "\n")
+
+	scope := day + "/" + region + "/" + service + "/aws4_request"
+	requestHash := sha256.Sum256([]byte(request))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + creds.SecretKey)
+	for _, part := range []string{day, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+	header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+creds.AccessKey+"/"+scope+
+		", SignedHeaders="+signed+", Signature="+signature)
+	// net/http sends Host from the request, not the header map.
+	header.Del("Host")
+}
+
+// Region returns the region of the environment, as the AWS SDKs do.
+func Region() string {
+	return cmp.Or(os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION"), "us-east-1")
+}
+
+// S3ObjectURL returns the URL of key in bucket. S3-compatible services at
+// endpoint, or at AWS_ENDPOINT_URL_S3 or AWS_ENDPOINT_URL when endpoint
+// is empty, are addressed path-style; AWS itself virtual-host style.
+func S3ObjectURL(endpoint, region, bucket, key string) string {
+	key = EscapePath("/" + strings.TrimPrefix(key, "/"))
+	if endpoint = cmp.Or(endpoint, os.Getenv("AWS_ENDPOINT_URL_S3"), os.Getenv("AWS_ENDPOINT_URL")); endpoint != "" {
+		return strings.TrimSuffix(endpoint, "/") + "/" + bucket + key
+	}
+	return "https://" + bucket + ".s3." + region + ".amazonaws.com" + key
+}
+
+// EscapePath percent-encodes every byte of path except unreserved
+// characters and "/", as SigV4 canonical paths require.
+func EscapePath(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if c == '/' || c == '-' || c == '.' || c == '_' || c == '~' ||
+			'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,92 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+)
+
+// ageExtension marks a config file encrypted with age
+// (https://age-encryption.org). The extension before it selects the
+// format, as in users.yaml.age.
+const ageExtension = ".age"
+
+// Environment variables holding the age identities that decrypt config
+// files: the identities themselves, or the path of a file containing them
+// as written by age-keygen.
+const (
+	ageKeyEnv     = "TINYSSH_AGE_KEY"
+	ageKeyFileEnv = "TINYSSH_AGE_KEY_FILE"
+)
+
+// plainName returns path without the age extension, if it has one.
+func plainName(path string) string {
+	if strings.EqualFold(filepath.Ext(path), ageExtension) {
+		return path[:len(path)-len(ageExtension)]
+	}
+	return path
+}
+
+// decryptAge decrypts an age-encrypted file, binary or ASCII-armored, with
+// the identities from the environment.
+func decryptAge(raw []byte) ([]byte, error) {
+	identities, err := ageIdentities()
+	if err != nil {
+		return nil, err
+	}
+	var src io.Reader = bytes.NewReader(raw)
+	if bytes.HasPrefix(bytes.TrimSpace(raw), []byte(armor.Header)) {
+		src = armor.NewReader(bytes.NewReader(bytes.TrimSpace(raw)))
+	}
+	r, err := age.Decrypt(src, identities...)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+// DecryptAge decrypts age-encrypted data, such as a recording, with the
+// identities in TINYSSH_AGE_KEY or TINYSSH_AGE_KEY_FILE.
+func DecryptAge(raw []byte) ([]byte, error) {
+	return decryptAge(raw)
+}
+
+// validateAgeRecipient checks that recipient is an age X25519 public key.
+func validateAgeRecipient(recipient string) error {
+	_, err := age.ParseX25519Recipient(recipient)
+	return err
+}
+
+func ageIdentities() ([]age.Identity, error) {
+	var identities []age.Identity
+	if key := os.Getenv(ageKeyEnv); key != "" {
+		parsed, err := age.ParseIdentities(strings.NewReader(key))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", ageKeyEnv, err)
+		}
+		identities = append(identities, parsed...)
+	}
+	if path := os.Getenv(ageKeyFileEnv); path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", ageKeyFileEnv, err)
+		}
+		defer f.Close()
+		parsed, err := age.ParseIdentities(f)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s: %w", ageKeyFileEnv, path, err)
+		}
+		identities = append(identities, parsed...)
+	}
+	if len(identities) == 0 {
+		return nil, errors.New("no age identity: set " + ageKeyEnv + " or " + ageKeyFileEnv)
+	}
+	return identities, nil
+}
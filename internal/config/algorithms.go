@@ -0,0 +1,125 @@
+package config
+
+import (
+	"fmt"
+	"slices"
+)
+
+// The transport algorithms the SSH library can run on the server side.
+// Names outside these lists would be dropped silently at handshake time,
+// so they are rejected when the configuration is loaded instead.
+var (
+	SupportedCiphers = []string{
+		"aes128-gcm@openssh.com", "aes256-gcm@openssh.com",
+		"chacha20-poly1305@openssh.com",
+		"aes128-ctr", "aes192-ctr", "aes256-ctr",
+		"aes128-cbc", "3des-cbc",
+		"arcfour256", "arcfour128", "arcfour",
+	}
+	SupportedKexAlgorithms = []string{
+		KexMLKEM768X25519,
+		"curve25519-sha256", "curve25519-sha256@libssh.org",
+		"ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521",
+		"diffie-hellman-group14-sha256", "diffie-hellman-group16-sha512",
+		"diffie-hellman-group-exchange-sha256",
+		"diffie-hellman-group14-sha1", "diffie-hellman-group1-sha1",
+		"diffie-hellman-group-exchange-sha1",
+	}
+	SupportedMACs = []string{
+		"hmac-sha2-256-etm@openssh.com", "hmac-sha2-512-etm@openssh.com",
+		"hmac-sha2-256", "hmac-sha2-512",
+		"hmac-sha1", "hmac-sha1-96",
+	}
+)
+
+// KexMLKEM768X25519 is the hybrid post-quantum key exchange (ML-KEM-768
+// with X25519) supported by OpenSSH 9.9 and later. It protects recorded
+// sessions against decryption by a future quantum computer and is
+// preferred by default. sntrup761x25519-sha512 is not implemented by the
+// SSH library; clients that offer both pick ML-KEM.
+const KexMLKEM768X25519 = "mlkem768x25519-sha256"
+
+// PostQuantumKex reports whether a key exchange algorithm is hybrid
+// post-quantum.
+func PostQuantumKex(name string) bool {
+	return name == KexMLKEM768X25519
+}
+
+// validateAlgorithms checks that list only names supported algorithms.
+func validateAlgorithms(field string, list, supported []string) error {
+	for _, name := range list {
+		if !slices.Contains(supported, name) {
+			return fmt.Errorf("%s: unsupported algorithm %q", field, name)
+		}
+	}
+	return nil
+}
+
+// CryptoPolicy is a curated set of transport algorithms and host key
+// requirements selected with crypto_policy.
+type CryptoPolicy struct {
+	Ciphers       []string
+	KexAlgorithms []string
+	MACs          []string
+	// MinRSABits is the smallest RSA host key accepted.
+	MinRSABits int
+	// NoSHA1 stops RSA host keys from signing with ssh-rsa (SHA-1) and
+	// rejects DSA host keys.
+	NoSHA1 bool
+}
+
+// Values accepted by crypto_policy.
+const (
+	PolicyModern       = "modern"
+	PolicyIntermediate = "intermediate"
+	PolicyLegacy       = "legacy"
+)
+
+// CryptoPolicies holds the crypto_policy presets. Modern suits current
+// OpenSSH clients only; intermediate adds the NIST curves, AES-CTR and
+// non-ETM MACs for older clients and appliances; legacy enables every
+// supported algorithm for equipment that cannot be upgraded.
+var CryptoPolicies = map[string]CryptoPolicy{
+	PolicyModern: {
+		Ciphers: []string{
+			"chacha20-poly1305@openssh.com",
+			"aes256-gcm@openssh.com", "aes128-gcm@openssh.com",
+		},
+		KexAlgorithms: []string{KexMLKEM768X25519, "curve25519-sha256", "curve25519-sha256@libssh.org"},
+		MACs:          []string{"hmac-sha2-512-etm@openssh.com", "hmac-sha2-256-etm@openssh.com"},
+		MinRSABits:    3072,
+		NoSHA1:        true,
+	},
+	PolicyIntermediate: {
+		Ciphers: []string{
+			"chacha20-poly1305@openssh.com",
+			"aes256-gcm@openssh.com", "aes128-gcm@openssh.com",
+			"aes256-ctr", "aes192-ctr", "aes128-ctr",
+		},
+		KexAlgorithms: []string{
+			KexMLKEM768X25519,
+			"curve25519-sha256", "curve25519-sha256@libssh.org",
+			"ecdh-sha2-nistp521", "ecdh-sha2-nistp384", "ecdh-sha2-nistp256",
+			"diffie-hellman-group16-sha512", "diffie-hellman-group14-sha256",
+			"diffie-hellman-group-exchange-sha256",
+		},
+		MACs: []string{
+			"hmac-sha2-512-etm@openssh.com", "hmac-sha2-256-etm@openssh.com",
+			"hmac-sha2-512", "hmac-sha2-256",
+		},
+		MinRSABits: 2048,
+		NoSHA1:     true,
+	},
+	PolicyLegacy: {
+		Ciphers:       SupportedCiphers,
+		KexAlgorithms: SupportedKexAlgorithms,
+		MACs:          SupportedMACs,
+		MinRSABits:    1024,
+	},
+}
+
+// Policy returns the selected crypto_policy, or the zero policy (library
+// defaults, no key requirements) when none is set.
+func (c *Config) Policy() CryptoPolicy {
+	return CryptoPolicies[c.CryptoPolicy]
+}
@@ -1,12 +1,24 @@
 package config
 
 import (
+	"bytes"
+	"cmp"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"maps"
+	"net"
+	"net/netip"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"text/template"
+	"time"
 )
 
 // Config represents the JSON configuration expected by the tiny SSH server.
@@ -16,80 +28,2124 @@ type Config struct {
 	HostKeyPath   string `json:"host_key_path"`
 	Shell         string `json:"shell"`
 	Users         []User `json:"users"`
+	// UsersFile names a file, relative to the config directory, or an
+	// https:// or s3:// URL whose "users" list is added to Users. It can be
+	// reloaded on its own with ReloadUsers, leaving the rest of the
+	// configuration untouched.
+	UsersFile string `json:"users_file"`
+
+	// AllowUsers limits logins on every listener to these users; entries
+	// may use the * and ? wildcards. Empty allows every user.
+	AllowUsers []string `json:"allow_users"`
+	// Match applies per-user settings to groups of users, like sshd_config
+	// "Match User" blocks.
+	Match []Match `json:"match"`
+
+	// HostKeyPaths lists several host keys, typically one per algorithm, and
+	// replaces HostKeyPath when set. Missing files are generated with the
+	// algorithm named in the file name (e.g. ssh_host_ecdsa_key), falling
+	// back to HostKeyType.
+	HostKeyPaths []string `json:"host_key_paths"`
+
+	// HostKeyAgent lists the SHA256 fingerprints of keys held by an
+	// ssh-agent to use as host keys, so their private halves never touch
+	// disk. The agent is reached through HostKeyAgentSocket, which defaults
+	// to SSH_AUTH_SOCK. When only agent keys are configured no host key
+	// file is generated.
+	HostKeyAgent       []string `json:"host_key_agent"`
+	HostKeyAgentSocket string   `json:"host_key_agent_socket"`
+
+	// HostKeyPKCS11 and HostKeyTPM add a host key held in an HSM or smart
+	// card (through a PKCS#11 module) or persisted in a TPM 2.0. Like agent
+	// keys, they stop a host key file from being generated when no paths
+	// are configured.
+	HostKeyPKCS11 PKCS11Key `json:"host_key_pkcs11"`
+	HostKeyTPM    TPMKey    `json:"host_key_tpm"`
+	// HostKeyKMS adds a non-exportable host key held in AWS KMS or Google
+	// Cloud KMS.
+	HostKeyKMS KMSKey `json:"host_key_kms"`
+
+	// HostKeyPassphrase decrypts passphrase-protected host keys and
+	// encrypts generated ones. HostKeyPassphraseFile reads it from a file
+	// instead; the TINYSSH_HOST_KEY_PASSPHRASE environment variable takes
+	// precedence over both.
+	HostKeyPassphrase     string `json:"host_key_passphrase"`
+	HostKeyPassphraseFile string `json:"host_key_passphrase_file"`
+
+	// HostKeyType is the algorithm used when a missing host key is
+	// generated: "ed25519" (default), "ecdsa" or "rsa". An existing key is
+	// used whatever its type.
+	HostKeyType string `json:"host_key_type"`
+
+	// HostKeyRotationGrace is how many seconds a host key replaced by a
+	// reload (SIGHUP or the admin API) keeps being used for key exchange
+	// while clients learn its successor through hostkeys-00@openssh.com.
+	// Defaults to 604800 (one week).
+	HostKeyRotationGrace int `json:"host_key_rotation_grace"`
+
+	// CryptoPolicy selects a preset of algorithms and host key
+	// requirements: "modern", "intermediate" or "legacy". Empty keeps the
+	// library's defaults.
+	CryptoPolicy string `json:"crypto_policy"`
+
+	// ServerVersion is the identification string sent to clients, e.g.
+	// "OpenSSH_9.6p1 Ubuntu-3ubuntu13" to blend in or "SSH" to reveal
+	// nothing. The "SSH-2.0-" prefix is added when missing. Defaults to
+	// "SSH-2.0-tinyssh".
+	ServerVersion string `json:"server_version"`
+	// Banner is shown to clients before they authenticate, like OpenSSH's
+	// Banner. Listeners may override it.
+	Banner string `json:"banner"`
+
+	// RequireStrictKex refuses clients that do not offer strict key
+	// exchange (kex-strict-c-v00@openssh.com), the Terrapin attack
+	// mitigation, instead of only logging it.
+	RequireStrictKex bool `json:"require_strict_kex"`
+
+	// DenyHASSH refuses clients whose key exchange proposal has one of these
+	// HASSH fingerprints (MD5 hex digests), e.g. known scanners' SSH stacks.
+	DenyHASSH []string `json:"deny_hassh"`
+
+	// Ciphers, KexAlgorithms and MACs restrict the transport algorithms
+	// offered to clients, in order of preference. An empty list keeps the
+	// crypto_policy (or library) defaults.
+	Ciphers       []string `json:"ciphers"`
+	KexAlgorithms []string `json:"kex_algorithms"`
+	MACs          []string `json:"macs"`
+
+	// RekeyThreshold is the number of bytes sent or received after which
+	// a new key exchange starts; at least 256. Zero keeps the cipher's
+	// default (64 GiB for AES, 1 GiB otherwise).
+	RekeyThreshold int64 `json:"rekey_threshold"`
+
+	// ShellArgs are passed to the shell before anything else, for both
+	// interactive shells and commands (e.g. ["sh"] for busybox, ["-l"]).
+	ShellArgs []string `json:"shell_args"`
+	// ShellCommandArgs are placed between ShellArgs and the command for exec
+	// requests. Defaults to ["-c"].
+	ShellCommandArgs []string `json:"shell_command_args"`
+
+	// Subsystems maps subsystem names (e.g. "netconf") to the command run
+	// through the shell when a client requests them.
+	Subsystems map[string]string `json:"subsystems"`
+
+	// AllowTCPForwarding selects which TCP forwarding directions are allowed:
+	// "both" (default), "local", "remote" or "none". Users may override it.
+	AllowTCPForwarding string `json:"allow_tcp_forwarding"`
+
+	// AllowStreamLocalForwarding selects which Unix socket forwarding
+	// directions are allowed, with the values of AllowTCPForwarding. Unset,
+	// it is "both" for accounts with unrestricted TCP forwarding and "none"
+	// for forwarding_only accounts and those limited by
+	// allow_tcp_forwarding, permit_open or permit_listen. Users may
+	// override it.
+	AllowStreamLocalForwarding string `json:"allow_stream_local_forwarding"`
+
+	// GatewayPorts controls where remote-forward listeners bind: "no"
+	// (default) forces loopback, "yes" forces all interfaces and
+	// "clientspecified" honours the address requested by the client.
+	GatewayPorts string `json:"gateway_ports"`
+
+	// PermitTunnel allows tun@openssh.com device forwarding (ssh -w):
+	// "no" (default) or "point-to-point". Users may override it.
+	PermitTunnel string `json:"permit_tunnel"`
+
+	// ForwardRateLimit caps each forwarded channel, per direction, in bytes
+	// per second; zero means unlimited. Users may override it.
+	ForwardRateLimit int64 `json:"forward_rate_limit"`
+
+	// Upstreams are the SSH servers tinyssh can act as a bastion for, keyed
+	// by the name clients use in "user@name" logins.
+	Upstreams map[string]Upstream `json:"upstreams"`
+
+	// ForwardDial tunes the outbound connections made for direct-tcpip
+	// forwards.
+	ForwardDial DialOptions `json:"forward_dial"`
+
+	// IngressRateLimit and EgressRateLimit cap, in bytes per second, the
+	// data received from and sent to all clients together, across sessions
+	// and forwards. Zero means unlimited.
+	IngressRateLimit int64 `json:"ingress_rate_limit"`
+	EgressRateLimit  int64 `json:"egress_rate_limit"`
+
+	// PermitOpen restricts the host:port destinations of local forwards and
+	// PermitListen the addresses remote forwards may bind. Unset means no
+	// restriction; users may override both.
+	PermitOpen   []string `json:"permit_open"`
+	PermitListen []string `json:"permit_listen"`
+
+	// Reservations lets clients claim a stable remote-forward port by name
+	// with "ssh -R name:0:host:port".
+	Reservations ReservationOptions `json:"reservations"`
+
+	// Recording records interactive sessions for auditing.
+	Recording RecordingOptions `json:"recording"`
+	// Upload ships finished recordings to object storage.
+	Upload UploadOptions `json:"upload"`
+	// Tracing exports OpenTelemetry spans of connections and sessions.
+	Tracing TracingOptions `json:"tracing"`
+	// StatsD pushes the metrics of /metrics to a StatsD server.
+	StatsD StatsDOptions `json:"statsd"`
+	// Webhooks notify HTTP endpoints of logins, logouts, repeated
+	// authentication failures and logins from new addresses.
+	Webhooks WebhookOptions `json:"webhooks"`
+	// Log configures where logs go besides standard output. It is read
+	// at startup only.
+	Log LogOptions `json:"log"`
+
+	// VHost enables an HTTP(S) front end that routes requests for
+	// <name>.<domain> to remote forwards requested as "ssh -R name:80:...".
+	VHost VHostOptions `json:"vhost"`
+
+	// WebTerminal serves a browser terminal that logs in with the same
+	// users and opens an ordinary shell session, for when no SSH client is
+	// at hand.
+	WebTerminal WebTerminalOptions `json:"web_terminal"`
+
+	// AdminListen enables the admin HTTP API on a TCP address or, when it
+	// starts with "/", a unix socket path. AdminToken, when set, must be
+	// presented as a bearer token; TCP addresses, which any local user can
+	// reach, require it.
+	AdminListen string `json:"admin_listen"`
+	AdminToken  string `json:"admin_token"`
+
+	// SessionOutputBuffer caps, in bytes, how much PTY output a session may
+	// hold while waiting for the client to open its window.
+	SessionOutputBuffer int `json:"session_output_buffer"`
+
+	// LoginGraceTime is how many seconds a client has to complete the
+	// handshake and authenticate before it is disconnected. Defaults to 30;
+	// a negative value disables the limit.
+	LoginGraceTime int `json:"login_grace_time"`
+
+	// UseDNS resolves the PTR record of clients for connection logs, like
+	// OpenSSH's option of the same name. Off by default.
+	UseDNS bool `json:"use_dns"`
+
+	// Listeners adds SSH listening addresses beside listen_address, each
+	// able to override the version, banner, algorithms and allowed users. When only
+	// listeners are configured, listen_address no longer defaults to :2222.
+	Listeners []Listener `json:"listeners"`
+
+	// ProxyProtocol accepts HAProxy PROXY protocol headers from load
+	// balancers, so the real client address is used for logs, limits and
+	// access rules.
+	ProxyProtocol ProxyProtocolOptions `json:"proxy_protocol"`
+
+	// AllowCIDRs and DenyCIDRs filter client addresses (CIDRs or single
+	// IPs) before the SSH handshake. A denied address is always refused;
+	// when AllowCIDRs is set, only addresses in it are admitted.
+	AllowCIDRs []string `json:"allow_cidrs"`
+	DenyCIDRs  []string `json:"deny_cidrs"`
+
+	// MaxConnections caps concurrent SSH connections, authenticated or
+	// not; further connections are closed on accept. Zero means unlimited.
+	MaxConnections int `json:"max_connections"`
+
+	// ConnectionRate limits how fast one source address may open new
+	// connections.
+	ConnectionRate ConnectionRateOptions `json:"connection_rate"`
+
+	// GeoIP filters connections by the country of their source address and
+	// tags connection logs with it.
+	GeoIP GeoIPOptions `json:"geoip"`
+
+	// DNSBL looks client addresses up in DNS blocklists.
+	DNSBL DNSBLOptions `json:"dnsbl"`
+
+	// MaxStartups limits concurrent unauthenticated connections like
+	// OpenSSH's option of the same name. "start:rate:full" refuses a new
+	// connection with probability rate% once start are pending, rising
+	// linearly to 100% at full; a single number refuses every connection
+	// beyond it. Defaults to "10:30:100".
+	MaxStartups string `json:"max_startups"`
+
+	// AddressFamily restricts listening and forwarding to "inet" (IPv4)
+	// or "inet6" (IPv6); "any" (default) uses both.
+	AddressFamily string `json:"address_family"`
+	// BindInterface binds SSH listeners to a network interface, e.g. a
+	// management VLAN, with SO_BINDTODEVICE (Linux only).
+	BindInterface string `json:"bind_interface"`
+
+	// TCP tunes accepted SSH connections and the outbound connections of
+	// forwards, e.g. for lossy or long fat networks.
+	TCP TCPOptions `json:"tcp"`
+
+	// ReusePort binds SSH listeners with SO_REUSEPORT (Linux only), so a
+	// new instance can start on the same port before the old one stops.
+	ReusePort bool `json:"reuse_port"`
+	// AcceptLoops is how many goroutines accept connections on each
+	// listener; defaults to 1. With reuse_port every loop gets its own
+	// socket and the kernel spreads new connections across them.
+	AcceptLoops int `json:"accept_loops"`
+
+	// ClientAliveInterval is the number of seconds between keepalive probes
+	// sent to idle clients; zero disables them.
+	ClientAliveInterval int `json:"client_alive_interval"`
+	// ClientAliveCountMax is how many probes may go unanswered before the
+	// connection is dropped.
+	ClientAliveCountMax int `json:"client_alive_count_max"`
+
+	// WatchConfig reloads the configuration whenever its files change, as
+	// SIGHUP does.
+	WatchConfig bool `json:"watch_config"`
+	// ConfigPollInterval is how often, in seconds, a configuration loaded
+	// from an https:// or s3:// URL is fetched again and, if it changed,
+	// reloaded. Defaults to 60; negative disables polling.
+	ConfigPollInterval int `json:"config_poll_interval"`
+	// Strict rejects fields tinyssh does not know, which are otherwise
+	// ignored, so that a misspelt setting is an error instead of silently
+	// having no effect.
+	Strict bool `json:"strict"`
 
 	configDir string
+	sources   sources
+	// configUsers are the users of the config files as read, before
+	// users_file and defaults were applied.
+	configUsers []User
+	// wildcard is the user named WildcardUser as written, before defaults.
+	wildcard *User
+}
+
+// WildcardUser is the username of the entry that applies to every login
+// name not listed in users: its password and settings are used for them.
+const WildcardUser = "*"
+
+// User describes an account allowed to log in to the SSH server.
+type User struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+
+	// ShellArgs and ShellCommandArgs override the global settings of the
+	// same name when set.
+	ShellArgs        []string `json:"shell_args"`
+	ShellCommandArgs []string `json:"shell_command_args"`
+
+	// SFTPOnly restricts the account to the SFTP subsystem; shell, exec and
+	// PTY requests are refused.
+	SFTPOnly bool `json:"sftp_only"`
+	// ForwardingOnly restricts the account to port forwarding; session
+	// channels are refused, so no shell, exec or subsystem can run.
+	ForwardingOnly bool `json:"forwarding_only"`
+
+	// Record turns session recording on or off for this user, overriding
+	// recording.enabled.
+	Record *bool `json:"record"`
+	// RecordInput turns the recording of typed input on or off for this
+	// user, overriding recording.record_input.
+	RecordInput *bool `json:"record_input"`
+
+	// RunAsWrapper is prepended to every shell and command invocation, e.g.
+	// ["doas", "-u", "app", "--"]. A wrapper ending in "-c" (su style)
+	// receives the invocation as one shell-quoted argument instead.
+	RunAsWrapper []string `json:"run_as_wrapper"`
+
+	AllowTCPForwarding         string   `json:"allow_tcp_forwarding"`
+	AllowStreamLocalForwarding string   `json:"allow_stream_local_forwarding"`
+	PermitOpen                 []string `json:"permit_open"`
+	PermitListen               []string `json:"permit_listen"`
+	ForwardRateLimit           int64    `json:"forward_rate_limit"`
+	PermitTunnel               string   `json:"permit_tunnel"`
+
+	// Upstream routes every login of this user to the named upstream.
+	// Upstreams lists the upstreams the user may pick with "user@name".
+	Upstream  string   `json:"upstream"`
+	Upstreams []string `json:"upstreams"`
+}
+
+// Match overrides settings for the users matching Users (names or
+// patterns with * and ?). A user's own settings take precedence, and for
+// each setting the first matching block wins, as in sshd_config.
+type Match struct {
+	Users                      []string `json:"users"`
+	AllowTCPForwarding         string   `json:"allow_tcp_forwarding"`
+	AllowStreamLocalForwarding string   `json:"allow_stream_local_forwarding"`
+	PermitOpen                 []string `json:"permit_open"`
+	PermitListen               []string `json:"permit_listen"`
+	PermitTunnel               string   `json:"permit_tunnel"`
+	SFTPOnly                   bool     `json:"sftp_only"`
+}
+
+// matches reports whether the block applies to username.
+func (m Match) matches(username string) bool {
+	return matchUser(m.Users, username)
+}
+
+// matchUser reports whether username matches one of patterns.
+func matchUser(patterns []string, username string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, username); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// UserAllowed reports whether allow_users admits username.
+func (c *Config) UserAllowed(username string) bool {
+	return len(c.AllowUsers) == 0 || matchUser(c.AllowUsers, username)
+}
+
+// Listener is an additional SSH listening address. Unset fields inherit
+// the top-level setting of the same name; setting crypto_policy also
+// replaces the inherited algorithm lists with the policy's.
+type Listener struct {
+	Address string `json:"address"`
+	// Protocol is "ssh" (default) or "websocket", which runs SSH inside
+	// WebSocket binary messages for browser clients and HTTP-only proxies.
+	Protocol string `json:"protocol"`
+	// Path is the URL path prefix WebSocket upgrades are accepted on;
+	// defaults to "/".
+	Path             string                `json:"path"`
+	ServerVersion    string                `json:"server_version"`
+	Banner           string                `json:"banner"`
+	CryptoPolicy     string                `json:"crypto_policy"`
+	Ciphers          []string              `json:"ciphers"`
+	KexAlgorithms    []string              `json:"kex_algorithms"`
+	MACs             []string              `json:"macs"`
+	RequireStrictKex *bool                 `json:"require_strict_kex"`
+	ProxyProtocol    *ProxyProtocolOptions `json:"proxy_protocol"`
+	// AllowUsers limits logins on this listener to these users; empty
+	// allows everyone.
+	AllowUsers []string `json:"allow_users"`
+	// TLSCert and TLSKey wrap the listener in TLS, e.g. to share port 443
+	// behind an SNI router. Relative paths are resolved against the config
+	// directory.
+	TLSCert string `json:"tls_cert"`
+	TLSKey  string `json:"tls_key"`
+	// ACME wraps the listener in TLS with certificates obtained and renewed
+	// automatically, instead of tls_cert/tls_key.
+	ACME ACMEOptions `json:"acme"`
+}
+
+// TLS reports whether connections to the listener start with TLS.
+func (l Listener) TLS() bool {
+	return l.TLSCert != "" || l.ACME.Enabled()
+}
+
+// ACMEOptions configures certificates from an ACME CA. Challenges are
+// answered with TLS-ALPN-01 on the listener itself, so it must be
+// reachable on port 443 under each domain.
+type ACMEOptions struct {
+	Domains []string `json:"domains"`
+	Email   string   `json:"email"`
+	// CacheDir stores the account key and certificates; defaults to
+	// "acme" in the config directory.
+	CacheDir string `json:"cache_dir"`
+	// DirectoryURL selects the CA; defaults to Let's Encrypt production.
+	DirectoryURL string `json:"directory_url"`
+}
+
+// Enabled reports whether ACME certificates were requested.
+func (a ACMEOptions) Enabled() bool {
+	return len(a.Domains) > 0
+}
+
+// Values accepted by address_family.
+const (
+	AddressFamilyAny   = "any"
+	AddressFamilyInet  = "inet"
+	AddressFamilyInet6 = "inet6"
+)
+
+// Network returns the Go network name ("tcp", "tcp4" or "tcp6") for
+// address_family.
+func (c *Config) Network() string {
+	switch c.AddressFamily {
+	case AddressFamilyInet:
+		return "tcp4"
+	case AddressFamilyInet6:
+		return "tcp6"
+	default:
+		return "tcp"
+	}
+}
+
+// Values accepted by a listener's protocol.
+const (
+	ListenerSSH       = "ssh"
+	ListenerWebSocket = "websocket"
+)
+
+// SSHListeners returns every SSH listener with its settings resolved:
+// listen_address (when set) first, then listeners.
+func (c *Config) SSHListeners() []Listener {
+	var listeners []Listener
+	if c.ListenAddress != "" {
+		listeners = append(listeners, Listener{
+			Address:          c.ListenAddress,
+			Protocol:         ListenerSSH,
+			ServerVersion:    c.ServerVersion,
+			Banner:           c.Banner,
+			CryptoPolicy:     c.CryptoPolicy,
+			Ciphers:          c.Ciphers,
+			KexAlgorithms:    c.KexAlgorithms,
+			MACs:             c.MACs,
+			RequireStrictKex: &c.RequireStrictKex,
+			ProxyProtocol:    &c.ProxyProtocol,
+		})
+	}
+	return append(listeners, c.Listeners...)
+}
+
+// ProxyProtocolOptions configures PROXY protocol (v1 and v2) support.
+// Connections from Trusted addresses or CIDRs must start with a header;
+// connections from anywhere else are served as-is, so a header from an
+// untrusted client is never believed.
+type ProxyProtocolOptions struct {
+	Trusted []string `json:"trusted"`
+}
+
+// ParsePrefix parses a CIDR or a single IP address as a prefix.
+func ParsePrefix(value string) (netip.Prefix, error) {
+	if strings.Contains(value, "/") {
+		prefix, err := netip.ParsePrefix(value)
+		return prefix.Masked(), err
+	}
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()), nil
+}
+
+// ConnectionRateOptions configures a token bucket per source address:
+// PerMinute connections a minute, with up to Burst at once. IPv6 clients
+// share a bucket per /64, which is what a single host can usually pick
+// addresses from. It is enabled when PerMinute is set.
+type ConnectionRateOptions struct {
+	PerMinute int `json:"per_minute"`
+	// Burst defaults to PerMinute.
+	Burst int `json:"burst"`
+}
+
+// Enabled reports whether per-address connection rate limiting is on.
+func (r ConnectionRateOptions) Enabled() bool {
+	return r.PerMinute > 0
+}
+
+// GeoIPOptions configures country lookups in a MaxMind DB (MMDB) file such
+// as GeoLite2-Country. They are enabled when Database is set.
+type GeoIPOptions struct {
+	Database string `json:"database"`
+	// AllowCountries admits only these ISO 3166-1 alpha-2 codes, e.g.
+	// "DE"; empty admits every country.
+	AllowCountries []string `json:"allow_countries"`
+	// DenyCountries refuses these codes, before AllowCountries is checked.
+	DenyCountries []string `json:"deny_countries"`
+	// AllowUnknown admits addresses without a country in the database,
+	// such as private networks, when AllowCountries is set.
+	AllowUnknown bool `json:"allow_unknown"`
+}
+
+// Enabled reports whether GeoIP lookups are on.
+func (g GeoIPOptions) Enabled() bool {
+	return g.Database != ""
+}
+
+// Values accepted by dnsbl.action.
+const (
+	DNSBLReject = "reject"
+	DNSBLTarpit = "tarpit"
+)
+
+// DNSBLOptions configures DNS blocklist checks of client addresses. They
+// are enabled when Zones is set.
+type DNSBLOptions struct {
+	// Zones are blocklist domains, e.g. "dnsbl.dronebl.org". An address is
+	// listed when any of them has an A record for it.
+	Zones []string `json:"zones"`
+	// Action is "reject" (default) to close the connection or "tarpit" to
+	// keep the client waiting for a banner that never comes.
+	Action string `json:"action"`
+	// Timeout bounds the lookups in seconds; defaults to 2. Addresses whose
+	// lookups fail are admitted.
+	Timeout int `json:"timeout"`
+	// CacheTTL is how long results are kept, in seconds; defaults to 3600.
+	CacheTTL int `json:"cache_ttl"`
+}
+
+// Enabled reports whether DNSBL checks are on.
+func (d DNSBLOptions) Enabled() bool {
+	return len(d.Zones) > 0
+}
+
+// ReservationOptions configures named remote-forward reservations. They are
+// enabled when PortMin is set.
+type ReservationOptions struct {
+	// PortMin and PortMax bound the ports handed out to new names.
+	PortMin int `json:"port_min"`
+	PortMax int `json:"port_max"`
+	// Path is the JSON file reservations persist in, relative to the
+	// configuration file. Defaults to "tinyssh_reservations.json".
+	Path string `json:"path"`
+	// TTL is how many seconds an unused reservation is kept; zero keeps
+	// reservations until they are removed through the admin API.
+	TTL int `json:"ttl"`
+}
+
+// Enabled reports whether named reservations are configured.
+func (r ReservationOptions) Enabled() bool {
+	return r.PortMin > 0
+}
+
+// Values accepted by recording.format.
+const (
+	RecordingAsciicast = "asciicast"
+	RecordingScript    = "script"
+)
+
+// RecordingOptions configures recording of interactive (PTY) sessions.
+// Recording is on for every user when Enabled is set; a user's Record
+// setting overrides it.
+type RecordingOptions struct {
+	Enabled bool `json:"enabled"`
+	// Format is RecordingAsciicast (the default) for asciicast v2 files,
+	// which asciinema plays back, or RecordingScript for the typescript
+	// and timing files of "script --timing" and scriptreplay.
+	Format string `json:"format"`
+	// Dir holds the recordings, relative to the configuration file.
+	// Defaults to "recordings".
+	Dir string `json:"dir"`
+	// MaxSize caps one recording in bytes; output beyond it is not
+	// recorded. Zero means no limit.
+	MaxSize int64 `json:"max_size"`
+	// MaxTotalSize caps the size of Dir in bytes: when a recording starts,
+	// the oldest ones are deleted until the rest fit. Zero means no limit.
+	MaxTotalSize int64 `json:"max_total_size"`
+	// AgeRecipients encrypts recordings with age to these X25519 public
+	// keys (age1...), so only the holders of the private keys can read
+	// them. The files get a .age extension.
+	AgeRecipients []string `json:"age_recipients"`
+	// RecordInput also records what the client types, including input the
+	// terminal does not echo such as passwords. It is separate from
+	// Enabled because such recordings hold secrets; a user's RecordInput
+	// setting overrides it.
+	RecordInput bool `json:"record_input"`
+}
+
+// Records reports whether the sessions of user are recorded.
+func (c *Config) Records(user User) bool {
+	if user.Record != nil {
+		return *user.Record
+	}
+	return c.Recording.Enabled
+}
+
+// RecordsInput reports whether the recorded sessions of user include their
+// input.
+func (c *Config) RecordsInput(user User) bool {
+	if user.RecordInput != nil {
+		return *user.RecordInput
+	}
+	return c.Recording.RecordInput
+}
+
+// UploadOptions configures uploading files to an S3 bucket or an
+// S3-compatible service once they are complete. It is enabled when Bucket
+// is set. Credentials come from the environment or the instance role.
+type UploadOptions struct {
+	Bucket string `json:"bucket"`
+	// Prefix is prepended to the file name to form the object key. It may
+	// contain {date} (YYYY-MM-DD), {year}, {month}, {day} and {user}, taken
+	// from the start of the session. Defaults to "{date}/{user}/".
+	Prefix string `json:"prefix"`
+	// Region defaults to AWS_REGION.
+	Region string `json:"region"`
+	// Endpoint is the URL of an S3-compatible service, addressed
+	// path-style. Defaults to AWS_ENDPOINT_URL_S3 or AWS itself.
+	Endpoint string `json:"endpoint"`
+	// DeleteAfterUpload removes the local copy once it is uploaded.
+	DeleteAfterUpload bool `json:"delete_after_upload"`
+}
+
+// Enabled reports whether uploads are configured.
+func (u UploadOptions) Enabled() bool {
+	return u.Bucket != ""
+}
+
+// TracingOptions configures exporting OpenTelemetry traces over OTLP/HTTP.
+// Tracing is on when Endpoint is set.
+type TracingOptions struct {
+	// Endpoint is the base URL of the OTLP/HTTP collector, such as
+	// http://localhost:4318; spans are posted to its /v1/traces. Defaults
+	// to OTEL_EXPORTER_OTLP_ENDPOINT.
+	Endpoint string `json:"endpoint"`
+	// Headers are sent with every export, e.g. for authentication.
+	// Defaults to OTEL_EXPORTER_OTLP_HEADERS (key=value,...).
+	Headers map[string]string `json:"headers"`
+	// ServiceName is the service.name resource attribute. Defaults to
+	// OTEL_SERVICE_NAME or "tinyssh".
+	ServiceName string `json:"service_name"`
+}
+
+// Enabled reports whether tracing is configured.
+func (t TracingOptions) Enabled() bool {
+	return t.Endpoint != ""
+}
+
+// TracesURL returns the URL spans are posted to.
+func (t TracingOptions) TracesURL() string {
+	if strings.HasSuffix(t.Endpoint, "/v1/traces") {
+		return t.Endpoint
+	}
+	return strings.TrimSuffix(t.Endpoint, "/") + "/v1/traces"
+}
+
+// StatsDOptions configures pushing metrics over UDP to StatsD or the
+// Datadog agent. Pushing is on when Address is set.
+type StatsDOptions struct {
+	// Address is the host:port of the server, such as 127.0.0.1:8125.
+	Address string `json:"address"`
+	// Prefix starts every metric name. Defaults to "tinyssh.".
+	Prefix string `json:"prefix"`
+	// Interval is how often, in seconds, metrics are pushed. Defaults
+	// to 10.
+	Interval int `json:"interval"`
+	// DogStatsD sends labels such as the drop reason as DogStatsD tags
+	// instead of in the metric name.
+	DogStatsD bool `json:"dogstatsd"`
+	// Tags are added to every metric, as key:value, with DogStatsD.
+	Tags []string `json:"tags"`
+}
+
+// Enabled reports whether pushing to StatsD is configured.
+func (s StatsDOptions) Enabled() bool {
+	return s.Address != ""
+}
+
+// Webhook events.
+const (
+	WebhookLogin        = "login"
+	WebhookLogout       = "logout"
+	WebhookAuthFailures = "auth_failures"
+	WebhookNewSource    = "new_source"
+)
+
+// Values accepted by webhooks.endpoints.format.
+const (
+	WebhookJSON  = "json"
+	WebhookSlack = "slack"
+)
+
+// WebhookOptions configures webhook notifications. They are on when an
+// endpoint is set.
+type WebhookOptions struct {
+	Endpoints []Webhook `json:"endpoints"`
+	// AuthFailureThreshold fires auth_failures when this many logins from
+	// one address fail within AuthFailureWindow seconds. Defaults to 5
+	// and 300.
+	AuthFailureThreshold int `json:"auth_failure_threshold"`
+	AuthFailureWindow    int `json:"auth_failure_window"`
+	// KnownSourcesPath is the JSON file keeping the addresses each user
+	// logged in from, for new_source, relative to the configuration
+	// file. Defaults to "tinyssh_known_sources.json".
+	KnownSourcesPath string `json:"known_sources_path"`
+}
+
+// Enabled reports whether any webhook is configured.
+func (w WebhookOptions) Enabled() bool {
+	return len(w.Endpoints) > 0
+}
+
+// Webhook is one endpoint notified with a POST per event.
+type Webhook struct {
+	URL string `json:"url"`
+	// Format is WebhookJSON (the default) for the event as a JSON object
+	// or WebhookSlack for a Slack incoming-webhook message.
+	Format string `json:"format"`
+	// Template is a text/template for the body instead of Format, given
+	// the event; its json function encodes a value as JSON.
+	Template string `json:"template"`
+	// ContentType is the Content-Type of templated bodies. Defaults to
+	// "application/json".
+	ContentType string `json:"content_type"`
+	// Headers are added to each request, such as an Authorization token.
+	Headers map[string]string `json:"headers"`
+	// Events selects the events sent; empty means all of them.
+	Events []string `json:"events"`
+}
+
+// Wants reports whether w is sent event.
+func (w Webhook) Wants(event string) bool {
+	return len(w.Events) == 0 || slices.Contains(w.Events, event)
+}
+
+// WebhookTemplate parses a webhook body template. It is shared by
+// validation and delivery so both accept the same templates.
+func WebhookTemplate(text string) (*template.Template, error) {
+	return template.New("webhook").Funcs(template.FuncMap{
+		"json": func(v any) (string, error) {
+			raw, err := json.Marshal(v)
+			return string(raw), err
+		},
+	}).Parse(text)
+}
+
+// LogOptions configures log destinations.
+type LogOptions struct {
+	Syslog SyslogOptions `json:"syslog"`
+	// Rotate rotates the file given with -log-file.
+	Rotate RotateOptions `json:"rotate"`
+	// NATS and Kafka receive every audit event as a JSON message.
+	NATS  NATSOptions  `json:"nats"`
+	Kafka KafkaOptions `json:"kafka"`
+	// SQLite records connections, sessions and audit events in a local
+	// database.
+	SQLite SQLiteOptions `json:"sqlite"`
+	// Chain writes audit events to a hash-chained file.
+	Chain ChainOptions `json:"chain"`
+}
+
+// ChainOptions configures the tamper-evident audit log. It is on when Path
+// is set.
+type ChainOptions struct {
+	// Path is the log file, relative to the configuration file.
+	Path string `json:"path"`
+	// AnchorInterval is how often, in seconds, the head of the chain is
+	// signed with the host key; 300 by default.
+	AnchorInterval int `json:"anchor_interval"`
+}
+
+// Enabled reports whether the tamper-evident audit log is configured.
+func (c ChainOptions) Enabled() bool {
+	return c.Path != ""
+}
+
+// SQLiteOptions configures the audit database. It is on when Path is set.
+type SQLiteOptions struct {
+	// Path is the database file, relative to the configuration file.
+	Path string `json:"path"`
+	// MaxAge deletes records older than this many seconds. Zero keeps
+	// them all.
+	MaxAge int `json:"max_age"`
+}
+
+// Enabled reports whether the audit database is configured.
+func (s SQLiteOptions) Enabled() bool {
+	return s.Path != ""
+}
+
+// NATSOptions configures publishing audit events to NATS. It is on when
+// URL is set.
+type NATSOptions struct {
+	// URL lists the servers, comma separated, such as
+	// nats://127.0.0.1:4222; credentials may be given in it.
+	URL string `json:"url"`
+	// Subject prefixes the subject of each event, which ends with the
+	// event name, such as tinyssh.events.connection.open. Defaults to
+	// "tinyssh.events".
+	Subject string `json:"subject"`
+	// CredsFile is a NATS credentials file (JWT and NKey seed).
+	CredsFile string `json:"creds_file"`
+}
+
+// Enabled reports whether publishing to NATS is configured.
+func (n NATSOptions) Enabled() bool {
+	return n.URL != ""
+}
+
+// KafkaOptions configures publishing audit events to Kafka. It is on when
+// Brokers is set. Messages are keyed by connection ID, so the events of a
+// connection stay in order.
+type KafkaOptions struct {
+	// Brokers are the host:port addresses used to discover the cluster.
+	Brokers []string `json:"brokers"`
+	// Topic defaults to "tinyssh-events".
+	Topic string `json:"topic"`
+	// TLS connects to the brokers over TLS.
+	TLS bool `json:"tls"`
+	// Username and Password authenticate with SASL/PLAIN.
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// Enabled reports whether publishing to Kafka is configured.
+func (k KafkaOptions) Enabled() bool {
+	return len(k.Brokers) > 0
+}
+
+// RotateOptions configures rotating a log file. It is on when MaxSize or
+// Interval is set. Durations are in seconds.
+type RotateOptions struct {
+	// MaxSize rotates the file before it grows past this many bytes.
+	MaxSize int64 `json:"max_size"`
+	// Interval rotates the file once it has been written to this long.
+	Interval int `json:"interval"`
+	// MaxBackups keeps at most this many rotated files, deleting the
+	// oldest. Zero keeps them all.
+	MaxBackups int `json:"max_backups"`
+	// MaxBackupAge deletes rotated files older than this. Zero keeps them
+	// regardless of age.
+	MaxBackupAge int `json:"max_backup_age"`
+	// Compress gzips rotated files.
+	Compress bool `json:"compress"`
+}
+
+// Enabled reports whether rotation is configured.
+func (r RotateOptions) Enabled() bool {
+	return r.MaxSize > 0 || r.Interval > 0
+}
+
+// SyslogFacilities maps the names accepted by log.syslog.facility to their
+// codes.
+var SyslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+	"lpr": 6, "news": 7, "uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// SyslogOptions configures sending logs to syslog as RFC 5424 messages.
+// It is on when Address is set.
+type SyslogOptions struct {
+	// Address is "local" for the local syslog socket, or a URL:
+	// udp://host:514, tcp://host:601, tls://host:6514 or unix:///dev/log.
+	Address string `json:"address"`
+	// Facility is a name from SyslogFacilities. Defaults to "auth".
+	Facility string `json:"facility"`
+	// AppName is the APP-NAME of the messages. Defaults to "tinyssh".
+	AppName string `json:"app_name"`
+	// AuditOnly sends only audit events: logins, sessions, file
+	// transfers and forwards.
+	AuditOnly bool `json:"audit_only"`
+	// CAFile verifies a tls:// server with these certificates instead of
+	// the system roots.
+	CAFile string `json:"ca_file"`
+}
+
+// Enabled reports whether syslog output is configured.
+func (s SyslogOptions) Enabled() bool {
+	return s.Address != ""
+}
+
+// PKCS11Key locates a private key on a PKCS#11 token. It is enabled when
+// Module is set; RSA and ECDSA keys are supported.
+type PKCS11Key struct {
+	// Module is the path of the PKCS#11 library, e.g.
+	// /usr/lib/softhsm/libsofthsm2.so.
+	Module string `json:"module"`
+	// TokenLabel selects the token; empty uses the first one present.
+	TokenLabel string `json:"token_label"`
+	// KeyLabel is the CKA_LABEL of the private key and its public key.
+	KeyLabel string `json:"key_label"`
+	// PIN logs in to the token; PINFile reads it from a file instead.
+	PIN     string `json:"pin"`
+	PINFile string `json:"pin_file"`
+}
+
+// TPMKey locates a signing key persisted in a TPM 2.0. It is enabled when
+// Handle is set; RSA and ECDSA keys are supported.
+type TPMKey struct {
+	// Device defaults to /dev/tpmrm0.
+	Device string `json:"device"`
+	// Handle is the persistent handle, e.g. "0x81000001".
+	Handle string `json:"handle"`
+	// Password is the key's authorization value, if any.
+	Password string `json:"password"`
+}
+
+// KMSKey locates an asymmetric signing key in a cloud KMS. It is enabled
+// when Provider is set.
+type KMSKey struct {
+	// Provider is "aws" or "gcp".
+	Provider string `json:"provider"`
+	// Key is the AWS key ID, ARN or alias, or the full resource name of a
+	// GCP crypto key version.
+	Key string `json:"key"`
+	// Region is the AWS region; defaults to AWS_REGION.
+	Region string `json:"region"`
+	// Endpoint overrides the API base URL, e.g. for VPC endpoints.
+	Endpoint string `json:"endpoint"`
+	// CredentialsFile is a GCP service account key. Without it GCP tokens
+	// come from the metadata server; AWS credentials always come from the
+	// standard environment variables or the instance role.
+	CredentialsFile string `json:"credentials_file"`
+}
+
+// Values accepted by host_key_kms.provider.
+const (
+	KMSProviderAWS = "aws"
+	KMSProviderGCP = "gcp"
+)
+
+// VHostOptions configures the HTTP vhost front end.
+type VHostOptions struct {
+	// Listen is the address of the front end, e.g. ":443".
+	Listen string `json:"listen"`
+	// Domain is the parent domain tunnels are exposed under.
+	Domain string `json:"domain"`
+	// TLSCert and TLSKey switch the front end to HTTPS. Relative paths are
+	// resolved against the configuration file.
+	TLSCert string `json:"tls_cert"`
+	TLSKey  string `json:"tls_key"`
+}
+
+// WebTerminalOptions configures the browser terminal.
+type WebTerminalOptions struct {
+	// Listen is the HTTP address of the terminal page, e.g. ":8443".
+	Listen string `json:"listen"`
+	// TLSCert and TLSKey switch the page to HTTPS, which should be used
+	// anywhere but localhost since passwords are sent through it.
+	TLSCert string `json:"tls_cert"`
+	TLSKey  string `json:"tls_key"`
+	// AssetsDir serves xterm.js and xterm.css from a local directory
+	// instead of a CDN, for networks without internet access.
+	AssetsDir string `json:"assets_dir"`
+}
+
+// Upstream describes an SSH server that sessions are spliced through to.
+type Upstream struct {
+	// Address is the upstream host:port; it is dialed with forward_dial.
+	Address string `json:"address"`
+	// HostKey is the upstream's public host key in authorized_keys format.
+	HostKey string `json:"host_key"`
+	// User defaults to the tinyssh login name.
+	User         string `json:"user"`
+	Password     string `json:"password"`
+	IdentityFile string `json:"identity_file"`
+}
+
+// DialOptions controls how tinyssh dials destinations on behalf of clients.
+// Durations are in seconds.
+type DialOptions struct {
+	// Timeout bounds each connection attempt. Defaults to 10.
+	Timeout int `json:"timeout"`
+	// KeepAlive is the TCP keepalive period; zero keeps Go's default and a
+	// negative value disables keepalives.
+	KeepAlive int `json:"keepalive"`
+	// SourceAddress is the local IP outbound connections are bound to.
+	SourceAddress string `json:"source_address"`
+	// Retries is how many more times a failed dial is attempted, waiting
+	// RetryDelay (default 1) between attempts.
+	Retries    int `json:"retries"`
+	RetryDelay int `json:"retry_delay"`
+	// Proxy routes dials through an upstream proxy given as a URL:
+	// socks5://[user:pass@]host:port or http://[user:pass@]host:port
+	// (HTTP CONNECT).
+	Proxy string `json:"proxy"`
+}
+
+// TCPOptions are socket options for client and forwarded connections.
+type TCPOptions struct {
+	// KeepAliveIdle and KeepAliveInterval (seconds) and KeepAliveCount
+	// configure keep-alive probing. Zero keeps Go's default (15, 15 and 9)
+	// and a negative value the operating system's.
+	KeepAliveIdle     int `json:"keepalive_idle"`
+	KeepAliveInterval int `json:"keepalive_interval"`
+	KeepAliveCount    int `json:"keepalive_count"`
+	// NoDelay sets TCP_NODELAY; defaults to true.
+	NoDelay *bool `json:"nodelay"`
+	// SendBuffer and ReceiveBuffer set SO_SNDBUF and SO_RCVBUF in bytes;
+	// zero leaves the kernel's autotuning in place.
+	SendBuffer    int `json:"send_buffer"`
+	ReceiveBuffer int `json:"receive_buffer"`
+}
+
+// KeepAlive returns the keep-alive settings, and false when none of them
+// is set.
+func (t TCPOptions) KeepAlive() (net.KeepAliveConfig, bool) {
+	if t.KeepAliveIdle == 0 && t.KeepAliveInterval == 0 && t.KeepAliveCount == 0 {
+		return net.KeepAliveConfig{}, false
+	}
+	return net.KeepAliveConfig{
+		Enable:   true,
+		Idle:     time.Duration(t.KeepAliveIdle) * time.Second,
+		Interval: time.Duration(t.KeepAliveInterval) * time.Second,
+		Count:    t.KeepAliveCount,
+	}, true
+}
+
+// Values accepted by host_key_type.
+const (
+	HostKeyEd25519 = "ed25519"
+	HostKeyECDSA   = "ecdsa"
+	HostKeyRSA     = "rsa"
+)
+
+// HostKeyPassphraseEnv overrides the configured host key passphrase.
+const HostKeyPassphraseEnv = "TINYSSH_HOST_KEY_PASSPHRASE"
+
+// HostKeyPassphraseBytes returns the host key passphrase from the
+// environment, the passphrase file or the config, in that order, or nil if
+// none is set. A trailing newline in the file is ignored.
+func (c *Config) HostKeyPassphraseBytes() ([]byte, error) {
+	if v, ok := os.LookupEnv(HostKeyPassphraseEnv); ok && v != "" {
+		return []byte(v), nil
+	}
+	if c.HostKeyPassphraseFile != "" {
+		raw, err := os.ReadFile(c.HostKeyPassphraseFile)
+		if err != nil {
+			return nil, fmt.Errorf("read host key passphrase: %w", err)
+		}
+		return []byte(strings.TrimRight(string(raw), "\r\n")), nil
+	}
+	if c.HostKeyPassphrase != "" {
+		return []byte(c.HostKeyPassphrase), nil
+	}
+	return nil, nil
+}
+
+// KeyTypeFor returns the algorithm to generate the host key at path with:
+// the one named in the file name, as in OpenSSH's ssh_host_<type>_key, or
+// HostKeyType otherwise.
+func (c *Config) KeyTypeFor(path string) string {
+	name := strings.ToLower(filepath.Base(path))
+	for _, keyType := range []string{HostKeyEd25519, HostKeyECDSA, HostKeyRSA} {
+		if strings.Contains(name, keyType) {
+			return keyType
+		}
+	}
+	return c.HostKeyType
+}
+
+// Values accepted by allow_tcp_forwarding.
+const (
+	ForwardingBoth   = "both"
+	ForwardingLocal  = "local"
+	ForwardingRemote = "remote"
+	ForwardingNone   = "none"
+)
+
+// Values accepted by gateway_ports.
+const (
+	GatewayPortsNo              = "no"
+	GatewayPortsYes             = "yes"
+	GatewayPortsClientSpecified = "clientspecified"
+)
+
+// Values accepted by permit_tunnel. "yes" is accepted as an alias of
+// "point-to-point"; ethernet (tap) tunnels are not supported.
+const (
+	TunnelNo           = "no"
+	TunnelPointToPoint = "point-to-point"
+	TunnelYes          = "yes"
+)
+
+// AllowsTunnel reports whether the user may forward a tun device (ssh -w).
+func (u User) AllowsTunnel() bool {
+	return u.PermitTunnel == TunnelPointToPoint || u.PermitTunnel == TunnelYes
+}
+
+// AllowsLocalForwarding reports whether the user may open direct-tcpip
+// channels (ssh -L).
+func (u User) AllowsLocalForwarding() bool {
+	return u.AllowTCPForwarding == ForwardingBoth || u.AllowTCPForwarding == ForwardingLocal
+}
+
+// AllowsRemoteForwarding reports whether the user may request tcpip-forward
+// listeners (ssh -R).
+func (u User) AllowsRemoteForwarding() bool {
+	return u.AllowTCPForwarding == ForwardingBoth || u.AllowTCPForwarding == ForwardingRemote
+}
+
+// AllowsLocalStreamForwarding reports whether the user may open
+// direct-streamlocal channels to Unix sockets (ssh -L to a socket path).
+func (u User) AllowsLocalStreamForwarding() bool {
+	return u.AllowStreamLocalForwarding == ForwardingBoth || u.AllowStreamLocalForwarding == ForwardingLocal
+}
+
+// AllowsRemoteStreamForwarding reports whether the user may request
+// streamlocal-forward listeners on Unix sockets (ssh -R from a socket
+// path).
+func (u User) AllowsRemoteStreamForwarding() bool {
+	return u.AllowStreamLocalForwarding == ForwardingBoth || u.AllowStreamLocalForwarding == ForwardingRemote
+}
+
+// Load reads and validates the configuration file at the provided path,
+// which may be JSON, YAML or TOML, merged with its include and conf.d
+// fragments (see decode).
+func Load(path string) (*Config, error) {
+	return LoadWith(path, nil)
+}
+
+// LoadWith is Load with overrides, a document in the generic form of
+// configuration files, merged over the file as a fragment would be. An
+// empty path loads the overrides alone, so a configuration can be given
+// entirely on the command line.
+func LoadWith(path string, overrides map[string]any) (*Config, error) {
+	var cfg Config
+	var err error
+	if cfg.sources, err = decode(path, overrides, &cfg); err != nil {
+		return nil, fmt.Errorf("parse config: %w", err)
+	}
+
+	// Relative paths in a remote configuration, or in one without a file,
+	// are relative to the working directory.
+	if path != "" && !isRemote(path) {
+		cfg.configDir = filepath.Dir(path)
+	}
+	cfg.configUsers = slices.Clone(cfg.Users)
+	if cfg.UsersFile != "" {
+		if !isRemote(cfg.UsersFile) {
+			if !filepath.IsAbs(cfg.UsersFile) {
+				cfg.UsersFile = filepath.Join(cfg.configDir, cfg.UsersFile)
+			}
+			cfg.sources.files = append(cfg.sources.files, filepath.Clean(cfg.UsersFile))
+		}
+		if err := cfg.readUsersFile(); err != nil {
+			return nil, err
+		}
+	}
+	cfg.applyDefaults()
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	return &cfg, nil
+}
+
+// ReloadUsers returns a copy of c with the users of users_file read again
+// and every other setting unchanged.
+func (c *Config) ReloadUsers() (*Config, error) {
+	if c.UsersFile == "" {
+		return nil, errors.New("users_file is not set")
+	}
+	next := *c
+	if err := next.readUsersFile(); err != nil {
+		return nil, err
+	}
+	next.applyUserDefaults()
+	if err := next.validate(); err != nil {
+		return nil, err
+	}
+	return &next, nil
+}
+
+// IsUsersFile reports whether path is the users_file.
+func (c *Config) IsUsersFile(path string) bool {
+	return c.UsersFile != "" && filepath.Clean(path) == filepath.Clean(c.UsersFile)
+}
+
+// readUsersFile sets Users to the users of the config files followed by
+// those of users_file, which may only contain a "users" list.
+func (c *Config) readUsersFile() error {
+	doc, err := readDocument(c.UsersFile, nil)
+	if err != nil {
+		return fmt.Errorf("users_file: %w", err)
+	}
+	for key := range doc {
+		if key != "users" {
+			return fmt.Errorf("users_file: unexpected field %q, only users is allowed", key)
+		}
+	}
+	if err := expandEnv(doc); err != nil {
+		return fmt.Errorf("users_file: %w", err)
+	}
+	raw, err := json.Marshal(doc["users"])
+	if err != nil {
+		return fmt.Errorf("users_file: %w", err)
+	}
+	var users []User
+	if err := unmarshal(raw, &users, c.Strict); err != nil {
+		return fmt.Errorf("users_file: %w", err)
+	}
+	c.Users = append(slices.Clone(c.configUsers), users...)
+	return nil
+}
+
+// redactedValue replaces secrets in Redacted.
+const redactedValue = "REDACTED"
+
+// Redacted returns a copy of c with passwords, tokens, PINs and
+// passphrases replaced, safe to print or log. Empty secrets stay empty so
+// it still shows which ones are set.
+func (c *Config) Redacted() *Config {
+	redact := func(secret *string) {
+		if *secret != "" {
+			*secret = redactedValue
+		}
+	}
+	r := *c
+	redact(&r.AdminToken)
+	redact(&r.HostKeyPassphrase)
+	redact(&r.HostKeyPKCS11.PIN)
+	redact(&r.HostKeyTPM.Password)
+	if u, err := url.Parse(r.ForwardDial.Proxy); err == nil && u.User != nil {
+		r.ForwardDial.Proxy = u.Redacted()
+	}
+	r.Users = slices.Clone(c.Users)
+	for i := range r.Users {
+		redact(&r.Users[i].Password)
+	}
+	r.Upstreams = maps.Clone(c.Upstreams)
+	for name, upstream := range r.Upstreams {
+		redact(&upstream.Password)
+		r.Upstreams[name] = upstream
+	}
+	r.Tracing.Endpoint = redactedUserinfo(c.Tracing.Endpoint)
+	r.Tracing.Headers = redactedHeaders(c.Tracing.Headers)
+	r.Webhooks.Endpoints = slices.Clone(c.Webhooks.Endpoints)
+	for i := range r.Webhooks.Endpoints {
+		endpoint := &r.Webhooks.Endpoints[i]
+		endpoint.URL = redactedWebhookURL(endpoint.URL)
+		endpoint.Headers = redactedHeaders(endpoint.Headers)
+	}
+	redact(&r.Log.Kafka.Password)
+	if r.Log.NATS.URL != "" {
+		servers := strings.Split(r.Log.NATS.URL, ",")
+		for i, server := range servers {
+			servers[i] = redactedUserinfo(strings.TrimSpace(server))
+		}
+		r.Log.NATS.URL = strings.Join(servers, ",")
+	}
+	return &r
+}
+
+// redactedWebhookURL returns only the scheme and host of a webhook URL:
+// for Slack-style hooks the path is the secret.
+func redactedWebhookURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return redactedValue
+	}
+	return u.Scheme + "://" + u.Host + "/" + redactedValue
+}
+
+// redactedUserinfo returns rawURL with its user name and password, which
+// may be a token, replaced.
+func redactedUserinfo(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.User == nil {
+		return rawURL
+	}
+	u.User = url.User(redactedValue)
+	return u.String()
+}
+
+// redactedHeaders returns headers with every value redacted, since they
+// typically carry credentials.
+func redactedHeaders(headers map[string]string) map[string]string {
+	if headers == nil {
+		return nil
+	}
+	r := make(map[string]string, len(headers))
+	for name := range headers {
+		r[name] = redactedValue
+	}
+	return r
+}
+
+// Changed returns the names of the top-level fields whose effective values
+// differ between a and b, in sorted order.
+func Changed(a, b *Config) []string {
+	fields := func(c *Config) map[string]json.RawMessage {
+		raw, _ := json.Marshal(c)
+		var m map[string]json.RawMessage
+		_ = json.Unmarshal(raw, &m)
+		return m
+	}
+	before, after := fields(a), fields(b)
+	var changed []string
+	for name, value := range after {
+		if !bytes.Equal(before[name], value) {
+			changed = append(changed, name)
+		}
+	}
+	for name := range before {
+		if _, ok := after[name]; !ok {
+			changed = append(changed, name)
+		}
+	}
+	slices.Sort(changed)
+	return changed
+}
+
+// UsersByName returns a map of username to account for quick lookup.
+func (c *Config) UsersByName() map[string]User {
+	users := make(map[string]User, len(c.Users))
+	for _, user := range c.Users {
+		users[user.Username] = user
+	}
+	return users
 }
 
-// User describes an account allowed to log in to the SSH server.
-type User struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
-}
+// WildcardAccount returns the account for a login name not listed in
+// users: the wildcard user's settings, with Username set to name and the
+// match blocks for name applied. It reports false if there is no wildcard
+// user.
+func (c *Config) WildcardAccount(name string) (User, bool) {
+	if c.wildcard == nil {
+		return User{}, false
+	}
+	user := *c.wildcard
+	user.Username = name
+	c.applyUserDefaultsTo(&user)
+	return user, true
+}
+
+// Credentials returns a map of username to password for quick lookup.
+func (c *Config) Credentials() map[string]string {
+	creds := make(map[string]string, len(c.Users))
+	for _, user := range c.Users {
+		creds[user.Username] = user.Password
+	}
+	return creds
+}
+
+// applyDefaults fills in reasonable defaults when values are omitted.
+func (c *Config) applyDefaults() {
+	if c.ListenAddress == "" {
+		if c.ListenPort > 0 {
+			c.ListenAddress = fmt.Sprintf(":%d", c.ListenPort)
+		} else if len(c.Listeners) == 0 {
+			c.ListenAddress = ":2222"
+		}
+	}
+
+	if c.HostKeyType == "" {
+		c.HostKeyType = HostKeyEd25519
+	}
+	external := len(c.HostKeyAgent) > 0 || c.HostKeyPKCS11.Module != "" || c.HostKeyTPM.Handle != "" || c.HostKeyKMS.Provider != ""
+	externalOnly := external && c.HostKeyPath == "" && len(c.HostKeyPaths) == 0
+	if c.HostKeyPath == "" {
+		c.HostKeyPath = filepath.Join(c.configDir, "tinyssh_host_key")
+	} else if !filepath.IsAbs(c.HostKeyPath) {
+		c.HostKeyPath = filepath.Join(c.configDir, c.HostKeyPath)
+	}
+	if c.HostKeyPassphraseFile != "" && !filepath.IsAbs(c.HostKeyPassphraseFile) {
+		c.HostKeyPassphraseFile = filepath.Join(c.configDir, c.HostKeyPassphraseFile)
+	}
+	if len(c.HostKeyPaths) == 0 && !externalOnly {
+		c.HostKeyPaths = []string{c.HostKeyPath}
+	}
+	if len(c.HostKeyAgent) > 0 && c.HostKeyAgentSocket == "" {
+		c.HostKeyAgentSocket = os.Getenv("SSH_AUTH_SOCK")
+	}
+	if c.HostKeyPKCS11.PINFile != "" && !filepath.IsAbs(c.HostKeyPKCS11.PINFile) {
+		c.HostKeyPKCS11.PINFile = filepath.Join(c.configDir, c.HostKeyPKCS11.PINFile)
+	}
+	if c.HostKeyTPM.Handle != "" && c.HostKeyTPM.Device == "" {
+		c.HostKeyTPM.Device = "/dev/tpmrm0"
+	}
+	if c.CryptoPolicy != "" {
+		policy := c.Policy()
+		if len(c.Ciphers) == 0 {
+			c.Ciphers = slices.Clone(policy.Ciphers)
+		}
+		if len(c.KexAlgorithms) == 0 {
+			c.KexAlgorithms = slices.Clone(policy.KexAlgorithms)
+		}
+		if len(c.MACs) == 0 {
+			c.MACs = slices.Clone(policy.MACs)
+		}
+	}
+	if c.LoginGraceTime == 0 {
+		c.LoginGraceTime = 30
+	}
+	if c.ConnectionRate.Enabled() && c.ConnectionRate.Burst == 0 {
+		c.ConnectionRate.Burst = c.ConnectionRate.PerMinute
+	}
+	if c.GeoIP.Enabled() && !filepath.IsAbs(c.GeoIP.Database) {
+		c.GeoIP.Database = filepath.Join(c.configDir, c.GeoIP.Database)
+	}
+	for i, code := range c.GeoIP.AllowCountries {
+		c.GeoIP.AllowCountries[i] = strings.ToUpper(code)
+	}
+	for i, code := range c.GeoIP.DenyCountries {
+		c.GeoIP.DenyCountries[i] = strings.ToUpper(code)
+	}
+	if c.DNSBL.Enabled() {
+		if c.DNSBL.Action == "" {
+			c.DNSBL.Action = DNSBLReject
+		}
+		if c.DNSBL.Timeout == 0 {
+			c.DNSBL.Timeout = 2
+		}
+		if c.DNSBL.CacheTTL == 0 {
+			c.DNSBL.CacheTTL = 3600
+		}
+	}
+	for i, hassh := range c.DenyHASSH {
+		c.DenyHASSH[i] = strings.ToLower(hassh)
+	}
+	if c.MaxStartups == "" {
+		c.MaxStartups = "10:30:100"
+	}
+	if c.AcceptLoops == 0 {
+		c.AcceptLoops = 1
+	}
+	if c.AddressFamily == "" {
+		c.AddressFamily = AddressFamilyAny
+	}
+	if c.TCP.NoDelay == nil {
+		noDelay := true
+		c.TCP.NoDelay = &noDelay
+	}
+	if c.ServerVersion == "" {
+		c.ServerVersion = "SSH-2.0-tinyssh"
+	}
+	c.ServerVersion = fullServerVersion(c.ServerVersion)
+	for i := range c.Listeners {
+		l := &c.Listeners[i]
+		if l.Protocol == "" {
+			l.Protocol = ListenerSSH
+		}
+		if l.Protocol == ListenerWebSocket && l.Path == "" {
+			l.Path = "/"
+		}
+		if l.TLSCert != "" && !filepath.IsAbs(l.TLSCert) {
+			l.TLSCert = filepath.Join(c.configDir, l.TLSCert)
+		}
+		if l.TLSKey != "" && !filepath.IsAbs(l.TLSKey) {
+			l.TLSKey = filepath.Join(c.configDir, l.TLSKey)
+		}
+		if l.ACME.Enabled() {
+			if l.ACME.CacheDir == "" {
+				l.ACME.CacheDir = "acme"
+			}
+			if !filepath.IsAbs(l.ACME.CacheDir) {
+				l.ACME.CacheDir = filepath.Join(c.configDir, l.ACME.CacheDir)
+			}
+		}
+		if l.ServerVersion == "" {
+			l.ServerVersion = c.ServerVersion
+		}
+		l.ServerVersion = fullServerVersion(l.ServerVersion)
+		if l.Banner == "" {
+			l.Banner = c.Banner
+		}
+		if l.CryptoPolicy == "" {
+			l.CryptoPolicy = c.CryptoPolicy
+			l.Ciphers = listOr(l.Ciphers, c.Ciphers)
+			l.KexAlgorithms = listOr(l.KexAlgorithms, c.KexAlgorithms)
+			l.MACs = listOr(l.MACs, c.MACs)
+		} else {
+			policy := CryptoPolicies[l.CryptoPolicy]
+			l.Ciphers = listOr(l.Ciphers, policy.Ciphers)
+			l.KexAlgorithms = listOr(l.KexAlgorithms, policy.KexAlgorithms)
+			l.MACs = listOr(l.MACs, policy.MACs)
+		}
+		if l.RequireStrictKex == nil {
+			l.RequireStrictKex = &c.RequireStrictKex
+		}
+		if l.ProxyProtocol == nil {
+			l.ProxyProtocol = &c.ProxyProtocol
+		}
+	}
+	if c.HostKeyRotationGrace == 0 {
+		c.HostKeyRotationGrace = 7 * 24 * 60 * 60
+	}
+	if c.HostKeyKMS.Provider == KMSProviderAWS && c.HostKeyKMS.Region == "" {
+		c.HostKeyKMS.Region = os.Getenv("AWS_REGION")
+	}
+	if c.HostKeyKMS.CredentialsFile != "" && !filepath.IsAbs(c.HostKeyKMS.CredentialsFile) {
+		c.HostKeyKMS.CredentialsFile = filepath.Join(c.configDir, c.HostKeyKMS.CredentialsFile)
+	}
+	for i, path := range c.HostKeyPaths {
+		if path != "" && !filepath.IsAbs(path) {
+			c.HostKeyPaths[i] = filepath.Join(c.configDir, path)
+		}
+	}
+
+	if c.Shell == "" {
+		if shell := os.Getenv("SHELL"); shell != "" {
+			c.Shell = shell
+		} else {
+			c.Shell = "/bin/sh"
+		}
+	}
+
+	if c.ShellCommandArgs == nil {
+		c.ShellCommandArgs = []string{"-c"}
+	}
+
+	if c.PermitTunnel == "" {
+		c.PermitTunnel = TunnelNo
+	}
+	if c.AllowTCPForwarding == "" {
+		c.AllowTCPForwarding = ForwardingBoth
+	}
+	if c.GatewayPorts == "" {
+		c.GatewayPorts = GatewayPortsNo
+	}
+	c.applyUserDefaults()
+
+	if c.ForwardDial.Timeout == 0 {
+		c.ForwardDial.Timeout = 10
+	}
+	if c.ForwardDial.RetryDelay == 0 {
+		c.ForwardDial.RetryDelay = 1
+	}
+
+	if c.Reservations.Enabled() {
+		if c.Reservations.PortMax == 0 {
+			c.Reservations.PortMax = c.Reservations.PortMin
+		}
+		if c.Reservations.Path == "" {
+			c.Reservations.Path = "tinyssh_reservations.json"
+		}
+		if !filepath.IsAbs(c.Reservations.Path) {
+			c.Reservations.Path = filepath.Join(c.configDir, c.Reservations.Path)
+		}
+	}
+
+	if c.Tracing.Endpoint == "" {
+		c.Tracing.Endpoint = os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+	}
+	if c.Tracing.Headers == nil {
+		for _, pair := range strings.Split(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"), ",") {
+			if key, value, ok := strings.Cut(pair, "="); ok {
+				if c.Tracing.Headers == nil {
+					c.Tracing.Headers = make(map[string]string)
+				}
+				c.Tracing.Headers[strings.TrimSpace(key)] = strings.TrimSpace(value)
+			}
+		}
+	}
+	if c.Tracing.ServiceName == "" {
+		c.Tracing.ServiceName = cmp.Or(os.Getenv("OTEL_SERVICE_NAME"), "tinyssh")
+	}
+	if c.Log.Syslog.Enabled() {
+		if c.Log.Syslog.Facility == "" {
+			c.Log.Syslog.Facility = "auth"
+		}
+		if c.Log.Syslog.AppName == "" {
+			c.Log.Syslog.AppName = "tinyssh"
+		}
+		if c.Log.Syslog.CAFile != "" && !filepath.IsAbs(c.Log.Syslog.CAFile) {
+			c.Log.Syslog.CAFile = filepath.Join(c.configDir, c.Log.Syslog.CAFile)
+		}
+	}
+	if c.Log.NATS.Enabled() {
+		if c.Log.NATS.Subject == "" {
+			c.Log.NATS.Subject = "tinyssh.events"
+		}
+		if c.Log.NATS.CredsFile != "" && !filepath.IsAbs(c.Log.NATS.CredsFile) {
+			c.Log.NATS.CredsFile = filepath.Join(c.configDir, c.Log.NATS.CredsFile)
+		}
+	}
+	if c.Log.SQLite.Enabled() && !filepath.IsAbs(c.Log.SQLite.Path) {
+		c.Log.SQLite.Path = filepath.Join(c.configDir, c.Log.SQLite.Path)
+	}
+	if c.Log.Chain.Enabled() {
+		if !filepath.IsAbs(c.Log.Chain.Path) {
+			c.Log.Chain.Path = filepath.Join(c.configDir, c.Log.Chain.Path)
+		}
+		if c.Log.Chain.AnchorInterval == 0 {
+			c.Log.Chain.AnchorInterval = 300
+		}
+	}
+	if c.Log.Kafka.Enabled() && c.Log.Kafka.Topic == "" {
+		c.Log.Kafka.Topic = "tinyssh-events"
+	}
+	if c.StatsD.Enabled() {
+		if c.StatsD.Prefix == "" {
+			c.StatsD.Prefix = "tinyssh."
+		}
+		if c.StatsD.Interval == 0 {
+			c.StatsD.Interval = 10
+		}
+	}
+	if c.Webhooks.Enabled() {
+		w := &c.Webhooks
+		if w.AuthFailureThreshold == 0 {
+			w.AuthFailureThreshold = 5
+		}
+		if w.AuthFailureWindow == 0 {
+			w.AuthFailureWindow = 300
+		}
+		if w.KnownSourcesPath == "" {
+			w.KnownSourcesPath = "tinyssh_known_sources.json"
+		}
+		if !filepath.IsAbs(w.KnownSourcesPath) {
+			w.KnownSourcesPath = filepath.Join(c.configDir, w.KnownSourcesPath)
+		}
+		for i := range w.Endpoints {
+			if w.Endpoints[i].Format == "" {
+				w.Endpoints[i].Format = WebhookJSON
+			}
+			if w.Endpoints[i].ContentType == "" {
+				w.Endpoints[i].ContentType = "application/json"
+			}
+		}
+	}
+	if c.Upload.Enabled() && c.Upload.Prefix == "" {
+		c.Upload.Prefix = "{date}/{user}/"
+	}
+	if c.Recording.Format == "" {
+		c.Recording.Format = RecordingAsciicast
+	}
+	if c.Recording.Dir == "" {
+		c.Recording.Dir = "recordings"
+	}
+	if !filepath.IsAbs(c.Recording.Dir) {
+		c.Recording.Dir = filepath.Join(c.configDir, c.Recording.Dir)
+	}
+
+	c.VHost.Domain = strings.Trim(strings.ToLower(c.VHost.Domain), ".")
+	if c.VHost.TLSCert != "" && !filepath.IsAbs(c.VHost.TLSCert) {
+		c.VHost.TLSCert = filepath.Join(c.configDir, c.VHost.TLSCert)
+	}
+	if c.VHost.TLSKey != "" && !filepath.IsAbs(c.VHost.TLSKey) {
+		c.VHost.TLSKey = filepath.Join(c.configDir, c.VHost.TLSKey)
+	}
 
-// Load reads and validates the configuration file at the provided path.
-func Load(path string) (*Config, error) {
-	raw, err := os.ReadFile(path)
-	if err != nil {
-		return nil, fmt.Errorf("read config: %w", err)
+	w := &c.WebTerminal
+	for _, path := range []*string{&w.TLSCert, &w.TLSKey, &w.AssetsDir} {
+		if *path != "" && !filepath.IsAbs(*path) {
+			*path = filepath.Join(c.configDir, *path)
+		}
 	}
 
-	var cfg Config
-	if err := json.Unmarshal(raw, &cfg); err != nil {
-		return nil, fmt.Errorf("parse config: %w", err)
+	for name, upstream := range c.Upstreams {
+		if upstream.IdentityFile != "" && !filepath.IsAbs(upstream.IdentityFile) {
+			upstream.IdentityFile = filepath.Join(c.configDir, upstream.IdentityFile)
+			c.Upstreams[name] = upstream
+		}
 	}
 
-	cfg.configDir = filepath.Dir(path)
-	cfg.applyDefaults()
-	if err := cfg.validate(); err != nil {
-		return nil, err
+	if c.SessionOutputBuffer == 0 {
+		c.SessionOutputBuffer = 256 * 1024
 	}
 
-	return &cfg, nil
-}
+	if c.ClientAliveCountMax == 0 {
+		c.ClientAliveCountMax = 3
+	}
 
-// Credentials returns a map of username to password for quick lookup.
-func (c *Config) Credentials() map[string]string {
-	creds := make(map[string]string, len(c.Users))
-	for _, user := range c.Users {
-		creds[user.Username] = user.Password
+	if c.ConfigPollInterval == 0 {
+		c.ConfigPollInterval = 60
 	}
-	return creds
 }
 
-// applyDefaults fills in reasonable defaults when values are omitted.
-func (c *Config) applyDefaults() {
-	if c.ListenAddress == "" {
-		if c.ListenPort > 0 {
-			c.ListenAddress = fmt.Sprintf(":%d", c.ListenPort)
-		} else {
-			c.ListenAddress = ":2222"
+// applyUserDefaults fills in the settings users leave unset from the
+// matching Match blocks, then from the global settings. The wildcard
+// user is also kept as written, for WildcardAccount.
+func (c *Config) applyUserDefaults() {
+	c.wildcard = nil
+	for i := range c.Users {
+		user := &c.Users[i]
+		if user.Username == WildcardUser {
+			raw := *user
+			c.wildcard = &raw
 		}
+		c.applyUserDefaultsTo(user)
 	}
+}
 
-	if c.HostKeyPath == "" {
-		c.HostKeyPath = filepath.Join(c.configDir, "tinyssh_host_key")
-	} else if !filepath.IsAbs(c.HostKeyPath) {
-		c.HostKeyPath = filepath.Join(c.configDir, c.HostKeyPath)
+// applyUserDefaultsTo fills in the settings user leaves unset from the
+// match blocks that apply to it and then from the global settings.
+func (c *Config) applyUserDefaultsTo(user *User) {
+	for _, m := range c.Match {
+		if !m.matches(user.Username) {
+			continue
+		}
+		if user.AllowTCPForwarding == "" {
+			user.AllowTCPForwarding = m.AllowTCPForwarding
+		}
+		if user.AllowStreamLocalForwarding == "" {
+			user.AllowStreamLocalForwarding = m.AllowStreamLocalForwarding
+		}
+		if user.PermitOpen == nil {
+			user.PermitOpen = m.PermitOpen
+		}
+		if user.PermitListen == nil {
+			user.PermitListen = m.PermitListen
+		}
+		if user.PermitTunnel == "" {
+			user.PermitTunnel = m.PermitTunnel
+		}
+		user.SFTPOnly = user.SFTPOnly || m.SFTPOnly
 	}
-
-	if c.Shell == "" {
-		if shell := os.Getenv("SHELL"); shell != "" {
-			c.Shell = shell
-		} else {
-			c.Shell = "/bin/sh"
+	if user.ShellArgs == nil {
+		user.ShellArgs = c.ShellArgs
+	}
+	if user.ShellCommandArgs == nil {
+		user.ShellCommandArgs = c.ShellCommandArgs
+	}
+	if user.PermitTunnel == "" {
+		user.PermitTunnel = c.PermitTunnel
+	}
+	if user.AllowTCPForwarding == "" {
+		user.AllowTCPForwarding = c.AllowTCPForwarding
+	}
+	if user.PermitOpen == nil {
+		user.PermitOpen = c.PermitOpen
+	}
+	if user.ForwardRateLimit == 0 {
+		user.ForwardRateLimit = c.ForwardRateLimit
+	}
+	if user.PermitListen == nil {
+		user.PermitListen = c.PermitListen
+	}
+	if user.AllowStreamLocalForwarding == "" {
+		user.AllowStreamLocalForwarding = c.AllowStreamLocalForwarding
+	}
+	if user.AllowStreamLocalForwarding == "" {
+		// Socket forwarding reaches local services such as the Docker
+		// socket, so accounts whose forwarding is restricted in any way do
+		// not get it unless it is allowed explicitly.
+		user.AllowStreamLocalForwarding = ForwardingBoth
+		if user.ForwardingOnly || user.AllowTCPForwarding != ForwardingBoth || user.PermitOpen != nil || user.PermitListen != nil {
+			user.AllowStreamLocalForwarding = ForwardingNone
 		}
 	}
 }
 
 // validate ensures the configuration values are sane.
 func (c *Config) validate() error {
-	if c.ListenAddress == "" {
+	if c.ListenAddress == "" && len(c.Listeners) == 0 {
 		return errors.New("listen address is required")
 	}
 
+	if c.SessionOutputBuffer < 0 {
+		return errors.New("session output buffer cannot be negative")
+	}
+
+	if c.ClientAliveInterval < 0 {
+		return errors.New("client alive interval cannot be negative")
+	}
+	if c.ClientAliveCountMax < 0 {
+		return errors.New("client alive count max cannot be negative")
+	}
+
+	for name, command := range c.Subsystems {
+		if strings.TrimSpace(name) == "" {
+			return errors.New("subsystem name cannot be empty")
+		}
+		if strings.TrimSpace(command) == "" {
+			return fmt.Errorf("subsystem %s must have a command", name)
+		}
+	}
+
+	if c.HostKeyPassphrase != "" && c.HostKeyPassphraseFile != "" {
+		return errors.New("host_key_passphrase and host_key_passphrase_file are mutually exclusive")
+	}
+	if c.ConnectionRate.PerMinute < 0 || c.ConnectionRate.Burst < 0 {
+		return errors.New("connection_rate values cannot be negative")
+	}
+	if c.MaxConnections < 0 {
+		return errors.New("max connections cannot be negative")
+	}
+	for _, entry := range c.AllowCIDRs {
+		if _, err := ParsePrefix(entry); err != nil {
+			return fmt.Errorf("allow_cidrs: %w", err)
+		}
+	}
+	for _, entry := range c.DenyCIDRs {
+		if _, err := ParsePrefix(entry); err != nil {
+			return fmt.Errorf("deny_cidrs: %w", err)
+		}
+	}
+	if !c.GeoIP.Enabled() && (len(c.GeoIP.AllowCountries) > 0 || len(c.GeoIP.DenyCountries) > 0) {
+		return errors.New("geoip country lists require a database")
+	}
+	if c.RekeyThreshold != 0 && c.RekeyThreshold < 256 {
+		return errors.New("rekey_threshold must be at least 256 bytes")
+	}
+	for _, hassh := range c.DenyHASSH {
+		if _, err := hex.DecodeString(hassh); err != nil || len(hassh) != 32 {
+			return fmt.Errorf("deny_hassh: invalid fingerprint %q", hassh)
+		}
+	}
+	if c.DNSBL.Enabled() {
+		switch c.DNSBL.Action {
+		case DNSBLReject, DNSBLTarpit:
+		default:
+			return fmt.Errorf("unknown dnsbl action %q", c.DNSBL.Action)
+		}
+		if c.DNSBL.Timeout < 0 || c.DNSBL.CacheTTL < 0 {
+			return errors.New("dnsbl timeout and cache_ttl cannot be negative")
+		}
+	}
+	for _, code := range slices.Concat(c.GeoIP.AllowCountries, c.GeoIP.DenyCountries) {
+		if len(code) != 2 || strings.Trim(code, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") != "" {
+			return fmt.Errorf("geoip: invalid country code %q", code)
+		}
+	}
+	if c.AcceptLoops < 0 {
+		return errors.New("accept loops cannot be negative")
+	}
+	if c.TCP.SendBuffer < 0 || c.TCP.ReceiveBuffer < 0 {
+		return errors.New("tcp buffer sizes cannot be negative")
+	}
+	switch c.AddressFamily {
+	case AddressFamilyAny, AddressFamilyInet, AddressFamilyInet6:
+	default:
+		return fmt.Errorf("unknown address_family %q", c.AddressFamily)
+	}
+	if _, err := parseStartupLimit(c.MaxStartups); err != nil {
+		return fmt.Errorf("max_startups: %w", err)
+	}
+	addresses := make(map[string]bool)
+	for i, l := range c.SSHListeners() {
+		if err := c.validateListener(l); err != nil {
+			if i == 0 && c.ListenAddress != "" {
+				return err
+			}
+			return fmt.Errorf("listener %s: %w", l.Address, err)
+		}
+		if addresses[l.Address] {
+			return fmt.Errorf("listen address %s is used twice", l.Address)
+		}
+		addresses[l.Address] = true
+	}
+	if c.HostKeyRotationGrace < 0 {
+		return errors.New("host key rotation grace cannot be negative")
+	}
+	for _, path := range c.HostKeyPaths {
+		if path == "" {
+			return errors.New("host_key_paths cannot contain empty paths")
+		}
+	}
+	if len(c.HostKeyAgent) > 0 && c.HostKeyAgentSocket == "" {
+		return errors.New("host_key_agent requires host_key_agent_socket or SSH_AUTH_SOCK")
+	}
+	if p := c.HostKeyPKCS11; p.Module != "" {
+		if p.KeyLabel == "" {
+			return errors.New("host_key_pkcs11: key_label is required")
+		}
+		if p.PIN != "" && p.PINFile != "" {
+			return errors.New("host_key_pkcs11: pin and pin_file are mutually exclusive")
+		}
+	}
+	if h := c.HostKeyTPM.Handle; h != "" {
+		if _, err := strconv.ParseUint(h, 0, 32); err != nil {
+			return fmt.Errorf("host_key_tpm: invalid handle %q", h)
+		}
+	}
+	if k := c.HostKeyKMS; k.Provider != "" {
+		switch k.Provider {
+		case KMSProviderAWS:
+			if k.Region == "" && k.Endpoint == "" {
+				return errors.New("host_key_kms: region is required (or set AWS_REGION)")
+			}
+		case KMSProviderGCP:
+		default:
+			return fmt.Errorf("host_key_kms: unknown provider %q", k.Provider)
+		}
+		if k.Key == "" {
+			return errors.New("host_key_kms: key is required")
+		}
+	}
+	for _, fp := range c.HostKeyAgent {
+		if !strings.HasPrefix(fp, "SHA256:") {
+			return fmt.Errorf("host_key_agent: %q is not a SHA256 fingerprint", fp)
+		}
+	}
+	switch c.HostKeyType {
+	case HostKeyEd25519, HostKeyECDSA, HostKeyRSA:
+	default:
+		return fmt.Errorf("host_key_type: unknown value %q", c.HostKeyType)
+	}
+
+	if c.AdminListen != "" && !strings.HasPrefix(c.AdminListen, "/") && c.AdminToken == "" {
+		return errors.New("admin_listen: a TCP address requires admin_token")
+	}
+
+	if err := validateForwarding("allow_tcp_forwarding", c.AllowTCPForwarding); err != nil {
+		return err
+	}
+	if c.AllowStreamLocalForwarding != "" {
+		if err := validateForwarding("allow_stream_local_forwarding", c.AllowStreamLocalForwarding); err != nil {
+			return err
+		}
+	}
+	if err := validateTunnel("permit_tunnel", c.PermitTunnel); err != nil {
+		return err
+	}
+	switch c.GatewayPorts {
+	case GatewayPortsNo, GatewayPortsYes, GatewayPortsClientSpecified:
+	default:
+		return fmt.Errorf("gateway_ports: unknown value %q", c.GatewayPorts)
+	}
+	if c.ForwardRateLimit < 0 {
+		return errors.New("forward rate limit cannot be negative")
+	}
+	if c.ForwardDial.Timeout < 0 || c.ForwardDial.Retries < 0 || c.ForwardDial.RetryDelay < 0 {
+		return errors.New("forward_dial timeout, retries and retry_delay cannot be negative")
+	}
+	if addr := c.ForwardDial.SourceAddress; addr != "" && net.ParseIP(addr) == nil {
+		return fmt.Errorf("forward_dial: invalid source_address %q", addr)
+	}
+	if c.ForwardDial.Proxy != "" {
+		proxyURL, err := url.Parse(c.ForwardDial.Proxy)
+		if err != nil {
+			return fmt.Errorf("forward_dial: invalid proxy: %w", err)
+		}
+		switch proxyURL.Scheme {
+		case "socks5", "socks5h", "http":
+		default:
+			return fmt.Errorf("forward_dial: unsupported proxy scheme %q", proxyURL.Scheme)
+		}
+		if proxyURL.Port() == "" {
+			return fmt.Errorf("forward_dial: proxy %q must include a port", c.ForwardDial.Proxy)
+		}
+	}
+	if r := c.Reservations; r.Enabled() {
+		if r.PortMin > r.PortMax || r.PortMax > 65535 {
+			return fmt.Errorf("reservations: invalid port range %d-%d", r.PortMin, r.PortMax)
+		}
+		if r.TTL < 0 {
+			return errors.New("reservations: ttl cannot be negative")
+		}
+	}
+	if f := c.Recording.Format; f != RecordingAsciicast && f != RecordingScript {
+		return fmt.Errorf("recording: unknown format %q", f)
+	}
+	if c.Recording.MaxSize < 0 || c.Recording.MaxTotalSize < 0 {
+		return errors.New("recording: size limits cannot be negative")
+	}
+	if a := c.Log.Syslog.Address; a != "" && a != "local" {
+		u, err := url.Parse(a)
+		switch {
+		case err != nil:
+			return fmt.Errorf("log.syslog: address %q: %w", a, err)
+		case u.Scheme == "unix":
+			if u.Path == "" {
+				return fmt.Errorf("log.syslog: address %q has no socket path", a)
+			}
+		case u.Scheme == "udp" || u.Scheme == "tcp" || u.Scheme == "tls":
+			if _, _, err := net.SplitHostPort(u.Host); err != nil {
+				return fmt.Errorf("log.syslog: address %q: %w", a, err)
+			}
+		default:
+			return fmt.Errorf("log.syslog: address %q must be local or a udp://, tcp://, tls:// or unix:// URL", a)
+		}
+	}
+	if f := c.Log.Syslog.Facility; f != "" {
+		if _, ok := SyslogFacilities[f]; !ok {
+			return fmt.Errorf("log.syslog: unknown facility %q", f)
+		}
+	}
+	if r := c.Log.Rotate; r.MaxSize < 0 || r.Interval < 0 || r.MaxBackups < 0 || r.MaxBackupAge < 0 {
+		return errors.New("log.rotate: limits cannot be negative")
+	}
+	for _, b := range c.Log.Kafka.Brokers {
+		if _, _, err := net.SplitHostPort(b); err != nil {
+			return fmt.Errorf("log.kafka: broker %q: %w", b, err)
+		}
+	}
+	if c.Log.SQLite.MaxAge < 0 {
+		return errors.New("log.sqlite: max_age cannot be negative")
+	}
+	if c.Log.Chain.AnchorInterval < 0 {
+		return errors.New("log.chain: anchor_interval cannot be negative")
+	}
+	if (c.Log.Kafka.Username == "") != (c.Log.Kafka.Password == "") {
+		return errors.New("log.kafka: username and password must be set together")
+	}
+	if a := c.StatsD.Address; a != "" {
+		if _, _, err := net.SplitHostPort(a); err != nil {
+			return fmt.Errorf("statsd: address %q: %w", a, err)
+		}
+	}
+	if c.StatsD.Interval < 0 {
+		return errors.New("statsd: interval cannot be negative")
+	}
+	if len(c.StatsD.Tags) > 0 && !c.StatsD.DogStatsD {
+		return errors.New("statsd: tags require dogstatsd")
+	}
+	for _, w := range c.Webhooks.Endpoints {
+		if u, err := url.Parse(w.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("webhooks: url %q must be an http:// or https:// URL", w.URL)
+		}
+		if w.Format != WebhookJSON && w.Format != WebhookSlack {
+			return fmt.Errorf("webhooks: %s: unknown format %q", w.URL, w.Format)
+		}
+		if w.Template != "" {
+			if _, err := WebhookTemplate(w.Template); err != nil {
+				return fmt.Errorf("webhooks: %s: %w", w.URL, err)
+			}
+		}
+		for _, event := range w.Events {
+			if event != WebhookLogin && event != WebhookLogout && event != WebhookAuthFailures && event != WebhookNewSource {
+				return fmt.Errorf("webhooks: %s: unknown event %q", w.URL, event)
+			}
+		}
+	}
+	if c.Webhooks.AuthFailureThreshold < 0 || c.Webhooks.AuthFailureWindow < 0 {
+		return errors.New("webhooks: auth failure limits cannot be negative")
+	}
+	if e := c.Tracing.Endpoint; e != "" {
+		if u, err := url.Parse(e); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("tracing: endpoint %q must be an http:// or https:// URL", e)
+		}
+	}
+	if e := c.Upload.Endpoint; e != "" {
+		if u, err := url.Parse(e); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("upload: endpoint %q must be an http:// or https:// URL", e)
+		}
+	}
+	for _, recipient := range c.Recording.AgeRecipients {
+		if err := validateAgeRecipient(recipient); err != nil {
+			return fmt.Errorf("recording: age_recipients: %w", err)
+		}
+	}
+	if v := c.VHost; v.Listen != "" {
+		if v.Domain == "" {
+			return errors.New("vhost: domain is required")
+		}
+		if (v.TLSCert == "") != (v.TLSKey == "") {
+			return errors.New("vhost: tls_cert and tls_key must be set together")
+		}
+	}
+	if w := c.WebTerminal; (w.TLSCert == "") != (w.TLSKey == "") {
+		return errors.New("web_terminal: tls_cert and tls_key must be set together")
+	}
+	for name, upstream := range c.Upstreams {
+		if name == "" || strings.Contains(name, "@") {
+			return fmt.Errorf("invalid upstream name %q", name)
+		}
+		if _, _, err := net.SplitHostPort(upstream.Address); err != nil {
+			return fmt.Errorf("upstream %s: invalid address: %w", name, err)
+		}
+		if upstream.HostKey == "" {
+			return fmt.Errorf("upstream %s must have a host_key", name)
+		}
+		if upstream.Password == "" && upstream.IdentityFile == "" {
+			return fmt.Errorf("upstream %s needs a password or identity_file", name)
+		}
+	}
+	if c.IngressRateLimit < 0 || c.EgressRateLimit < 0 {
+		return errors.New("ingress and egress rate limits cannot be negative")
+	}
+	if err := validatePermits("permit_open", c.PermitOpen, false); err != nil {
+		return err
+	}
+	if err := validatePermits("permit_listen", c.PermitListen, true); err != nil {
+		return err
+	}
+
 	if len(c.Users) == 0 {
 		return errors.New("at least one user must be configured")
 	}
+	for _, pattern := range c.AllowUsers {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("allow_users: invalid pattern %q", pattern)
+		}
+	}
+	for i, m := range c.Match {
+		if len(m.Users) == 0 {
+			return fmt.Errorf("match[%d]: users is required", i)
+		}
+		for _, pattern := range m.Users {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("match[%d]: invalid user pattern %q", i, pattern)
+			}
+		}
+		if m.AllowTCPForwarding != "" {
+			if err := validateForwarding(fmt.Sprintf("match[%d] allow_tcp_forwarding", i), m.AllowTCPForwarding); err != nil {
+				return err
+			}
+		}
+		if m.AllowStreamLocalForwarding != "" {
+			if err := validateForwarding(fmt.Sprintf("match[%d] allow_stream_local_forwarding", i), m.AllowStreamLocalForwarding); err != nil {
+				return err
+			}
+		}
+		if m.PermitTunnel != "" {
+			if err := validateTunnel(fmt.Sprintf("match[%d] permit_tunnel", i), m.PermitTunnel); err != nil {
+				return err
+			}
+		}
+		if err := validatePermits(fmt.Sprintf("match[%d] permit_open", i), m.PermitOpen, false); err != nil {
+			return err
+		}
+		if err := validatePermits(fmt.Sprintf("match[%d] permit_listen", i), m.PermitListen, true); err != nil {
+			return err
+		}
+	}
 
 	seen := make(map[string]struct{}, len(c.Users))
 	for _, user := range c.Users {
@@ -100,6 +2156,37 @@ func (c *Config) validate() error {
 		if user.Password == "" {
 			return fmt.Errorf("user %s must have a password", username)
 		}
+		for _, arg := range user.RunAsWrapper {
+			if arg == "" {
+				return fmt.Errorf("user %s run_as_wrapper cannot contain empty arguments", username)
+			}
+		}
+		if err := validateForwarding(fmt.Sprintf("user %s allow_tcp_forwarding", username), user.AllowTCPForwarding); err != nil {
+			return err
+		}
+		if err := validateForwarding(fmt.Sprintf("user %s allow_stream_local_forwarding", username), user.AllowStreamLocalForwarding); err != nil {
+			return err
+		}
+		if err := validateTunnel(fmt.Sprintf("user %s permit_tunnel", username), user.PermitTunnel); err != nil {
+			return err
+		}
+		if err := validatePermits(fmt.Sprintf("user %s permit_open", username), user.PermitOpen, false); err != nil {
+			return err
+		}
+		if err := validatePermits(fmt.Sprintf("user %s permit_listen", username), user.PermitListen, true); err != nil {
+			return err
+		}
+		if user.ForwardRateLimit < 0 {
+			return fmt.Errorf("user %s forward rate limit cannot be negative", username)
+		}
+		for _, name := range append([]string{user.Upstream}, user.Upstreams...) {
+			if _, ok := c.Upstreams[name]; name != "" && !ok {
+				return fmt.Errorf("user %s references unknown upstream %s", username, name)
+			}
+		}
+		if user.SFTPOnly && user.ForwardingOnly {
+			return fmt.Errorf("user %s cannot be both sftp_only and forwarding_only", username)
+		}
 		if _, ok := seen[username]; ok {
 			return fmt.Errorf("duplicate user %s", username)
 		}
@@ -109,7 +2196,160 @@ func (c *Config) validate() error {
 	return nil
 }
 
+// validateListener checks the settings a listener may override.
+func (c *Config) validateListener(l Listener) error {
+	if l.Address == "" {
+		return errors.New("address is required")
+	}
+	switch l.Protocol {
+	case ListenerSSH:
+	case ListenerWebSocket:
+		if !strings.HasPrefix(l.Path, "/") {
+			return errors.New("path must start with /")
+		}
+	default:
+		return fmt.Errorf("unknown protocol %q", l.Protocol)
+	}
+	if (l.TLSCert == "") != (l.TLSKey == "") {
+		return errors.New("tls_cert and tls_key must be set together")
+	}
+	if l.TLSCert != "" && l.ACME.Enabled() {
+		return errors.New("tls_cert and acme are mutually exclusive")
+	}
+	// RFC 4253 section 4.2: printable US-ASCII, at most 255 bytes with CRLF.
+	if len(l.ServerVersion) > 253 {
+		return errors.New("server_version is longer than 253 characters")
+	}
+	for _, r := range l.ServerVersion {
+		if r < 0x20 || r > 0x7e {
+			return errors.New("server_version must be printable ASCII")
+		}
+	}
+	if _, ok := CryptoPolicies[l.CryptoPolicy]; l.CryptoPolicy != "" && !ok {
+		return fmt.Errorf("unknown crypto_policy %q", l.CryptoPolicy)
+	}
+	if err := validateAlgorithms("ciphers", l.Ciphers, SupportedCiphers); err != nil {
+		return err
+	}
+	if err := validateAlgorithms("kex_algorithms", l.KexAlgorithms, SupportedKexAlgorithms); err != nil {
+		return err
+	}
+	if err := validateAlgorithms("macs", l.MACs, SupportedMACs); err != nil {
+		return err
+	}
+	for _, entry := range l.ProxyProtocol.Trusted {
+		if _, err := ParsePrefix(entry); err != nil {
+			return fmt.Errorf("proxy_protocol.trusted: %w", err)
+		}
+	}
+	users := c.UsersByName()
+	_, wildcard := users[WildcardUser]
+	for _, name := range l.AllowUsers {
+		if _, ok := users[name]; !ok && !wildcard {
+			return fmt.Errorf("allow_users: unknown user %q", name)
+		}
+	}
+	return nil
+}
+
+// fullServerVersion adds the SSH-2.0- prefix to a bare software version.
+func fullServerVersion(version string) string {
+	if strings.HasPrefix(version, "SSH-2.0-") {
+		return version
+	}
+	return "SSH-2.0-" + version
+}
+
+// listOr returns list, or a copy of fallback when list is empty.
+func listOr(list, fallback []string) []string {
+	if len(list) > 0 {
+		return list
+	}
+	return slices.Clone(fallback)
+}
+
+func validateTunnel(field, value string) error {
+	switch value {
+	case TunnelNo, TunnelPointToPoint, TunnelYes:
+		return nil
+	case "ethernet":
+		return fmt.Errorf("%s: ethernet tunnels are not supported", field)
+	default:
+		return fmt.Errorf("%s: unknown value %q", field, value)
+	}
+}
+
+// validateForwarding checks an allow_tcp_forwarding or
+// allow_stream_local_forwarding value.
+func validateForwarding(field, value string) error {
+	switch value {
+	case ForwardingBoth, ForwardingLocal, ForwardingRemote, ForwardingNone:
+		return nil
+	default:
+		return fmt.Errorf("%s: unknown value %q", field, value)
+	}
+}
+
+// validatePermits checks permit_open/permit_listen entries: "none", or
+// "host:port" where the port is a number or "*". Listen entries may also be a
+// bare port.
+func validatePermits(field string, entries []string, allowBarePort bool) error {
+	for _, entry := range entries {
+		if entry == "none" {
+			continue
+		}
+		_, port, err := net.SplitHostPort(entry)
+		if err != nil {
+			if !allowBarePort {
+				return fmt.Errorf("%s: invalid entry %q: %w", field, entry, err)
+			}
+			port = entry
+		}
+		if port == "*" {
+			continue
+		}
+		if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+			return fmt.Errorf("%s: invalid port in %q", field, entry)
+		}
+	}
+	return nil
+}
+
 // ConfigDir exposes the directory where the configuration file lives.
 func (c *Config) ConfigDir() string {
 	return c.configDir
 }
+
+// StartupLimit is a parsed max_startups value.
+type StartupLimit struct {
+	Start, Rate, Full int
+}
+
+// Startups returns the parsed max_startups setting.
+func (c *Config) Startups() StartupLimit {
+	limit, _ := parseStartupLimit(c.MaxStartups)
+	return limit
+}
+
+func parseStartupLimit(value string) (StartupLimit, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) != 1 && len(parts) != 3 {
+		return StartupLimit{}, fmt.Errorf("%q is not start or start:rate:full", value)
+	}
+	var nums [3]int
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 1 {
+			return StartupLimit{}, fmt.Errorf("%q is not a positive number", part)
+		}
+		nums[i] = n
+	}
+	if len(parts) == 1 {
+		return StartupLimit{Start: nums[0], Rate: 100, Full: nums[0]}, nil
+	}
+	limit := StartupLimit{Start: nums[0], Rate: nums[1], Full: nums[2]}
+	if limit.Rate > 100 || limit.Full < limit.Start {
+		return StartupLimit{}, fmt.Errorf("%q needs rate <= 100 and full >= start", value)
+	}
+	return limit, nil
+}
@@ -0,0 +1,103 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// expandEnv replaces ${VAR} in every string value of doc, in place, with
+// the environment variable VAR. ${VAR:-default} uses default when VAR is
+// unset or empty, and $${ stands for a literal ${. Other uses of $, such
+// as in password hashes, are left alone. Referring to an unset variable
+// without a default is an error naming the field.
+func expandEnv(doc map[string]any) error {
+	for key, value := range doc {
+		expanded, err := expandEnvValue(value)
+		if err != nil {
+			return fmt.Errorf("%s%w", key, err)
+		}
+		doc[key] = expanded
+	}
+	return nil
+}
+
+func expandEnvValue(value any) (any, error) {
+	switch v := value.(type) {
+	case string:
+		expanded, err := expandEnvString(v)
+		if err != nil {
+			return nil, fmt.Errorf(": %w", err)
+		}
+		return expanded, nil
+	case map[string]any:
+		for key, item := range v {
+			expanded, err := expandEnvValue(item)
+			if err != nil {
+				return nil, fmt.Errorf(".%s%w", key, err)
+			}
+			v[key] = expanded
+		}
+	case []any:
+		for i, item := range v {
+			expanded, err := expandEnvValue(item)
+			if err != nil {
+				return nil, fmt.Errorf("[%d]%w", i, err)
+			}
+			v[i] = expanded
+		}
+	}
+	return value, nil
+}
+
+// expandEnvString expands the ${VAR} references of s.
+func expandEnvString(s string) (string, error) {
+	if !strings.Contains(s, "${") {
+		return s, nil
+	}
+	var b strings.Builder
+	for {
+		i := strings.Index(s, "${")
+		if i < 0 {
+			b.WriteString(s)
+			return b.String(), nil
+		}
+		if i > 0 && s[i-1] == '$' {
+			b.WriteString(s[:i-1] + "${")
+			s = s[i+2:]
+			continue
+		}
+		b.WriteString(s[:i])
+		end := strings.IndexByte(s[i:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated ${ in %q", s[i:])
+		}
+		ref := s[i+2 : i+end]
+		s = s[i+end+1:]
+
+		name, fallback, hasFallback := strings.Cut(ref, ":-")
+		if !validEnvName(name) {
+			return "", fmt.Errorf("invalid variable name %q", name)
+		}
+		value, ok := os.LookupEnv(name)
+		switch {
+		case hasFallback && value == "":
+			value = fallback
+		case !ok:
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		b.WriteString(value)
+	}
+}
+
+func validEnvName(name string) bool {
+	if name == "" || '0' <= name[0] && name[0] <= '9' {
+		return false
+	}
+	for _, c := range name {
+		if c != '_' && !('a' <= c && c <= 'z') && !('A' <= c && c <= 'Z') && !('0' <= c && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,315 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// configExtensions are the file extensions loaded from conf.d directories,
+// also when followed by the age extension.
+var configExtensions = []string{".json", ".yaml", ".yml", ".toml", ".conf"}
+
+// readDocument parses the file at path as sshd_config (see isSSHDConfig),
+// YAML (.yaml, .yml), TOML (.toml) or, for any other extension, JSON.
+// Files ending in .age are decrypted first and parsed by the extension
+// before it. https:// and s3:// URLs are fetched (see fetchRemote).
+// Documents of every format are decoded into the same generic form and
+// then into Config through encoding/json, so they share field names and
+// types. warn is passed on to parseSSHDConfig.
+func readDocument(path string, warn func(error)) (map[string]any, error) {
+	var raw []byte
+	var err error
+	name := path
+	if isRemote(path) {
+		raw, _, err = fetchRemote(path)
+		name = remoteName(path)
+	} else {
+		raw, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if plain := plainName(name); plain != name {
+		if raw, err = decryptAge(raw); err != nil {
+			return nil, fmt.Errorf("decrypt: %w", err)
+		}
+		name = plain
+	}
+	if isSSHDConfig(name) {
+		var warnPath func(error)
+		if warn != nil {
+			warnPath = func(err error) { warn(fmt.Errorf("%s: %w", path, err)) }
+		}
+		return parseSSHDConfig(raw, warnPath)
+	}
+	doc := make(map[string]any)
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(raw, &doc)
+	case ".toml":
+		// Arrays of tables decode as []map[string]any; going through JSON
+		// turns them into the []any that mergeDocument appends to.
+		var tomlDoc map[string]any
+		if err := toml.Unmarshal(raw, &tomlDoc); err != nil {
+			return nil, err
+		}
+		if raw, err = json.Marshal(tomlDoc); err != nil {
+			return nil, err
+		}
+		fallthrough
+	default:
+		dec := json.NewDecoder(bytes.NewReader(raw))
+		dec.UseNumber()
+		err = dec.Decode(&doc)
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			line, column := position(raw, syntaxErr.Offset)
+			err = fmt.Errorf("line %d, column %d: %w", line, column, err)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// position returns the 1-based line and column of the byte a JSON syntax
+// error at offset was reported for; the offset counts that byte.
+func position(raw []byte, offset int64) (int, int) {
+	before := raw[:min(int(offset), len(raw))]
+	line := bytes.Count(before, []byte("\n")) + 1
+	column := len(before) - bytes.LastIndexByte(before, '\n') - 1
+	return line, column
+}
+
+// sources records where a configuration was read from, so that changes to
+// it can be noticed.
+type sources struct {
+	// files are the main config file and the fragments merged into it.
+	files []string
+	// patterns are the include globs, which may match new files later.
+	patterns []string
+	confDir  string
+	// remote is the URL of a configuration fetched over the network,
+	// which has no files or fragments.
+	remote string
+}
+
+// fragmentPaths lists the files merged into the main config at path: the
+// matches of its include globs, then the files of the conf.d directory next
+// to it (config.d for config.json), each group in lexical order. It also
+// returns the include globs, made absolute.
+func fragmentPaths(path string, doc map[string]any) ([]string, []string, error) {
+	dir := filepath.Dir(path)
+	var patterns []string
+	switch include := doc["include"].(type) {
+	case nil:
+	case string:
+		patterns = []string{include}
+	case []any:
+		for _, p := range include {
+			pattern, ok := p.(string)
+			if !ok {
+				return nil, nil, errors.New("include must be a string or a list of strings")
+			}
+			patterns = append(patterns, pattern)
+		}
+	default:
+		return nil, nil, errors.New("include must be a string or a list of strings")
+	}
+
+	var paths []string
+	for i, pattern := range patterns {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(dir, pattern)
+			patterns[i] = pattern
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, nil, fmt.Errorf("include %s: %w", pattern, err)
+		}
+		slices.Sort(matches)
+		paths = append(paths, matches...)
+	}
+
+	entries, err := os.ReadDir(confDir(path))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, nil, err
+	}
+	for _, entry := range entries {
+		// sshd_config usually includes its drop-in directory itself.
+		fragment := filepath.Join(confDir(path), entry.Name())
+		if !entry.IsDir() && isConfigFile(entry.Name()) && !slices.Contains(paths, fragment) {
+			paths = append(paths, fragment)
+		}
+	}
+	return paths, patterns, nil
+}
+
+// confDir returns the fragment directory of the main config at path.
+func confDir(path string) string {
+	path = plainName(path)
+	return strings.TrimSuffix(path, filepath.Ext(path)) + ".d"
+}
+
+func isConfigFile(name string) bool {
+	return slices.Contains(configExtensions, strings.ToLower(filepath.Ext(plainName(name))))
+}
+
+// mergeDocument folds fragment into doc: objects are merged key by key,
+// lists are appended (so fragments can add users or listeners) and other
+// values replace the existing ones.
+func mergeDocument(doc, fragment map[string]any) {
+	for key, value := range fragment {
+		switch v := value.(type) {
+		case map[string]any:
+			if existing, ok := doc[key].(map[string]any); ok {
+				mergeDocument(existing, v)
+				continue
+			}
+		case []any:
+			if existing, ok := doc[key].([]any); ok {
+				doc[key] = append(existing, v...)
+				continue
+			}
+		}
+		doc[key] = value
+	}
+}
+
+// decode reads the config at path with its fragments, and overrides merged
+// last, into cfg. An empty path reads only overrides.
+func decode(path string, overrides map[string]any, cfg *Config) (sources, error) {
+	doc, src := map[string]any{}, sources{}
+	if path != "" {
+		var err error
+		if doc, src, err = readMerged(path, nil); err != nil {
+			return src, err
+		}
+	}
+	mergeDocument(doc, overrides)
+	// "$schema" only points editors at the JSON Schema.
+	delete(doc, "$schema")
+	if err := expandEnv(doc); err != nil {
+		return src, err
+	}
+	converted, err := json.Marshal(doc)
+	if err != nil {
+		return src, fmt.Errorf("convert to json: %w", err)
+	}
+	strict, _ := doc["strict"].(bool)
+	return src, unmarshal(converted, cfg, strict)
+}
+
+// unmarshal decodes the JSON in raw into v, failing on fields v does not
+// have if strict is set.
+func unmarshal(raw []byte, v any, strict bool) error {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	if strict {
+		dec.DisallowUnknownFields()
+	}
+	return dec.Decode(v)
+}
+
+// ReadDocument returns the config at path with its fragments merged, as
+// the generic document it is decoded from. Defaults are not applied and
+// nothing is validated, so it may be incomplete. If warn is not nil,
+// sshd_config directives tinyssh cannot honour are passed to it and
+// skipped instead of failing.
+func ReadDocument(path string, warn func(error)) (map[string]any, error) {
+	doc, _, err := readMerged(path, warn)
+	return doc, err
+}
+
+// readMerged reads the config at path and merges its fragments into it.
+func readMerged(path string, warn func(error)) (map[string]any, sources, error) {
+	if isRemote(path) {
+		doc, err := readDocument(path, warn)
+		if err != nil {
+			return nil, sources{remote: path}, err
+		}
+		if _, ok := doc["include"]; ok {
+			return nil, sources{remote: path}, errors.New("include is not supported in remote configurations")
+		}
+		return doc, sources{remote: path}, nil
+	}
+
+	src := sources{files: []string{filepath.Clean(path)}, confDir: confDir(filepath.Clean(path))}
+	doc, err := readDocument(path, warn)
+	if err != nil {
+		return nil, src, err
+	}
+	fragments, patterns, err := fragmentPaths(path, doc)
+	if err != nil {
+		return nil, src, err
+	}
+	src.files = append(src.files, fragments...)
+	src.patterns = patterns
+	delete(doc, "include")
+	for _, fragmentPath := range fragments {
+		fragment, err := readDocument(fragmentPath, warn)
+		if err != nil {
+			return nil, src, fmt.Errorf("%s: %w", fragmentPath, err)
+		}
+		if _, ok := fragment["include"]; ok {
+			return nil, src, fmt.Errorf("%s: include is only allowed in the main config file", fragmentPath)
+		}
+		mergeDocument(doc, fragment)
+	}
+	return doc, src, nil
+}
+
+// WatchDirs returns the directories to watch for changes to the
+// configuration: those holding its files, the conf.d directory and the
+// directories of include globs, which may gain new files.
+func (c *Config) WatchDirs() []string {
+	if c.sources.remote != "" {
+		return nil
+	}
+	var dirs []string
+	if c.sources.confDir != "" {
+		dirs = append(dirs, c.sources.confDir)
+	}
+	for _, file := range c.sources.files {
+		dirs = append(dirs, filepath.Dir(file))
+	}
+	for _, pattern := range c.sources.patterns {
+		dirs = append(dirs, filepath.Dir(pattern))
+	}
+	slices.Sort(dirs)
+	return slices.Compact(dirs)
+}
+
+// RemoteSource returns the URL the configuration was fetched from, or ""
+// if it was read from files.
+func (c *Config) RemoteSource() string {
+	return c.sources.remote
+}
+
+// IsSource reports whether a change to the file at path can change the
+// configuration: it is one of the files read, matches an include glob or
+// is a config file in the conf.d directory.
+func (c *Config) IsSource(path string) bool {
+	path = filepath.Clean(path)
+	if path == c.sources.confDir || slices.Contains(c.sources.files, path) {
+		return true
+	}
+	if filepath.Dir(path) == c.sources.confDir && isConfigFile(path) {
+		return true
+	}
+	for _, pattern := range c.sources.patterns {
+		if ok, _ := filepath.Match(pattern, path); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,149 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dollarkillerx/tinyssh/internal/awsauth"
+)
+
+// remoteTimeout bounds fetching a remote configuration.
+const remoteTimeout = 30 * time.Second
+
+// remoteMaxSize bounds the size of a remote configuration.
+const remoteMaxSize = 16 << 20
+
+// RemoteTokenEnv holds a bearer token sent with requests for https://
+// configurations.
+const RemoteTokenEnv = "TINYSSH_CONFIG_TOKEN"
+
+var remoteClient = &http.Client{Timeout: remoteTimeout}
+
+// remoteCache keeps the last response for each remote configuration, so
+// that later requests can be conditional.
+var remoteCache = struct {
+	sync.Mutex
+	responses map[string]remoteResponse
+}{responses: make(map[string]remoteResponse)}
+
+type remoteResponse struct {
+	etag         string
+	lastModified string
+	body         []byte
+}
+
+// isRemote reports whether path is the URL of a remote configuration
+// rather than a file name.
+func isRemote(path string) bool {
+	return strings.HasPrefix(path, "https://") || strings.HasPrefix(path, "s3://")
+}
+
+// remoteName returns the path of the remote configuration at location,
+// whose extension selects the format.
+func remoteName(location string) string {
+	u, err := url.Parse(location)
+	if err != nil {
+		return location
+	}
+	return u.Path
+}
+
+// IsRemote reports whether path is an https:// or s3:// URL.
+func IsRemote(path string) bool {
+	return isRemote(path)
+}
+
+// RemoteChanged fetches the remote configuration at location and reports
+// whether it differs from the last fetched copy.
+func RemoteChanged(location string) (bool, error) {
+	_, changed, err := fetchRemote(location)
+	return changed, err
+}
+
+// fetchRemote returns the remote configuration at location and whether it
+// changed since the previous fetch. Requests carry the ETag and
+// Last-Modified of the previous response, so an unchanged configuration
+// is answered with 304 Not Modified and served from the cache.
+func fetchRemote(location string) ([]byte, bool, error) {
+	remoteCache.Lock()
+	defer remoteCache.Unlock()
+	prev, cached := remoteCache.responses[location]
+
+	ctx, cancel := context.WithTimeout(context.Background(), remoteTimeout)
+	defer cancel()
+	req, err := remoteRequest(ctx, location, prev)
+	if err != nil {
+		return nil, false, err
+	}
+	resp, err := remoteClient.Do(req)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified && cached {
+		return prev.body, false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, false, fmt.Errorf("fetch %s: %s", location, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, remoteMaxSize+1))
+	if err != nil {
+		return nil, false, fmt.Errorf("fetch %s: %w", location, err)
+	}
+	if len(body) > remoteMaxSize {
+		return nil, false, fmt.Errorf("fetch %s: larger than %d bytes", location, remoteMaxSize)
+	}
+	remoteCache.responses[location] = remoteResponse{
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+		body:         body,
+	}
+	return body, !cached || !bytes.Equal(body, prev.body), nil
+}
+
+// remoteRequest builds the GET request for location: s3://bucket/key is
+// signed with the AWS credentials of the environment or instance role,
+// and https:// URLs carry the bearer token from TINYSSH_CONFIG_TOKEN.
+func remoteRequest(ctx context.Context, location string, prev remoteResponse) (*http.Request, error) {
+	header := http.Header{}
+	if prev.etag != "" {
+		header.Set("If-None-Match", prev.etag)
+	}
+	if prev.lastModified != "" {
+		header.Set("If-Modified-Since", prev.lastModified)
+	}
+
+	target := location
+	rest, s3 := strings.CutPrefix(location, "s3://")
+	if s3 {
+		bucket, key, _ := strings.Cut(rest, "/")
+		if bucket == "" || key == "" {
+			return nil, fmt.Errorf("%s: want s3://bucket/key", location)
+		}
+		target = awsauth.S3ObjectURL("", awsauth.Region(), bucket, key)
+	} else if token := os.Getenv(RemoteTokenEnv); token != "" {
+		header.Set("Authorization", "Bearer "+token)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	if s3 {
+		creds, _, err := awsauth.FetchCredentials(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("aws credentials: %w", err)
+		}
+		awsauth.Sign(header, http.MethodGet, req.URL, nil, creds, awsauth.Region(), "s3", time.Now())
+	}
+	req.Header = header
+	return req, nil
+}
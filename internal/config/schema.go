@@ -0,0 +1,131 @@
+package config
+
+import (
+	"maps"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// schemaEnums lists the values of string fields that accept a fixed set,
+// keyed by field path. The empty string selects the default.
+var schemaEnums = map[string][]string{
+	"crypto_policy":                       {PolicyModern, PolicyIntermediate, PolicyLegacy},
+	"listeners.crypto_policy":             {PolicyModern, PolicyIntermediate, PolicyLegacy},
+	"listeners.protocol":                  {ListenerSSH, ListenerWebSocket},
+	"address_family":                      {AddressFamilyAny, AddressFamilyInet, AddressFamilyInet6},
+	"host_key_type":                       {HostKeyEd25519, HostKeyECDSA, HostKeyRSA},
+	"host_key_kms.provider":               {KMSProviderAWS, KMSProviderGCP},
+	"dnsbl.action":                        {DNSBLReject, DNSBLTarpit},
+	"allow_tcp_forwarding":                {ForwardingBoth, ForwardingLocal, ForwardingRemote, ForwardingNone},
+	"users.allow_tcp_forwarding":          {ForwardingBoth, ForwardingLocal, ForwardingRemote, ForwardingNone},
+	"gateway_ports":                       {GatewayPortsNo, GatewayPortsYes, GatewayPortsClientSpecified},
+	"permit_tunnel":                       {TunnelNo, TunnelPointToPoint, TunnelYes},
+	"users.permit_tunnel":                 {TunnelNo, TunnelPointToPoint, TunnelYes},
+	"match.allow_tcp_forwarding":          {ForwardingBoth, ForwardingLocal, ForwardingRemote, ForwardingNone},
+	"allow_stream_local_forwarding":       {ForwardingBoth, ForwardingLocal, ForwardingRemote, ForwardingNone},
+	"users.allow_stream_local_forwarding": {ForwardingBoth, ForwardingLocal, ForwardingRemote, ForwardingNone},
+	"match.allow_stream_local_forwarding": {ForwardingBoth, ForwardingLocal, ForwardingRemote, ForwardingNone},
+	"match.permit_tunnel":                 {TunnelNo, TunnelPointToPoint, TunnelYes},
+	"recording.format":                    {RecordingAsciicast, RecordingScript},
+	"log.syslog.facility":                 slices.Sorted(maps.Keys(SyslogFacilities)),
+	"webhooks.endpoints.format":           {WebhookJSON, WebhookSlack},
+	"webhooks.endpoints.events":           {WebhookLogin, WebhookLogout, WebhookAuthFailures, WebhookNewSource},
+}
+
+// Schema returns a JSON Schema (draft 2020-12) of the configuration file,
+// for editor completion and validation in CI. It is derived from Config,
+// so it always matches the fields this build accepts. Unknown fields are
+// rejected to catch misspelt options.
+func Schema() map[string]any {
+	schema := schemaFor(reflect.TypeFor[Config](), "")
+	schema["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	schema["title"] = "tinyssh configuration"
+	properties := schema["properties"].(map[string]any)
+	// Files may point editors at the schema; the key is ignored on load.
+	properties["$schema"] = map[string]any{"type": "string"}
+	// include is consumed while reading the file and has no Config field.
+	properties["include"] = map[string]any{
+		"description": "Globs of configuration fragments to merge, relative to this file.",
+		"oneOf": []any{
+			map[string]any{"type": "string"},
+			map[string]any{"type": "array", "items": map[string]any{"type": "string"}},
+		},
+	}
+	return schema
+}
+
+// schemaFor describes t, found at path (JSON field names joined by dots,
+// without array indexes).
+func schemaFor(t reflect.Type, path string) map[string]any {
+	switch t.Kind() {
+	case reflect.Pointer:
+		return nullable(schemaFor(t.Elem(), path))
+	case reflect.Struct:
+		properties := make(map[string]any)
+		for field := range fieldsOf(t) {
+			name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if name == "" {
+				name = field.Name
+			}
+			properties[name] = schemaFor(field.Type, strings.TrimPrefix(path+"."+name, "."))
+		}
+		return map[string]any{"type": "object", "properties": properties, "additionalProperties": false}
+	case reflect.Slice, reflect.Array:
+		return nullable(map[string]any{"type": "array", "items": schemaFor(t.Elem(), path)})
+	case reflect.Map:
+		return nullable(map[string]any{"type": "object", "additionalProperties": schemaFor(t.Elem(), path)})
+	case reflect.String:
+		schema := map[string]any{"type": "string"}
+		if values, ok := schemaEnums[path]; ok {
+			schema["enum"] = append([]string{""}, values...)
+		}
+		return schema
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]any{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	}
+	return map[string]any{}
+}
+
+// nullable also admits null, which encoding/json decodes into a nil
+// pointer, slice or map, as print-config writes unset lists.
+func nullable(schema map[string]any) map[string]any {
+	if t, ok := schema["type"].(string); ok {
+		schema["type"] = []string{t, "null"}
+	}
+	return schema
+}
+
+// fieldsOf yields the fields of struct t that encoding/json decodes,
+// flattening embedded structs as it does.
+func fieldsOf(t reflect.Type) func(yield func(reflect.StructField) bool) {
+	return func(yield func(reflect.StructField) bool) {
+		for i := range t.NumField() {
+			field := t.Field(i)
+			tag, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if tag == "-" {
+				continue
+			}
+			if field.Anonymous && tag == "" && field.Type.Kind() == reflect.Struct {
+				for inner := range fieldsOf(field.Type) {
+					if !yield(inner) {
+						return
+					}
+				}
+				continue
+			}
+			if !field.IsExported() {
+				continue
+			}
+			if !yield(field) {
+				return
+			}
+		}
+	}
+}
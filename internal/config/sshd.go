@@ -0,0 +1,424 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// isSSHDConfig reports whether the file at path is in OpenSSH sshd_config
+// format: one named sshd_config, or a .conf drop-in such as those in
+// sshd_config.d.
+func isSSHDConfig(path string) bool {
+	return filepath.Base(path) == "sshd_config" || strings.EqualFold(filepath.Ext(path), ".conf")
+}
+
+// sshdParser translates the supported subset of sshd_config into a config
+// document. As in sshd, the first value of a keyword wins, except for the
+// keywords that may be repeated.
+type sshdParser struct {
+	doc       map[string]any
+	ports     []string
+	addresses []string
+	// match is the "Match User" block being read, nil outside one.
+	match map[string]any
+	// skipMatch is set inside a Match block that was rejected and skipped,
+	// whose directives must not apply globally.
+	skipMatch bool
+}
+
+// parseSSHDConfig reads an sshd_config file. Keywords tinyssh has no
+// counterpart for are ignored; ones it cannot honour as written, such as
+// "PasswordAuthentication no" or Match criteria other than User, are
+// errors rather than being dropped, unless warn is set: then they are
+// passed to warn and skipped.
+func parseSSHDConfig(raw []byte, warn func(error)) (map[string]any, error) {
+	p := &sshdParser{doc: make(map[string]any)}
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		keyword, args, err := splitSSHDLine(text)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		if len(args) == 0 {
+			return nil, fmt.Errorf("line %d: %s: missing argument", line, keyword)
+		}
+		if err := p.directive(strings.ToLower(keyword), args); err != nil {
+			err = fmt.Errorf("line %d: %s: %w", line, keyword, err)
+			if warn == nil {
+				return nil, err
+			}
+			warn(err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	p.finishListeners()
+	return p.doc, nil
+}
+
+// splitSSHDLine splits a line into its keyword and arguments. The keyword
+// may be followed by "=", and arguments may be double-quoted.
+func splitSSHDLine(text string) (string, []string, error) {
+	end := strings.IndexFunc(text, func(r rune) bool { return r == '=' || unicode.IsSpace(r) })
+	if end < 0 {
+		return text, nil, nil
+	}
+	keyword := text[:end]
+	rest := strings.TrimLeftFunc(text[end:], unicode.IsSpace)
+	rest = strings.TrimPrefix(rest, "=")
+
+	var args []string
+	var arg strings.Builder
+	inArg, quoted := false, false
+	for _, r := range rest {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			inArg = true
+		case unicode.IsSpace(r) && !quoted:
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quoted {
+		return "", nil, errors.New("unterminated quote")
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return keyword, args, nil
+}
+
+func (p *sshdParser) directive(keyword string, args []string) error {
+	if keyword == "match" {
+		p.match = nil
+		err := p.startMatch(args)
+		p.skipMatch = err != nil
+		return err
+	}
+	if p.skipMatch {
+		return nil
+	}
+	if p.match != nil {
+		return p.matchDirective(keyword, args)
+	}
+
+	switch keyword {
+	case "port":
+		if n, err := strconv.Atoi(args[0]); err != nil || n <= 0 || n > 65535 {
+			return fmt.Errorf("invalid port %q", args[0])
+		}
+		p.ports = append(p.ports, args[0])
+	case "listenaddress":
+		p.addresses = append(p.addresses, args[0])
+	case "addressfamily":
+		p.set("address_family", strings.ToLower(args[0]))
+	case "passwordauthentication":
+		enabled, err := sshdBool(args[0])
+		if err != nil {
+			return err
+		}
+		if !enabled {
+			return errors.New("tinyssh only supports password authentication")
+		}
+	case "allowusers":
+		for _, pattern := range args {
+			if strings.Contains(pattern, "@") {
+				return fmt.Errorf("host patterns (%s) are not supported", pattern)
+			}
+			p.doc["allow_users"] = append(sshdList(p.doc["allow_users"]), pattern)
+		}
+	case "subsystem":
+		if len(args) < 2 {
+			return errors.New("missing command")
+		}
+		name := args[0]
+		subsystems, _ := p.doc["subsystems"].(map[string]any)
+		if _, ok := subsystems[name]; ok {
+			break
+		}
+		if args[1] == "internal-sftp" {
+			// The built-in SFTP server is used when sftp is not configured.
+			if name != "sftp" {
+				return errors.New("internal-sftp can only serve the sftp subsystem")
+			}
+			break
+		}
+		if subsystems == nil {
+			subsystems = make(map[string]any)
+			p.doc["subsystems"] = subsystems
+		}
+		subsystems[name] = strings.Join(args[1:], " ")
+	case "hostkey":
+		p.doc["host_key_paths"] = append(sshdList(p.doc["host_key_paths"]), args[0])
+	case "logingracetime":
+		return p.setTime("login_grace_time", args[0])
+	case "clientaliveinterval":
+		return p.setTime("client_alive_interval", args[0])
+	case "clientalivecountmax":
+		n, err := strconv.Atoi(args[0])
+		if err != nil {
+			return err
+		}
+		p.set("client_alive_count_max", n)
+	case "maxstartups":
+		p.set("max_startups", args[0])
+	case "ciphers", "kexalgorithms", "macs":
+		if strings.IndexAny(args[0], "+-^") == 0 {
+			return errors.New("lists relative to the default (+, -, ^) are not supported")
+		}
+		key := map[string]string{"ciphers": "ciphers", "kexalgorithms": "kex_algorithms", "macs": "macs"}[keyword]
+		p.set(key, sshdList(strings.Split(args[0], ",")))
+	case "allowtcpforwarding":
+		value, err := sshdForwarding(args[0])
+		if err != nil {
+			return err
+		}
+		p.set("allow_tcp_forwarding", value)
+	case "allowstreamlocalforwarding":
+		value, err := sshdForwarding(args[0])
+		if err != nil {
+			return err
+		}
+		p.set("allow_stream_local_forwarding", value)
+	case "gatewayports":
+		p.set("gateway_ports", strings.ToLower(args[0]))
+	case "permitopen":
+		p.setPermits(p.doc, "permit_open", args)
+	case "permitlisten":
+		p.setPermits(p.doc, "permit_listen", args)
+	case "permittunnel":
+		p.set("permit_tunnel", strings.ToLower(args[0]))
+	case "usedns":
+		enabled, err := sshdBool(args[0])
+		if err != nil {
+			return err
+		}
+		p.set("use_dns", enabled)
+	case "rekeylimit":
+		if args[0] == "default" {
+			break
+		}
+		size, err := sshdSize(args[0])
+		if err != nil {
+			return err
+		}
+		p.set("rekey_threshold", size)
+	case "include":
+		p.doc["include"] = append(sshdList(p.doc["include"]), sshdList(args)...)
+	}
+	return nil
+}
+
+// startMatch begins a Match block. Only User criteria are supported;
+// "Match all" returns to global settings.
+func (p *sshdParser) startMatch(args []string) error {
+	if len(args) == 1 && strings.EqualFold(args[0], "all") {
+		return nil
+	}
+	if len(args) != 2 || !strings.EqualFold(args[0], "user") {
+		return fmt.Errorf("only \"Match User\" is supported, not %q", strings.Join(args, " "))
+	}
+	for _, pattern := range strings.Split(args[1], ",") {
+		if strings.HasPrefix(pattern, "!") {
+			return fmt.Errorf("negated pattern %s is not supported", pattern)
+		}
+	}
+	p.match = map[string]any{"users": sshdList(strings.Split(args[1], ","))}
+	p.doc["match"] = append(sshdList(p.doc["match"]), p.match)
+	return nil
+}
+
+// matchDirective applies a keyword inside a Match User block.
+func (p *sshdParser) matchDirective(keyword string, args []string) error {
+	switch keyword {
+	case "allowtcpforwarding":
+		value, err := sshdForwarding(args[0])
+		if err != nil {
+			return err
+		}
+		setFirst(p.match, "allow_tcp_forwarding", value)
+	case "allowstreamlocalforwarding":
+		value, err := sshdForwarding(args[0])
+		if err != nil {
+			return err
+		}
+		setFirst(p.match, "allow_stream_local_forwarding", value)
+	case "permitopen":
+		p.setPermits(p.match, "permit_open", args)
+	case "permitlisten":
+		p.setPermits(p.match, "permit_listen", args)
+	case "permittunnel":
+		setFirst(p.match, "permit_tunnel", strings.ToLower(args[0]))
+	case "forcecommand":
+		if strings.Join(args, " ") != "internal-sftp" {
+			return errors.New("only internal-sftp is supported")
+		}
+		p.match["sftp_only"] = true
+	default:
+		return errors.New("not supported inside Match")
+	}
+	return nil
+}
+
+// finishListeners turns Port and ListenAddress into listeners: addresses
+// without a port listen on every Port, which defaults to 22.
+func (p *sshdParser) finishListeners() {
+	if len(p.ports) == 0 && len(p.addresses) == 0 {
+		return
+	}
+	if len(p.ports) == 0 {
+		p.ports = []string{"22"}
+	}
+	if len(p.addresses) == 0 {
+		p.addresses = []string{""}
+	}
+	var listeners []any
+	for _, address := range p.addresses {
+		if _, _, err := net.SplitHostPort(address); err == nil {
+			listeners = append(listeners, map[string]any{"address": address})
+			continue
+		}
+		host := strings.Trim(address, "[]")
+		for _, port := range p.ports {
+			listeners = append(listeners, map[string]any{"address": net.JoinHostPort(host, port)})
+		}
+	}
+	p.doc["listeners"] = listeners
+}
+
+func (p *sshdParser) set(key string, value any) {
+	setFirst(p.doc, key, value)
+}
+
+func (p *sshdParser) setTime(key, value string) error {
+	seconds, err := sshdTime(value)
+	if err != nil {
+		return err
+	}
+	p.set(key, seconds)
+	return nil
+}
+
+// setPermits translates PermitOpen/PermitListen arguments: "any" leaves
+// the setting unrestricted and "none" denies everything.
+func (p *sshdParser) setPermits(target map[string]any, key string, args []string) {
+	if len(args) == 1 && args[0] == "any" {
+		return
+	}
+	setFirst(target, key, sshdList(args))
+}
+
+func setFirst(target map[string]any, key string, value any) {
+	if _, ok := target[key]; !ok {
+		target[key] = value
+	}
+}
+
+// sshdList returns value, a []any built by earlier directives or a
+// []string, as a []any for the config document.
+func sshdList(value any) []any {
+	switch v := value.(type) {
+	case []any:
+		return v
+	case []string:
+		list := make([]any, len(v))
+		for i, s := range v {
+			list[i] = s
+		}
+		return list
+	}
+	return nil
+}
+
+func sshdBool(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "yes":
+		return true, nil
+	case "no":
+		return false, nil
+	}
+	return false, fmt.Errorf("invalid value %q", value)
+}
+
+func sshdForwarding(value string) (string, error) {
+	switch strings.ToLower(value) {
+	case "yes", "all":
+		return ForwardingBoth, nil
+	case "no":
+		return ForwardingNone, nil
+	case "local":
+		return ForwardingLocal, nil
+	case "remote":
+		return ForwardingRemote, nil
+	}
+	return "", fmt.Errorf("invalid value %q", value)
+}
+
+// sshdTime parses an sshd_config time such as "120", "2m" or "1h30m" into
+// seconds.
+func sshdTime(value string) (int, error) {
+	units := map[byte]int{'s': 1, 'm': 60, 'h': 3600, 'd': 86400, 'w': 604800}
+	total, start := 0, 0
+	for i := 0; i <= len(value); i++ {
+		if i < len(value) && value[i] >= '0' && value[i] <= '9' {
+			continue
+		}
+		if i == start {
+			if i == len(value) && i > 0 {
+				break
+			}
+			return 0, fmt.Errorf("invalid time %q", value)
+		}
+		n, _ := strconv.Atoi(value[start:i])
+		unit := 1
+		if i < len(value) {
+			var ok bool
+			if unit, ok = units[value[i]|0x20]; !ok {
+				return 0, fmt.Errorf("invalid time %q", value)
+			}
+		}
+		total += n * unit
+		start = i + 1
+	}
+	return total, nil
+}
+
+// sshdSize parses a byte count with an optional K, M or G suffix.
+func sshdSize(value string) (int64, error) {
+	multiplier := int64(1)
+	switch strings.ToUpper(value[len(value)-1:]) {
+	case "K":
+		multiplier = 1 << 10
+	case "M":
+		multiplier = 1 << 20
+	case "G":
+		multiplier = 1 << 30
+	}
+	if multiplier > 1 {
+		value = value[:len(value)-1]
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return n * multiplier, nil
+}
@@ -0,0 +1,349 @@
+package logging
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/dollarkillerx/tinyssh/internal/config"
+)
+
+// EventChainAnchor is the record that signs the head of the audit chain.
+const EventChainAnchor = "chain.anchor"
+
+// chainSignedPrefix starts the data an anchor signs, so an anchor signature
+// cannot be mistaken for a signature over anything else.
+const chainSignedPrefix = "tinyssh-audit-chain-v1\n"
+
+// chainGenesis is the prev of the first record of a chain.
+var chainGenesis = strings.Repeat("0", sha256.Size*2)
+
+// ChainHandler appends audit events to a tamper-evident log: one JSON
+// object per line, like those of the json log format, numbered by a seq
+// attribute and carrying in prev the SHA-256 of the line before. Every
+// anchor interval, an anchor record signs the hash of the last line with
+// the host key, so the log up to it cannot be edited, reordered or
+// truncated without breaking the chain or the signature. Other records are
+// left out, and audit events are written whatever the log level.
+type ChainHandler struct {
+	*chain
+	json  slog.Handler
+	event string
+}
+
+type chain struct {
+	mu     sync.Mutex
+	f      *os.File
+	buf    bytes.Buffer
+	json   slog.Handler
+	seq    int64
+	prev   string
+	signer func() ssh.Signer
+	// anchored is the seq of the last record an anchor signed.
+	anchored int64
+	closed   bool
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// NewChainHandler opens the log of opts, continuing the chain it holds.
+func NewChainHandler(opts config.ChainOptions) (*ChainHandler, error) {
+	f, err := os.OpenFile(opts.Path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("audit chain: %w", err)
+	}
+	c := &chain{f: f, prev: chainGenesis, stop: make(chan struct{}), done: make(chan struct{})}
+	if err := c.resume(); err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("audit chain: %s: %w", opts.Path, err)
+	}
+	c.anchored = c.seq
+	c.json = slog.NewJSONHandler(&c.buf, &slog.HandlerOptions{Level: slog.LevelDebug})
+	go c.run(time.Duration(opts.AnchorInterval) * time.Second)
+	return &ChainHandler{chain: c, json: c.json}, nil
+}
+
+// resume reads the seq and hash of the last line of the file.
+func (c *chain) resume() error {
+	info, err := c.f.Stat()
+	if err != nil {
+		return err
+	}
+	// Lines are short; the end of the file holds the last one.
+	const tail = 1 << 20
+	offset := max(info.Size()-tail, 0)
+	raw := make([]byte, info.Size()-offset)
+	if _, err := c.f.ReadAt(raw, offset); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	if len(raw) == 0 {
+		return nil
+	}
+	if raw[len(raw)-1] != '\n' {
+		return errors.New("last line is incomplete")
+	}
+	raw = raw[:len(raw)-1]
+	last := raw[bytes.LastIndexByte(raw, '\n')+1:]
+	var record struct {
+		Seq int64 `json:"seq"`
+	}
+	if err := json.Unmarshal(last, &record); err != nil {
+		return fmt.Errorf("last line: %w", err)
+	}
+	c.seq = record.Seq
+	c.prev = chainHash(last)
+	return nil
+}
+
+// SetSigner sets the source of the key anchors are signed with. Anchors
+// are not written before it is set, or while it returns nil.
+func (h *ChainHandler) SetSigner(signer func() ssh.Signer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.signer = signer
+}
+
+func (h *ChainHandler) Enabled(context.Context, slog.Level) bool {
+	return true
+}
+
+func (h *ChainHandler) Handle(ctx context.Context, r slog.Record) error {
+	event, ok := Event(r)
+	if !ok {
+		event = h.event
+	}
+	if event == "" {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return nil
+	}
+	return h.appendLocked(ctx, h.json, r)
+}
+
+// appendLocked writes r, rendered by json, as the next line of the chain.
+func (c *chain) appendLocked(ctx context.Context, json slog.Handler, r slog.Record) error {
+	r = r.Clone()
+	r.AddAttrs(slog.Int64("seq", c.seq+1), slog.String("prev", c.prev))
+	c.buf.Reset()
+	if err := json.Handle(ctx, r); err != nil {
+		return err
+	}
+	line := c.buf.Bytes()
+	if _, err := c.f.Write(line); err != nil {
+		return err
+	}
+	c.seq++
+	c.prev = chainHash(bytes.TrimSuffix(line, []byte("\n")))
+	return nil
+}
+
+func (h *ChainHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	c := *h
+	c.json = h.json.WithAttrs(attrs)
+	for _, a := range attrs {
+		if a.Key == EventKey {
+			c.event = a.Value.String()
+		}
+	}
+	return &c
+}
+
+// WithGroup is not used by tinyssh's audit events, which are top level;
+// seq and prev must stay top level too.
+func (h *ChainHandler) WithGroup(string) slog.Handler {
+	return h
+}
+
+func (c *chain) run(interval time.Duration) {
+	defer close(c.done)
+	if interval <= 0 {
+		<-c.stop
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.mu.Lock()
+			if err := c.anchorLocked(); err != nil {
+				fmt.Fprintf(os.Stderr, "audit chain: anchor: %v\n", err)
+			}
+			c.mu.Unlock()
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// anchorLocked signs the head of the chain, unless it is signed already.
+func (c *chain) anchorLocked() error {
+	if c.seq == c.anchored || c.signer == nil {
+		return nil
+	}
+	signer := c.signer()
+	if signer == nil {
+		return nil
+	}
+	sig, err := chainSign(signer, chainSignedData(c.seq, c.prev))
+	if err != nil {
+		return err
+	}
+	head := c.seq
+	r := slog.NewRecord(time.Now(), slog.LevelInfo, "audit chain anchor", 0)
+	r.AddAttrs(
+		slog.String(EventKey, EventChainAnchor),
+		slog.Int64("anchor_seq", head),
+		slog.String("key", strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey())))),
+		slog.String("sig", base64.StdEncoding.EncodeToString(ssh.Marshal(sig))),
+	)
+	if err := c.appendLocked(context.Background(), c.json, r); err != nil {
+		return err
+	}
+	c.anchored = c.seq
+	return nil
+}
+
+// Close anchors the head of the chain and closes the file.
+func (c *chain) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	err := c.anchorLocked()
+	c.closed = true
+	c.mu.Unlock()
+	close(c.stop)
+	<-c.done
+	return errors.Join(err, c.f.Close())
+}
+
+// chainSign signs data with signer, using SHA-256 for RSA keys.
+func chainSign(signer ssh.Signer, data []byte) (*ssh.Signature, error) {
+	if as, ok := signer.(ssh.AlgorithmSigner); ok && signer.PublicKey().Type() == ssh.KeyAlgoRSA {
+		return as.SignWithAlgorithm(rand.Reader, data, ssh.KeyAlgoRSASHA256)
+	}
+	return signer.Sign(rand.Reader, data)
+}
+
+// chainSignedData is what an anchor of the record seq with hash signs.
+func chainSignedData(seq int64, hash string) []byte {
+	return fmt.Appendf(nil, "%s%d %s\n", chainSignedPrefix, seq, hash)
+}
+
+func chainHash(line []byte) string {
+	sum := sha256.Sum256(line)
+	return hex.EncodeToString(sum[:])
+}
+
+// ChainReport summarizes a verified audit chain.
+type ChainReport struct {
+	// First and Last are the seq of the first and last records. A chain
+	// that does not start at 1 lost its beginning, or continues one that
+	// was rotated away.
+	First, Last int64
+	// Anchors counts the valid anchors; Anchored is the seq of the last
+	// one. Records after it could be removed without trace.
+	Anchors  int
+	Anchored int64
+	// Keys lists the keys that signed anchors, in authorized_keys format.
+	Keys []string
+}
+
+// VerifyChain checks the audit chain read from r: that every line carries
+// the next seq and the hash of the line before, and that every anchor is
+// signed by a valid key, by one of trusted if any are given. It returns the
+// first break found.
+func VerifyChain(r io.Reader, trusted []ssh.PublicKey) (*ChainReport, error) {
+	report := &ChainReport{}
+	var prev string
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 16<<20)
+	for n := 1; sc.Scan(); n++ {
+		line := sc.Bytes()
+		var record struct {
+			Event     string `json:"event"`
+			Seq       int64  `json:"seq"`
+			Prev      string `json:"prev"`
+			AnchorSeq int64  `json:"anchor_seq"`
+			Key       string `json:"key"`
+			Sig       string `json:"sig"`
+		}
+		if err := json.Unmarshal(line, &record); err != nil {
+			return report, fmt.Errorf("line %d: %w", n, err)
+		}
+		switch {
+		case n == 1:
+			report.First = record.Seq
+			if record.Seq == 1 && record.Prev != chainGenesis {
+				return report, fmt.Errorf("line %d: first record does not start a chain", n)
+			}
+		case record.Seq != report.Last+1:
+			return report, fmt.Errorf("line %d: seq %d follows %d", n, record.Seq, report.Last)
+		case record.Prev != prev:
+			return report, fmt.Errorf("line %d: seq %d: hash of the previous record does not match", n, record.Seq)
+		}
+		if record.Event == EventChainAnchor {
+			if record.AnchorSeq != record.Seq-1 {
+				return report, fmt.Errorf("line %d: anchor signs seq %d, not the record before it", n, record.AnchorSeq)
+			}
+			key, err := verifyAnchor(record.Key, record.Sig, chainSignedData(record.AnchorSeq, record.Prev), trusted)
+			if err != nil {
+				return report, fmt.Errorf("line %d: anchor: %w", n, err)
+			}
+			report.Anchors++
+			report.Anchored = record.Seq
+			if !slices.Contains(report.Keys, key) {
+				report.Keys = append(report.Keys, key)
+			}
+		}
+		report.Last = record.Seq
+		prev = chainHash(line)
+	}
+	return report, sc.Err()
+}
+
+// verifyAnchor checks sig over data and returns the key that made it.
+func verifyAnchor(authorizedKey, sig string, data []byte, trusted []ssh.PublicKey) (string, error) {
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(authorizedKey))
+	if err != nil {
+		return "", fmt.Errorf("key: %w", err)
+	}
+	if len(trusted) > 0 {
+		if !slices.ContainsFunc(trusted, func(t ssh.PublicKey) bool { return bytes.Equal(t.Marshal(), key.Marshal()) }) {
+			return "", fmt.Errorf("signed by untrusted key %s", ssh.FingerprintSHA256(key))
+		}
+	}
+	raw, err := base64.StdEncoding.DecodeString(sig)
+	if err != nil {
+		return "", fmt.Errorf("signature: %w", err)
+	}
+	var signature ssh.Signature
+	if err := ssh.Unmarshal(raw, &signature); err != nil {
+		return "", fmt.Errorf("signature: %w", err)
+	}
+	if err := key.Verify(data, &signature); err != nil {
+		return "", fmt.Errorf("bad signature by %s", ssh.FingerprintSHA256(key))
+	}
+	return strings.TrimSpace(authorizedKey), nil
+}
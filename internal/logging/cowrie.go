@@ -0,0 +1,157 @@
+package logging
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// cowrieTimeFormat is the timestamp format of Cowrie's JSON log.
+const cowrieTimeFormat = "2006-01-02T15:04:05.000000Z"
+
+// cowrieHandler writes audit events as the JSON events of the Cowrie SSH
+// honeypot, one per line, so its analytics can read them: connections and
+// logins, failed logins, commands run with exec, files uploaded over SFTP
+// and direct-tcpip requests. Other records are left out.
+type cowrieHandler struct {
+	level  slog.Leveler
+	w      io.Writer
+	sensor string
+	attrs  []slog.Attr
+	// conns holds the client address and start of each open connection, by
+	// connection ID, since later events of a connection do not carry them.
+	mu    *sync.Mutex
+	conns map[string]cowrieConn
+}
+
+type cowrieConn struct {
+	ip    string
+	port  int
+	start time.Time
+}
+
+func newCowrieHandler(w io.Writer, level slog.Leveler) *cowrieHandler {
+	sensor, _ := os.Hostname()
+	return &cowrieHandler{level: level, w: w, sensor: sensor, mu: &sync.Mutex{}, conns: map[string]cowrieConn{}}
+}
+
+func (h *cowrieHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *cowrieHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	c := *h
+	c.attrs = slices.Concat(h.attrs, attrs)
+	return &c
+}
+
+// WithGroup is not used by tinyssh's audit events, which are top level.
+func (h *cowrieHandler) WithGroup(string) slog.Handler {
+	return h
+}
+
+func (h *cowrieHandler) Handle(_ context.Context, r slog.Record) error {
+	attrs := map[string]slog.Value{}
+	for _, a := range h.attrs {
+		attrs[a.Key] = a.Value.Resolve()
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		attrs[a.Key] = a.Value.Resolve()
+		return true
+	})
+	get := func(key string) string {
+		if v, ok := attrs[key]; ok {
+			return v.String()
+		}
+		return ""
+	}
+	event, session := get(EventKey), get("conn")
+	if event == "" {
+		return nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	conn, known := h.conns[session]
+	if remote := get("remote"); remote != "" {
+		if host, port, err := net.SplitHostPort(remote); err == nil {
+			conn.ip = host
+			conn.port, _ = strconv.Atoi(port)
+		}
+	}
+
+	var events []map[string]any
+	add := func(id, message string, fields ...any) {
+		e := map[string]any{"eventid": id, "message": message}
+		for i := 0; i+1 < len(fields); i += 2 {
+			e[fields[i].(string)] = fields[i+1]
+		}
+		events = append(events, e)
+	}
+	switch event {
+	case EventConnect:
+		if !known {
+			conn.start = r.Time
+		}
+		h.conns[session] = conn
+		add("cowrie.session.connect", "New connection: "+net.JoinHostPort(conn.ip, strconv.Itoa(conn.port)),
+			"src_port", conn.port, "protocol", "ssh")
+		if hassh := get("hassh"); hassh != "" {
+			add("cowrie.client.kex", "SSH client hassh fingerprint: "+hassh, "hassh", hassh, "kexAlgs", []string{get("kex")})
+		}
+		add("cowrie.login.success", "login attempt ["+get("user")+"] succeeded", "username", get("user"))
+	case EventAuthFailure:
+		add("cowrie.login.failed", "login attempt ["+get("user")+"] failed", "username", get("user"))
+	case EventSession:
+		if command := get("command"); command != "" {
+			add("cowrie.command.input", "CMD: "+command, "input", command)
+		}
+	case EventSFTP:
+		written := attrs["bytes_written"]
+		if get("op") == "close" && get("result") == "ok" && written.Kind() == slog.KindInt64 && written.Int64() > 0 {
+			file := get("path")
+			add("cowrie.session.file_upload", "Uploaded file "+file,
+				"filename", path.Base(file), "outfile", file, "size", written.Int64())
+		}
+	case EventForward:
+		if dest := get("dest"); dest != "" {
+			host, port, _ := net.SplitHostPort(dest)
+			dport, _ := strconv.Atoi(port)
+			add("cowrie.direct-tcpip.request", "direct-tcp connection request to "+dest,
+				"dst_ip", host, "dst_port", dport)
+		}
+	case EventDisconnect:
+		delete(h.conns, session)
+		duration := 0.0
+		if known {
+			duration = r.Time.Sub(conn.start).Seconds()
+		}
+		add("cowrie.session.closed", "Connection lost after "+strconv.FormatFloat(duration, 'f', 1, 64)+" seconds",
+			"duration", duration)
+	}
+
+	for _, e := range events {
+		e["timestamp"] = r.Time.UTC().Format(cowrieTimeFormat)
+		e["session"] = session
+		e["sensor"] = h.sensor
+		if conn.ip != "" {
+			e["src_ip"] = conn.ip
+		}
+		line, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if _, err := h.w.Write(append(line, '\n')); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+// Package logging builds tinyssh's log handlers and marks the log records
+// that are audit events.
+package logging
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+)
+
+// EventKey is the attribute that makes a log record an audit event; its
+// value names what happened. Handlers can pick audit events out by it.
+const EventKey = "event"
+
+// Audit event names.
+const (
+	EventConnect     = "connection.open"
+	EventDisconnect  = "connection.close"
+	EventAuthFailure = "auth.failure"
+	EventSession     = "session.start"
+	EventSessionEnd  = "session.end"
+	EventSFTP        = "sftp"
+	EventForward     = "forward.open"
+)
+
+// Event returns the audit event named by r, if it is one.
+func Event(r slog.Record) (string, bool) {
+	var event string
+	r.Attrs(func(a slog.Attr) bool {
+		if a.Key == EventKey {
+			event = a.Value.String()
+			return false
+		}
+		return true
+	})
+	return event, event != ""
+}
+
+// NewHandler returns a handler writing records at level or above to w in
+// format: "text" (logfmt), "json" (one object per line), or "ecs" or "cef"
+// for SIEMs, which use the Elastic Common Schema and ArcSight Common Event
+// Format names for the fields of audit events, or "cowrie" for only the
+// audit events, as the Cowrie honeypot's JSON events.
+func NewHandler(w io.Writer, format string, level slog.Leveler) (slog.Handler, error) {
+	opts := &slog.HandlerOptions{Level: level}
+	switch format {
+	case "", "text":
+		return slog.NewTextHandler(w, opts), nil
+	case "json":
+		return slog.NewJSONHandler(w, opts), nil
+	case "ecs", "cef":
+		return newSIEMHandler(w, format, level), nil
+	case "cowrie":
+		return newCowrieHandler(w, level), nil
+	}
+	return nil, fmt.Errorf("unknown log format %q (want text, json, ecs, cef or cowrie)", format)
+}
+
+// fanout passes every record to all of its handlers.
+type fanout []slog.Handler
+
+// Fanout returns a handler that passes records to every one of handlers.
+func Fanout(handlers ...slog.Handler) slog.Handler {
+	if len(handlers) == 1 {
+		return handlers[0]
+	}
+	return fanout(handlers)
+}
+
+func (f fanout) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, h := range f {
+		if h.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f fanout) Handle(ctx context.Context, r slog.Record) error {
+	var errs []error
+	for _, h := range f {
+		if h.Enabled(ctx, r.Level) {
+			errs = append(errs, h.Handle(ctx, r.Clone()))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (f fanout) WithAttrs(attrs []slog.Attr) slog.Handler {
+	out := make(fanout, len(f))
+	for i, h := range f {
+		out[i] = h.WithAttrs(attrs)
+	}
+	return out
+}
+
+func (f fanout) WithGroup(name string) slog.Handler {
+	out := make(fanout, len(f))
+	for i, h := range f {
+		out[i] = h.WithGroup(name)
+	}
+	return out
+}
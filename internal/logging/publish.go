@@ -0,0 +1,250 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl/plain"
+
+	"github.com/dollarkillerx/tinyssh/internal/config"
+)
+
+// sink is an event bus that audit events are published to. publish must
+// not block on the network.
+type sink interface {
+	publish(event, conn string, msg []byte)
+	Close() error
+}
+
+// PublishHandler publishes audit events, as JSON objects like those of the
+// json log format, to NATS and Kafka. Other records are left out, and
+// audit events are published whatever the log level. Close flushes the
+// events still buffered.
+type PublishHandler struct {
+	*publisher
+	json slog.Handler
+	// event and conn are set when WithAttrs added the audit event or the
+	// connection ID.
+	event string
+	conn  string
+}
+
+type publisher struct {
+	sinks []sink
+	mu    sync.Mutex
+	buf   bytes.Buffer
+}
+
+// NewPublishHandler returns a handler publishing to the buses configured
+// in opts. Servers that are down are retried in the background, so they
+// do not keep tinyssh from starting.
+func NewPublishHandler(opts config.LogOptions) (*PublishHandler, error) {
+	p := &publisher{}
+	if opts.NATS.Enabled() {
+		s, err := newNATSSink(opts.NATS)
+		if err != nil {
+			return nil, err
+		}
+		p.sinks = append(p.sinks, s)
+	}
+	if opts.Kafka.Enabled() {
+		p.sinks = append(p.sinks, newKafkaSink(opts.Kafka))
+	}
+	return &PublishHandler{publisher: p, json: slog.NewJSONHandler(&p.buf, &slog.HandlerOptions{Level: slog.LevelDebug})}, nil
+}
+
+func (h *PublishHandler) Enabled(context.Context, slog.Level) bool {
+	return true
+}
+
+func (h *PublishHandler) Handle(ctx context.Context, r slog.Record) error {
+	event, ok := Event(r)
+	if !ok {
+		event = h.event
+	}
+	if event == "" {
+		return nil
+	}
+	conn := h.conn
+	r.Attrs(func(a slog.Attr) bool {
+		if a.Key == "conn" {
+			conn = a.Value.String()
+			return false
+		}
+		return true
+	})
+
+	h.mu.Lock()
+	h.buf.Reset()
+	err := h.json.Handle(ctx, r)
+	msg := bytes.TrimSuffix(bytes.Clone(h.buf.Bytes()), []byte("\n"))
+	h.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	for _, s := range h.sinks {
+		s.publish(event, conn, msg)
+	}
+	return nil
+}
+
+func (h *PublishHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	c := *h
+	c.json = h.json.WithAttrs(attrs)
+	for _, a := range attrs {
+		switch a.Key {
+		case EventKey:
+			c.event = a.Value.String()
+		case "conn":
+			c.conn = a.Value.String()
+		}
+	}
+	return &c
+}
+
+func (h *PublishHandler) WithGroup(name string) slog.Handler {
+	c := *h
+	c.json = h.json.WithGroup(name)
+	return &c
+}
+
+// Close flushes and closes the connections to the buses.
+func (p *publisher) Close() error {
+	var errs []error
+	for _, s := range p.sinks {
+		errs = append(errs, s.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// natsSink publishes each event to the subject prefix followed by the
+// event name. The client buffers messages while it reconnects.
+type natsSink struct {
+	conn    *nats.Conn
+	subject string
+}
+
+func newNATSSink(opts config.NATSOptions) (*natsSink, error) {
+	options := []nats.Option{
+		nats.Name("tinyssh"),
+		nats.MaxReconnects(-1),
+		nats.RetryOnFailedConnect(true),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "nats: disconnected: %v\n", err)
+			}
+		}),
+		nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) {
+			fmt.Fprintf(os.Stderr, "nats: %v\n", err)
+		}),
+	}
+	if opts.CredsFile != "" {
+		options = append(options, nats.UserCredentials(opts.CredsFile))
+	}
+	conn, err := nats.Connect(opts.URL, options...)
+	if err != nil {
+		return nil, fmt.Errorf("nats: %w", err)
+	}
+	return &natsSink{conn: conn, subject: opts.Subject}, nil
+}
+
+func (s *natsSink) publish(event, _ string, msg []byte) {
+	if err := s.conn.Publish(s.subject+"."+event, msg); err != nil {
+		fmt.Fprintf(os.Stderr, "nats: publish %s: %v\n", event, err)
+	}
+}
+
+func (s *natsSink) Close() error {
+	err := s.conn.FlushTimeout(5 * time.Second)
+	s.conn.Close()
+	if errors.Is(err, nats.ErrConnectionClosed) {
+		return nil
+	}
+	return err
+}
+
+// kafkaQueue bounds the events waiting for Kafka; more are dropped while
+// the brokers are unreachable.
+const kafkaQueue = 4096
+
+// kafkaSink writes events in small batches, keyed by connection ID. The
+// writer looks up the topic's partitions before queueing messages, which
+// may block on the network, so messages are handed to it by a goroutine.
+type kafkaSink struct {
+	w     *kafka.Writer
+	queue chan kafka.Message
+	done  chan struct{}
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func newKafkaSink(opts config.KafkaOptions) *kafkaSink {
+	transport := &kafka.Transport{ClientID: "tinyssh"}
+	if opts.TLS {
+		transport.TLS = &tls.Config{}
+	}
+	if opts.Username != "" {
+		transport.SASL = plain.Mechanism{Username: opts.Username, Password: opts.Password}
+	}
+	s := &kafkaSink{
+		w: &kafka.Writer{
+			Addr:         kafka.TCP(opts.Brokers...),
+			Topic:        opts.Topic,
+			Balancer:     &kafka.Hash{},
+			BatchTimeout: 100 * time.Millisecond,
+			Async:        true,
+			Transport:    transport,
+			Completion: func(messages []kafka.Message, err error) {
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "kafka: %d events lost: %v\n", len(messages), err)
+				}
+			},
+		},
+		queue: make(chan kafka.Message, kafkaQueue),
+		done:  make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+func (s *kafkaSink) run() {
+	defer close(s.done)
+	for msg := range s.queue {
+		if err := s.w.WriteMessages(context.Background(), msg); err != nil {
+			fmt.Fprintf(os.Stderr, "kafka: event lost: %v\n", err)
+		}
+	}
+}
+
+func (s *kafkaSink) publish(event, conn string, msg []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.queue <- kafka.Message{Key: []byte(conn), Value: msg}:
+	default:
+		fmt.Fprintf(os.Stderr, "kafka: queue full, %s event lost\n", event)
+	}
+}
+
+// Close writes the queued events and waits for the writer to send them.
+func (s *kafkaSink) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	close(s.queue)
+	s.mu.Unlock()
+	<-s.done
+	return s.w.Close()
+}
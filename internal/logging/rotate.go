@@ -0,0 +1,201 @@
+package logging
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dollarkillerx/tinyssh/internal/config"
+)
+
+// rotatedTimeFormat is appended to the name of rotated files, so they sort
+// by age.
+const rotatedTimeFormat = "20060102T150405.000"
+
+// RotatingFile is a log file that is rotated by size or age. A rotated file
+// is renamed with the time of rotation appended, then compressed and pruned
+// in the background.
+type RotatingFile struct {
+	path string
+	opts config.RotateOptions
+
+	mu     sync.Mutex
+	f      *os.File
+	size   int64
+	opened time.Time
+	// onRotate is called with each rotated file once it is compressed.
+	onRotate func(path string)
+	// cleanup serializes compressing and pruning rotated files.
+	cleanup sync.Mutex
+}
+
+// OpenRotatingFile opens path for appending, rotating it according to
+// opts.
+func OpenRotatingFile(path string, opts config.RotateOptions) (*RotatingFile, error) {
+	r := &RotatingFile{path: path, opts: opts}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	go r.clean("")
+	return r, nil
+}
+
+func (r *RotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	r.f, r.size, r.opened = f, info.Size(), time.Now()
+	return nil
+}
+
+// Write appends p, first rotating the file if p would take it past the
+// size limit or the file has been written to longer than the interval.
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.due(int64(len(p))) {
+		if err := r.rotate(); err != nil {
+			// Keep logging to the current file rather than lose records.
+			fmt.Fprintf(os.Stderr, "rotate %s: %v\n", r.path, err)
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *RotatingFile) due(n int64) bool {
+	if r.size == 0 {
+		return false
+	}
+	if r.opts.MaxSize > 0 && r.size+n > r.opts.MaxSize {
+		return true
+	}
+	return r.opts.Interval > 0 && time.Since(r.opened) >= time.Duration(r.opts.Interval)*time.Second
+}
+
+func (r *RotatingFile) rotate() error {
+	rotated := r.path + "." + time.Now().UTC().Format(rotatedTimeFormat)
+	if err := os.Rename(r.path, rotated); err != nil {
+		return err
+	}
+	old := r.f
+	if err := r.open(); err != nil {
+		// Go on writing to the renamed file.
+		return err
+	}
+	_ = old.Close()
+	go r.clean(rotated)
+	return nil
+}
+
+// SetOnRotate sets a function called, in the background, with the path of
+// every file rotated from then on, once it is compressed; it may upload or
+// archive the file.
+func (r *RotatingFile) SetOnRotate(fn func(path string)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.onRotate = fn
+}
+
+// Close closes the current file.
+func (r *RotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.f.Close()
+}
+
+// clean compresses the file just rotated, if any, hands it to onRotate and
+// deletes the rotated files beyond the retention limits.
+func (r *RotatingFile) clean(rotated string) {
+	r.cleanup.Lock()
+	defer r.cleanup.Unlock()
+	if rotated != "" && r.opts.Compress {
+		if err := gzipFile(rotated); err != nil {
+			fmt.Fprintf(os.Stderr, "compress %s: %v\n", rotated, err)
+		} else {
+			rotated += ".gz"
+		}
+	}
+	if rotated != "" {
+		r.mu.Lock()
+		onRotate := r.onRotate
+		r.mu.Unlock()
+		if onRotate != nil {
+			onRotate(rotated)
+		}
+	}
+	if r.opts.MaxBackups == 0 && r.opts.MaxBackupAge == 0 {
+		return
+	}
+
+	dir, base := filepath.Split(r.path)
+	entries, err := os.ReadDir(filepath.Clean(dir))
+	if err != nil {
+		return
+	}
+	var backups []string
+	for _, e := range entries {
+		stamp, ok := strings.CutPrefix(e.Name(), base+".")
+		if !ok {
+			continue
+		}
+		if _, err := time.Parse(rotatedTimeFormat, strings.TrimSuffix(stamp, ".gz")); err == nil {
+			backups = append(backups, filepath.Join(dir, e.Name()))
+		}
+	}
+	// Newest first; the timestamps sort with or without .gz.
+	slices.SortFunc(backups, func(a, b string) int {
+		return strings.Compare(strings.TrimSuffix(b, ".gz"), strings.TrimSuffix(a, ".gz"))
+	})
+	for i, path := range backups {
+		expired := r.opts.MaxBackups > 0 && i >= r.opts.MaxBackups
+		if !expired && r.opts.MaxBackupAge > 0 {
+			info, err := os.Stat(path)
+			expired = err == nil && time.Since(info.ModTime()) > time.Duration(r.opts.MaxBackupAge)*time.Second
+		}
+		if expired {
+			if err := os.Remove(path); err != nil {
+				fmt.Fprintf(os.Stderr, "remove %s: %v\n", path, err)
+			}
+		}
+	}
+}
+
+// gzipFile replaces path with path.gz.
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	_, err = io.Copy(zw, in)
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
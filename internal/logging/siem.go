@@ -0,0 +1,317 @@
+package logging
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ecsVersion is the Elastic Common Schema version the ECS format follows.
+const ecsVersion = "8.11.0"
+
+// ecsEventTypes gives the ECS event.category and event.type of each audit
+// event.
+var ecsEventTypes = map[string][2][]string{
+	EventConnect:     {{"network", "session"}, {"connection", "start"}},
+	EventDisconnect:  {{"network", "session"}, {"connection", "end"}},
+	EventAuthFailure: {{"authentication"}, {"start"}},
+	EventSession:     {{"session", "process"}, {"start"}},
+	EventSessionEnd:  {{"session", "process"}, {"end"}},
+	EventSFTP:        {{"file"}, {"access"}},
+	EventForward:     {{"network"}, {"connection", "start"}},
+}
+
+// ecsFields maps tinyssh's log attributes to ECS fields. Attributes not
+// listed go under "tinyssh.".
+var ecsFields = map[string]string{
+	"user":    "user.name",
+	"conn":    "tinyssh.conn_id",
+	"command": "process.command_line",
+	"path":    "file.path",
+	"target":  "file.target_path",
+	"err":     "error.message",
+	"address": "server.address",
+}
+
+// cefFields maps tinyssh's log attributes to CEF extension keys. Attributes
+// not listed are appended to msg as key=value.
+var cefFields = map[string]string{
+	"user":    "suser",
+	"path":    "filePath",
+	"command": "cs2",
+	"conn":    "cs1",
+	"err":     "reason",
+}
+
+// cefLabels names the custom string fields of cefFields.
+var cefLabels = []string{"cs1Label=conn", "cs2Label=command"}
+
+// siemHandler writes records in a SIEM format, "ecs" or "cef", one per
+// line. Audit events become typed events; other records are written with
+// their message and attributes so nothing is lost.
+type siemHandler struct {
+	format string
+	level  slog.Leveler
+	mu     *sync.Mutex
+	w      io.Writer
+	attrs  []slog.Attr
+	group  string
+}
+
+func newSIEMHandler(w io.Writer, format string, level slog.Leveler) *siemHandler {
+	return &siemHandler{format: format, level: level, mu: &sync.Mutex{}, w: w}
+}
+
+func (h *siemHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *siemHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	c := *h
+	c.attrs = slices.Concat(h.attrs, qualify(h.group, attrs))
+	return &c
+}
+
+func (h *siemHandler) WithGroup(name string) slog.Handler {
+	c := *h
+	if c.group != "" {
+		name = c.group + "." + name
+	}
+	c.group = name
+	return &c
+}
+
+// qualify prefixes the keys of attrs with group.
+func qualify(group string, attrs []slog.Attr) []slog.Attr {
+	if group == "" {
+		return attrs
+	}
+	out := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		out[i] = slog.Attr{Key: group + "." + a.Key, Value: a.Value}
+	}
+	return out
+}
+
+// fields returns the attributes of r with those added by WithAttrs,
+// flattened with the keys of groups joined by dots.
+func (h *siemHandler) fields(r slog.Record) []slog.Attr {
+	attrs := slices.Clone(h.attrs)
+	var own []slog.Attr
+	r.Attrs(func(a slog.Attr) bool {
+		own = append(own, a)
+		return true
+	})
+	attrs = append(attrs, qualify(h.group, own)...)
+
+	var out []slog.Attr
+	var flatten func(prefix string, a slog.Attr)
+	flatten = func(prefix string, a slog.Attr) {
+		a.Value = a.Value.Resolve()
+		key := prefix + a.Key
+		if a.Value.Kind() == slog.KindGroup {
+			for _, g := range a.Value.Group() {
+				flatten(key+".", g)
+			}
+			return
+		}
+		if a.Key != "" {
+			out = append(out, slog.Attr{Key: key, Value: a.Value})
+		}
+	}
+	for _, a := range attrs {
+		flatten("", a)
+	}
+	return out
+}
+
+func (h *siemHandler) Handle(_ context.Context, r slog.Record) error {
+	var line []byte
+	if h.format == "cef" {
+		line = h.cef(r)
+	} else {
+		var err error
+		if line, err = h.ecs(r); err != nil {
+			return err
+		}
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := h.w.Write(append(line, '\n'))
+	return err
+}
+
+// ecs formats r as an ECS document.
+func (h *siemHandler) ecs(r slog.Record) ([]byte, error) {
+	doc := map[string]any{}
+	set := func(key string, value any) {
+		m := doc
+		parts := strings.Split(key, ".")
+		for _, p := range parts[:len(parts)-1] {
+			next, ok := m[p].(map[string]any)
+			if !ok {
+				next = map[string]any{}
+				m[p] = next
+			}
+			m = next
+		}
+		m[parts[len(parts)-1]] = value
+	}
+	set("@timestamp", r.Time.UTC().Format(time.RFC3339Nano))
+	set("log.level", strings.ToLower(r.Level.String()))
+	set("message", r.Message)
+	set("ecs.version", ecsVersion)
+	set("event.kind", "event")
+	set("event.module", "tinyssh")
+
+	var event string
+	for _, f := range h.fields(r) {
+		key, value := f.Key, f.Value.String()
+		switch key {
+		case EventKey:
+			event = value
+		case "remote", "dest":
+			side := "source"
+			if key == "dest" {
+				side = "destination"
+			}
+			host, port, err := net.SplitHostPort(value)
+			if err != nil {
+				set(side+".address", value)
+				continue
+			}
+			set(side+".address", host)
+			if ip := net.ParseIP(host); ip != nil {
+				set(side+".ip", host)
+			}
+			if n, err := strconv.Atoi(port); err == nil {
+				set(side+".port", n)
+			}
+		case "result":
+			outcome := "success"
+			if value != "ok" {
+				outcome = "failure"
+			}
+			set("event.outcome", outcome)
+		default:
+			name, ok := ecsFields[key]
+			if !ok {
+				name = "tinyssh." + key
+			}
+			switch f.Value.Kind() {
+			case slog.KindBool, slog.KindInt64, slog.KindUint64, slog.KindFloat64:
+				set(name, f.Value.Any())
+			default:
+				set(name, value)
+			}
+		}
+	}
+	if event != "" {
+		set("event.action", event)
+		if types, ok := ecsEventTypes[event]; ok {
+			set("event.category", types[0])
+			set("event.type", types[1])
+		}
+		if event == EventAuthFailure {
+			set("event.outcome", "failure")
+		}
+	}
+	return json.Marshal(doc)
+}
+
+// cef formats r as an ArcSight Common Event Format line. The signature ID
+// is the audit event, or "log" for other records.
+func (h *siemHandler) cef(r slog.Record) []byte {
+	event := "log"
+	ext := []string{"rt=" + strconv.FormatInt(r.Time.UnixMilli(), 10)}
+	var rest []string
+	labels := false
+	for _, f := range h.fields(r) {
+		key, value := f.Key, f.Value.String()
+		switch key {
+		case EventKey:
+			event = value
+			ext = append(ext, "act="+cefValue(value))
+		case "remote", "dest":
+			addr, port := "src", "spt"
+			if key == "dest" {
+				addr, port = "dhost", "dpt"
+			}
+			host, p, err := net.SplitHostPort(value)
+			if err != nil {
+				host = value
+			}
+			ext = append(ext, addr+"="+cefValue(host))
+			if p != "" {
+				ext = append(ext, port+"="+p)
+			}
+		case "result":
+			outcome := "success"
+			if value != "ok" {
+				outcome = "failure"
+			}
+			ext = append(ext, "outcome="+outcome)
+		default:
+			if name, ok := cefFields[key]; ok {
+				ext = append(ext, name+"="+cefValue(value))
+				labels = labels || strings.HasPrefix(name, "cs")
+			} else {
+				rest = append(rest, key+"="+value)
+			}
+		}
+	}
+	if event == EventAuthFailure {
+		ext = append(ext, "outcome=failure")
+	}
+	if labels {
+		ext = append(ext, cefLabels...)
+	}
+	if len(rest) > 0 {
+		ext = append(ext, "msg="+cefValue(strings.Join(rest, " ")))
+	}
+	return fmt.Appendf(nil, "CEF:0|tinyssh|tinyssh|%s|%s|%s|%d|%s",
+		cefHeader(version()), cefHeader(event), cefHeader(r.Message), cefSeverity(r.Level), strings.Join(ext, " "))
+}
+
+// cefSeverity maps a slog level to the CEF scale of 0 to 10.
+func cefSeverity(level slog.Level) int {
+	switch {
+	case level >= slog.LevelError:
+		return 8
+	case level >= slog.LevelWarn:
+		return 5
+	case level >= slog.LevelInfo:
+		return 3
+	default:
+		return 1
+	}
+}
+
+var cefHeaderEscaper = strings.NewReplacer(`\`, `\\`, `|`, `\|`, "\n", " ", "\r", " ")
+
+func cefHeader(s string) string {
+	return cefHeaderEscaper.Replace(s)
+}
+
+var cefValueEscaper = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\n", `\n`, "\r", `\r`)
+
+func cefValue(s string) string {
+	return cefValueEscaper.Replace(s)
+}
+
+// version returns the module version tinyssh was built from.
+func version() string {
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		return info.Main.Version
+	}
+	return "devel"
+}
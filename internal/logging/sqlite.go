@@ -0,0 +1,281 @@
+package logging
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	_ "modernc.org/sqlite"
+
+	"github.com/dollarkillerx/tinyssh/internal/config"
+)
+
+const (
+	// sqliteTimeFormat stores times as UTC text that sorts by time.
+	sqliteTimeFormat = "2006-01-02T15:04:05.000Z"
+	// sqliteQueue bounds the events waiting to be written.
+	sqliteQueue = 4096
+	// sqliteBatch is the most events written in one transaction.
+	sqliteBatch = 256
+	// sqlitePruneInterval is how often records past the maximum age are
+	// deleted.
+	sqlitePruneInterval = time.Hour
+)
+
+// sqliteSchema creates the tables of the audit database. The commands view
+// lists what was run with exec.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS connections (
+	conn_id TEXT PRIMARY KEY,
+	user TEXT,
+	remote TEXT,
+	kex TEXT,
+	hassh TEXT,
+	connected_at TEXT,
+	disconnected_at TEXT,
+	bytes_received INTEGER,
+	bytes_sent INTEGER
+);
+CREATE INDEX IF NOT EXISTS connections_user ON connections (user, connected_at);
+CREATE TABLE IF NOT EXISTS sessions (
+	session_id TEXT PRIMARY KEY,
+	conn_id TEXT,
+	user TEXT,
+	type TEXT,
+	command TEXT,
+	subsystem TEXT,
+	started_at TEXT,
+	ended_at TEXT,
+	exit_status INTEGER
+);
+CREATE INDEX IF NOT EXISTS sessions_conn ON sessions (conn_id);
+CREATE TABLE IF NOT EXISTS auth_failures (
+	id INTEGER PRIMARY KEY,
+	at TEXT,
+	conn_id TEXT,
+	user TEXT,
+	remote TEXT,
+	method TEXT,
+	error TEXT
+);
+CREATE INDEX IF NOT EXISTS auth_failures_at ON auth_failures (at);
+CREATE TABLE IF NOT EXISTS events (
+	id INTEGER PRIMARY KEY,
+	at TEXT,
+	event TEXT,
+	conn_id TEXT,
+	user TEXT,
+	message TEXT,
+	attrs TEXT
+);
+CREATE INDEX IF NOT EXISTS events_at ON events (at);
+CREATE VIEW IF NOT EXISTS commands AS
+	SELECT started_at, ended_at, conn_id, session_id, user, command, exit_status
+	FROM sessions WHERE type = 'exec';
+`
+
+// sqliteEvent is an audit event waiting to be written.
+type sqliteEvent struct {
+	at      time.Time
+	event   string
+	message string
+	attrs   map[string]any
+}
+
+// SQLiteHandler records audit events in an SQLite database: every event in
+// the events table, and connections, sessions and failed logins in tables
+// of their own, so history can be queried without a log stack. Events are
+// written in the background, in batches; Close writes the rest.
+type SQLiteHandler struct {
+	*sqliteWriter
+	attrs []slog.Attr
+}
+
+type sqliteWriter struct {
+	db     *sql.DB
+	opts   config.SQLiteOptions
+	queue  chan sqliteEvent
+	done   chan struct{}
+	mu     sync.Mutex
+	closed bool
+}
+
+// NewSQLiteHandler opens or creates the database of opts.
+func NewSQLiteHandler(opts config.SQLiteOptions) (*SQLiteHandler, error) {
+	db, err := sql.Open("sqlite", "file:"+opts.Path+"?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, fmt.Errorf("sqlite: %w", err)
+	}
+	// One connection keeps writes in order and avoids lock contention.
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("sqlite: %s: %w", opts.Path, err)
+	}
+	_ = os.Chmod(opts.Path, 0600)
+	w := &sqliteWriter{db: db, opts: opts, queue: make(chan sqliteEvent, sqliteQueue), done: make(chan struct{})}
+	go w.run()
+	return &SQLiteHandler{sqliteWriter: w}, nil
+}
+
+func (h *SQLiteHandler) Enabled(context.Context, slog.Level) bool {
+	return true
+}
+
+func (h *SQLiteHandler) Handle(_ context.Context, r slog.Record) error {
+	attrs := make(map[string]any)
+	add := func(a slog.Attr) bool {
+		value := a.Value.Resolve()
+		switch value.Kind() {
+		case slog.KindString, slog.KindInt64, slog.KindUint64, slog.KindFloat64, slog.KindBool:
+			attrs[a.Key] = value.Any()
+		default:
+			// Errors, durations and other values are stored as text.
+			attrs[a.Key] = value.String()
+		}
+		return true
+	}
+	for _, a := range h.attrs {
+		add(a)
+	}
+	r.Attrs(add)
+	event, _ := attrs[EventKey].(string)
+	if event == "" {
+		return nil
+	}
+	delete(attrs, EventKey)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return nil
+	}
+	select {
+	case h.queue <- sqliteEvent{at: r.Time, event: event, message: r.Message, attrs: attrs}:
+	default:
+		fmt.Fprintf(os.Stderr, "sqlite: queue full, %s event lost\n", event)
+	}
+	return nil
+}
+
+func (h *SQLiteHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	c := *h
+	c.attrs = append(h.attrs[:len(h.attrs):len(h.attrs)], attrs...)
+	return &c
+}
+
+// WithGroup is not used by tinyssh's audit events, which are top level.
+func (h *SQLiteHandler) WithGroup(string) slog.Handler {
+	return h
+}
+
+// Close writes the queued events and closes the database.
+func (w *sqliteWriter) Close() error {
+	w.mu.Lock()
+	w.closed = true
+	close(w.queue)
+	w.mu.Unlock()
+	<-w.done
+	return w.db.Close()
+}
+
+func (w *sqliteWriter) run() {
+	defer close(w.done)
+	w.prune()
+	lastPrune := time.Now()
+	for e := range w.queue {
+		batch := []sqliteEvent{e}
+	drain:
+		for len(batch) < sqliteBatch {
+			select {
+			case e, ok := <-w.queue:
+				if !ok {
+					break drain
+				}
+				batch = append(batch, e)
+			default:
+				break drain
+			}
+		}
+		if err := w.write(batch); err != nil {
+			fmt.Fprintf(os.Stderr, "sqlite: %d events lost: %v\n", len(batch), err)
+		}
+		if time.Since(lastPrune) >= sqlitePruneInterval {
+			w.prune()
+			lastPrune = time.Now()
+		}
+	}
+}
+
+// write records batch in one transaction.
+func (w *sqliteWriter) write(batch []sqliteEvent) error {
+	tx, err := w.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, e := range batch {
+		if err := writeEvent(tx, e); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func writeEvent(tx *sql.Tx, e sqliteEvent) error {
+	at := e.at.UTC().Format(sqliteTimeFormat)
+	get := func(key string) any {
+		return e.attrs[key]
+	}
+	attrs, err := json.Marshal(e.attrs)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO events (at, event, conn_id, user, message, attrs) VALUES (?, ?, ?, ?, ?, ?)`,
+		at, e.event, get("conn"), get("user"), e.message, string(attrs)); err != nil {
+		return err
+	}
+
+	switch e.event {
+	case EventConnect:
+		_, err = tx.Exec(`INSERT OR REPLACE INTO connections (conn_id, user, remote, kex, hassh, connected_at) VALUES (?, ?, ?, ?, ?, ?)`,
+			get("conn"), get("user"), get("remote"), get("kex"), get("hassh"), at)
+	case EventDisconnect:
+		_, err = tx.Exec(`UPDATE connections SET disconnected_at = ?, bytes_received = ?, bytes_sent = ? WHERE conn_id = ?`,
+			at, get("bytes_received"), get("bytes_sent"), get("conn"))
+	case EventAuthFailure:
+		_, err = tx.Exec(`INSERT INTO auth_failures (at, conn_id, user, remote, method, error) VALUES (?, ?, ?, ?, ?, ?)`,
+			at, get("conn"), get("user"), get("remote"), get("method"), get("err"))
+	case EventSession:
+		_, err = tx.Exec(`INSERT OR REPLACE INTO sessions (session_id, conn_id, user, type, command, subsystem, started_at) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			get("session"), get("conn"), get("user"), get("type"), get("command"), get("subsystem"), at)
+	case EventSessionEnd:
+		_, err = tx.Exec(`UPDATE sessions SET ended_at = ?, exit_status = ? WHERE session_id = ?`,
+			at, get("exit_status"), get("session"))
+	}
+	return err
+}
+
+// prune deletes the records older than the maximum age.
+func (w *sqliteWriter) prune() {
+	if w.opts.MaxAge <= 0 {
+		return
+	}
+	cutoff := time.Now().Add(-time.Duration(w.opts.MaxAge) * time.Second).UTC().Format(sqliteTimeFormat)
+	for _, stmt := range []string{
+		`DELETE FROM events WHERE at < ?`,
+		`DELETE FROM auth_failures WHERE at < ?`,
+		`DELETE FROM sessions WHERE started_at < ?`,
+		`DELETE FROM connections WHERE connected_at < ?`,
+	} {
+		if _, err := w.db.Exec(stmt, cutoff); err != nil {
+			fmt.Fprintf(os.Stderr, "sqlite: prune: %v\n", err)
+			return
+		}
+	}
+}
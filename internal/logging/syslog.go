@@ -0,0 +1,233 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dollarkillerx/tinyssh/internal/config"
+)
+
+// localSyslogSockets are tried in order for the "local" address.
+var localSyslogSockets = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+
+// syslogWriter sends RFC 5424 messages to one syslog server. Stream
+// transports use octet-counting framing (RFC 6587) and are redialled once
+// when a write fails; messages that still cannot be sent are dropped with
+// a note on standard error, since they cannot be logged.
+type syslogWriter struct {
+	opts     config.SyslogOptions
+	network  string
+	address  string
+	tls      *tls.Config
+	stream   bool
+	hostname string
+
+	mu   sync.Mutex
+	conn net.Conn
+	// The header fields of the record being formatted.
+	pri   int
+	at    time.Time
+	msgID string
+}
+
+// syslogHandler formats records with a text handler and sends them to
+// syslog, with the level as severity and the audit event as MSGID.
+type syslogHandler struct {
+	w    *syslogWriter
+	text slog.Handler
+	// event is set when WithAttrs added the audit event attribute.
+	event string
+}
+
+// NewSyslogHandler returns a handler sending records at level or above to
+// the syslog server of opts.
+func NewSyslogHandler(opts config.SyslogOptions, level slog.Leveler) (slog.Handler, error) {
+	w := &syslogWriter{opts: opts}
+	w.hostname, _ = os.Hostname()
+	if opts.Address == "local" {
+		for _, path := range localSyslogSockets {
+			if _, err := os.Stat(path); err == nil {
+				w.network, w.address = "unixgram", path
+				break
+			}
+		}
+		if w.address == "" {
+			return nil, errors.New("syslog: no local syslog socket")
+		}
+	} else {
+		u, err := url.Parse(opts.Address)
+		if err != nil {
+			return nil, fmt.Errorf("syslog: %w", err)
+		}
+		switch u.Scheme {
+		case "udp":
+			w.network, w.address = "udp", u.Host
+		case "tcp":
+			w.network, w.address, w.stream = "tcp", u.Host, true
+		case "tls":
+			w.network, w.address, w.stream = "tcp", u.Host, true
+			w.tls = &tls.Config{ServerName: u.Hostname()}
+			if opts.CAFile != "" {
+				pem, err := os.ReadFile(opts.CAFile)
+				if err != nil {
+					return nil, fmt.Errorf("syslog: %w", err)
+				}
+				w.tls.RootCAs = x509.NewCertPool()
+				if !w.tls.RootCAs.AppendCertsFromPEM(pem) {
+					return nil, fmt.Errorf("syslog: %s: no certificates", opts.CAFile)
+				}
+			}
+		case "unix":
+			w.network, w.address = "unixgram", u.Path
+		default:
+			return nil, fmt.Errorf("syslog: unsupported address %q", opts.Address)
+		}
+	}
+	// A server that is down now is dialled again for the first message,
+	// so it does not keep tinyssh from starting.
+	if err := w.dial(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+
+	text := slog.NewTextHandler(w, &slog.HandlerOptions{
+		Level: level,
+		// The syslog header carries the time and severity.
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) == 0 && (a.Key == slog.TimeKey || a.Key == slog.LevelKey) {
+				return slog.Attr{}
+			}
+			return a
+		},
+	})
+	return &syslogHandler{w: w, text: text}, nil
+}
+
+func (w *syslogWriter) dial() error {
+	var (
+		conn net.Conn
+		err  error
+	)
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	if w.tls != nil {
+		conn, err = tls.DialWithDialer(dialer, w.network, w.address, w.tls)
+	} else {
+		conn, err = dialer.Dial(w.network, w.address)
+	}
+	if err != nil {
+		return fmt.Errorf("syslog: %w", err)
+	}
+	w.conn = conn
+	return nil
+}
+
+// Write sends one formatted record. It is called by the text handler with
+// w.mu held by syslogHandler.Handle.
+func (w *syslogWriter) Write(p []byte) (int, error) {
+	msg := bytes.TrimSuffix(p, []byte("\n"))
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "<%d>1 %s %s %s %d %s - ", w.pri, w.at.Format(time.RFC3339Nano),
+		headerField(w.hostname), headerField(w.opts.AppName), os.Getpid(), headerField(w.msgID))
+	b.Write(msg)
+	packet := b.Bytes()
+	if w.stream {
+		packet = append([]byte(strconv.Itoa(len(packet))+" "), packet...)
+	}
+
+	err := w.send(packet)
+	if err != nil {
+		if w.conn != nil {
+			_ = w.conn.Close()
+			w.conn = nil
+		}
+		if err = w.dial(); err == nil {
+			err = w.send(packet)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "syslog %s: %v\n", w.opts.Address, err)
+	}
+	return len(p), nil
+}
+
+func (w *syslogWriter) send(packet []byte) error {
+	if w.conn == nil {
+		return net.ErrClosed
+	}
+	_ = w.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	_, err := w.conn.Write(packet)
+	return err
+}
+
+// headerField returns s as an RFC 5424 header field: "-" when empty,
+// printable ASCII without spaces otherwise.
+func headerField(s string) string {
+	if s == "" {
+		return "-"
+	}
+	b := []byte(s)
+	for i, c := range b {
+		if c <= ' ' || c > '~' {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+// severity maps a slog level to a syslog severity.
+func severity(level slog.Level) int {
+	switch {
+	case level >= slog.LevelError:
+		return 3
+	case level >= slog.LevelWarn:
+		return 4
+	case level >= slog.LevelInfo:
+		return 6
+	default:
+		return 7
+	}
+}
+
+func (h *syslogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.text.Enabled(ctx, level)
+}
+
+func (h *syslogHandler) Handle(ctx context.Context, r slog.Record) error {
+	event, ok := Event(r)
+	if !ok {
+		event = h.event
+	}
+	if h.w.opts.AuditOnly && event == "" {
+		return nil
+	}
+	h.w.mu.Lock()
+	defer h.w.mu.Unlock()
+	h.w.pri = config.SyslogFacilities[h.w.opts.Facility]*8 + severity(r.Level)
+	h.w.at = r.Time
+	h.w.msgID = event
+	return h.text.Handle(ctx, r)
+}
+
+func (h *syslogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	event := h.event
+	for _, a := range attrs {
+		if a.Key == EventKey {
+			event = a.Value.String()
+		}
+	}
+	return &syslogHandler{w: h.w, text: h.text.WithAttrs(attrs), event: event}
+}
+
+func (h *syslogHandler) WithGroup(name string) slog.Handler {
+	return &syslogHandler{w: h.w, text: h.text.WithGroup(name), event: h.event}
+}
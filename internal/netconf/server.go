@@ -0,0 +1,148 @@
+package netconf
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Base capabilities defined by RFC 6241.
+const (
+	CapabilityBase10 = "urn:ietf:params:netconf:base:1.0"
+	CapabilityBase11 = "urn:ietf:params:netconf:base:1.1"
+)
+
+const baseNamespace = "urn:ietf:params:xml:ns:netconf:base:1.0"
+
+// Handler processes NETCONF RPCs.
+type Handler interface {
+	// HandleRPC receives one <rpc> document and returns the complete
+	// <rpc-reply> to send back.
+	HandleRPC(ctx context.Context, rpc []byte) ([]byte, error)
+}
+
+// HandlerFunc adapts an ordinary function to the Handler interface.
+type HandlerFunc func(ctx context.Context, rpc []byte) ([]byte, error)
+
+// HandleRPC calls f(ctx, rpc).
+func (f HandlerFunc) HandleRPC(ctx context.Context, rpc []byte) ([]byte, error) {
+	return f(ctx, rpc)
+}
+
+// Server runs the NETCONF protocol on top of a subsystem channel. It performs
+// the hello exchange, negotiates framing, answers <close-session> itself and
+// passes every other RPC to Handler.
+type Server struct {
+	// Capabilities are advertised in addition to base:1.0 and base:1.1.
+	Capabilities []string
+	Handler      Handler
+	// MaxMessageSize limits the size of a message from the client; larger
+	// messages end the session. Zero means DefaultMaxMessageSize.
+	MaxMessageSize int
+}
+
+type hello struct {
+	XMLName      xml.Name `xml:"hello"`
+	Capabilities []string `xml:"capabilities>capability"`
+}
+
+type rpcEnvelope struct {
+	XMLName      xml.Name  `xml:"rpc"`
+	MessageID    string    `xml:"message-id,attr"`
+	CloseSession *struct{} `xml:"close-session"`
+}
+
+// Serve runs a NETCONF session over rw until the client closes the session,
+// the stream ends or ctx is cancelled.
+func (s *Server) Serve(ctx context.Context, rw io.ReadWriter, sessionID uint32) error {
+	if s.Handler == nil {
+		return errors.New("netconf: handler is required")
+	}
+
+	t := NewTransport(rw)
+	if s.MaxMessageSize > 0 {
+		t.SetMaxMessageSize(s.MaxMessageSize)
+	}
+	if err := t.WriteMessage(s.hello(sessionID)); err != nil {
+		return fmt.Errorf("netconf: send hello: %w", err)
+	}
+
+	raw, err := t.ReadMessage()
+	if err != nil {
+		return fmt.Errorf("netconf: read hello: %w", err)
+	}
+	var peer hello
+	if err := xml.Unmarshal(raw, &peer); err != nil {
+		return fmt.Errorf("netconf: parse hello: %w", err)
+	}
+	for _, capability := range peer.Capabilities {
+		if capability == CapabilityBase11 {
+			t.SetChunked()
+			break
+		}
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		msg, err := t.ReadMessage()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+
+		var env rpcEnvelope
+		if err := xml.Unmarshal(msg, &env); err != nil {
+			if err := t.WriteMessage(malformedReply()); err != nil {
+				return err
+			}
+			continue
+		}
+		if env.CloseSession != nil {
+			return t.WriteMessage(okReply(env.MessageID))
+		}
+
+		reply, err := s.Handler.HandleRPC(ctx, msg)
+		if err != nil {
+			return fmt.Errorf("netconf: handle rpc %s: %w", env.MessageID, err)
+		}
+		if err := t.WriteMessage(reply); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *Server) hello(sessionID uint32) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	fmt.Fprintf(&buf, `<hello xmlns="%s"><capabilities>`, baseNamespace)
+	capabilities := append([]string{CapabilityBase10, CapabilityBase11}, s.Capabilities...)
+	for _, capability := range capabilities {
+		buf.WriteString("<capability>")
+		_ = xml.EscapeText(&buf, []byte(capability))
+		buf.WriteString("</capability>")
+	}
+	fmt.Fprintf(&buf, "</capabilities><session-id>%d</session-id></hello>", sessionID)
+	return buf.Bytes()
+}
+
+func okReply(messageID string) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<rpc-reply xmlns="%s" message-id="`, baseNamespace)
+	_ = xml.EscapeText(&buf, []byte(messageID))
+	buf.WriteString(`"><ok/></rpc-reply>`)
+	return buf.Bytes()
+}
+
+func malformedReply() []byte {
+	return []byte(fmt.Sprintf(`<rpc-reply xmlns="%s"><rpc-error>`+
+		`<error-type>rpc</error-type><error-tag>malformed-message</error-tag>`+
+		`<error-severity>error</error-severity></rpc-error></rpc-reply>`, baseNamespace))
+}
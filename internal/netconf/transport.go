@@ -0,0 +1,153 @@
+// Package netconf implements the NETCONF over SSH transport described in
+// RFC 6242: the hello exchange and both end-of-message and chunked framing.
+package netconf
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+)
+
+const (
+	endOfMessage = "]]>]]>"
+	// maxChunkSize is the largest chunk RFC 6242 permits.
+	maxChunkSize = 4294967295
+	// chunkReadSize bounds each read of a chunk body, so memory follows the
+	// data actually received rather than the size the peer declared.
+	chunkReadSize = 32 * 1024
+)
+
+// DefaultMaxMessageSize is the largest message a Transport reads unless
+// SetMaxMessageSize chooses another limit.
+const DefaultMaxMessageSize = 4 << 20
+
+// ErrMessageTooLarge is returned when a message, or a chunk of it, would
+// exceed the transport's maximum message size.
+var ErrMessageTooLarge = errors.New("netconf: message too large")
+
+// Transport reads and writes framed NETCONF messages. It starts in
+// end-of-message framing, as required for the hello exchange, and switches
+// to chunked framing once both peers announced base:1.1.
+type Transport struct {
+	r       *bufio.Reader
+	w       io.Writer
+	chunked bool
+	maxSize int
+}
+
+// NewTransport wraps rw in a NETCONF transport using end-of-message framing.
+func NewTransport(rw io.ReadWriter) *Transport {
+	return &Transport{r: bufio.NewReader(rw), w: rw, maxSize: DefaultMaxMessageSize}
+}
+
+// SetChunked selects chunked framing for all subsequent messages.
+func (t *Transport) SetChunked() {
+	t.chunked = true
+}
+
+// SetMaxMessageSize limits the messages ReadMessage accepts to n bytes.
+func (t *Transport) SetMaxMessageSize(n int) {
+	t.maxSize = n
+}
+
+// ReadMessage returns the next complete message.
+func (t *Transport) ReadMessage() ([]byte, error) {
+	if t.chunked {
+		return t.readChunked()
+	}
+	return t.readEOM()
+}
+
+// WriteMessage frames msg and writes it to the peer.
+func (t *Transport) WriteMessage(msg []byte) error {
+	if t.chunked {
+		if _, err := fmt.Fprintf(t.w, "\n#%d\n", len(msg)); err != nil {
+			return err
+		}
+		if _, err := t.w.Write(msg); err != nil {
+			return err
+		}
+		_, err := io.WriteString(t.w, "\n##\n")
+		return err
+	}
+
+	buf := make([]byte, 0, len(msg)+len(endOfMessage))
+	buf = append(buf, msg...)
+	buf = append(buf, endOfMessage...)
+	_, err := t.w.Write(buf)
+	return err
+}
+
+func (t *Transport) readEOM() ([]byte, error) {
+	var msg []byte
+	for {
+		b, err := t.r.ReadByte()
+		if err != nil {
+			if errors.Is(err, io.EOF) && len(bytes.TrimSpace(msg)) > 0 {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		msg = append(msg, b)
+		if len(msg) > t.maxSize+len(endOfMessage) {
+			return nil, ErrMessageTooLarge
+		}
+		if bytes.HasSuffix(msg, []byte(endOfMessage)) {
+			return msg[:len(msg)-len(endOfMessage)], nil
+		}
+	}
+}
+
+func (t *Transport) readChunked() ([]byte, error) {
+	var msg []byte
+	for {
+		if err := t.expect("\n#"); err != nil {
+			return nil, err
+		}
+		header, err := t.r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		header = header[:len(header)-1]
+		if header == "#" {
+			return msg, nil
+		}
+
+		size, err := strconv.ParseUint(header, 10, 32)
+		if err != nil || size == 0 || size > maxChunkSize {
+			return nil, fmt.Errorf("netconf: invalid chunk size %q", header)
+		}
+		if size > uint64(t.maxSize-len(msg)) {
+			return nil, ErrMessageTooLarge
+		}
+		for remaining := int(size); remaining > 0; {
+			n := min(remaining, chunkReadSize)
+			start := len(msg)
+			msg = slices.Grow(msg, n)[:start+n]
+			if _, err := io.ReadFull(t.r, msg[start:]); err != nil {
+				if errors.Is(err, io.EOF) {
+					err = io.ErrUnexpectedEOF
+				}
+				return nil, err
+			}
+			remaining -= n
+		}
+	}
+}
+
+func (t *Transport) expect(s string) error {
+	for i := 0; i < len(s); i++ {
+		b, err := t.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if b != s[i] {
+			return fmt.Errorf("netconf: malformed chunk framing")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package server
+
+import (
+	"net"
+	"path"
+	"strconv"
+)
+
+// permitsHostPort reports whether host and port match one of the given
+// permit_open/permit_listen patterns. A nil list permits everything. Patterns
+// are "host:port" (or just "port", meaning any host); the host may use
+// shell-style wildcards and the port may be "*". The single entry "none"
+// denies everything.
+func permitsHostPort(patterns []string, host string, port uint32) bool {
+	if patterns == nil {
+		return true
+	}
+	for _, pattern := range patterns {
+		if pattern == "none" {
+			return false
+		}
+
+		patternHost, patternPort, err := net.SplitHostPort(pattern)
+		if err != nil {
+			patternHost, patternPort = "*", pattern
+		}
+		if patternPort != "*" && patternPort != strconv.Itoa(int(port)) {
+			continue
+		}
+		if ok, _ := path.Match(patternHost, host); ok {
+			return true
+		}
+	}
+	return false
+}
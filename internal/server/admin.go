@@ -0,0 +1,197 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// LogLevel is the log level reported and set by the admin API.
+type LogLevel struct {
+	Level string `json:"level"`
+}
+
+// SetLogLevel lets the admin API change level, the level of the server's
+// logger, at runtime.
+func (s *Server) SetLogLevel(level *slog.LevelVar) {
+	s.logLevel.Store(level)
+}
+
+// adminNetwork returns the network of an admin_listen address: "unix" for
+// paths, which start with "/", and "tcp" otherwise.
+func adminNetwork(address string) string {
+	if strings.HasPrefix(address, "/") {
+		return "unix"
+	}
+	return "tcp"
+}
+
+// listenAdmin binds admin_listen. Addresses starting with "/" are unix socket
+// paths, created with owner-only permissions. A stale socket left at the path
+// is replaced; any other file there is an error, not something to delete.
+func (s *Server) listenAdmin() (net.Listener, error) {
+	address := s.config().AdminListen
+	network := adminNetwork(address)
+	if network == "unix" {
+		stale, err := staleAdminSocket(address)
+		if err == nil && stale {
+			err = os.Remove(address)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("admin listen %s: %w", address, err)
+		}
+	}
+
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return nil, fmt.Errorf("admin listen %s: %w", address, err)
+	}
+	if network == "unix" {
+		if err := os.Chmod(address, 0600); err != nil {
+			_ = listener.Close()
+			return nil, fmt.Errorf("admin socket permissions: %w", err)
+		}
+	}
+	return listener, nil
+}
+
+// staleAdminSocket reports whether a socket is left at path, and fails if
+// anything other than a socket is there.
+func staleAdminSocket(path string) (bool, error) {
+	info, err := os.Lstat(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return false, nil
+	case err != nil:
+		return false, err
+	case info.Mode().Type() != fs.ModeSocket:
+		return false, errors.New("exists and is not a socket")
+	}
+	return true, nil
+}
+
+// serveAdmin serves the admin HTTP API on listener until ctx is cancelled.
+func (s *Server) serveAdmin(ctx context.Context, listener net.Listener) {
+	s.logger.Info("admin api listening", "address", listener.Addr().String())
+
+	httpSrv := &http.Server{
+		Handler:           s.adminHandler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = httpSrv.Shutdown(shutdownCtx)
+	}()
+
+	if err := httpSrv.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		s.logger.Error("admin api stopped", "err", err)
+	}
+}
+
+func (s *Server) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /tunnels", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, s.tunnels.snapshot())
+	})
+	mux.HandleFunc("GET /traffic", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, s.traffic.snapshot())
+	})
+	mux.HandleFunc("GET /reservations", func(w http.ResponseWriter, r *http.Request) {
+		if s.reservations == nil {
+			writeJSON(w, []Reservation{})
+			return
+		}
+		writeJSON(w, s.reservations.snapshot())
+	})
+	mux.HandleFunc("DELETE /reservations/{name}", func(w http.ResponseWriter, r *http.Request) {
+		if s.reservations == nil {
+			http.Error(w, "reservations are not enabled", http.StatusNotFound)
+			return
+		}
+		removed, err := s.reservations.remove(r.PathValue("name"))
+		switch {
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		case !removed:
+			http.Error(w, "no such reservation", http.StatusNotFound)
+		default:
+			s.logger.Info("reservation removed", "name", r.PathValue("name"))
+			w.WriteHeader(http.StatusNoContent)
+		}
+	})
+	mux.HandleFunc("GET /log-level", func(w http.ResponseWriter, r *http.Request) {
+		level := s.logLevel.Load()
+		if level == nil {
+			http.Error(w, "the log level cannot be changed", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, LogLevel{Level: level.Level().String()})
+	})
+	mux.HandleFunc("PUT /log-level", func(w http.ResponseWriter, r *http.Request) {
+		level := s.logLevel.Load()
+		if level == nil {
+			http.Error(w, "the log level cannot be changed", http.StatusNotFound)
+			return
+		}
+		var req LogLevel
+		var next slog.Level
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1024)).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := next.UnmarshalText([]byte(req.Level)); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		prev := level.Level()
+		level.Set(next)
+		// Logged at warn so the change shows at any level.
+		s.logger.Warn("log level changed", "from", prev.String(), "to", next.String(), "trigger", "admin api")
+		writeJSON(w, LogLevel{Level: next.String()})
+	})
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		s.writeMetrics(w)
+	})
+	mux.HandleFunc("GET /hostkeys", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, s.HostKeys())
+	})
+	mux.HandleFunc("POST /hostkeys/reload", func(w http.ResponseWriter, r *http.Request) {
+		if err := s.ReloadHostKeys(); err != nil {
+			s.logger.Error("reload host keys", "err", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, s.HostKeys())
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token := s.config().AdminToken; token != "" {
+			got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
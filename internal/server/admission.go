@@ -0,0 +1,177 @@
+package server
+
+import (
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/dollarkillerx/tinyssh/internal/config"
+)
+
+// admission is a connection that passed the admission checks, with the
+// ID, logger and trace span it carries from then on.
+type admission struct {
+	connID string
+	logger *slog.Logger
+	span   *span
+	// startup is set while the connection counts towards max_startups.
+	startup bool
+}
+
+// addrLimiter keeps a connection token bucket per source address.
+type addrLimiter struct {
+	limit rate.Limit
+	burst int
+
+	mu        sync.Mutex
+	buckets   map[netip.Prefix]*rate.Limiter
+	lastSweep time.Time
+}
+
+func newAddrLimiter(opts config.ConnectionRateOptions) *addrLimiter {
+	if !opts.Enabled() {
+		return nil
+	}
+	return &addrLimiter{
+		limit:   rate.Limit(float64(opts.PerMinute) / 60),
+		burst:   opts.Burst,
+		buckets: make(map[netip.Prefix]*rate.Limiter),
+	}
+}
+
+// allow takes a token from the bucket of addr's source. Addresses that are
+// not IP (e.g. unix sockets) are never limited.
+func (l *addrLimiter) allow(addr net.Addr) bool {
+	key, ok := limiterKey(addr)
+	if !ok {
+		return true
+	}
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// Buckets that have refilled are indistinguishable from new ones, so
+	// they are dropped to keep scanners from growing the map forever.
+	if now.Sub(l.lastSweep) > time.Minute {
+		for k, bucket := range l.buckets {
+			if bucket.TokensAt(now) >= float64(l.burst) {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = rate.NewLimiter(l.limit, l.burst)
+		l.buckets[key] = bucket
+	}
+	return bucket.AllowN(now, 1)
+}
+
+// addrIP returns the IP of a TCP address, with IPv4-mapped IPv6 addresses
+// unmapped.
+func addrIP(addr net.Addr) (netip.Addr, bool) {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return netip.Addr{}, false
+	}
+	ip, ok := netip.AddrFromSlice(tcpAddr.IP)
+	return ip.Unmap(), ok
+}
+
+// limiterKey returns the bucket for addr: the address itself for IPv4 and
+// its /64 for IPv6.
+func limiterKey(addr net.Addr) (netip.Prefix, bool) {
+	ip, ok := addrIP(addr)
+	if !ok {
+		return netip.Prefix{}, false
+	}
+	bits := 32
+	if ip.Is6() {
+		bits = 64
+	}
+	prefix, err := ip.Prefix(bits)
+	return prefix, err == nil
+}
+
+// admitCIDR enforces allow_cidrs and deny_cidrs. Connections without an
+// IP address, such as stdio ones, are admitted.
+func (s *Server) admitCIDR(conn net.Conn, logger *slog.Logger) bool {
+	ip, ok := addrIP(conn.RemoteAddr())
+	if !ok {
+		return true
+	}
+	cur := s.current.Load()
+	if prefixesContain(cur.denyNets, ip) || (cur.allowNets != nil && !prefixesContain(cur.allowNets, ip)) {
+		s.dropConnection(logger, conn, "cidr")
+		return false
+	}
+	return true
+}
+
+func prefixesContain(prefixes []netip.Prefix, ip netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// admitRate enforces connection_rate.
+func (s *Server) admitRate(conn net.Conn, logger *slog.Logger) bool {
+	if limiter := s.current.Load().connRate; limiter == nil || limiter.allow(conn.RemoteAddr()) {
+		return true
+	}
+	s.dropConnection(logger, conn, "connection_rate")
+	return false
+}
+
+// admitConnection enforces max_connections. Admitted connections call
+// endConnection when they close.
+func (s *Server) admitConnection(conn net.Conn, logger *slog.Logger) bool {
+	open := s.connections.Add(1)
+	if max := s.config().MaxConnections; max > 0 && open > int64(max) {
+		s.connections.Add(-1)
+		s.dropConnection(logger, conn, "max_connections", "open", open-1)
+		return false
+	}
+	return true
+}
+
+func (s *Server) endConnection() {
+	s.connections.Add(-1)
+}
+
+// admitStartup decides whether a newly accepted connection may start its
+// handshake, following OpenSSH's MaxStartups: below Start pending
+// handshakes everything is admitted, at Full nothing is, and in between
+// connections are dropped with a probability rising linearly from Rate%.
+// Admitted connections call endStartup once authenticated or failed.
+func (s *Server) admitStartup(conn net.Conn, logger *slog.Logger) bool {
+	limit := s.config().Startups()
+	pending := int(s.startups.Add(1)) - 1
+	drop := false
+	switch {
+	case limit.Full == 0 || pending < limit.Start:
+	case pending >= limit.Full:
+		drop = true
+	default:
+		p := limit.Rate + (100-limit.Rate)*(pending-limit.Start)/(limit.Full-limit.Start)
+		drop = rand.IntN(100) < p
+	}
+	if drop {
+		s.startups.Add(-1)
+		s.dropConnection(logger, conn, "max_startups", "pending", pending)
+	}
+	return !drop
+}
+
+func (s *Server) endStartup() {
+	s.startups.Add(-1)
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// loadAgentHostKeys returns signers for the agent keys with the given
+// SHA256 fingerprints, failing if any of them is not in the agent.
+func loadAgentHostKeys(socket string, fingerprints []string) ([]ssh.Signer, error) {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, fmt.Errorf("connect to ssh-agent: %w", err)
+	}
+	defer conn.Close()
+
+	keys, err := agent.NewClient(conn).List()
+	if err != nil {
+		return nil, fmt.Errorf("list ssh-agent keys: %w", err)
+	}
+
+	signers := make([]ssh.Signer, 0, len(fingerprints))
+	for _, fp := range fingerprints {
+		var found ssh.PublicKey
+		for _, key := range keys {
+			if ssh.FingerprintSHA256(key) == fp {
+				found = key
+				break
+			}
+		}
+		if found == nil {
+			return nil, fmt.Errorf("ssh-agent has no key %s", fp)
+		}
+		pub, err := ssh.ParsePublicKey(found.Marshal())
+		if err != nil {
+			return nil, fmt.Errorf("parse ssh-agent key %s: %w", fp, err)
+		}
+		signers = append(signers, &agentSigner{socket: socket, pub: pub})
+	}
+	return signers, nil
+}
+
+// agentSigner signs with a key held by an ssh-agent. It connects for every
+// signature, so an agent restart does not break the server as long as the
+// key is loaded again.
+type agentSigner struct {
+	socket string
+	pub    ssh.PublicKey
+}
+
+func (s *agentSigner) PublicKey() ssh.PublicKey {
+	return s.pub
+}
+
+func (s *agentSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	return s.SignWithAlgorithm(rand, data, "")
+}
+
+// SignWithAlgorithm lets RSA agent keys serve the rsa-sha2-256 and
+// rsa-sha2-512 host key algorithms.
+func (s *agentSigner) SignWithAlgorithm(_ io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	var flags agent.SignatureFlags
+	switch algorithm {
+	case ssh.KeyAlgoRSASHA256:
+		flags = agent.SignatureFlagRsaSha256
+	case ssh.KeyAlgoRSASHA512:
+		flags = agent.SignatureFlagRsaSha512
+	}
+
+	conn, err := net.Dial("unix", s.socket)
+	if err != nil {
+		return nil, fmt.Errorf("connect to ssh-agent: %w", err)
+	}
+	defer conn.Close()
+
+	client, ok := agent.NewClient(conn).(agent.ExtendedAgent)
+	if !ok {
+		return nil, fmt.Errorf("ssh-agent client does not support signature flags")
+	}
+	return client.SignWithFlags(s.pub, data, flags)
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+)
+
+// dialForward opens the outbound TCP connection for a direct-tcpip channel
+// according to forward_dial, optionally through an upstream proxy, retrying
+// failed attempts.
+func (s *Server) dialForward(ctx context.Context, address string, logger *slog.Logger) (net.Conn, error) {
+	opts := s.config().ForwardDial
+	dialer := net.Dialer{
+		Timeout:   time.Duration(opts.Timeout) * time.Second,
+		KeepAlive: time.Duration(opts.KeepAlive) * time.Second,
+		Control:   s.controlDial,
+	}
+	if opts.SourceAddress != "" {
+		dialer.LocalAddr = &net.TCPAddr{IP: net.ParseIP(opts.SourceAddress)}
+	}
+
+	for attempt := 0; ; attempt++ {
+		conn, err := s.dialOnce(ctx, &dialer, address)
+		if err == nil {
+			return conn, nil
+		}
+		if attempt >= opts.Retries {
+			return nil, err
+		}
+
+		logger.Debug("forward dial retry", "dest", address, "attempt", attempt+1, "err", err)
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(time.Duration(opts.RetryDelay) * time.Second):
+		}
+	}
+}
+
+func (s *Server) dialOnce(ctx context.Context, dialer *net.Dialer, address string) (net.Conn, error) {
+	proxy := s.current.Load().forwardProxy
+	if proxy == nil {
+		conn, err := dialer.DialContext(ctx, s.config().Network(), address)
+		if err != nil {
+			return nil, err
+		}
+		tuneTCP(conn, s.config().TCP)
+		return conn, nil
+	}
+
+	conn, err := dialer.DialContext(ctx, s.config().Network(), proxy.Host)
+	if err != nil {
+		return nil, fmt.Errorf("dial proxy %s: %w", proxy.Host, err)
+	}
+	tuneTCP(conn, s.config().TCP)
+	tunnel, err := connectViaProxy(conn, proxy, address, dialer.Timeout)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return tunnel, nil
+}
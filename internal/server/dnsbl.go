@@ -0,0 +1,166 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dollarkillerx/tinyssh/internal/config"
+)
+
+// tarpitInterval is how often a tarpitted client receives another line.
+const tarpitInterval = 10 * time.Second
+
+// dnsbl checks client addresses against DNS blocklists and caches the
+// answers.
+type dnsbl struct {
+	zones   []string
+	timeout time.Duration
+	ttl     time.Duration
+
+	mu        sync.Mutex
+	cache     map[netip.Addr]dnsblEntry
+	lastSweep time.Time
+}
+
+type dnsblEntry struct {
+	// zone is the blocklist listing the address, or "" if none does.
+	zone    string
+	expires time.Time
+}
+
+func newDNSBL(opts config.DNSBLOptions) *dnsbl {
+	if !opts.Enabled() {
+		return nil
+	}
+	return &dnsbl{
+		zones:   opts.Zones,
+		timeout: time.Duration(opts.Timeout) * time.Second,
+		ttl:     time.Duration(opts.CacheTTL) * time.Second,
+		cache:   make(map[netip.Addr]dnsblEntry),
+	}
+}
+
+// listed returns the zone listing ip, or "" when none does. Failed lookups
+// count as not listed and are not cached.
+func (d *dnsbl) listed(ctx context.Context, ip netip.Addr) string {
+	now := time.Now()
+	d.mu.Lock()
+	entry, ok := d.cache[ip]
+	d.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.zone
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	type result struct {
+		zone string
+		err  error
+	}
+	results := make(chan result, len(d.zones))
+	for _, zone := range d.zones {
+		go func() {
+			_, err := net.DefaultResolver.LookupHost(ctx, dnsblName(ip, zone))
+			var dnsErr *net.DNSError
+			if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+				results <- result{}
+				return
+			}
+			results <- result{zone: zone, err: err}
+		}()
+	}
+	var zone string
+	var failed bool
+	for range d.zones {
+		r := <-results
+		switch {
+		case r.err != nil:
+			failed = true
+		case r.zone != "" && zone == "":
+			zone = r.zone
+		}
+	}
+	if zone == "" && failed {
+		return ""
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if now.Sub(d.lastSweep) > time.Minute {
+		for addr, entry := range d.cache {
+			if now.After(entry.expires) {
+				delete(d.cache, addr)
+			}
+		}
+		d.lastSweep = now
+	}
+	d.cache[ip] = dnsblEntry{zone: zone, expires: now.Add(d.ttl)}
+	return zone
+}
+
+// dnsblName returns the name to look up for ip in zone: the IPv4 octets or
+// IPv6 nibbles in reverse order, e.g. "4.3.2.1.dnsbl.example" for 1.2.3.4.
+func dnsblName(ip netip.Addr, zone string) string {
+	var labels []string
+	if ip.Is4() {
+		for _, b := range ip.As4() {
+			labels = append(labels, fmt.Sprint(b))
+		}
+	} else {
+		for _, b := range ip.As16() {
+			labels = append(labels, fmt.Sprintf("%x", b>>4), fmt.Sprintf("%x", b&0x0f))
+		}
+	}
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	return strings.Join(labels, ".") + "." + strings.TrimSuffix(zone, ".")
+}
+
+// admitDNSBL rejects or tarpits clients whose address is on a configured
+// blocklist. It returns once a tarpitted client has gone.
+func (s *Server) admitDNSBL(ctx context.Context, conn net.Conn, logger *slog.Logger) bool {
+	cur := s.current.Load()
+	if cur.dnsbl == nil {
+		return true
+	}
+	ip, ok := addrIP(conn.RemoteAddr())
+	if !ok {
+		return true
+	}
+	zone := cur.dnsbl.listed(ctx, ip)
+	if zone == "" {
+		return true
+	}
+	s.dropConnection(logger, conn, "dnsbl", "zone", zone, "action", cur.cfg.DNSBL.Action)
+	if cur.cfg.DNSBL.Action == config.DNSBLTarpit {
+		tarpit(ctx, conn)
+	}
+	return false
+}
+
+// tarpit keeps conn busy until the client or the server gives up. Servers
+// may send other lines before their version string (RFC 4253, section
+// 4.2), so clients keep waiting as long as random lines trickle in.
+func tarpit(ctx context.Context, conn net.Conn) {
+	ticker := time.NewTicker(tarpitInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := fmt.Fprintf(conn, "%x\r\n", rand.Uint64()); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/dollarkillerx/tinyssh/internal/config"
+)
+
+// DryRun goes through the startup New and Run would perform for cfg
+// without serving or changing anything: it loads the host keys (missing
+// files are reported, not generated), derives the listener settings and
+// binds every listening address once to check it is free. What would
+// happen is logged to logger, and every problem found is returned.
+func DryRun(cfg *config.Config, logger *slog.Logger) error {
+	var errs []error
+
+	signers, sources, err := dryRunFileHostKeys(cfg, logger)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	external, externalSources, err := loadExternalHostKeys(cfg)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	for i, signer := range external {
+		logger.Info("host key", "source", externalSources[i], "type", signer.PublicKey().Type(), "fingerprint", ssh.FingerprintSHA256(signer.PublicKey()))
+	}
+	if err := checkHostKeys(slices.Concat(signers, external), slices.Concat(sources, externalSources), cfg.Policy()); err != nil {
+		errs = append(errs, err)
+	}
+
+	if _, err := newSettings(cfg, nil); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.Reservations.Enabled() {
+		if _, err := loadReservations(cfg.Reservations); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	probe := func(kind, address, network string) {
+		listener, err := net.Listen(network, address)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s listen %s: %w", kind, address, err))
+			return
+		}
+		_ = listener.Close()
+		logger.Info("would listen", "kind", kind, "address", address)
+	}
+	for _, l := range cfg.SSHListeners() {
+		probe("ssh", l.Address, cfg.Network())
+	}
+	switch {
+	case cfg.AdminListen == "":
+	case adminNetwork(cfg.AdminListen) == "unix":
+		// Binding would replace the socket of a running server, so only
+		// check that the socket can be created.
+		_, err := staleAdminSocket(cfg.AdminListen)
+		if err == nil {
+			err = dirWritable(filepath.Dir(cfg.AdminListen))
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("admin listen %s: %w", cfg.AdminListen, err))
+		} else {
+			logger.Info("would listen", "kind", "admin", "address", cfg.AdminListen)
+		}
+	default:
+		probe("admin", cfg.AdminListen, "tcp")
+	}
+	if cfg.VHost.Listen != "" {
+		probe("vhost", cfg.VHost.Listen, "tcp")
+	}
+	if cfg.WebTerminal.Listen != "" {
+		probe("web terminal", cfg.WebTerminal.Listen, "tcp")
+	}
+	return errors.Join(errs...)
+}
+
+// dirWritable reports whether files can be created in dir.
+func dirWritable(dir string) error {
+	f, err := os.CreateTemp(dir, ".tinyssh-dry-run-*")
+	if err != nil {
+		return err
+	}
+	_ = f.Close()
+	return os.Remove(f.Name())
+}
+
+// dryRunFileHostKeys reads the host_key_paths files of cfg, logging each
+// key and the files New would generate.
+func dryRunFileHostKeys(cfg *config.Config, logger *slog.Logger) ([]ssh.Signer, []string, error) {
+	passphrase, err := cfg.HostKeyPassphraseBytes()
+	if err != nil {
+		return nil, nil, err
+	}
+	var signers []ssh.Signer
+	var sources []string
+	for _, path := range cfg.HostKeyPaths {
+		pemBytes, err := os.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			logger.Info("host key would be generated", "path", path, "type", cfg.KeyTypeFor(path))
+			continue
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: read host key: %w", path, err)
+		}
+		signer, err := parseHostKey(pemBytes, passphrase)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", path, err)
+		}
+		logger.Info("host key", "source", path, "type", signer.PublicKey().Type(), "fingerprint", ssh.FingerprintSHA256(signer.PublicKey()))
+		signers = append(signers, signer)
+		sources = append(sources, path)
+	}
+	return signers, sources, nil
+}
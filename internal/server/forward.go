@@ -0,0 +1,497 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/dollarkillerx/tinyssh/internal/config"
+	"github.com/dollarkillerx/tinyssh/internal/logging"
+)
+
+// forwarder implements port forwarding for one connection: direct-tcpip and
+// direct-streamlocal channels opened by the client (ssh -L) and tcpip-forward
+// and streamlocal-forward listeners whose connections are handed back to the
+// client (ssh -R).
+type forwarder struct {
+	srv     *Server
+	conn    *ssh.ServerConn
+	account config.User
+	logger  *slog.Logger
+	// span traces the connection; forwards are traced within it.
+	span *span
+
+	mu        sync.Mutex
+	listeners map[string]net.Listener
+}
+
+func newForwarder(srv *Server, conn *ssh.ServerConn, account config.User, span *span, logger *slog.Logger) *forwarder {
+	return &forwarder{
+		srv:       srv,
+		conn:      conn,
+		account:   account,
+		logger:    logger,
+		span:      span,
+		listeners: make(map[string]net.Listener),
+	}
+}
+
+// permitted reports whether the account may use the given forwarding
+// request, logging the refusal.
+func (f *forwarder) permitted(kind string) bool {
+	var reason string
+	switch {
+	case f.account.SFTPOnly:
+		reason = "sftp only"
+	case kind == "direct-tcpip" && !f.account.AllowsLocalForwarding():
+		reason = "local forwarding disabled"
+	case kind == "tcpip-forward" && !f.account.AllowsRemoteForwarding():
+		reason = "remote forwarding disabled"
+	case kind == "direct-streamlocal" && !f.account.AllowsLocalStreamForwarding():
+		reason = "local socket forwarding disabled"
+	case kind == "streamlocal-forward" && !f.account.AllowsRemoteStreamForwarding():
+		reason = "remote socket forwarding disabled"
+	case kind == "tun" && !f.account.AllowsTunnel():
+		reason = "tunnel forwarding disabled"
+	default:
+		return true
+	}
+	f.logger.Warn("forwarding denied", "user", f.conn.User(), "request", kind, "reason", reason)
+	return false
+}
+
+// handleDirect serves a direct-tcpip channel by dialing the requested
+// destination and proxying data in both directions.
+func (f *forwarder) handleDirect(ctx context.Context, newChannel ssh.NewChannel) {
+	var payload struct {
+		DestAddr   string
+		DestPort   uint32
+		OriginAddr string
+		OriginPort uint32
+	}
+	if err := ssh.Unmarshal(newChannel.ExtraData(), &payload); err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, "malformed direct-tcpip request")
+		return
+	}
+	dest := net.JoinHostPort(payload.DestAddr, strconv.Itoa(int(payload.DestPort)))
+	sp := f.span.child("ssh.forward direct-tcpip", spanKindClient, "tinyssh.forward.target", dest)
+	defer sp.finish()
+	if !permitsHostPort(f.account.PermitOpen, payload.DestAddr, payload.DestPort) {
+		f.logger.Warn("direct-tcpip destination denied", "user", f.conn.User(), "dest", dest)
+		sp.fail(errors.New("destination not permitted"))
+		newChannel.Reject(ssh.Prohibited, "destination not permitted")
+		return
+	}
+
+	conn, err := f.srv.dialForward(ctx, dest, f.logger)
+	if err != nil {
+		sp.fail(err)
+		f.logger.Warn("direct-tcpip dial failed", "user", f.conn.User(), "dest", dest, "err", err)
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		_ = conn.Close()
+		f.logger.Error("channel accept", "err", err)
+		return
+	}
+	go ssh.DiscardRequests(requests)
+
+	f.logger.Info("direct-tcpip opened", logging.EventKey, logging.EventForward, "user", f.conn.User(), "dest", dest)
+	t := f.srv.tunnels.add("direct-tcpip", f.conn.User(), f.conn.RemoteAddr().String(), dest)
+	defer f.srv.tunnels.remove(t)
+	in, out := f.proxy(channel, conn, t)
+	sp.set("tinyssh.forward.bytes_in", in, "tinyssh.forward.bytes_out", out)
+	f.logger.Debug("direct-tcpip closed", "user", f.conn.User(), "dest", dest)
+}
+
+// handleTCPIPForward starts a listener for a tcpip-forward global request.
+func (f *forwarder) handleTCPIPForward(req *ssh.Request) {
+	var payload struct {
+		BindAddr string
+		BindPort uint32
+	}
+	if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+		req.Reply(false, nil)
+		return
+	}
+
+	// With reservations enabled, "ssh -R name:0:..." binds the port
+	// reserved for name on the address an unspecified bind would use.
+	bindHost, bindPort := f.bindHost(payload.BindAddr), payload.BindPort
+	reserved := ""
+	if f.srv.reservations != nil && payload.BindPort == 0 && isReservationName(payload.BindAddr) {
+		port, err := f.srv.reservations.claim(f.conn.User(), payload.BindAddr)
+		if err != nil {
+			f.logger.Warn("tcpip-forward reservation failed", "user", f.conn.User(), "name", payload.BindAddr, "err", err)
+			req.Reply(false, nil)
+			return
+		}
+		reserved = payload.BindAddr
+		bindHost, bindPort = f.bindHost(""), uint32(port)
+	}
+	release := func() {
+		if reserved != "" {
+			f.srv.reservations.release(reserved)
+		}
+	}
+
+	addr := net.JoinHostPort(payload.BindAddr, strconv.Itoa(int(bindPort)))
+	if !permitsHostPort(f.account.PermitListen, payload.BindAddr, bindPort) {
+		f.logger.Warn("tcpip-forward address denied", "user", f.conn.User(), "address", addr)
+		release()
+		req.Reply(false, nil)
+		return
+	}
+
+	var (
+		listener net.Listener
+		port     uint32
+	)
+	if f.srv.config().VHost.Listen != "" && payload.BindPort == vhostPort && isReservationName(payload.BindAddr) {
+		// Served by the HTTP front end as <name>.<domain> instead of a port.
+		if owner := f.srv.reservations.owner(payload.BindAddr); owner != "" && owner != f.conn.User() {
+			f.logger.Warn("vhost forward denied", "user", f.conn.User(), "name", payload.BindAddr, "reason", "reserved by another user")
+			req.Reply(false, nil)
+			return
+		}
+		vl, err := f.srv.vhosts.listen(payload.BindAddr)
+		if err != nil {
+			f.logger.Warn("vhost forward failed", "user", f.conn.User(), "err", err)
+			req.Reply(false, nil)
+			return
+		}
+		listener, port = vl, vhostPort
+	} else {
+		listenAddr := net.JoinHostPort(bindHost, strconv.Itoa(int(bindPort)))
+		tcpListener, err := net.Listen(f.srv.config().Network(), listenAddr)
+		if err != nil {
+			f.logger.Warn("tcpip-forward listen failed", "user", f.conn.User(), "address", listenAddr, "err", err)
+			release()
+			req.Reply(false, nil)
+			return
+		}
+		listener, port = tcpListener, uint32(tcpListener.Addr().(*net.TCPAddr).Port)
+	}
+
+	key := forwardKey(payload.BindAddr, port)
+
+	f.mu.Lock()
+	if _, exists := f.listeners[key]; exists {
+		f.mu.Unlock()
+		_ = listener.Close()
+		release()
+		req.Reply(false, nil)
+		return
+	}
+	f.listeners[key] = listener
+	f.mu.Unlock()
+
+	var reply []byte
+	if payload.BindPort == 0 {
+		reply = ssh.Marshal(struct{ Port uint32 }{Port: port})
+	}
+	req.Reply(true, reply)
+
+	f.logger.Info("tcpip-forward listening", logging.EventKey, logging.EventForward, "user", f.conn.User(), "address", listener.Addr().String(), "reservation", reserved)
+	f.span.event("tcpip-forward", "tinyssh.forward.address", listener.Addr().String())
+	t := f.srv.tunnels.add("tcpip-forward", f.conn.User(), f.conn.RemoteAddr().String(), listener.Addr().String())
+	go func() {
+		f.acceptForwarded(listener, payload.BindAddr, port, t)
+		release()
+	}()
+}
+
+// bindHost maps the address requested for a remote forward to the one
+// actually bound, according to gateway_ports.
+func (f *forwarder) bindHost(requested string) string {
+	switch f.srv.config().GatewayPorts {
+	case config.GatewayPortsYes:
+		return ""
+	case config.GatewayPortsClientSpecified:
+		if requested == "*" {
+			return ""
+		}
+		return requested
+	default:
+		return "localhost"
+	}
+}
+
+// handleCancelTCPIPForward stops a listener started by tcpip-forward.
+func (f *forwarder) handleCancelTCPIPForward(req *ssh.Request) {
+	var payload struct {
+		BindAddr string
+		BindPort uint32
+	}
+	if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+		req.Reply(false, nil)
+		return
+	}
+
+	key := forwardKey(payload.BindAddr, payload.BindPort)
+	f.mu.Lock()
+	listener, ok := f.listeners[key]
+	delete(f.listeners, key)
+	f.mu.Unlock()
+
+	if ok {
+		_ = listener.Close()
+		f.logger.Info("tcpip-forward cancelled", "user", f.conn.User(), "address", listener.Addr().String())
+		f.span.event("cancel-tcpip-forward", "tinyssh.forward.address", listener.Addr().String())
+	}
+	req.Reply(ok, nil)
+}
+
+func (f *forwarder) acceptForwarded(listener net.Listener, bindAddr string, port uint32, t *tunnel) {
+	defer f.srv.tunnels.remove(t)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go f.openForwarded(conn, bindAddr, port, t)
+	}
+}
+
+func (f *forwarder) openForwarded(conn net.Conn, bindAddr string, port uint32, t *tunnel) {
+	origin := conn.RemoteAddr().(*net.TCPAddr)
+	payload := ssh.Marshal(struct {
+		Addr       string
+		Port       uint32
+		OriginAddr string
+		OriginPort uint32
+	}{
+		Addr:       bindAddr,
+		Port:       port,
+		OriginAddr: origin.IP.String(),
+		OriginPort: uint32(origin.Port),
+	})
+	sp := f.span.child("ssh.forward forwarded-tcpip", spanKindServer, "tinyssh.forward.target", t.target, "tinyssh.forward.origin", origin.String())
+	defer sp.finish()
+
+	channel, requests, err := f.conn.OpenChannel("forwarded-tcpip", payload)
+	if err != nil {
+		sp.fail(err)
+		_ = conn.Close()
+		f.logger.Warn("forwarded-tcpip open failed", "user", f.conn.User(), "origin", origin.String(), "err", err)
+		return
+	}
+	go ssh.DiscardRequests(requests)
+
+	in, out := f.proxy(channel, conn, t)
+	sp.set("tinyssh.forward.bytes_in", in, "tinyssh.forward.bytes_out", out)
+}
+
+// handleDirectStreamLocal serves a direct-streamlocal@openssh.com channel by
+// connecting to the requested unix socket.
+func (f *forwarder) handleDirectStreamLocal(ctx context.Context, newChannel ssh.NewChannel) {
+	var payload struct {
+		SocketPath string
+		Reserved0  string
+		Reserved1  uint32
+	}
+	if err := ssh.Unmarshal(newChannel.ExtraData(), &payload); err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, "malformed direct-streamlocal request")
+		return
+	}
+
+	sp := f.span.child("ssh.forward direct-streamlocal", spanKindClient, "tinyssh.forward.target", payload.SocketPath)
+	defer sp.finish()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "unix", payload.SocketPath)
+	if err != nil {
+		sp.fail(err)
+		f.logger.Warn("direct-streamlocal dial failed", "user", f.conn.User(), "socket", payload.SocketPath, "err", err)
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		_ = conn.Close()
+		f.logger.Error("channel accept", "err", err)
+		return
+	}
+	go ssh.DiscardRequests(requests)
+
+	f.logger.Info("direct-streamlocal opened", logging.EventKey, logging.EventForward, "user", f.conn.User(), "socket", payload.SocketPath)
+	t := f.srv.tunnels.add("direct-streamlocal", f.conn.User(), f.conn.RemoteAddr().String(), payload.SocketPath)
+	defer f.srv.tunnels.remove(t)
+	in, out := f.proxy(channel, conn, t)
+	sp.set("tinyssh.forward.bytes_in", in, "tinyssh.forward.bytes_out", out)
+	f.logger.Debug("direct-streamlocal closed", "user", f.conn.User(), "socket", payload.SocketPath)
+}
+
+// handleStreamLocalForward starts a unix socket listener for a
+// streamlocal-forward@openssh.com global request.
+func (f *forwarder) handleStreamLocalForward(req *ssh.Request) {
+	var payload struct {
+		SocketPath string
+	}
+	if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+		req.Reply(false, nil)
+		return
+	}
+
+	key := streamLocalKey(payload.SocketPath)
+	f.mu.Lock()
+	if _, exists := f.listeners[key]; exists {
+		f.mu.Unlock()
+		req.Reply(false, nil)
+		return
+	}
+	listener, err := net.Listen("unix", payload.SocketPath)
+	if err != nil {
+		f.mu.Unlock()
+		f.logger.Warn("streamlocal-forward listen failed", "user", f.conn.User(), "socket", payload.SocketPath, "err", err)
+		req.Reply(false, nil)
+		return
+	}
+	f.listeners[key] = listener
+	f.mu.Unlock()
+
+	req.Reply(true, nil)
+
+	f.logger.Info("streamlocal-forward listening", logging.EventKey, logging.EventForward, "user", f.conn.User(), "socket", payload.SocketPath)
+	f.span.event("streamlocal-forward", "tinyssh.forward.address", payload.SocketPath)
+	t := f.srv.tunnels.add("streamlocal-forward", f.conn.User(), f.conn.RemoteAddr().String(), payload.SocketPath)
+	go func() {
+		defer f.srv.tunnels.remove(t)
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go f.openForwardedStreamLocal(conn, payload.SocketPath, t)
+		}
+	}()
+}
+
+// handleCancelStreamLocalForward stops a listener started by
+// streamlocal-forward@openssh.com.
+func (f *forwarder) handleCancelStreamLocalForward(req *ssh.Request) {
+	var payload struct {
+		SocketPath string
+	}
+	if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+		req.Reply(false, nil)
+		return
+	}
+
+	key := streamLocalKey(payload.SocketPath)
+	f.mu.Lock()
+	listener, ok := f.listeners[key]
+	delete(f.listeners, key)
+	f.mu.Unlock()
+
+	if ok {
+		_ = listener.Close()
+		f.logger.Info("streamlocal-forward cancelled", "user", f.conn.User(), "socket", payload.SocketPath)
+		f.span.event("cancel-streamlocal-forward", "tinyssh.forward.address", payload.SocketPath)
+	}
+	req.Reply(ok, nil)
+}
+
+func (f *forwarder) openForwardedStreamLocal(conn net.Conn, socketPath string, t *tunnel) {
+	payload := ssh.Marshal(struct {
+		SocketPath string
+		Reserved   string
+	}{SocketPath: socketPath})
+	sp := f.span.child("ssh.forward forwarded-streamlocal", spanKindServer, "tinyssh.forward.target", socketPath)
+	defer sp.finish()
+
+	channel, requests, err := f.conn.OpenChannel("forwarded-streamlocal@openssh.com", payload)
+	if err != nil {
+		sp.fail(err)
+		_ = conn.Close()
+		f.logger.Warn("forwarded-streamlocal open failed", "user", f.conn.User(), "socket", socketPath, "err", err)
+		return
+	}
+	go ssh.DiscardRequests(requests)
+
+	in, out := f.proxy(channel, conn, t)
+	sp.set("tinyssh.forward.bytes_in", in, "tinyssh.forward.bytes_out", out)
+}
+
+// closeAll stops every remote-forward listener of the connection. Unix
+// socket listeners remove their socket file when closed.
+func (f *forwarder) closeAll() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for key, listener := range f.listeners {
+		_ = listener.Close()
+		delete(f.listeners, key)
+	}
+}
+
+func forwardKey(addr string, port uint32) string {
+	return fmt.Sprintf("%s:%d", addr, port)
+}
+
+func streamLocalKey(socketPath string) string {
+	return "unix:" + socketPath
+}
+
+// proxy copies data between the client's channel and conn until both
+// directions are done, propagating half-closes, then closes both ends.
+// Transferred bytes are added to t's counters and each direction is limited
+// to the account's forward_rate_limit as well as the server-wide limits.
+// It returns the bytes copied from the channel to conn and back.
+func (f *forwarder) proxy(channel ssh.Channel, conn net.Conn, t *tunnel) (in, out int64) {
+	cur := f.srv.current.Load()
+	toConn := throttle(countingWriter[int64]{w: conn, n: &t.bytesIn}, newByteLimiter(f.account.ForwardRateLimit), cur.ingress)
+	toChannel := throttle(countingWriter[int64]{w: channel, n: &t.bytesOut}, newByteLimiter(f.account.ForwardRateLimit), cur.egress)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		in, _ = copyPooled(toConn, channel)
+		if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+			_ = cw.CloseWrite()
+		} else {
+			_ = conn.Close()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		out, _ = copyPooled(toChannel, conn)
+		_ = channel.CloseWrite()
+	}()
+
+	wg.Wait()
+	_ = channel.Close()
+	_ = conn.Close()
+	return in, out
+}
+
+// copyBufferPool recycles the buffers used to proxy forwarded channels, so
+// short-lived tunnels don't allocate fresh buffers for every connection.
+var copyBufferPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, 32*1024)
+		return &buf
+	},
+}
+
+// copyPooled copies src to dst through a pooled buffer. One end of a forward
+// is always an SSH channel whose data is encrypted in user space, so the
+// kernel's splice/sendfile paths cannot apply; the WriterTo/ReaderFrom fast
+// paths are hidden because they would only fall back to allocating their own
+// buffer.
+func copyPooled(dst io.Writer, src io.Reader) (int64, error) {
+	buf := copyBufferPool.Get().(*[]byte)
+	defer copyBufferPool.Put(buf)
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, *buf)
+}
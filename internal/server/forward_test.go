@@ -0,0 +1,34 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// benchTunnelSize is the data one short-lived forwarded connection carries.
+const benchTunnelSize = 16 * 1024
+
+// BenchmarkCopyPooled compares copyPooled with a plain io.Copy for many
+// short tunnels copied concurrently. Neither end offers WriterTo or
+// ReaderFrom, like the SSH channel on one side of every forward, so io.Copy
+// allocates a 32 KiB buffer per call.
+func BenchmarkCopyPooled(b *testing.B) {
+	payload := make([]byte, benchTunnelSize)
+	bench := func(b *testing.B, copyFn func(io.Writer, io.Reader) (int64, error)) {
+		b.SetBytes(benchTunnelSize)
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			src := bytes.NewReader(payload)
+			for pb.Next() {
+				src.Reset(payload)
+				if _, err := copyFn(struct{ io.Writer }{io.Discard}, struct{ io.Reader }{src}); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+	}
+	b.Run("io.Copy", func(b *testing.B) { bench(b, io.Copy) })
+	b.Run("copyPooled", func(b *testing.B) { bench(b, copyPooled) })
+}
@@ -0,0 +1,248 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/dollarkillerx/tinyssh/internal/config"
+)
+
+// Permission extensions recorded at authentication time.
+const (
+	permUser     = "tinyssh-user"
+	permUpstream = "tinyssh-upstream"
+)
+
+// splitLogin separates a login name of the form "user@upstream" into the
+// local account and the requested upstream. Names that match an account
+// as a whole are never split.
+func (s *Server) splitLogin(login string) (string, string) {
+	if _, ok := s.current.Load().users[login]; ok {
+		return login, ""
+	}
+	if i := strings.LastIndex(login, "@"); i > 0 {
+		return login[:i], login[i+1:]
+	}
+	return login, ""
+}
+
+// routeFor returns the upstream a login should be spliced to, or "" for a
+// local session.
+func routeFor(account config.User, requested string) (string, error) {
+	if requested == "" {
+		return account.Upstream, nil
+	}
+	if requested == account.Upstream {
+		return requested, nil
+	}
+	for _, name := range account.Upstreams {
+		if name == requested {
+			return requested, nil
+		}
+	}
+	return "", fmt.Errorf("upstream %s not permitted for %s", requested, account.Username)
+}
+
+// dialUpstream connects and authenticates to an upstream SSH server,
+// verifying its host key against the configured one.
+func (s *Server) dialUpstream(ctx context.Context, name, login string, logger *slog.Logger) (ssh.Conn, <-chan ssh.NewChannel, <-chan *ssh.Request, error) {
+	target := s.config().Upstreams[name]
+
+	hostKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(target.HostKey))
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("upstream %s host key: %w", name, err)
+	}
+
+	var auth []ssh.AuthMethod
+	if target.IdentityFile != "" {
+		pemBytes, err := os.ReadFile(target.IdentityFile)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("upstream %s identity: %w", name, err)
+		}
+		signer, err := ssh.ParsePrivateKey(pemBytes)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("upstream %s identity: %w", name, err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if target.Password != "" {
+		auth = append(auth, ssh.Password(target.Password))
+	}
+
+	user := target.User
+	if user == "" {
+		user = login
+	}
+
+	netConn, err := s.dialForward(ctx, target.Address, logger)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("dial upstream %s: %w", name, err)
+	}
+	clientCfg := &ssh.ClientConfig{
+		Config:          ssh.Config{RekeyThreshold: uint64(s.config().RekeyThreshold)},
+		User:            user,
+		Auth:            auth,
+		HostKeyCallback: ssh.FixedHostKey(hostKey),
+		Timeout:         time.Duration(s.config().ForwardDial.Timeout) * time.Second,
+	}
+	conn, channels, requests, err := ssh.NewClientConn(netConn, target.Address, clientCfg)
+	if err != nil {
+		_ = netConn.Close()
+		return nil, nil, nil, fmt.Errorf("upstream %s handshake: %w", name, err)
+	}
+	return conn, channels, requests, nil
+}
+
+// handleGateway splices a client connection through to an upstream SSH
+// server: every channel and global request is relayed in both directions,
+// and channel opens plus shell/exec/subsystem requests are logged.
+func (s *Server) handleGateway(ctx context.Context, client *ssh.ServerConn, clientChannels <-chan ssh.NewChannel, clientRequests <-chan *ssh.Request, login, name string, logger *slog.Logger) error {
+	upstream, upstreamChannels, upstreamRequests, err := s.dialUpstream(ctx, name, login, logger)
+	if err != nil {
+		return err
+	}
+	defer upstream.Close()
+	logger.Info("gateway connected", "user", client.User(), "upstream", name, "address", upstream.RemoteAddr().String())
+
+	// Host key updates concern this server, not the upstream: answer the
+	// client's proofs here and keep the upstream's announcements to
+	// ourselves.
+	go relayGlobalRequests(clientRequests, upstream, func(req *ssh.Request) bool {
+		if req.Type != hostKeysProveRequest {
+			return false
+		}
+		payload, err := s.proveHostKeys(client, req.Payload)
+		req.Reply(err == nil, payload)
+		return true
+	})
+	go relayGlobalRequests(upstreamRequests, client, func(req *ssh.Request) bool {
+		return req.Type == hostKeysRequest
+	})
+
+	go func() {
+		for newChannel := range upstreamChannels {
+			go relayChannel(newChannel, client, nil, logger)
+		}
+	}()
+
+	go func() {
+		// Tear down the client side when the upstream goes away.
+		_ = upstream.Wait()
+		_ = client.Close()
+	}()
+
+	audit := func(channelType string, req *ssh.Request) {
+		switch req.Type {
+		case "shell", "exec", "subsystem":
+			var payload struct{ Value string }
+			_ = ssh.Unmarshal(req.Payload, &payload)
+			logger.Info("gateway request", "user", client.User(), "upstream", name, "channel", channelType, "request", req.Type, "command", payload.Value)
+		}
+	}
+	for newChannel := range clientChannels {
+		logger.Info("gateway channel", "user", client.User(), "upstream", name, "channel", newChannel.ChannelType())
+		go relayChannel(newChannel, upstream, audit, logger)
+	}
+
+	return nil
+}
+
+// relayChannel opens the same channel on the other connection and, if that
+// succeeds, splices the two.
+func relayChannel(newChannel ssh.NewChannel, peer ssh.Conn, audit func(string, *ssh.Request), logger *slog.Logger) {
+	peerChannel, peerRequests, err := peer.OpenChannel(newChannel.ChannelType(), newChannel.ExtraData())
+	if err != nil {
+		if openErr, ok := err.(*ssh.OpenChannelError); ok {
+			newChannel.Reject(openErr.Reason, openErr.Message)
+		} else {
+			newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		}
+		return
+	}
+
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		_ = peerChannel.Close()
+		logger.Error("channel accept", "err", err)
+		return
+	}
+
+	spliceChannels(newChannel.ChannelType(), channel, requests, peerChannel, peerRequests, audit)
+}
+
+// spliceChannels relays data, extended data and requests between a and b.
+// When one side closes, its remaining data is flushed to the other side
+// before that is closed too.
+func spliceChannels(channelType string, a ssh.Channel, aRequests <-chan *ssh.Request, b ssh.Channel, bRequests <-chan *ssh.Request, audit func(string, *ssh.Request)) {
+	toB := relayData(b, a)
+	toA := relayData(a, b)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		relayChannelRequests(channelType, aRequests, b, audit)
+		<-toB
+		_ = b.Close()
+	}()
+	go func() {
+		defer wg.Done()
+		relayChannelRequests(channelType, bRequests, a, nil)
+		<-toA
+		_ = a.Close()
+	}()
+	wg.Wait()
+}
+
+// relayData copies src's data and extended data to dst, sending EOF once
+// src has none left. The returned channel is closed when copying is done.
+func relayData(dst, src ssh.Channel) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _ = io.Copy(dst.Stderr(), src.Stderr())
+		}()
+		_, _ = io.Copy(dst, src)
+		wg.Wait()
+		_ = dst.CloseWrite()
+	}()
+	return done
+}
+
+func relayChannelRequests(channelType string, requests <-chan *ssh.Request, dst ssh.Channel, audit func(string, *ssh.Request)) {
+	for req := range requests {
+		if audit != nil {
+			audit(channelType, req)
+		}
+		ok, err := dst.SendRequest(req.Type, req.WantReply, req.Payload)
+		if req.WantReply {
+			req.Reply(ok && err == nil, nil)
+		}
+	}
+}
+
+// relayGlobalRequests forwards requests to dst, except those intercept
+// reports as handled.
+func relayGlobalRequests(requests <-chan *ssh.Request, dst ssh.Conn, intercept func(*ssh.Request) bool) {
+	for req := range requests {
+		if intercept(req) {
+			continue
+		}
+		ok, payload, err := dst.SendRequest(req.Type, req.WantReply, req.Payload)
+		if req.WantReply {
+			req.Reply(ok && err == nil, payload)
+		}
+	}
+}
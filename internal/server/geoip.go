@@ -0,0 +1,95 @@
+package server
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+
+	"github.com/oschwald/maxminddb-golang/v2"
+
+	"github.com/dollarkillerx/tinyssh/internal/config"
+)
+
+// geoIP looks up the country of client addresses and applies the geoip
+// country lists.
+type geoIP struct {
+	db           *maxminddb.Reader
+	allow        map[string]bool
+	deny         map[string]bool
+	allowUnknown bool
+}
+
+func newGeoIP(opts config.GeoIPOptions) (*geoIP, error) {
+	if !opts.Enabled() {
+		return nil, nil
+	}
+	// Read the whole file rather than mapping it, so a reader replaced by
+	// Reload is simply garbage collected.
+	data, err := os.ReadFile(opts.Database)
+	if err != nil {
+		return nil, fmt.Errorf("open geoip database: %w", err)
+	}
+	db, err := maxminddb.OpenBytes(data)
+	if err != nil {
+		return nil, fmt.Errorf("open geoip database: %w", err)
+	}
+	g := &geoIP{db: db, deny: make(map[string]bool), allowUnknown: opts.AllowUnknown}
+	for _, code := range opts.DenyCountries {
+		g.deny[code] = true
+	}
+	if len(opts.AllowCountries) > 0 {
+		g.allow = make(map[string]bool, len(opts.AllowCountries))
+		for _, code := range opts.AllowCountries {
+			g.allow[code] = true
+		}
+	}
+	return g, nil
+}
+
+// country returns the ISO code of addr's country, or "" when the database
+// does not know it. City and Country databases both carry this field.
+func (g *geoIP) country(addr net.Addr) string {
+	ip, ok := addrIP(addr)
+	if !ok {
+		return ""
+	}
+	var record struct {
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+	}
+	if err := g.db.Lookup(ip).Decode(&record); err != nil {
+		return ""
+	}
+	return record.Country.ISOCode
+}
+
+// admits reports whether clients from country may connect.
+func (g *geoIP) admits(country string) bool {
+	if g.deny[country] {
+		return false
+	}
+	if g.allow == nil {
+		return true
+	}
+	if country == "" {
+		return g.allowUnknown
+	}
+	return g.allow[country]
+}
+
+// admitCountry enforces the geoip country lists and returns the country of
+// conn for connection logs.
+func (s *Server) admitCountry(conn net.Conn, logger *slog.Logger) (string, bool) {
+	geo := s.current.Load().geo
+	if geo == nil {
+		return "", true
+	}
+	country := geo.country(conn.RemoteAddr())
+	if !geo.admits(country) {
+		s.dropConnection(logger, conn, "geoip", "country", country)
+		return country, false
+	}
+	return country, true
+}
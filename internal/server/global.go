@@ -0,0 +1,104 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// GlobalRequestHandler answers a connection-level request. The returned
+// status and payload are sent to the client if it asked for a reply.
+type GlobalRequestHandler func(ctx context.Context, conn ssh.Conn, req *ssh.Request) (bool, []byte)
+
+// RegisterGlobalRequest installs a handler for the named global request
+// type. Handlers take precedence over the built-in ones and must be
+// registered before Run is called.
+func (s *Server) RegisterGlobalRequest(name string, handler GlobalRequestHandler) {
+	if s.globalRequests == nil {
+		s.globalRequests = make(map[string]GlobalRequestHandler)
+	}
+	s.globalRequests[name] = handler
+}
+
+// connRequests dispatches the global requests of a single connection and
+// keeps the per-connection state they change.
+type connRequests struct {
+	srv  *Server
+	conn *ssh.ServerConn
+	fwd  *forwarder
+	// logger tags lines with the connection ID.
+	logger *slog.Logger
+
+	// noMoreSessions is set once the client sent
+	// no-more-sessions@openssh.com; later session channels are refused.
+	noMoreSessions atomic.Bool
+}
+
+// builtinGlobalRequests are the request types tinyssh implements itself.
+// Each handler is responsible for replying.
+var builtinGlobalRequests = map[string]func(c *connRequests, req *ssh.Request){
+	"tcpip-forward": func(c *connRequests, req *ssh.Request) {
+		if !c.fwd.permitted(req.Type) {
+			req.Reply(false, nil)
+			return
+		}
+		c.fwd.handleTCPIPForward(req)
+	},
+	"cancel-tcpip-forward": func(c *connRequests, req *ssh.Request) {
+		c.fwd.handleCancelTCPIPForward(req)
+	},
+	"streamlocal-forward@openssh.com": func(c *connRequests, req *ssh.Request) {
+		if !c.fwd.permitted("streamlocal-forward") {
+			req.Reply(false, nil)
+			return
+		}
+		c.fwd.handleStreamLocalForward(req)
+	},
+	"cancel-streamlocal-forward@openssh.com": func(c *connRequests, req *ssh.Request) {
+		c.fwd.handleCancelStreamLocalForward(req)
+	},
+	hostKeysProveRequest: func(c *connRequests, req *ssh.Request) {
+		payload, err := c.srv.proveHostKeys(c.conn, req.Payload)
+		if err != nil {
+			c.logger.Warn("host key proof", "user", c.conn.User(), "err", err)
+		}
+		req.Reply(err == nil, payload)
+	},
+	// Clients with ServerAliveInterval probe with keepalive@openssh.com;
+	// answer positively so the probe is never mistaken for a failure.
+	"keepalive@openssh.com": func(c *connRequests, req *ssh.Request) {
+		if req.WantReply {
+			req.Reply(true, nil)
+		}
+	},
+	"no-more-sessions@openssh.com": func(c *connRequests, req *ssh.Request) {
+		c.noMoreSessions.Store(true)
+		if req.WantReply {
+			req.Reply(true, nil)
+		}
+	},
+}
+
+// serve answers connection-level requests until the connection closes.
+// Unknown request types are refused.
+func (c *connRequests) serve(ctx context.Context, requests <-chan *ssh.Request) {
+	for req := range requests {
+		if handler, ok := c.srv.globalRequests[req.Type]; ok {
+			ok, payload := handler(ctx, c.conn, req)
+			if req.WantReply {
+				req.Reply(ok, payload)
+			}
+			continue
+		}
+		if handler, ok := builtinGlobalRequests[req.Type]; ok {
+			handler(c, req)
+			continue
+		}
+		c.logger.Debug("global request refused", "user", c.conn.User(), "type", req.Type)
+		if req.WantReply {
+			req.Reply(false, nil)
+		}
+	}
+}
@@ -0,0 +1,310 @@
+package server
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// OpenSSH's host key update extension (PROTOCOL, section 2.5): after
+// authentication the server lists all of its host keys, and the client asks
+// it to prove possession of any it has not seen before.
+const (
+	hostKeysRequest      = "hostkeys-00@openssh.com"
+	hostKeysProveRequest = "hostkeys-prove-00@openssh.com"
+)
+
+// hostKeyring tracks the host keys in use. A reload replaces the active
+// keys; each key it drops keeps signing key exchanges until its grace
+// period ends, so clients that only know the old key can still connect
+// and learn the new one through hostkeys-00@openssh.com.
+type hostKeyring struct {
+	mu       sync.Mutex
+	active   []ssh.Signer
+	retiring []retiringKey
+
+	// external are the agent, hardware and KMS keys, which reloads keep.
+	external        []ssh.Signer
+	externalSources []string
+}
+
+type retiringKey struct {
+	signer ssh.Signer
+	until  time.Time
+}
+
+// HostKeyInfo describes a host key for the admin API.
+type HostKeyInfo struct {
+	Type        string    `json:"type"`
+	Fingerprint string    `json:"fingerprint"`
+	State       string    `json:"state"`
+	RetireAt    time.Time `json:"retire_at,omitzero"`
+}
+
+// Host key states reported by HostKeyInfo.
+const (
+	HostKeyActive   = "active"
+	HostKeyRetiring = "retiring"
+)
+
+// all returns every host key the server can prove possession of.
+func (r *hostKeyring) all() []ssh.Signer {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	keys := slices.Clone(r.active)
+	for _, k := range r.retiring {
+		keys = append(keys, k.signer)
+	}
+	return keys
+}
+
+// handshake returns the keys offered during key exchange: retiring keys,
+// plus the active keys of every type no retiring key covers.
+func (r *hostKeyring) handshake() []ssh.Signer {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var keys []ssh.Signer
+	retiringTypes := make(map[string]bool)
+	for _, k := range r.retiring {
+		keys = append(keys, k.signer)
+		retiringTypes[k.signer.PublicKey().Type()] = true
+	}
+	for _, signer := range r.active {
+		if !retiringTypes[signer.PublicKey().Type()] {
+			keys = append(keys, signer)
+		}
+	}
+	return keys
+}
+
+// replace makes active the new key set and starts the grace period of
+// every previously active key it no longer contains. It reports the keys
+// added and retired.
+func (r *hostKeyring) replace(active []ssh.Signer, until time.Time) (added, retired []ssh.Signer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, signer := range active {
+		if !containsKey(r.active, signer) {
+			added = append(added, signer)
+		}
+	}
+	for _, signer := range r.active {
+		if !containsKey(active, signer) {
+			retired = append(retired, signer)
+			r.retiring = append(r.retiring, retiringKey{signer: signer, until: until})
+		}
+	}
+	// A key brought back during its grace period is active again.
+	r.retiring = slices.DeleteFunc(r.retiring, func(k retiringKey) bool {
+		return containsKey(active, k.signer)
+	})
+	r.active = active
+	return added, retired
+}
+
+// prune drops retiring keys whose grace period has ended.
+func (r *hostKeyring) prune(now time.Time) []ssh.Signer {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var expired []ssh.Signer
+	r.retiring = slices.DeleteFunc(r.retiring, func(k retiringKey) bool {
+		if now.Before(k.until) {
+			return false
+		}
+		expired = append(expired, k.signer)
+		return true
+	})
+	return expired
+}
+
+func (r *hostKeyring) snapshot() []HostKeyInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	infos := make([]HostKeyInfo, 0, len(r.active)+len(r.retiring))
+	for _, signer := range r.active {
+		infos = append(infos, hostKeyInfo(signer, HostKeyActive, time.Time{}))
+	}
+	for _, k := range r.retiring {
+		infos = append(infos, hostKeyInfo(k.signer, HostKeyRetiring, k.until))
+	}
+	return infos
+}
+
+func hostKeyInfo(signer ssh.Signer, state string, until time.Time) HostKeyInfo {
+	return HostKeyInfo{
+		Type:        signer.PublicKey().Type(),
+		Fingerprint: ssh.FingerprintSHA256(signer.PublicKey()),
+		State:       state,
+		RetireAt:    until,
+	}
+}
+
+func containsKey(signers []ssh.Signer, signer ssh.Signer) bool {
+	blob := signer.PublicKey().Marshal()
+	return slices.ContainsFunc(signers, func(s ssh.Signer) bool {
+		return bytes.Equal(s.PublicKey().Marshal(), blob)
+	})
+}
+
+// hostKeys returns every host key the server can sign with.
+func (s *Server) hostKeys() []ssh.Signer {
+	return s.keyring.all()
+}
+
+// AuditSigner returns the host key that signs the anchors of the
+// tamper-evident audit log: the first active one.
+func (s *Server) AuditSigner() ssh.Signer {
+	keys := s.hostKeys()
+	if len(keys) == 0 {
+		return nil
+	}
+	return keys[0]
+}
+
+// HostKeys describes the active and retiring host keys.
+func (s *Server) HostKeys() []HostKeyInfo {
+	return s.keyring.snapshot()
+}
+
+// ReloadHostKeys re-reads the host key files, generating any that are
+// missing, so a key can be rotated by replacing or deleting its file and
+// signalling the server. Keys that changed keep being offered for
+// host_key_rotation_grace seconds. Agent, hardware and KMS keys are kept
+// as loaded at startup.
+func (s *Server) ReloadHostKeys() error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	fileSigners, fileSources, err := loadFileHostKeys(s.config())
+	if err != nil {
+		return err
+	}
+	active := slices.Concat(fileSigners, s.keyring.external)
+	if err := checkHostKeys(active, slices.Concat(fileSources, s.keyring.externalSources), s.config().Policy()); err != nil {
+		return err
+	}
+
+	grace := time.Duration(s.config().HostKeyRotationGrace) * time.Second
+	added, retired := s.keyring.replace(active, time.Now().Add(grace))
+	for _, signer := range added {
+		s.logger.Info("host key added", "type", signer.PublicKey().Type(), "fingerprint", ssh.FingerprintSHA256(signer.PublicKey()))
+	}
+	for _, signer := range retired {
+		s.logger.Info("host key retiring", "type", signer.PublicKey().Type(), "fingerprint", ssh.FingerprintSHA256(signer.PublicKey()), "grace", grace)
+	}
+	if len(retired) > 0 {
+		time.AfterFunc(grace, s.pruneHostKeys)
+	}
+	s.updateSSHConfig()
+	return nil
+}
+
+func (s *Server) pruneHostKeys() {
+	expired := s.keyring.prune(time.Now())
+	if len(expired) == 0 {
+		return
+	}
+	for _, signer := range expired {
+		s.logger.Info("host key retired", "type", signer.PublicKey().Type(), "fingerprint", ssh.FingerprintSHA256(signer.PublicKey()))
+	}
+	s.updateSSHConfig()
+}
+
+// announceHostKeys sends hostkeys-00@openssh.com so clients with
+// UpdateHostKeys enabled learn keys added or rotated since they last
+// connected.
+func (s *Server) announceHostKeys(conn ssh.Conn, logger *slog.Logger) {
+	var payload []byte
+	for _, signer := range s.hostKeys() {
+		payload = append(payload, ssh.Marshal(struct{ Blob string }{string(signer.PublicKey().Marshal())})...)
+	}
+	if _, _, err := conn.SendRequest(hostKeysRequest, false, payload); err != nil {
+		logger.Debug("announce host keys", "err", err)
+	}
+}
+
+// proveHostKeys answers hostkeys-prove-00@openssh.com with a signature by
+// each requested key over the session identifier.
+func (s *Server) proveHostKeys(conn ssh.Conn, payload []byte) ([]byte, error) {
+	var reply []byte
+	for len(payload) > 0 {
+		var blob struct {
+			Key  string
+			Rest []byte `ssh:"rest"`
+		}
+		if err := ssh.Unmarshal(payload, &blob); err != nil {
+			return nil, fmt.Errorf("parse host key: %w", err)
+		}
+		payload = blob.Rest
+
+		signer := s.hostKeyFor([]byte(blob.Key))
+		if signer == nil {
+			return nil, errors.New("unknown host key")
+		}
+
+		data := ssh.Marshal(struct {
+			Request   string
+			SessionID string
+			Key       string
+		}{hostKeysProveRequest, string(conn.SessionID()), blob.Key})
+
+		sig, err := signHostKeyProof(signer, data)
+		if err != nil {
+			return nil, fmt.Errorf("sign host key proof: %w", err)
+		}
+		reply = append(reply, ssh.Marshal(struct{ Sig string }{string(ssh.Marshal(sig))})...)
+	}
+	return reply, nil
+}
+
+func (s *Server) hostKeyFor(blob []byte) ssh.Signer {
+	for _, signer := range s.hostKeys() {
+		if bytes.Equal(signer.PublicKey().Marshal(), blob) {
+			return signer
+		}
+	}
+	return nil
+}
+
+// signHostKeyProof signs data with signer. OpenSSH verifies RSA proofs
+// against the signature algorithm negotiated during key exchange, which
+// x/crypto does not expose; rsa-sha2-512 is what OpenSSH clients prefer,
+// unless the signer is restricted to other algorithms.
+func signHostKeyProof(signer ssh.Signer, data []byte) (*ssh.Signature, error) {
+	if signer.PublicKey().Type() == ssh.KeyAlgoRSA {
+		if algSigner, ok := signer.(ssh.AlgorithmSigner); ok {
+			algorithm := ssh.KeyAlgoRSASHA512
+			if multi, ok := signer.(ssh.MultiAlgorithmSigner); ok {
+				algorithm = multi.Algorithms()[0]
+			}
+			return algSigner.SignWithAlgorithm(rand.Reader, data, algorithm)
+		}
+	}
+	return signer.Sign(rand.Reader, data)
+}
+
+// hardwareSigner wraps a crypto.Signer backed by an HSM or TPM. RSA keys
+// are limited to SHA-256 signatures, which every token supports, where
+// rsa-sha2-512 would be negotiated with most clients otherwise.
+func hardwareSigner(key crypto.Signer) (ssh.Signer, error) {
+	signer, err := ssh.NewSignerFromSigner(key)
+	if err != nil {
+		return nil, err
+	}
+	if signer.PublicKey().Type() != ssh.KeyAlgoRSA {
+		return signer, nil
+	}
+	algSigner, ok := signer.(ssh.AlgorithmSigner)
+	if !ok {
+		return signer, nil
+	}
+	return ssh.NewSignerWithAlgorithms(algSigner, []string{ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA})
+}
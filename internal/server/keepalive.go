@@ -0,0 +1,49 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// clientAlive periodically probes the client with keepalive@openssh.com
+// global requests and closes the connection once client_alive_count_max
+// probes in a row went unanswered. Any reply, including a failure reply,
+// counts as a sign of life.
+func (s *Server) clientAlive(ctx context.Context, conn ssh.Conn, logger *slog.Logger) {
+	interval := time.Duration(s.config().ClientAliveInterval) * time.Second
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	replies := make(chan struct{}, 1)
+	pending := false
+	missed := 0
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-replies:
+			pending = false
+			missed = 0
+		case <-ticker.C:
+			if pending {
+				missed++
+				if missed >= s.config().ClientAliveCountMax {
+					logger.Info("client alive timeout", "user", conn.User(), "remote", conn.RemoteAddr().String(), "missed", missed)
+					_ = conn.Close()
+					return
+				}
+				continue
+			}
+			pending = true
+			go func() {
+				if _, _, err := conn.SendRequest("keepalive@openssh.com", true, nil); err == nil {
+					replies <- struct{}{}
+				}
+			}()
+		}
+	}
+}
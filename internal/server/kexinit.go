@@ -0,0 +1,170 @@
+package server
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net"
+	"slices"
+	"strings"
+)
+
+// kexStrictClient is the pseudo-algorithm clients list to request strict
+// key exchange, OpenSSH's mitigation for the Terrapin attack
+// (CVE-2023-48795). The server always offers it, so strict mode is in
+// effect exactly when the client asks for it.
+const kexStrictClient = "kex-strict-c-v00@openssh.com"
+
+const (
+	msgKexInit = 20
+	// maxKexInitCapture bounds how much of the stream is buffered while
+	// looking for the client's KEXINIT.
+	maxKexInitCapture = 64 << 10
+)
+
+// errNoStrictKex is returned from the handshake when require_strict_kex
+// is set and the client did not offer strict key exchange.
+var errNoStrictKex = errors.New("client does not support strict key exchange")
+
+// errDeniedHASSH is returned from the handshake when the client's HASSH is
+// listed in deny_hassh.
+var errDeniedHASSH = errors.New("client fingerprint is denied")
+
+// clientKexInit holds the algorithm lists from a client's first
+// SSH_MSG_KEXINIT (RFC 4253, section 7.1).
+type clientKexInit struct {
+	Version        string
+	KexAlgorithms  []string
+	HostKeyAlgos   []string
+	CiphersC2S     []string
+	CiphersS2C     []string
+	MACsC2S        []string
+	MACsS2C        []string
+	CompressionC2S []string
+	CompressionS2C []string
+}
+
+// StrictKex reports whether the client requested strict key exchange.
+func (k *clientKexInit) StrictKex() bool {
+	return k != nil && slices.Contains(k.KexAlgorithms, kexStrictClient)
+}
+
+// HASSH returns the client's HASSH fingerprint: the MD5 of its key
+// exchange, encryption, MAC and compression lists (client to server),
+// which identifies the SSH implementation rather than the host.
+func (k *clientKexInit) HASSH() string {
+	if k == nil {
+		return ""
+	}
+	sum := md5.Sum([]byte(strings.Join([]string{
+		strings.Join(k.KexAlgorithms, ","),
+		strings.Join(k.CiphersC2S, ","),
+		strings.Join(k.MACsC2S, ","),
+		strings.Join(k.CompressionC2S, ","),
+	}, ";")))
+	return hex.EncodeToString(sum[:])
+}
+
+// kexInitConn passes the client's bytes through unchanged while parsing
+// its version line and first KEXINIT, which are sent before encryption
+// starts.
+type kexInitConn struct {
+	net.Conn
+	requireStrict bool
+	denyHASSH     []string
+
+	buf     []byte
+	done    bool
+	kexInit *clientKexInit
+}
+
+func newKexInitConn(conn net.Conn, requireStrict bool, denyHASSH []string) *kexInitConn {
+	return &kexInitConn{Conn: conn, requireStrict: requireStrict, denyHASSH: denyHASSH}
+}
+
+func (c *kexInitConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if c.done || n == 0 {
+		return n, err
+	}
+	c.buf = append(c.buf, p[:n]...)
+	kexInit, complete := parseClientKexInit(c.buf)
+	if !complete && len(c.buf) < maxKexInitCapture {
+		return n, err
+	}
+	c.done, c.kexInit, c.buf = true, kexInit, nil
+	if c.requireStrict && !kexInit.StrictKex() {
+		return 0, errNoStrictKex
+	}
+	if kexInit != nil && slices.Contains(c.denyHASSH, kexInit.HASSH()) {
+		return 0, errDeniedHASSH
+	}
+	return n, err
+}
+
+// KexInit returns the parsed client KEXINIT, or nil if it could not be
+// read.
+func (c *kexInitConn) KexInit() *clientKexInit {
+	return c.kexInit
+}
+
+// parseClientKexInit parses the identification line and first binary
+// packet from the start of a client stream. It reports complete once the
+// packet has been seen, even if it was malformed (kexInit is then nil).
+func parseClientKexInit(data []byte) (kexInit *clientKexInit, complete bool) {
+	// Clients send their identification string first (RFC 4253, 4.2).
+	end := bytes.IndexByte(data, '\n')
+	if end < 0 {
+		return nil, false
+	}
+	version := strings.TrimRight(string(data[:end]), "\r")
+	data = data[end+1:]
+
+	if len(data) < 5 {
+		return nil, false
+	}
+	length := binary.BigEndian.Uint32(data)
+	if length < 2 || length > maxKexInitCapture {
+		return nil, true
+	}
+	if uint32(len(data)-4) < length {
+		return nil, false
+	}
+	padding := uint32(data[4])
+	if padding+1 >= length {
+		return nil, true
+	}
+	payload := data[5 : 4+length-padding]
+	if payload[0] != msgKexInit || len(payload) < 17 {
+		return nil, true
+	}
+	payload = payload[17:] // message type and cookie
+
+	lists := make([][]string, 8)
+	for i := range lists {
+		if len(payload) < 4 {
+			return nil, true
+		}
+		n := binary.BigEndian.Uint32(payload)
+		if uint32(len(payload)-4) < n {
+			return nil, true
+		}
+		if n > 0 {
+			lists[i] = strings.Split(string(payload[4:4+n]), ",")
+		}
+		payload = payload[4+n:]
+	}
+	return &clientKexInit{
+		Version:        version,
+		KexAlgorithms:  lists[0],
+		HostKeyAlgos:   lists[1],
+		CiphersC2S:     lists[2],
+		CiphersS2C:     lists[3],
+		MACsC2S:        lists[4],
+		MACsS2C:        lists[5],
+		CompressionC2S: lists[6],
+		CompressionS2C: lists[7],
+	}, true
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/dollarkillerx/tinyssh/internal/config"
+)
+
+// kmsTimeout bounds each KMS round trip. A signature is needed for every
+// handshake, so a stalled KMS must not hold connections open for long.
+const kmsTimeout = 10 * time.Second
+
+var kmsClient = &http.Client{Timeout: kmsTimeout}
+
+// kmsSigner is a crypto.Signer whose private key lives in a cloud KMS.
+type kmsSigner struct {
+	pub  crypto.PublicKey
+	sign func(ctx context.Context, digest []byte, hash crypto.Hash) ([]byte, error)
+}
+
+func (s *kmsSigner) Public() crypto.PublicKey { return s.pub }
+
+func (s *kmsSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), kmsTimeout)
+	defer cancel()
+	return s.sign(ctx, digest, opts.HashFunc())
+}
+
+// loadKMSHostKey fetches the public half of the configured KMS key and
+// returns an ssh.Signer restricted to the algorithms the key can produce.
+func loadKMSHostKey(cfg config.KMSKey) (ssh.Signer, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), kmsTimeout)
+	defer cancel()
+
+	var (
+		key        *kmsSigner
+		algorithms []string
+		err        error
+	)
+	switch cfg.Provider {
+	case config.KMSProviderAWS:
+		key, algorithms, err = loadAWSKMSKey(ctx, cfg)
+	case config.KMSProviderGCP:
+		key, algorithms, err = loadGCPKMSKey(ctx, cfg)
+	default:
+		err = fmt.Errorf("unknown provider %q", cfg.Provider)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("kms host key %s: %w", cfg.Key, err)
+	}
+	switch key.pub.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+	default:
+		return nil, fmt.Errorf("kms host key %s: unsupported key type %T", cfg.Key, key.pub)
+	}
+
+	signer, err := ssh.NewSignerFromSigner(key)
+	if err != nil {
+		return nil, fmt.Errorf("kms host key %s: %w", cfg.Key, err)
+	}
+	algSigner, ok := signer.(ssh.AlgorithmSigner)
+	if !ok || len(algorithms) == 0 {
+		return signer, nil
+	}
+	return ssh.NewSignerWithAlgorithms(algSigner, algorithms)
+}
+
+// kmsCall POSTs (or GETs, when body is nil) a JSON request and decodes the
+// JSON reply into out. Non-2xx replies are returned as errors carrying the
+// response body, which both providers use for their error details.
+func kmsCall(ctx context.Context, method, url string, header http.Header, body []byte, out any) error {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, reader)
+	if err != nil {
+		return err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := kmsClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(data))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+// cachedCredential memoises a short-lived credential until shortly before
+// it expires.
+type cachedCredential[T any] struct {
+	fetch func(ctx context.Context) (T, time.Time, error)
+
+	mu     sync.Mutex
+	value  T
+	expiry time.Time
+}
+
+func (c *cachedCredential[T]) get(ctx context.Context) (T, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Until(c.expiry) > 5*time.Minute {
+		return c.value, nil
+	}
+	value, expiry, err := c.fetch(ctx)
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	c.value, c.expiry = value, expiry
+	return value, nil
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/dollarkillerx/tinyssh/internal/awsauth"
+	"github.com/dollarkillerx/tinyssh/internal/config"
+)
+
+// awsKMS calls the AWS KMS JSON API, signing each request with SigV4.
+type awsKMS struct {
+	endpoint string
+	region   string
+	creds    *cachedCredential[awsauth.Credentials]
+}
+
+func loadAWSKMSKey(ctx context.Context, cfg config.KMSKey) (*kmsSigner, []string, error) {
+	endpoint := cfg.Endpoint
+	if endpoint == "" {
+		endpoint = "https://kms." + cfg.Region + ".amazonaws.com"
+	}
+	region := cfg.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	k := &awsKMS{
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		region:   region,
+		creds:    &cachedCredential[awsauth.Credentials]{fetch: awsauth.FetchCredentials},
+	}
+
+	var reply struct {
+		PublicKey         []byte
+		KeySpec           string
+		KeyUsage          string
+		SigningAlgorithms []string
+	}
+	if err := k.call(ctx, "GetPublicKey", map[string]any{"KeyId": cfg.Key}, &reply); err != nil {
+		return nil, nil, err
+	}
+	if reply.KeyUsage != "" && reply.KeyUsage != "SIGN_VERIFY" {
+		return nil, nil, fmt.Errorf("key usage is %s, want SIGN_VERIFY", reply.KeyUsage)
+	}
+	pub, err := x509.ParsePKIXPublicKey(reply.PublicKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parse public key: %w", err)
+	}
+
+	var algorithms []string
+	if _, ok := pub.(*rsa.PublicKey); ok {
+		if slices.Contains(reply.SigningAlgorithms, "RSASSA_PKCS1_V1_5_SHA_512") {
+			algorithms = append(algorithms, ssh.KeyAlgoRSASHA512)
+		}
+		if slices.Contains(reply.SigningAlgorithms, "RSASSA_PKCS1_V1_5_SHA_256") {
+			algorithms = append(algorithms, ssh.KeyAlgoRSASHA256)
+		}
+		if len(algorithms) == 0 {
+			return nil, nil, fmt.Errorf("key spec %s has no PKCS#1 v1.5 signing algorithm", reply.KeySpec)
+		}
+	}
+
+	keyID := cfg.Key
+	signer := &kmsSigner{pub: pub}
+	signer.sign = func(ctx context.Context, digest []byte, hash crypto.Hash) ([]byte, error) {
+		alg, err := awsSigningAlgorithm(pub, hash)
+		if err != nil {
+			return nil, err
+		}
+		var reply struct{ Signature []byte }
+		err = k.call(ctx, "Sign", map[string]any{
+			"KeyId":            keyID,
+			"Message":          digest,
+			"MessageType":      "DIGEST",
+			"SigningAlgorithm": alg,
+		}, &reply)
+		if err != nil {
+			return nil, fmt.Errorf("kms sign: %w", err)
+		}
+		return reply.Signature, nil
+	}
+	return signer, algorithms, nil
+}
+
+// awsSigningAlgorithm maps a key and hash to the KMS SigningAlgorithm name.
+// ECDSA signatures come back ASN.1 encoded, as crypto.Signer expects.
+func awsSigningAlgorithm(pub crypto.PublicKey, hash crypto.Hash) (string, error) {
+	switch pub := pub.(type) {
+	case *ecdsa.PublicKey:
+		want := map[elliptic.Curve]crypto.Hash{
+			elliptic.P256(): crypto.SHA256,
+			elliptic.P384(): crypto.SHA384,
+			elliptic.P521(): crypto.SHA512,
+		}[pub.Curve]
+		if hash == want {
+			return fmt.Sprintf("ECDSA_SHA_%d", hash.Size()*8), nil
+		}
+	default:
+		switch hash {
+		case crypto.SHA256:
+			return "RSASSA_PKCS1_V1_5_SHA_256", nil
+		case crypto.SHA512:
+			return "RSASSA_PKCS1_V1_5_SHA_512", nil
+		}
+	}
+	return "", fmt.Errorf("kms: unsupported hash %v", hash)
+}
+
+func (k *awsKMS) call(ctx context.Context, action string, params any, out any) error {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	creds, err := k.creds.get(ctx)
+	if err != nil {
+		return fmt.Errorf("aws credentials: %w", err)
+	}
+	u, err := url.Parse(k.endpoint)
+	if err != nil {
+		return err
+	}
+	header := http.Header{}
+	header.Set("Content-Type", "application/x-amz-json-1.1")
+	header.Set("X-Amz-Target", "TrentService."+action)
+	awsauth.Sign(header, http.MethodPost, u, body, creds, k.region, "kms", time.Now())
+	return kmsCall(ctx, http.MethodPost, k.endpoint+"/", header, body, out)
+}
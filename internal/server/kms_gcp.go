@@ -0,0 +1,213 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/dollarkillerx/tinyssh/internal/config"
+)
+
+const (
+	gcpKMSEndpoint = "https://cloudkms.googleapis.com"
+	gcpMetadata    = "http://metadata.google.internal"
+	gcpKMSScope    = "https://www.googleapis.com/auth/cloudkms"
+)
+
+// gcpAlgorithms maps Cloud KMS signing algorithms to the digest they sign
+// and the SSH algorithm that matches. A Cloud KMS key version signs with
+// exactly one algorithm, so RSA keys are limited to that one.
+var gcpAlgorithms = map[string]struct {
+	hash crypto.Hash
+	ssh  string
+}{
+	"RSA_SIGN_PKCS1_2048_SHA256": {crypto.SHA256, ssh.KeyAlgoRSASHA256},
+	"RSA_SIGN_PKCS1_3072_SHA256": {crypto.SHA256, ssh.KeyAlgoRSASHA256},
+	"RSA_SIGN_PKCS1_4096_SHA256": {crypto.SHA256, ssh.KeyAlgoRSASHA256},
+	"RSA_SIGN_PKCS1_4096_SHA512": {crypto.SHA512, ssh.KeyAlgoRSASHA512},
+	"EC_SIGN_P256_SHA256":        {crypto.SHA256, ssh.KeyAlgoECDSA256},
+	"EC_SIGN_P384_SHA384":        {crypto.SHA384, ssh.KeyAlgoECDSA384},
+}
+
+var gcpDigestFields = map[crypto.Hash]string{
+	crypto.SHA256: "sha256",
+	crypto.SHA384: "sha384",
+	crypto.SHA512: "sha512",
+}
+
+func loadGCPKMSKey(ctx context.Context, cfg config.KMSKey) (*kmsSigner, []string, error) {
+	endpoint := strings.TrimSuffix(cfg.Endpoint, "/")
+	if endpoint == "" {
+		endpoint = gcpKMSEndpoint
+	}
+	fetch := fetchGCPMetadataToken
+	if cfg.CredentialsFile != "" {
+		account, err := loadGCPServiceAccount(cfg.CredentialsFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		fetch = account.token
+	}
+	token := &cachedCredential[string]{fetch: fetch}
+	keyURL := endpoint + "/v1/" + strings.TrimPrefix(cfg.Key, "/")
+
+	call := func(ctx context.Context, method, url string, params any, out any) error {
+		bearer, err := token.get(ctx)
+		if err != nil {
+			return fmt.Errorf("gcp credentials: %w", err)
+		}
+		header := http.Header{"Authorization": {"Bearer " + bearer}}
+		var body []byte
+		if params != nil {
+			header.Set("Content-Type", "application/json")
+			if body, err = json.Marshal(params); err != nil {
+				return err
+			}
+		}
+		return kmsCall(ctx, method, url, header, body, out)
+	}
+
+	var reply struct {
+		PEM       string `json:"pem"`
+		Algorithm string `json:"algorithm"`
+	}
+	if err := call(ctx, http.MethodGet, keyURL+"/publicKey", nil, &reply); err != nil {
+		return nil, nil, err
+	}
+	alg, ok := gcpAlgorithms[reply.Algorithm]
+	if !ok {
+		return nil, nil, fmt.Errorf("unsupported algorithm %s", reply.Algorithm)
+	}
+	block, _ := pem.Decode([]byte(reply.PEM))
+	if block == nil {
+		return nil, nil, errors.New("public key is not PEM")
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parse public key: %w", err)
+	}
+
+	signer := &kmsSigner{pub: pub}
+	signer.sign = func(ctx context.Context, digest []byte, hash crypto.Hash) ([]byte, error) {
+		if hash != alg.hash {
+			return nil, fmt.Errorf("kms: key signs %v digests, not %v", alg.hash, hash)
+		}
+		params := map[string]any{
+			"digest": map[string][]byte{gcpDigestFields[hash]: digest},
+		}
+		var reply struct {
+			Signature []byte `json:"signature"`
+		}
+		if err := call(ctx, http.MethodPost, keyURL+":asymmetricSign", params, &reply); err != nil {
+			return nil, fmt.Errorf("kms sign: %w", err)
+		}
+		return reply.Signature, nil
+	}
+	var algorithms []string
+	if _, ok := pub.(*rsa.PublicKey); ok {
+		algorithms = []string{alg.ssh}
+	}
+	return signer, algorithms, nil
+}
+
+// fetchGCPMetadataToken asks the GCE metadata server for an access token
+// for the instance's default service account.
+func fetchGCPMetadataToken(ctx context.Context) (string, time.Time, error) {
+	header := http.Header{"Metadata-Flavor": {"Google"}}
+	var reply gcpToken
+	err := kmsCall(ctx, http.MethodGet, gcpMetadata+"/computeMetadata/v1/instance/service-accounts/default/token", header, nil, &reply)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("metadata server: %w", err)
+	}
+	return reply.AccessToken, time.Now().Add(time.Duration(reply.ExpiresIn) * time.Second), nil
+}
+
+type gcpToken struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+// gcpServiceAccount is the subset of a service account JSON key needed for
+// the OAuth 2.0 JWT bearer grant.
+type gcpServiceAccount struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+
+	key *rsa.PrivateKey
+}
+
+func loadGCPServiceAccount(path string) (*gcpServiceAccount, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read credentials: %w", err)
+	}
+	var account gcpServiceAccount
+	if err := json.Unmarshal(data, &account); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	block, _ := pem.Decode([]byte(account.PrivateKey))
+	if block == nil {
+		return nil, fmt.Errorf("%s: private_key is not PEM", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: private_key is not RSA", path)
+	}
+	account.key = rsaKey
+	if account.TokenURI == "" {
+		account.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+	return &account, nil
+}
+
+// token exchanges a self-signed JWT for an access token.
+func (a *gcpServiceAccount) token(ctx context.Context) (string, time.Time, error) {
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]any{
+		"iss":   a.ClientEmail,
+		"scope": gcpKMSScope,
+		"aud":   a.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, a.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {unsigned + "." + enc.EncodeToString(sig)},
+	}
+	var reply gcpToken
+	err = kmsCall(ctx, http.MethodPost, a.TokenURI,
+		http.Header{"Content-Type": {"application/x-www-form-urlencoded"}},
+		[]byte(form.Encode()), &reply)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("token exchange: %w", err)
+	}
+	return reply.AccessToken, now.Add(time.Duration(reply.ExpiresIn) * time.Second), nil
+}
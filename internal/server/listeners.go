@@ -0,0 +1,293 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/dollarkillerx/tinyssh/internal/config"
+	"github.com/dollarkillerx/tinyssh/internal/logging"
+	"github.com/dollarkillerx/tinyssh/internal/systemd"
+)
+
+// sshListener is one SSH listening address with its resolved settings.
+type sshListener struct {
+	config.Listener
+	// allowed is nil when every user may log in.
+	allowed map[string]bool
+	// trusted are the load balancers whose connections start with a PROXY
+	// protocol header.
+	trusted []netip.Prefix
+	// tlsConfig is set on TLS listeners.
+	tlsConfig *tls.Config
+	sshConfig atomic.Pointer[ssh.ServerConfig]
+}
+
+func newSSHListeners(cfg *config.Config) ([]*sshListener, error) {
+	var listeners []*sshListener
+	for _, settings := range cfg.SSHListeners() {
+		l := &sshListener{Listener: settings}
+		if len(settings.AllowUsers) > 0 {
+			l.allowed = make(map[string]bool, len(settings.AllowUsers))
+			for _, name := range settings.AllowUsers {
+				l.allowed[name] = true
+			}
+		}
+		for _, entry := range settings.ProxyProtocol.Trusted {
+			prefix, _ := config.ParsePrefix(entry)
+			l.trusted = append(l.trusted, prefix)
+		}
+		if settings.TLS() {
+			var err error
+			if l.tlsConfig, err = listenerTLSConfig(settings); err != nil {
+				return nil, err
+			}
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// serverConfig builds the listener's ServerConfig around hostKeys.
+func (l *sshListener) serverConfig(s *Server, hostKeys []ssh.Signer) *ssh.ServerConfig {
+	sshCfg := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			hs := s.handshakeOf(conn)
+			auth := hs.span.child("ssh.auth", spanKindInternal, "tinyssh.user", conn.User(), "tinyssh.auth.method", "password")
+			defer auth.finish()
+			perms, err := s.validateUser(conn, password)
+			if err == nil && l.allowed != nil && !l.allowed[perms.Extensions[permUser]] {
+				err = fmt.Errorf("user %s is not allowed on %s", conn.User(), l.Address)
+			}
+			auth.fail(err)
+			if err != nil {
+				s.metrics.authFailures.Add(1)
+				hs.logger.Warn("authentication failed", logging.EventKey, logging.EventAuthFailure,
+					"user", conn.User(), "method", "password", "remote", conn.RemoteAddr().String(), "err", err)
+				s.webhooks.authFailure(conn.User(), conn.RemoteAddr())
+				return nil, err
+			}
+			return perms, nil
+		},
+		ServerVersion: l.ServerVersion,
+		Config: ssh.Config{
+			Ciphers:        l.Ciphers,
+			KeyExchanges:   l.KexAlgorithms,
+			MACs:           l.MACs,
+			RekeyThreshold: uint64(s.config().RekeyThreshold),
+		},
+	}
+	if banner := l.Banner; banner != "" {
+		sshCfg.BannerCallback = func(ssh.ConnMetadata) string { return banner }
+	}
+	noSHA1 := config.CryptoPolicies[l.CryptoPolicy].NoSHA1
+	for _, signer := range hostKeys {
+		if noSHA1 {
+			signer = withoutSHA1(signer)
+		}
+		sshCfg.AddHostKey(signer)
+	}
+	return sshCfg
+}
+
+// trustsProxy reports whether conn comes from a load balancer listed in
+// the listener's proxy_protocol.trusted.
+func (l *sshListener) trustsProxy(conn net.Conn) bool {
+	ip, ok := addrIP(conn.RemoteAddr())
+	return ok && prefixesContain(l.trusted, ip)
+}
+
+// boundListener holds the listening sockets of one SSH listener address.
+// Reload may point it at new settings for the same address.
+type boundListener struct {
+	sockets []net.Listener
+	l       atomic.Pointer[sshListener]
+	closed  atomic.Bool
+}
+
+// close stops accepting connections. Accepted connections carry on.
+func (b *boundListener) close() {
+	b.closed.Store(true)
+	for _, socket := range b.sockets {
+		_ = socket.Close()
+	}
+}
+
+// bind opens the sockets of l, taking the socket systemd passed for its
+// address from activated when there is one.
+func (s *Server) bind(l *sshListener, activated *[]net.Listener) (*boundListener, error) {
+	b := &boundListener{}
+	b.l.Store(l)
+	// With reuse_port each accept loop gets its own socket.
+	sockets := 1
+	if s.config().ReusePort {
+		sockets = s.config().AcceptLoops
+	}
+	for i := range sockets {
+		var listener net.Listener
+		if i == 0 && activated != nil {
+			listener = takeActivated(activated, l.Address)
+		}
+		if listener == nil {
+			var err error
+			if listener, err = s.listen(l.Address); err != nil {
+				b.close()
+				return nil, fmt.Errorf("listen %s: %w", l.Address, err)
+			}
+		}
+		if i == 0 {
+			s.logger.Info("listening", "address", listener.Addr().String())
+		}
+		b.sockets = append(b.sockets, listener)
+	}
+	return b, nil
+}
+
+// start runs the accept loops of b for the current Run. Callers hold
+// bindMu.
+func (s *Server) start(b *boundListener) {
+	ctx, fail := s.serveCtx, s.fail
+	loops := 1
+	if !s.config().ReusePort {
+		loops = s.config().AcceptLoops
+	}
+	for _, socket := range b.sockets {
+		for range loops {
+			s.serving.Add(1)
+			go func() {
+				defer s.serving.Done()
+				if err := s.serve(ctx, socket, b); err != nil {
+					fail(err)
+				}
+			}()
+		}
+	}
+}
+
+// listen binds a TCP socket for an SSH listener.
+func (s *Server) listen(address string) (net.Listener, error) {
+	lc := net.ListenConfig{Control: s.controlListener}
+	return lc.Listen(context.Background(), s.config().Network(), address)
+}
+
+// takeActivated removes and returns the socket in activated bound to
+// address, or nil if systemd passed none. A wildcard address matches a
+// socket bound to either wildcard.
+func takeActivated(activated *[]net.Listener, address string) net.Listener {
+	want, err := net.ResolveTCPAddr("tcp", address)
+	if err != nil {
+		return nil
+	}
+	for i, listener := range *activated {
+		got, ok := listener.Addr().(*net.TCPAddr)
+		if !ok || got.Port != want.Port {
+			continue
+		}
+		wildcard := want.IP == nil || want.IP.IsUnspecified()
+		if (wildcard && got.IP.IsUnspecified()) || (!wildcard && want.IP.Equal(got.IP)) {
+			*activated = slices.Delete(*activated, i, i+1)
+			return listener
+		}
+	}
+	return nil
+}
+
+// watchdog keeps the systemd watchdog (WatchdogSec=) fed while ctx is
+// live.
+func (s *Server) watchdog(ctx context.Context, notifier *systemd.Notifier, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := notifier.Notify("WATCHDOG=1"); err != nil {
+				s.logger.Warn("systemd notify", "err", err)
+			}
+		}
+	}
+}
+
+// serve accepts connections on listener until ctx is cancelled or b is
+// closed, and waits for them to finish. Each connection uses the listener
+// settings current when it was accepted.
+func (s *Server) serve(ctx context.Context, listener net.Listener, b *boundListener) error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil || b.closed.Load() {
+				return nil
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				s.logger.Warn("temporary accept error", "err", err)
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return fmt.Errorf("accept connection: %w", err)
+		}
+		tuneTCP(conn, s.config().TCP)
+
+		l := b.l.Load()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.serveConn(ctx, conn, l); err != nil {
+				s.logger.Warn("connection ended", "remote", conn.RemoteAddr().String(), "err", err)
+			}
+		}()
+	}
+}
+
+// serveConn reads the PROXY protocol header when conn comes from a trusted
+// load balancer and admits the client address, then completes the TLS
+// handshake and WebSocket upgrade on listeners that use them and runs the
+// SSH connection. Admission comes first so that refused addresses cannot
+// hold handshakes open.
+func (s *Server) serveConn(ctx context.Context, conn net.Conn, l *sshListener) error {
+	if l.trustsProxy(conn) {
+		proxied, err := readProxyHeader(conn)
+		if err != nil {
+			s.dropConnection(s.logger, conn, "proxy_protocol", "err", err)
+			_ = conn.Close()
+			return nil
+		}
+		conn = proxied
+	}
+	a, ok := s.admit(ctx, conn, l)
+	if !ok {
+		_ = conn.Close()
+		return nil
+	}
+	defer s.release(a)
+	if l.tlsConfig != nil {
+		tlsConn, err := acceptTLS(ctx, conn, l.tlsConfig)
+		if err != nil {
+			a.logger.Debug("tls handshake failed", "remote", conn.RemoteAddr().String(), "err", err)
+			_ = conn.Close()
+			return nil
+		}
+		conn = tlsConn
+	}
+	if l.Protocol == config.ListenerWebSocket {
+		ws, err := upgradeWebSocket(conn, l.Path)
+		if err != nil {
+			a.logger.Debug("websocket upgrade failed", "remote", conn.RemoteAddr().String(), "err", err)
+			_ = conn.Close()
+			return nil
+		}
+		conn = ws
+	}
+	return s.serveSSH(ctx, conn, l, a)
+}
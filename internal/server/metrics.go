@@ -0,0 +1,108 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// metrics are the counters served by the admin API's /metrics in the
+// Prometheus text format and pushed to StatsD.
+type metrics struct {
+	// accepted counts the connections accepted, authFailures the failed
+	// password attempts, and received and sent the bytes of SSH traffic.
+	accepted     atomic.Uint64
+	authFailures atomic.Uint64
+	received     atomic.Uint64
+	sent         atomic.Uint64
+
+	mu sync.Mutex
+	// dropped counts connections refused before the handshake, by reason.
+	dropped map[string]uint64
+}
+
+// droppedSnapshot returns a copy of the drop counts.
+func (m *metrics) droppedSnapshot() map[string]uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return maps.Clone(m.dropped)
+}
+
+// countedConn counts the bytes read from and written to a connection, in
+// the server totals and its own.
+type countedConn struct {
+	net.Conn
+	m        *metrics
+	received atomic.Uint64
+	sent     atomic.Uint64
+}
+
+func (c *countedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.m.received.Add(uint64(n))
+	c.received.Add(uint64(n))
+	return n, err
+}
+
+func (c *countedConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.m.sent.Add(uint64(n))
+	c.sent.Add(uint64(n))
+	return n, err
+}
+
+func (m *metrics) countDrop(reason string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.dropped == nil {
+		m.dropped = make(map[string]uint64)
+	}
+	m.dropped[reason]++
+}
+
+// dropConnection logs and counts a connection refused before the SSH
+// handshake; args add details to the log line.
+func (s *Server) dropConnection(logger *slog.Logger, conn net.Conn, reason string, args ...any) {
+	s.metrics.countDrop(reason)
+	logger.Warn("connection dropped", append([]any{"remote", conn.RemoteAddr().String(), "reason", reason}, args...)...)
+}
+
+// writeMetrics writes the current metrics to w.
+func (s *Server) writeMetrics(w io.Writer) {
+	fmt.Fprintln(w, "# HELP tinyssh_connections_open Open SSH connections.")
+	fmt.Fprintln(w, "# TYPE tinyssh_connections_open gauge")
+	fmt.Fprintf(w, "tinyssh_connections_open %d\n", s.connections.Load())
+	counter := func(name, help string, value uint64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, value)
+	}
+	counter("tinyssh_connections_total", "Connections accepted.", s.metrics.accepted.Load())
+	counter("tinyssh_auth_failures_total", "Failed authentication attempts.", s.metrics.authFailures.Load())
+	counter("tinyssh_bytes_received_total", "Bytes received on SSH connections.", s.metrics.received.Load())
+	counter("tinyssh_bytes_sent_total", "Bytes sent on SSH connections.", s.metrics.sent.Load())
+
+	traffic := s.traffic.snapshot()
+	for _, m := range []struct {
+		name, help string
+		value      func(UserTraffic) uint64
+	}{
+		{"tinyssh_user_bytes_received_total", "Bytes received on SSH connections, by user.", func(t UserTraffic) uint64 { return t.BytesReceived }},
+		{"tinyssh_user_bytes_sent_total", "Bytes sent on SSH connections, by user.", func(t UserTraffic) uint64 { return t.BytesSent }},
+	} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", m.name, m.help, m.name)
+		for _, t := range traffic {
+			fmt.Fprintf(w, "%s{user=%q} %d\n", m.name, t.User, m.value(t))
+		}
+	}
+
+	dropped := s.metrics.droppedSnapshot()
+	fmt.Fprintln(w, "# HELP tinyssh_connections_dropped_total Connections refused before the SSH handshake.")
+	fmt.Fprintln(w, "# TYPE tinyssh_connections_dropped_total counter")
+	for _, reason := range slices.Sorted(maps.Keys(dropped)) {
+		fmt.Fprintf(w, "tinyssh_connections_dropped_total{reason=%q} %d\n", reason, dropped[reason])
+	}
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"io"
+	"sync"
+)
+
+// outputReadSize is the size of each read from a session's PTY.
+const outputReadSize = 32 * 1024
+
+// outputPump copies session output from src to dst through a bounded buffer.
+// Writes to an SSH channel block while the client's window is exhausted; once
+// the buffered plus in-flight bytes reach limit the pump stops reading src, so
+// a stalled client stalls the child process instead of growing memory.
+//
+// Reads and writes run on separate goroutines. Everything read while a write
+// is in flight is handed to the next write as a single batch, so bulk output
+// that arrives from the PTY in small pieces leaves in few large channel
+// writes rather than one SSH packet per read.
+type outputPump struct {
+	src      io.Reader
+	dst      io.Writer
+	limit    int
+	readSize int
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	buf      []byte
+	inflight int
+	readErr  error
+	writeErr error
+	stopped  bool
+	done     chan struct{}
+}
+
+func newOutputPump(src io.Reader, dst io.Writer, limit, readSize int) *outputPump {
+	p := &outputPump{
+		src:      src,
+		dst:      dst,
+		limit:    limit,
+		readSize: readSize,
+		done:     make(chan struct{}),
+	}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+// start launches the read and write sides of the pump.
+func (p *outputPump) start() {
+	go p.fill()
+	go p.drain()
+}
+
+// wait blocks until all output read from src has been written to dst, or
+// until writing to dst failed.
+func (p *outputPump) wait() {
+	<-p.done
+}
+
+// stop ends the pump without waiting for src to reach EOF: output already
+// read is still written, anything read later is dropped.
+func (p *outputPump) stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stopped = true
+	if p.readErr == nil {
+		p.readErr = io.EOF
+	}
+	p.cond.Broadcast()
+}
+
+func (p *outputPump) fill() {
+	chunk := make([]byte, p.readSize)
+	for {
+		p.mu.Lock()
+		for len(p.buf)+p.inflight >= p.limit && p.writeErr == nil && !p.stopped {
+			p.cond.Wait()
+		}
+		stopped := p.writeErr != nil || p.stopped
+		room := p.limit - len(p.buf) - p.inflight
+		p.mu.Unlock()
+		if stopped {
+			return
+		}
+
+		n, err := p.src.Read(chunk[:min(room, len(chunk))])
+
+		p.mu.Lock()
+		if p.stopped {
+			p.mu.Unlock()
+			return
+		}
+		p.buf = append(p.buf, chunk[:n]...)
+		if err != nil {
+			p.readErr = err
+		}
+		p.cond.Broadcast()
+		p.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (p *outputPump) drain() {
+	defer close(p.done)
+
+	var out []byte
+	for {
+		p.mu.Lock()
+		for len(p.buf) == 0 && p.readErr == nil {
+			p.cond.Wait()
+		}
+		if len(p.buf) == 0 {
+			p.mu.Unlock()
+			return
+		}
+		out, p.buf = p.buf, out[:0]
+		p.inflight = len(out)
+		p.mu.Unlock()
+
+		_, err := p.dst.Write(out)
+
+		p.mu.Lock()
+		p.inflight = 0
+		if err != nil {
+			p.writeErr = err
+		}
+		p.cond.Broadcast()
+		p.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/creack/pty"
+	"golang.org/x/crypto/ssh"
+)
+
+// benchOutputSize is the session output copied per benchmark iteration.
+const benchOutputSize = 16 << 20
+
+// benchChannel returns the server side of a session channel on a loopback
+// SSH connection whose client discards what it receives, so
+// writes pay for encryption and flow control as they would in a session.
+func benchChannel(b *testing.B) ssh.Channel {
+	b.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		b.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		b.Fatal(err)
+	}
+	serverConfig := &ssh.ServerConfig{NoClientAuth: true}
+	serverConfig.AddHostKey(signer)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer ln.Close()
+
+	channels := make(chan ssh.Channel, 1)
+	go func() {
+		serverNet, err := ln.Accept()
+		if err != nil {
+			close(channels)
+			return
+		}
+		_, chans, reqs, err := ssh.NewServerConn(serverNet, serverConfig)
+		if err != nil {
+			close(channels)
+			return
+		}
+		go ssh.DiscardRequests(reqs)
+		newChannel := <-chans
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			close(channels)
+			return
+		}
+		go ssh.DiscardRequests(requests)
+		channels <- channel
+	}()
+
+	clientNet, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	conn, chans, reqs, err := ssh.NewClientConn(clientNet, "bench", &ssh.ClientConfig{
+		User:            "bench",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	client := ssh.NewClient(conn, chans, reqs)
+	clientChannel, requests, err := client.OpenChannel("session", nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	go ssh.DiscardRequests(requests)
+	go func() { _, _ = io.Copy(io.Discard, clientChannel) }()
+	b.Cleanup(func() { _ = client.Close() })
+
+	channel, ok := <-channels
+	if !ok {
+		b.Fatal("server side of the channel failed")
+	}
+	return channel
+}
+
+// benchOutputSource starts a command writing benchOutputSize bytes to a
+// PTY, as bulk output such as cat of a large file reaches a session, and
+// returns the PTY master.
+func benchOutputSource(b *testing.B) *os.File {
+	b.Helper()
+	c := exec.Command("head", "-c", strconv.Itoa(benchOutputSize), "/dev/zero")
+	ptmx, err := pty.Start(c)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { _ = c.Wait() })
+	return ptmx
+}
+
+// writeCounter counts the writes made to an io.Writer.
+type writeCounter struct {
+	io.Writer
+	writes int
+}
+
+func (w *writeCounter) Write(p []byte) (int, error) {
+	w.writes++
+	return w.Writer.Write(p)
+}
+
+// BenchmarkOutputPump compares the io.Copy with a 32 KiB buffer that
+// sessions used before with the output pump at the default
+// session_output_buffer. A PTY hands over a few KiB per read; the pump
+// batches them into far fewer channel writes (writes/op), while throughput
+// stays bound by encryption. The PTY ends with EIO once the command exits,
+// as it does in a session.
+func BenchmarkOutputPump(b *testing.B) {
+	b.Run("io.Copy", func(b *testing.B) {
+		channel := &writeCounter{Writer: benchChannel(b)}
+		buf := make([]byte, 32*1024)
+		b.SetBytes(benchOutputSize)
+		b.ResetTimer()
+		for range b.N {
+			src := benchOutputSource(b)
+			if _, err := io.CopyBuffer(channel, src, buf); err != nil && !errors.Is(err, syscall.EIO) {
+				b.Fatal(err)
+			}
+			_ = src.Close()
+		}
+		b.ReportMetric(float64(channel.writes)/float64(b.N), "writes/op")
+	})
+	b.Run("outputPump", func(b *testing.B) {
+		channel := &writeCounter{Writer: benchChannel(b)}
+		b.SetBytes(benchOutputSize)
+		b.ResetTimer()
+		for range b.N {
+			src := benchOutputSource(b)
+			p := newOutputPump(src, channel, 256*1024, outputReadSize)
+			p.start()
+			p.wait()
+			if p.writeErr != nil {
+				b.Fatal(p.writeErr)
+			}
+			_ = src.Close()
+		}
+		b.ReportMetric(float64(channel.writes)/float64(b.N), "writes/op")
+	})
+}
@@ -0,0 +1,243 @@
+//go:build cgo
+
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/miekg/pkcs11"
+
+	"github.com/dollarkillerx/tinyssh/internal/config"
+)
+
+// loadPKCS11HostKey opens a session on the configured token and returns a
+// signer for the labelled key. The session stays open for the life of the
+// process.
+func loadPKCS11HostKey(cfg config.PKCS11Key) (crypto.Signer, error) {
+	pin := cfg.PIN
+	if cfg.PINFile != "" {
+		raw, err := os.ReadFile(cfg.PINFile)
+		if err != nil {
+			return nil, fmt.Errorf("read pkcs11 pin: %w", err)
+		}
+		pin = strings.TrimRight(string(raw), "\r\n")
+	}
+
+	ctx := pkcs11.New(cfg.Module)
+	if ctx == nil {
+		return nil, fmt.Errorf("load pkcs11 module %s", cfg.Module)
+	}
+	if err := ctx.Initialize(); err != nil {
+		return nil, fmt.Errorf("initialize pkcs11 module: %w", err)
+	}
+
+	slot, err := findPKCS11Slot(ctx, cfg.TokenLabel)
+	if err != nil {
+		return nil, err
+	}
+	session, err := ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION)
+	if err != nil {
+		return nil, fmt.Errorf("open pkcs11 session: %w", err)
+	}
+	if pin != "" {
+		if err := ctx.Login(session, pkcs11.CKU_USER, pin); err != nil {
+			return nil, fmt.Errorf("pkcs11 login: %w", err)
+		}
+	}
+
+	key, err := findPKCS11Object(ctx, session, pkcs11.CKO_PRIVATE_KEY, cfg.KeyLabel)
+	if err != nil {
+		return nil, err
+	}
+	pubObj, err := findPKCS11Object(ctx, session, pkcs11.CKO_PUBLIC_KEY, cfg.KeyLabel)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := pkcs11PublicKey(ctx, session, pubObj)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pkcs11Signer{ctx: ctx, session: session, key: key, pub: pub}, nil
+}
+
+func findPKCS11Slot(ctx *pkcs11.Ctx, label string) (uint, error) {
+	slots, err := ctx.GetSlotList(true)
+	if err != nil {
+		return 0, fmt.Errorf("list pkcs11 slots: %w", err)
+	}
+	for _, slot := range slots {
+		if label == "" {
+			return slot, nil
+		}
+		info, err := ctx.GetTokenInfo(slot)
+		if err == nil && strings.TrimSpace(info.Label) == label {
+			return slot, nil
+		}
+	}
+	if label == "" {
+		return 0, errors.New("no pkcs11 token present")
+	}
+	return 0, fmt.Errorf("no pkcs11 token labelled %q", label)
+}
+
+func findPKCS11Object(ctx *pkcs11.Ctx, session pkcs11.SessionHandle, class uint, label string) (pkcs11.ObjectHandle, error) {
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, class),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+	}
+	if err := ctx.FindObjectsInit(session, template); err != nil {
+		return 0, fmt.Errorf("find pkcs11 key: %w", err)
+	}
+	objects, _, err := ctx.FindObjects(session, 1)
+	_ = ctx.FindObjectsFinal(session)
+	if err != nil {
+		return 0, fmt.Errorf("find pkcs11 key: %w", err)
+	}
+	if len(objects) == 0 {
+		kind := "private"
+		if class == pkcs11.CKO_PUBLIC_KEY {
+			kind = "public"
+		}
+		return 0, fmt.Errorf("no pkcs11 %s key labelled %q", kind, label)
+	}
+	return objects[0], nil
+}
+
+var pkcs11Curves = map[string]elliptic.Curve{
+	asn1.ObjectIdentifier{1, 2, 840, 10045, 3, 1, 7}.String(): elliptic.P256(),
+	asn1.ObjectIdentifier{1, 3, 132, 0, 34}.String():          elliptic.P384(),
+	asn1.ObjectIdentifier{1, 3, 132, 0, 35}.String():          elliptic.P521(),
+}
+
+func pkcs11PublicKey(ctx *pkcs11.Ctx, session pkcs11.SessionHandle, obj pkcs11.ObjectHandle) (crypto.PublicKey, error) {
+	attrs, err := ctx.GetAttributeValue(session, obj, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, nil),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("read pkcs11 key type: %w", err)
+	}
+	keyType := new(big.Int).SetBytes(reverseIfLittleEndian(attrs[0].Value)).Uint64()
+
+	switch keyType {
+	case pkcs11.CKK_RSA:
+		attrs, err := ctx.GetAttributeValue(session, obj, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_MODULUS, nil),
+			pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, nil),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("read pkcs11 rsa key: %w", err)
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(attrs[0].Value),
+			E: int(new(big.Int).SetBytes(attrs[1].Value).Int64()),
+		}, nil
+	case pkcs11.CKK_EC:
+		attrs, err := ctx.GetAttributeValue(session, obj, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, nil),
+			pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("read pkcs11 ec key: %w", err)
+		}
+		var oid asn1.ObjectIdentifier
+		if _, err := asn1.Unmarshal(attrs[0].Value, &oid); err != nil {
+			return nil, fmt.Errorf("parse pkcs11 ec params: %w", err)
+		}
+		curve, ok := pkcs11Curves[oid.String()]
+		if !ok {
+			return nil, fmt.Errorf("unsupported pkcs11 curve %s", oid)
+		}
+		// CKA_EC_POINT is a DER OCTET STRING wrapping the uncompressed point.
+		var point []byte
+		if _, err := asn1.Unmarshal(attrs[1].Value, &point); err != nil {
+			point = attrs[1].Value
+		}
+		x, y := elliptic.Unmarshal(curve, point)
+		if x == nil {
+			return nil, errors.New("invalid pkcs11 ec point")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("unsupported pkcs11 key type %d", keyType)
+	}
+}
+
+// reverseIfLittleEndian converts a native-endian CK_ULONG attribute to big
+// endian. PKCS#11 modules return integers in host byte order, which is
+// little endian on every platform tinyssh targets.
+func reverseIfLittleEndian(b []byte) []byte {
+	out := make([]byte, len(b))
+	for i := range b {
+		out[len(b)-1-i] = b[i]
+	}
+	return out
+}
+
+// DigestInfo prefixes for CKM_RSA_PKCS, which signs a pre-hashed value.
+var pkcs1Prefixes = map[crypto.Hash][]byte{
+	crypto.SHA1:   {0x30, 0x21, 0x30, 0x09, 0x06, 0x05, 0x2b, 0x0e, 0x03, 0x02, 0x1a, 0x05, 0x00, 0x04, 0x14},
+	crypto.SHA256: {0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20},
+	crypto.SHA512: {0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40},
+}
+
+// pkcs11Signer is a crypto.Signer over a key on a PKCS#11 token. A session
+// may only run one operation at a time, so signing is serialised.
+type pkcs11Signer struct {
+	mu      sync.Mutex
+	ctx     *pkcs11.Ctx
+	session pkcs11.SessionHandle
+	key     pkcs11.ObjectHandle
+	pub     crypto.PublicKey
+}
+
+func (s *pkcs11Signer) Public() crypto.PublicKey {
+	return s.pub
+}
+
+func (s *pkcs11Signer) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	var mechanism uint
+	data := digest
+	switch s.pub.(type) {
+	case *rsa.PublicKey:
+		prefix, ok := pkcs1Prefixes[opts.HashFunc()]
+		if !ok {
+			return nil, fmt.Errorf("pkcs11: unsupported hash %v", opts.HashFunc())
+		}
+		mechanism = pkcs11.CKM_RSA_PKCS
+		data = append(append([]byte{}, prefix...), digest...)
+	case *ecdsa.PublicKey:
+		mechanism = pkcs11.CKM_ECDSA
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.ctx.SignInit(s.session, []*pkcs11.Mechanism{pkcs11.NewMechanism(mechanism, nil)}, s.key); err != nil {
+		return nil, fmt.Errorf("pkcs11 sign: %w", err)
+	}
+	sig, err := s.ctx.Sign(s.session, data)
+	if err != nil {
+		return nil, fmt.Errorf("pkcs11 sign: %w", err)
+	}
+
+	if _, ok := s.pub.(*ecdsa.PublicKey); ok {
+		// CKM_ECDSA returns r||s; crypto.Signer callers expect ASN.1.
+		half := len(sig) / 2
+		return asn1.Marshal(struct{ R, S *big.Int }{
+			new(big.Int).SetBytes(sig[:half]),
+			new(big.Int).SetBytes(sig[half:]),
+		})
+	}
+	return sig, nil
+}
@@ -0,0 +1,14 @@
+//go:build !cgo
+
+package server
+
+import (
+	"crypto"
+	"errors"
+
+	"github.com/dollarkillerx/tinyssh/internal/config"
+)
+
+func loadPKCS11HostKey(cfg config.PKCS11Key) (crypto.Signer, error) {
+	return nil, errors.New("pkcs11 host keys require a cgo build")
+}
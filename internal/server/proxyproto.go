@@ -0,0 +1,149 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// proxyHeaderTimeout bounds how long a trusted peer may take to send the
+// PROXY protocol header.
+const proxyHeaderTimeout = 5 * time.Second
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyConn is a connection whose addresses come from a PROXY protocol
+// header. Reads go through the buffer used to parse the header, which may
+// already hold the start of the SSH stream.
+type proxyConn struct {
+	net.Conn
+	r          *bufio.Reader
+	remoteAddr net.Addr
+	localAddr  net.Addr
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+func (c *proxyConn) RemoteAddr() net.Addr       { return c.remoteAddr }
+func (c *proxyConn) LocalAddr() net.Addr        { return c.localAddr }
+
+// readProxyHeader consumes a PROXY protocol v1 or v2 header from conn and
+// returns a connection reporting the client addresses it carries. LOCAL
+// (health check) and UNKNOWN headers keep the load balancer's addresses.
+func readProxyHeader(conn net.Conn) (net.Conn, error) {
+	_ = conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	r := bufio.NewReader(conn)
+	pc := &proxyConn{Conn: conn, r: r, remoteAddr: conn.RemoteAddr(), localAddr: conn.LocalAddr()}
+
+	prefix, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, fmt.Errorf("read proxy header: %w", err)
+	}
+	switch {
+	case bytes.Equal(prefix, proxyV2Signature):
+		err = pc.parseV2()
+	case bytes.HasPrefix(prefix, []byte("PROXY ")):
+		err = pc.parseV1()
+	default:
+		err = errors.New("missing proxy protocol header")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return pc, nil
+}
+
+// parseV1 parses the text header, e.g.
+// "PROXY TCP4 192.0.2.1 198.51.100.1 56324 22\r\n".
+func (c *proxyConn) parseV1() error {
+	var line []byte
+	for len(line) < 107 {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return fmt.Errorf("read proxy header: %w", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return errors.New("proxy v1 header too long")
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return fmt.Errorf("malformed proxy v1 header %q", bytes.TrimSpace(line))
+	}
+	src, err := parseProxyAddr(fields[2], fields[4])
+	if err != nil {
+		return err
+	}
+	dst, err := parseProxyAddr(fields[3], fields[5])
+	if err != nil {
+		return err
+	}
+	c.remoteAddr, c.localAddr = src, dst
+	return nil
+}
+
+func parseProxyAddr(host, port string) (*net.TCPAddr, error) {
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return nil, fmt.Errorf("proxy header address: %w", err)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("proxy header port: %w", err)
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, uint16(p))), nil
+}
+
+// parseV2 parses the binary header. TLVs after the addresses are skipped.
+func (c *proxyConn) parseV2() error {
+	var header [16]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		return fmt.Errorf("read proxy header: %w", err)
+	}
+	if header[12]>>4 != 2 {
+		return fmt.Errorf("unsupported proxy protocol version %d", header[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		return fmt.Errorf("read proxy header: %w", err)
+	}
+	if header[12]&0x0f == 0 { // LOCAL
+		return nil
+	}
+
+	var size int
+	switch header[13] >> 4 {
+	case 1: // AF_INET
+		size = 4
+	case 2: // AF_INET6
+		size = 16
+	default: // AF_UNSPEC or AF_UNIX
+		return nil
+	}
+	if len(body) < 2*size+4 {
+		return errors.New("proxy v2 header too short")
+	}
+	srcIP, _ := netip.AddrFromSlice(body[:size])
+	dstIP, _ := netip.AddrFromSlice(body[size : 2*size])
+	srcPort := binary.BigEndian.Uint16(body[2*size:])
+	dstPort := binary.BigEndian.Uint16(body[2*size+2:])
+	c.remoteAddr = net.TCPAddrFromAddrPort(netip.AddrPortFrom(srcIP, srcPort))
+	c.localAddr = net.TCPAddrFromAddrPort(netip.AddrPortFrom(dstIP, dstPort))
+	return nil
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// rdnsTimeout bounds the reverse and forward lookups of use_dns.
+	rdnsTimeout = 2 * time.Second
+	// rdnsCacheTTL is how long resolved names are reused.
+	rdnsCacheTTL = 10 * time.Minute
+)
+
+// rdnsResult is the PTR name of a client address. verified is true when
+// the name resolves back to the address, as a PTR record alone is under the
+// control of whoever owns the address.
+type rdnsResult struct {
+	name     string
+	verified bool
+}
+
+// rdnsCache resolves client host names for use_dns.
+type rdnsCache struct {
+	mu        sync.Mutex
+	entries   map[netip.Addr]rdnsEntry
+	lastSweep time.Time
+}
+
+type rdnsEntry struct {
+	rdnsResult
+	expires time.Time
+}
+
+func newRDNSCache(enabled bool) *rdnsCache {
+	if !enabled {
+		return nil
+	}
+	return &rdnsCache{entries: make(map[netip.Addr]rdnsEntry)}
+}
+
+// lookup starts resolving ip and returns a channel delivering the result,
+// so that the SSH handshake does not wait for DNS.
+func (c *rdnsCache) lookup(ctx context.Context, ip netip.Addr) <-chan rdnsResult {
+	result := make(chan rdnsResult, 1)
+	now := time.Now()
+	c.mu.Lock()
+	entry, ok := c.entries[ip]
+	c.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		result <- entry.rdnsResult
+		return result
+	}
+
+	go func() {
+		r, err := resolveHost(ctx, ip)
+		result <- r
+		if err != nil {
+			return
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if now.Sub(c.lastSweep) > time.Minute {
+			for addr, entry := range c.entries {
+				if now.After(entry.expires) {
+					delete(c.entries, addr)
+				}
+			}
+			c.lastSweep = now
+		}
+		c.entries[ip] = rdnsEntry{rdnsResult: r, expires: now.Add(rdnsCacheTTL)}
+	}()
+	return result
+}
+
+// resolveHost looks up the PTR name of ip and checks that it resolves back.
+// An address without a PTR record yields an empty result and no error.
+func resolveHost(ctx context.Context, ip netip.Addr) (rdnsResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, rdnsTimeout)
+	defer cancel()
+	names, err := net.DefaultResolver.LookupAddr(ctx, ip.String())
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			return rdnsResult{}, nil
+		}
+		return rdnsResult{}, err
+	}
+	if len(names) == 0 {
+		return rdnsResult{}, nil
+	}
+	name := strings.TrimSuffix(names[0], ".")
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", name)
+	if err != nil {
+		return rdnsResult{name: name}, nil
+	}
+	for i := range addrs {
+		addrs[i] = addrs[i].Unmap()
+	}
+	return rdnsResult{name: name, verified: slices.Contains(addrs, ip)}, nil
+}
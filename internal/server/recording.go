@@ -0,0 +1,399 @@
+package server
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"filippo.io/age"
+
+	"github.com/dollarkillerx/tinyssh/internal/config"
+)
+
+// recording writes one interactive session in one of two formats. An
+// asciicast v2 file has a JSON header line followed by one [time, code,
+// data] line per event. The script format is the pair of files written by
+// "script --timing" and read by scriptreplay: the typescript holds the raw
+// output and the timing file a "delay bytes" line per write. With age
+// recipients configured, every file is encrypted to them. Input, when
+// recorded, becomes "i" events in an asciicast and goes to a third file in
+// the script format, as "script --log-in" writes it. Recording
+// never fails the session: once writing fails or the size limit is
+// reached, further events are dropped and the reason is logged.
+type recording struct {
+	path   string
+	format string
+	user   string
+	// withInput is set when input is recorded too.
+	withInput bool
+	logger    *slog.Logger
+	maxSize   int64
+	// files lists every file written, for the upload once finished.
+	files []string
+
+	mu sync.Mutex
+	// closers finish the files, encryption first.
+	closers []io.Closer
+	w       *bufio.Writer
+	timing  *bufio.Writer
+	// in receives input in the script format.
+	in    *bufio.Writer
+	start time.Time
+	last  time.Time
+	size  int64
+	// stopped is set once events are dropped.
+	stopped bool
+	// pending and pendingIn hold the start of a UTF-8 sequence of output
+	// and input split across writes, since asciicast data must be valid
+	// UTF-8.
+	pending   []byte
+	pendingIn []byte
+}
+
+// recordingHeader is the first line of an asciicast v2 file.
+type recordingHeader struct {
+	Version   int               `json:"version"`
+	Width     uint32            `json:"width"`
+	Height    uint32            `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// startRecording creates the recording of a session of user in the
+// directory of opts, first deleting the oldest recordings if the
+// directory is over its size limit. Input is recorded only with input set.
+func startRecording(opts config.RecordingOptions, user, connID string, cols, rows uint32, env map[string]string, input bool, logger *slog.Logger) (*recording, error) {
+	if err := os.MkdirAll(opts.Dir, 0700); err != nil {
+		return nil, fmt.Errorf("create recording directory: %w", err)
+	}
+	if opts.MaxTotalSize > 0 {
+		pruneRecordings(opts.Dir, opts.MaxTotalSize, logger)
+	}
+
+	var recipients []age.Recipient
+	if len(opts.AgeRecipients) > 0 {
+		var err error
+		if recipients, err = age.ParseRecipients(strings.NewReader(strings.Join(opts.AgeRecipients, "\n"))); err != nil {
+			return nil, fmt.Errorf("recording age_recipients: %w", err)
+		}
+	}
+	suffix := ""
+	if len(recipients) > 0 {
+		suffix = ".age"
+	}
+
+	now := time.Now()
+	name := now.UTC().Format("20060102T150405Z") + "-" + recordingName(user) + "-" + connID + "-*"
+	ext := ".cast"
+	if opts.Format == config.RecordingScript {
+		ext = ".typescript"
+	}
+	file, err := os.CreateTemp(opts.Dir, name+ext+suffix)
+	if err != nil {
+		return nil, fmt.Errorf("create recording: %w", err)
+	}
+	r := &recording{
+		path:      file.Name(),
+		format:    opts.Format,
+		user:      user,
+		withInput: input,
+		logger:    logger,
+		maxSize:   opts.MaxSize,
+		start:     now,
+		last:      now,
+	}
+	w, err := r.open(file, recipients)
+	if err != nil {
+		return nil, err
+	}
+	r.w = bufio.NewWriter(w)
+	cols, rows = cmp.Or(cols, 80), cmp.Or(rows, 24)
+
+	if r.format == config.RecordingScript {
+		base := strings.TrimSuffix(r.path, ext+suffix)
+		w, err := r.create(base+".timing"+suffix, recipients)
+		if err != nil {
+			return nil, err
+		}
+		r.timing = bufio.NewWriter(w)
+		if input {
+			if w, err = r.create(base+".input"+suffix, recipients); err != nil {
+				return nil, err
+			}
+			r.in = bufio.NewWriter(w)
+		}
+		r.write(fmt.Sprintf("Script started on %s [TERM=%q COLUMNS=\"%d\" LINES=\"%d\"]\n",
+			now.Format("2006-01-02 15:04:05-07:00"), env["TERM"], cols, rows))
+		return r, nil
+	}
+	line, err := json.Marshal(recordingHeader{
+		Version:   2,
+		Width:     cols,
+		Height:    rows,
+		Timestamp: now.Unix(),
+		Title:     user + " (" + connID + ")",
+		Env:       env,
+	})
+	if err == nil {
+		r.write(string(line) + "\n")
+	}
+	return r, nil
+}
+
+// create creates another file of the recording at path. If that fails,
+// the files already created are removed.
+func (r *recording) create(path string, recipients []age.Recipient) (io.Writer, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	var w io.Writer
+	if err == nil {
+		w, err = r.open(file, recipients)
+	}
+	if err != nil {
+		for _, c := range r.closers {
+			_ = c.Close()
+		}
+		for _, path := range r.files {
+			_ = os.Remove(path)
+		}
+		return nil, fmt.Errorf("create recording: %w", err)
+	}
+	return w, nil
+}
+
+// open returns the writer for a recording file, which encrypts to
+// recipients if there are any, and adds what must be closed to finish it
+// to r.closers.
+func (r *recording) open(file *os.File, recipients []age.Recipient) (io.Writer, error) {
+	r.files = append(r.files, file.Name())
+	if len(recipients) == 0 {
+		r.closers = append(r.closers, file)
+		return file, nil
+	}
+	w, err := age.Encrypt(file, recipients...)
+	if err != nil {
+		_ = file.Close()
+		_ = os.Remove(file.Name())
+		return nil, fmt.Errorf("encrypt recording: %w", err)
+	}
+	r.closers = append(r.closers, w, file)
+	return w, nil
+}
+
+// recordingName makes user safe to use in a file name.
+func recordingName(user string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == '_' || r == '.' || r == '@' ||
+			'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' {
+			return r
+		}
+		return '_'
+	}, user)
+}
+
+// recordedWriter passes session output on to w and records what was
+// written.
+type recordedWriter struct {
+	w      io.Writer
+	record *recording
+}
+
+func (rw *recordedWriter) Write(p []byte) (int, error) {
+	n, err := rw.w.Write(p)
+	rw.record.output(p[:n])
+	return n, err
+}
+
+// output records data written to the terminal.
+func (r *recording) output(data []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stopped {
+		return
+	}
+	if r.format == config.RecordingScript {
+		now := time.Now()
+		if r.write(string(data)) {
+			fmt.Fprintf(r.timing, "%.6f %d\n", now.Sub(r.last).Seconds(), len(data))
+		}
+		r.last = now
+		return
+	}
+
+	if data = completeRunes(&r.pending, data); len(data) > 0 {
+		r.event("o", string(data))
+	}
+}
+
+// recordedReader passes session input on from r and records what was
+// read.
+type recordedReader struct {
+	r      io.Reader
+	record *recording
+}
+
+func (rr *recordedReader) Read(p []byte) (int, error) {
+	n, err := rr.r.Read(p)
+	rr.record.input(p[:n])
+	return n, err
+}
+
+// input records data typed by the client.
+func (r *recording) input(data []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stopped || !r.withInput || len(data) == 0 {
+		return
+	}
+	if r.format == config.RecordingScript {
+		r.writeTo(r.in, string(data))
+		return
+	}
+	if data = completeRunes(&r.pendingIn, data); len(data) > 0 {
+		r.event("i", string(data))
+	}
+}
+
+// completeRunes returns the bytes held in pending followed by data, up to
+// an incomplete UTF-8 sequence at the end, which it holds back in pending
+// for the next call.
+func completeRunes(pending *[]byte, data []byte) []byte {
+	data = append(*pending, data...)
+	complete := len(data)
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				complete = i
+			}
+			break
+		}
+	}
+	*pending = slices.Clone(data[complete:])
+	return data[:complete]
+}
+
+// resize records a change of the terminal size. The script format has no
+// place for it.
+func (r *recording) resize(cols, rows uint32) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.stopped && r.format != config.RecordingScript {
+		r.event("r", fmt.Sprintf("%dx%d", cols, rows))
+	}
+}
+
+// event writes one asciicast event line. r.mu must be held.
+func (r *recording) event(code, data string) {
+	elapsed := time.Since(r.start).Seconds()
+	line, err := json.Marshal([]any{float64(int64(elapsed*1e6)) / 1e6, code, data})
+	if err != nil {
+		r.stop("encode", err)
+		return
+	}
+	r.write(string(line) + "\n")
+}
+
+// write appends data to the recording and reports whether it did, which
+// it does not once writing failed or would exceed the size limit. r.mu
+// must be held.
+func (r *recording) write(data string) bool {
+	return r.writeTo(r.w, data)
+}
+
+// writeTo is write to one of the files of the recording. Every file counts
+// towards the size limit. r.mu must be held.
+func (r *recording) writeTo(w *bufio.Writer, data string) bool {
+	if r.maxSize > 0 && r.size+int64(len(data)) > r.maxSize {
+		r.stop("size limit reached", nil)
+		return false
+	}
+	if _, err := w.WriteString(data); err != nil {
+		r.stop("write", err)
+		return false
+	}
+	r.size += int64(len(data))
+	return true
+}
+
+// stop drops the events that follow, logging why. r.mu must be held.
+func (r *recording) stop(reason string, err error) {
+	r.stopped = true
+	if err != nil {
+		r.logger.Warn("recording stopped", "path", r.path, "reason", reason, "err", err)
+	} else {
+		r.logger.Warn("recording stopped", "path", r.path, "reason", reason)
+	}
+}
+
+// close finishes the recording files.
+func (r *recording) close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.format == config.RecordingScript && !r.stopped {
+		r.write("\nScript done on " + time.Now().Format("2006-01-02 15:04:05-07:00") + "\n")
+	}
+	r.stopped = true
+	err := r.w.Flush()
+	if r.timing != nil {
+		err = cmp.Or(err, r.timing.Flush())
+	}
+	if r.in != nil {
+		err = cmp.Or(err, r.in.Flush())
+	}
+	for _, c := range r.closers {
+		err = cmp.Or(err, c.Close())
+	}
+	return err
+}
+
+// pruneRecordings deletes the oldest recordings in dir until the rest
+// total at most maxTotal bytes.
+func pruneRecordings(dir string, maxTotal int64, logger *slog.Logger) {
+	type entry struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	var entries []entry
+	var total int64
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		entries = append(entries, entry{path, info.Size(), info.ModTime()})
+		total += info.Size()
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		logger.Warn("prune recordings", "dir", dir, "err", err)
+		return
+	}
+	slices.SortFunc(entries, func(a, b entry) int { return a.modTime.Compare(b.modTime) })
+	for _, e := range entries {
+		if total <= maxTotal {
+			return
+		}
+		if err := os.Remove(e.path); err != nil {
+			logger.Warn("prune recordings", "path", e.path, "err", err)
+			continue
+		}
+		total -= e.size
+		logger.Info("recording deleted", "path", e.path, "reason", "max_total_size")
+	}
+}
@@ -0,0 +1,233 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"net/url"
+	"reflect"
+
+	"golang.org/x/time/rate"
+
+	"github.com/dollarkillerx/tinyssh/internal/config"
+)
+
+// settings is everything derived from the configuration that Reload can
+// replace while the server runs. Connections load it once when they start
+// and keep that snapshot until they end.
+type settings struct {
+	cfg          *config.Config
+	users        map[string]config.User
+	listeners    []*sshListener
+	allowNets    []netip.Prefix
+	denyNets     []netip.Prefix
+	connRate     *addrLimiter
+	geo          *geoIP
+	dnsbl        *dnsbl
+	rdns         *rdnsCache
+	ingress      *rate.Limiter
+	egress       *rate.Limiter
+	forwardProxy *url.URL
+}
+
+// newSettings derives the settings for cfg. Rate limit buckets and lookup
+// caches are taken over from prev when their options did not change, so a
+// reload neither resets limits nor repeats DNS queries.
+func newSettings(cfg *config.Config, prev *settings) (*settings, error) {
+	next := &settings{cfg: cfg, users: cfg.UsersByName()}
+	var err error
+	if next.listeners, err = newSSHListeners(cfg); err != nil {
+		return nil, err
+	}
+	for _, entry := range cfg.AllowCIDRs {
+		prefix, _ := config.ParsePrefix(entry)
+		next.allowNets = append(next.allowNets, prefix)
+	}
+	for _, entry := range cfg.DenyCIDRs {
+		prefix, _ := config.ParsePrefix(entry)
+		next.denyNets = append(next.denyNets, prefix)
+	}
+	if cfg.ForwardDial.Proxy != "" {
+		if next.forwardProxy, err = url.Parse(cfg.ForwardDial.Proxy); err != nil {
+			return nil, fmt.Errorf("parse forward proxy: %w", err)
+		}
+	}
+	// The GeoIP database is always read again to pick up updates.
+	if next.geo, err = newGeoIP(cfg.GeoIP); err != nil {
+		return nil, err
+	}
+
+	if prev != nil && prev.cfg.ConnectionRate == cfg.ConnectionRate {
+		next.connRate = prev.connRate
+	} else {
+		next.connRate = newAddrLimiter(cfg.ConnectionRate)
+	}
+	if prev != nil && reflect.DeepEqual(prev.cfg.DNSBL, cfg.DNSBL) {
+		next.dnsbl = prev.dnsbl
+	} else {
+		next.dnsbl = newDNSBL(cfg.DNSBL)
+	}
+	if prev != nil && prev.cfg.UseDNS == cfg.UseDNS {
+		next.rdns = prev.rdns
+	} else {
+		next.rdns = newRDNSCache(cfg.UseDNS)
+	}
+	if prev != nil && prev.cfg.IngressRateLimit == cfg.IngressRateLimit {
+		next.ingress = prev.ingress
+	} else {
+		next.ingress = newByteLimiter(cfg.IngressRateLimit)
+	}
+	if prev != nil && prev.cfg.EgressRateLimit == cfg.EgressRateLimit {
+		next.egress = prev.egress
+	} else {
+		next.egress = newByteLimiter(cfg.EgressRateLimit)
+	}
+	return next, nil
+}
+
+// user returns the account for login: the user of that name, or else the
+// wildcard user's settings under that name.
+func (st *settings) user(login string) (config.User, bool) {
+	if user, ok := st.users[login]; ok {
+		return user, true
+	}
+	return st.cfg.WildcardAccount(login)
+}
+
+// config returns the configuration in effect.
+func (s *Server) config() *config.Config {
+	return s.current.Load().cfg
+}
+
+// Reload applies cfg without dropping connections: users, address and
+// rate limits, listener settings and the like apply to connections
+// accepted from now on, while existing ones keep the settings they started
+// with. Listening sockets stay open unless their address was removed, and
+// new addresses are bound. If cfg cannot be applied, including when a new
+// address cannot be bound, the previous configuration stays in effect and
+// the error is returned. Settings that are only read at startup are
+// logged and otherwise ignored until a restart.
+func (s *Server) Reload(cfg *config.Config) error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	prev := s.current.Load()
+	next, err := newSettings(cfg, prev)
+	if err != nil {
+		return err
+	}
+	hostKeys := s.keyring.handshake()
+	for _, l := range next.listeners {
+		l.sshConfig.Store(l.serverConfig(s, hostKeys))
+	}
+	if err := s.rebind(next.listeners); err != nil {
+		return err
+	}
+	for _, name := range restartOnly(prev.cfg, cfg) {
+		s.logger.Warn("setting change needs a restart", "setting", name)
+	}
+	s.current.Store(next)
+	s.logger.Info("configuration reloaded", "changed", config.Changed(prev.cfg, cfg))
+	return nil
+}
+
+// restartOnly names the settings that differ between prev and next but
+// only take effect at startup.
+func restartOnly(prev, next *config.Config) []string {
+	var changed []string
+	check := func(name string, a, b any) {
+		if !reflect.DeepEqual(a, b) {
+			changed = append(changed, name)
+		}
+	}
+	check("admin_listen", prev.AdminListen, next.AdminListen)
+	check("vhost.listen", prev.VHost.Listen, next.VHost.Listen)
+	check("web_terminal.listen", prev.WebTerminal.Listen, next.WebTerminal.Listen)
+	check("reservations", prev.Reservations, next.Reservations)
+	check("host_key_agent", prev.HostKeyAgent, next.HostKeyAgent)
+	check("host_key_pkcs11", prev.HostKeyPKCS11, next.HostKeyPKCS11)
+	check("host_key_tpm", prev.HostKeyTPM, next.HostKeyTPM)
+	check("host_key_kms", prev.HostKeyKMS, next.HostKeyKMS)
+	check("reuse_port", prev.ReusePort, next.ReusePort)
+	// Applied when a listening socket is bound; rebind keeps the sockets
+	// of addresses that stay.
+	check("bind_interface", prev.BindInterface, next.BindInterface)
+	check("address_family", prev.AddressFamily, next.AddressFamily)
+	check("tcp.send_buffer", prev.TCP.SendBuffer, next.TCP.SendBuffer)
+	check("tcp.receive_buffer", prev.TCP.ReceiveBuffer, next.TCP.ReceiveBuffer)
+	check("accept_loops", prev.AcceptLoops, next.AcceptLoops)
+	check("watch_config", prev.WatchConfig, next.WatchConfig)
+	check("log", prev.Log, next.Log)
+	return changed
+}
+
+// rebind points the sockets of addresses that are still configured at
+// their new listener settings, closes the sockets of removed addresses and
+// binds added ones. If an added address cannot be bound, the listeners are
+// put back as they were and the error is returned. It does nothing before
+// Run has bound the listeners.
+func (s *Server) rebind(listeners []*sshListener) error {
+	s.bindMu.Lock()
+	defer s.bindMu.Unlock()
+	if s.bound == nil {
+		return nil
+	}
+
+	wanted := make(map[string]*sshListener, len(listeners))
+	for _, l := range listeners {
+		wanted[l.Address] = l
+	}
+	kept := make(map[string]*sshListener)
+	var removed, added []*sshListener
+	for address, b := range s.bound {
+		if l, ok := wanted[address]; ok {
+			kept[address] = b.l.Swap(l)
+			continue
+		}
+		removed = append(removed, b.l.Load())
+		b.close()
+		delete(s.bound, address)
+	}
+	var errs []error
+	for _, l := range listeners {
+		if s.bound[l.Address] != nil {
+			continue
+		}
+		b, err := s.bind(l, nil)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		s.bound[l.Address] = b
+		added = append(added, l)
+	}
+
+	if len(errs) > 0 {
+		// Removed addresses were closed first so that an added address may
+		// reuse their port; binding them again is expected to succeed.
+		for _, l := range added {
+			s.bound[l.Address].close()
+			delete(s.bound, l.Address)
+		}
+		for address, l := range kept {
+			s.bound[address].l.Store(l)
+		}
+		for _, l := range removed {
+			b, err := s.bind(l, nil)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("restore: %w", err))
+				continue
+			}
+			s.bound[l.Address] = b
+			s.start(b)
+		}
+		return errors.Join(errs...)
+	}
+	for _, l := range removed {
+		s.logger.Info("stopped listening", "address", l.Address)
+	}
+	for _, l := range added {
+		s.start(s.bound[l.Address])
+	}
+	return nil
+}
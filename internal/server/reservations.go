@@ -0,0 +1,230 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dollarkillerx/tinyssh/internal/config"
+)
+
+// Reservation is a remote-forward name claimed by a user, together with the
+// port it is always served on.
+type Reservation struct {
+	Name     string    `json:"name"`
+	User     string    `json:"user"`
+	Port     int       `json:"port"`
+	Created  time.Time `json:"created"`
+	LastUsed time.Time `json:"last_used"`
+	// Active is true while a client is forwarding the name.
+	Active bool `json:"active"`
+}
+
+// reservationStore hands out stable ports for named remote forwards
+// ("ssh -R name:0:host:port") and persists them in a JSON file, so a client
+// that reconnects gets the port it had before.
+type reservationStore struct {
+	opts config.ReservationOptions
+
+	mu      sync.Mutex
+	entries map[string]*Reservation
+	active  map[string]int
+}
+
+func loadReservations(opts config.ReservationOptions) (*reservationStore, error) {
+	r := &reservationStore{
+		opts:    opts,
+		entries: make(map[string]*Reservation),
+		active:  make(map[string]int),
+	}
+
+	raw, err := os.ReadFile(opts.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read reservations: %w", err)
+	}
+	var list []*Reservation
+	if err := json.Unmarshal(raw, &list); err != nil {
+		return nil, fmt.Errorf("parse reservations %s: %w", opts.Path, err)
+	}
+	for _, res := range list {
+		res.Active = false
+		r.entries[res.Name] = res
+	}
+	return r, nil
+}
+
+// isReservationName reports whether a tcpip-forward bind address is a
+// reservation name rather than a host: a single DNS label that is not an
+// IP address, "localhost" or a wildcard.
+func isReservationName(host string) bool {
+	if host == "" || host == "localhost" || len(host) > 63 || net.ParseIP(host) != nil {
+		return false
+	}
+	for i, c := range host {
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9':
+		case c == '-' && i > 0 && i < len(host)-1:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// claim marks name as in use by user and returns its port, reserving a new
+// one from the configured range if the name is not known yet.
+func (r *reservationStore) claim(user, name string) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	r.pruneLocked(now)
+
+	res, ok := r.entries[name]
+	if ok && res.User != user {
+		return 0, fmt.Errorf("name %s is reserved by another user", name)
+	}
+	if !ok {
+		port, err := r.freePortLocked()
+		if err != nil {
+			return 0, err
+		}
+		res = &Reservation{Name: name, User: user, Port: port, Created: now}
+		r.entries[name] = res
+	}
+	res.LastUsed = now
+	if err := r.saveLocked(); err != nil {
+		return 0, err
+	}
+	r.active[name]++
+	return res.Port, nil
+}
+
+// owner returns the user holding name, or "" if it is not reserved. It is
+// safe to call on a nil store.
+func (r *reservationStore) owner(name string) string {
+	if r == nil {
+		return ""
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if res, ok := r.entries[name]; ok {
+		return res.User
+	}
+	return ""
+}
+
+// release records that a forward of name has ended.
+func (r *reservationStore) release(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.active[name]--; r.active[name] <= 0 {
+		delete(r.active, name)
+	}
+	if res, ok := r.entries[name]; ok {
+		res.LastUsed = time.Now()
+		_ = r.saveLocked()
+	}
+}
+
+// remove drops a reservation. A forward currently using it keeps running
+// until the client disconnects.
+func (r *reservationStore) remove(name string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.entries[name]; !ok {
+		return false, nil
+	}
+	delete(r.entries, name)
+	return true, r.saveLocked()
+}
+
+// snapshot lists the current reservations ordered by name.
+func (r *reservationStore) snapshot() []Reservation {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.pruneLocked(time.Now()) {
+		_ = r.saveLocked()
+	}
+	list := make([]Reservation, 0, len(r.entries))
+	for name, res := range r.entries {
+		entry := *res
+		entry.Active = r.active[name] > 0
+		list = append(list, entry)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// pruneLocked expires reservations unused for longer than the TTL and
+// reports whether any were removed.
+func (r *reservationStore) pruneLocked(now time.Time) bool {
+	if r.opts.TTL == 0 {
+		return false
+	}
+	ttl := time.Duration(r.opts.TTL) * time.Second
+	pruned := false
+	for name, res := range r.entries {
+		if r.active[name] == 0 && now.Sub(res.LastUsed) > ttl {
+			delete(r.entries, name)
+			pruned = true
+		}
+	}
+	return pruned
+}
+
+func (r *reservationStore) freePortLocked() (int, error) {
+	used := make(map[int]bool, len(r.entries))
+	for _, res := range r.entries {
+		used[res.Port] = true
+	}
+	for port := r.opts.PortMin; port <= r.opts.PortMax; port++ {
+		if !used[port] {
+			return port, nil
+		}
+	}
+	return 0, errors.New("no free reservation ports")
+}
+
+// saveLocked writes the reservations atomically with owner-only
+// permissions.
+func (r *reservationStore) saveLocked() error {
+	list := make([]*Reservation, 0, len(r.entries))
+	for _, res := range r.entries {
+		list = append(list, res)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	raw, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(r.opts.Path), ".reservations-*")
+	if err != nil {
+		return fmt.Errorf("save reservations: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(raw, '\n')); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("save reservations: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("save reservations: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), r.opts.Path); err != nil {
+		return fmt.Errorf("save reservations: %w", err)
+	}
+	return nil
+}
@@ -2,6 +2,10 @@ package server
 
 import (
 	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/subtle"
@@ -13,20 +17,55 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/crypto/ssh"
 
 	"github.com/dollarkillerx/tinyssh/internal/config"
+	"github.com/dollarkillerx/tinyssh/internal/logging"
+	"github.com/dollarkillerx/tinyssh/internal/systemd"
 )
 
 // Server represents a running tiny SSH server instance.
 type Server struct {
-	cfg     *config.Config
-	creds   map[string]string
-	hostKey ssh.Signer
-	logger  *slog.Logger
+	// current holds the settings derived from the configuration; Reload
+	// replaces them.
+	current     atomic.Pointer[settings]
+	keyring     hostKeyring
+	reloadMu    sync.Mutex
+	startups    atomic.Int64
+	connections atomic.Int64
+	logger      *slog.Logger
+	metrics     metrics
+	subsystems  map[string]SubsystemHandler
+	tunnels     tunnelRegistry
+	traffic     trafficAccounts
+	vhosts      vhostRouter
+
+	reservations *reservationStore
+	uploads      *uploader
+	webhooks     *notifier
+	tracer       tracer
+	// logLevel is the level of logger, changed through the admin API; nil
+	// until SetLogLevel is called.
+	logLevel atomic.Pointer[slog.LevelVar]
+	// handshakes maps the remote address of connections in their SSH
+	// handshake to their *handshake, for the authentication callbacks.
+	handshakes sync.Map
+
+	globalRequests map[string]GlobalRequestHandler
+
+	// bound maps each SSH listener address to its sockets while Run is
+	// serving; serveCtx and fail belong to that Run.
+	bindMu   sync.Mutex
+	bound    map[string]*boundListener
+	serveCtx context.Context
+	fail     context.CancelCauseFunc
+	serving  sync.WaitGroup
 }
 
 // New creates a new Server instance based on the provided configuration.
@@ -39,124 +78,594 @@ func New(cfg *config.Config, logger *slog.Logger) (*Server, error) {
 		logger = slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelInfo}))
 	}
 
-	hostKey, err := loadOrCreateHostKey(cfg.HostKeyPath)
+	fileSigners, fileSources, err := loadFileHostKeys(cfg)
 	if err != nil {
 		return nil, err
 	}
+	externalSigners, externalSources, err := loadExternalHostKeys(cfg)
+	if err != nil {
+		return nil, err
+	}
+	hostSigners := slices.Concat(fileSigners, externalSigners)
+	if err := checkHostKeys(hostSigners, slices.Concat(fileSources, externalSources), cfg.Policy()); err != nil {
+		return nil, err
+	}
 
-	return &Server{
-		cfg:     cfg,
-		creds:   cfg.Credentials(),
-		hostKey: hostKey,
+	current, err := newSettings(cfg, nil)
+	if err != nil {
+		return nil, err
+	}
+	srv := &Server{
+		keyring: hostKeyring{active: hostSigners, external: externalSigners, externalSources: externalSources},
 		logger:  logger,
-	}, nil
+	}
+	srv.current.Store(current)
+	srv.uploads = newUploader(srv)
+	srv.webhooks = newNotifier(srv)
+	srv.tracer.srv = srv
+
+	if cfg.Reservations.Enabled() {
+		srv.reservations, err = loadReservations(cfg.Reservations)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if _, ok := cfg.Subsystems["sftp"]; !ok {
+		srv.RegisterSubsystem("sftp", sftpSubsystem)
+	}
+
+	return srv, nil
 }
 
 // Run starts the SSH server and blocks until the context is cancelled or an error occurs.
 func (s *Server) Run(ctx context.Context) error {
-	sshCfg := &ssh.ServerConfig{
-		PasswordCallback: s.validateUser,
-		ServerVersion:    "SSH-2.0-tinyssh",
-	}
-	sshCfg.AddHostKey(s.hostKey)
+	s.updateSSHConfig()
 
-	listener, err := net.Listen("tcp", s.cfg.ListenAddress)
-	if err != nil {
-		return fmt.Errorf("listen %s: %w", s.cfg.ListenAddress, err)
+	cfg := s.config()
+	if cfg.AdminListen != "" {
+		adminListener, err := s.listenAdmin()
+		if err != nil {
+			return err
+		}
+		go s.serveAdmin(ctx, adminListener)
 	}
-	s.logger.Info("listening", "address", listener.Addr().String())
 
-	defer func() {
-		if cerr := listener.Close(); cerr != nil {
-			s.logger.Warn("listener close", "err", cerr)
+	if cfg.VHost.Listen != "" {
+		vhostListener, err := net.Listen("tcp", cfg.VHost.Listen)
+		if err != nil {
+			return fmt.Errorf("vhost listen %s: %w", cfg.VHost.Listen, err)
 		}
-	}()
-
-	var wg sync.WaitGroup
+		go s.serveVHost(ctx, vhostListener)
+	}
 
-	go func() {
-		<-ctx.Done()
-		_ = listener.Close()
-	}()
+	if cfg.WebTerminal.Listen != "" {
+		webListener, err := net.Listen("tcp", cfg.WebTerminal.Listen)
+		if err != nil {
+			return fmt.Errorf("web terminal listen %s: %w", cfg.WebTerminal.Listen, err)
+		}
+		go s.serveWebTerminal(ctx, webListener)
+	}
 
-	for {
-		conn, err := listener.Accept()
+	notifier := systemd.NewNotifier()
+	activated, err := systemd.Listeners()
+	if err != nil {
+		return err
+	}
+	bound := make(map[string]*boundListener)
+	closeAll := func() {
+		for _, b := range bound {
+			b.close()
+		}
+		for _, listener := range activated {
+			_ = listener.Close()
+		}
+	}
+	for _, l := range s.current.Load().listeners {
+		b, err := s.bind(l, &activated)
 		if err != nil {
-			if ctx.Err() != nil {
-				break
-			}
-			if ne, ok := err.(net.Error); ok && ne.Temporary() {
-				s.logger.Warn("temporary accept error", "err", err)
-				time.Sleep(100 * time.Millisecond)
-				continue
-			}
-			return fmt.Errorf("accept connection: %w", err)
+			closeAll()
+			return err
 		}
+		bound[l.Address] = b
+	}
+	if len(activated) > 0 {
+		unused := activated[0].Addr().String()
+		closeAll()
+		return fmt.Errorf("systemd socket %s does not match any listener", unused)
+	}
 
-		wg.Add(1)
-		go func(netConn net.Conn) {
-			defer wg.Done()
-			if err := s.handleConnection(ctx, netConn, sshCfg); err != nil {
-				s.logger.Warn("connection ended", "remote", netConn.RemoteAddr().String(), "err", err)
-			}
-		}(conn)
+	// A listener that fails stops the others so Run reports the error.
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	s.bindMu.Lock()
+	s.bound, s.serveCtx, s.fail = bound, ctx, cancel
+	for _, b := range bound {
+		s.start(b)
+	}
+	s.bindMu.Unlock()
+
+	if err := notifier.Notify("READY=1"); err != nil {
+		s.logger.Warn("systemd notify", "err", err)
+	}
+	if interval := notifier.WatchdogInterval(); interval > 0 {
+		go s.watchdog(ctx, notifier, interval)
+	}
+	go s.pushStatsD(ctx)
+
+	<-ctx.Done()
+	if err := notifier.Notify("STOPPING=1"); err != nil {
+		s.logger.Warn("systemd notify", "err", err)
+	}
+	s.bindMu.Lock()
+	for _, b := range s.bound {
+		b.close()
 	}
+	s.bound = nil
+	s.bindMu.Unlock()
+	s.serving.Wait()
+	// Export the spans of the connections that just ended.
+	s.tracer.flush()
 
-	wg.Wait()
+	// The cause differs from Err only when a listener failed.
+	if err := context.Cause(ctx); err != ctx.Err() {
+		return err
+	}
 	return nil
 }
 
 func (s *Server) validateUser(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
-	expected, ok := s.creds[conn.User()]
+	login, requested := s.splitLogin(conn.User())
+	cur := s.current.Load()
+	user, ok := cur.user(login)
 	if !ok {
 		return nil, fmt.Errorf("unknown user %s", conn.User())
 	}
-	if subtle.ConstantTimeCompare([]byte(expected), password) != 1 {
+	if subtle.ConstantTimeCompare([]byte(user.Password), password) != 1 {
 		return nil, fmt.Errorf("invalid credentials for %s", conn.User())
 	}
-	return nil, nil
+	if !cur.cfg.UserAllowed(login) {
+		return nil, fmt.Errorf("user %s is not in allow_users", login)
+	}
+	upstream, err := routeFor(user, requested)
+	if err != nil {
+		return nil, err
+	}
+	return &ssh.Permissions{
+		Extensions: map[string]string{
+			permUser:     login,
+			permUpstream: upstream,
+		},
+	}, nil
+}
+
+// handshake is what the authentication callbacks use of a connection in
+// its SSH handshake.
+type handshake struct {
+	span   *span
+	logger *slog.Logger
+}
+
+// handshakeOf returns the handshake of conn, or one that logs to the
+// server's logger if it is unknown.
+func (s *Server) handshakeOf(conn ssh.ConnMetadata) *handshake {
+	if hs, ok := s.handshakes.Load(conn.RemoteAddr().String()); ok {
+		return hs.(*handshake)
+	}
+	return &handshake{logger: s.logger}
+}
+
+// newConnID returns a short random ID that tags the log lines and session
+// environment of one connection.
+func newConnID() string {
+	var id [4]byte
+	_, _ = rand.Read(id[:])
+	return fmt.Sprintf("%x", id)
+}
+
+// handleConnection admits netConn and runs it as an SSH connection.
+func (s *Server) handleConnection(ctx context.Context, netConn net.Conn, l *sshListener) error {
+	a, ok := s.admit(ctx, netConn, l)
+	if !ok {
+		_ = netConn.Close()
+		return nil
+	}
+	defer s.release(a)
+	return s.serveSSH(ctx, netConn, l, a)
+}
+
+// admit runs the address-based admission checks on a newly accepted
+// connection, before any handshake: allow and deny CIDRs, GeoIP, the
+// connection rate, DNSBL, max_connections and max_startups. An admitted
+// connection is counted until release.
+func (s *Server) admit(ctx context.Context, netConn net.Conn, l *sshListener) (*admission, bool) {
+	connID := newConnID()
+	logger := s.logger.With("conn", connID)
+	clientHost, port, _ := net.SplitHostPort(netConn.RemoteAddr().String())
+	clientPort, _ := strconv.Atoi(port)
+	s.metrics.accepted.Add(1)
+	connSpan := s.tracer.start("ssh.connection", spanKindServer, connID,
+		"client.address", clientHost, "client.port", clientPort, "tinyssh.listener", l.Address)
+	ok := func() bool {
+		if !s.admitCIDR(netConn, logger) {
+			return false
+		}
+		country, ok := s.admitCountry(netConn, logger)
+		if !ok {
+			return false
+		}
+		if s.current.Load().geo != nil {
+			logger = logger.With("country", country)
+		}
+		if !s.admitRate(netConn, logger) {
+			return false
+		}
+		if !s.admitDNSBL(ctx, netConn, logger) {
+			return false
+		}
+		if !s.admitConnection(netConn, logger) {
+			return false
+		}
+		if !s.admitStartup(netConn, logger) {
+			s.endConnection()
+			return false
+		}
+		return true
+	}()
+	if !ok {
+		connSpan.finish()
+		return nil, false
+	}
+	return &admission{connID: connID, logger: logger, span: connSpan, startup: true}, true
 }
 
-func (s *Server) handleConnection(ctx context.Context, netConn net.Conn, sshCfg *ssh.ServerConfig) error {
+// release ends the accounting of an admitted connection.
+func (s *Server) release(a *admission) {
+	if a.startup {
+		s.endStartup()
+	}
+	s.endConnection()
+	a.span.finish()
+}
+
+// serveSSH runs the SSH handshake and session of an admitted connection,
+// and closes netConn when it ends.
+func (s *Server) serveSSH(ctx context.Context, netConn net.Conn, l *sshListener, a *admission) error {
 	defer func() {
 		_ = netConn.Close()
 	}()
 
-	sshConn, channels, requests, err := ssh.NewServerConn(netConn, sshCfg)
+	cur := s.current.Load()
+	connID, logger, connSpan := a.connID, a.logger, a.span
+	var rdns <-chan rdnsResult
+	if ip, ok := addrIP(netConn.RemoteAddr()); ok && cur.rdns != nil {
+		rdns = cur.rdns.lookup(ctx, ip)
+	}
+	if cur.cfg.LoginGraceTime > 0 {
+		_ = netConn.SetDeadline(time.Now().Add(time.Duration(cur.cfg.LoginGraceTime) * time.Second))
+	}
+	kexConn := newKexInitConn(netConn, *l.RequireStrictKex, cur.cfg.DenyHASSH)
+	hs := &handshake{span: connSpan.child("ssh.handshake", spanKindInternal), logger: logger}
+	s.handshakes.Store(netConn.RemoteAddr().String(), hs)
+	counted := &countedConn{Conn: kexConn, m: &s.metrics}
+	sshConn, channels, requests, err := ssh.NewServerConn(counted, l.sshConfig.Load())
+	s.endStartup()
+	a.startup = false
+	s.handshakes.Delete(netConn.RemoteAddr().String())
+	hs.span.set("tinyssh.hassh", kexConn.KexInit().HASSH(), "tinyssh.client_version", kexConn.KexInit().Version)
+	hs.span.fail(err)
+	hs.span.finish()
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		logger.Warn("login grace time exceeded", "remote", netConn.RemoteAddr().String(), "grace", time.Duration(cur.cfg.LoginGraceTime)*time.Second)
+		return nil
+	}
+	if errors.Is(err, errDeniedHASSH) {
+		s.dropConnection(logger, netConn, "hassh", "hassh", kexConn.KexInit().HASSH(), "client_version", kexConn.KexInit().Version)
+		return nil
+	}
 	if err != nil {
-		return fmt.Errorf("handshake failed: %w", err)
+		logger.Warn("handshake failed", "remote", netConn.RemoteAddr().String(), "hassh", kexConn.KexInit().HASSH(), "err", err)
+		return nil
+	}
+	_ = netConn.SetDeadline(time.Time{})
+	if rdns != nil {
+		if host := <-rdns; host.name != "" {
+			logger = logger.With("rdns", host.name, "rdns_verified", host.verified)
+		}
+	}
+	var kex string
+	if meta, ok := sshConn.Conn.(ssh.AlgorithmsConnMetadata); ok {
+		kex = meta.Algorithms().KeyExchange
+	}
+	logger.Info("client connected", logging.EventKey, logging.EventConnect, "user", sshConn.User(), "remote", sshConn.RemoteAddr().String(),
+		"kex", kex, "post_quantum", config.PostQuantumKex(kex), "strict_kex", kexConn.KexInit().StrictKex(),
+		"hassh", kexConn.KexInit().HASSH())
+	connSpan.set("tinyssh.user", sshConn.User(), "tinyssh.kex", kex)
+	connected := time.Now()
+	login := sshConn.Permissions.Extensions[permUser]
+	defer s.traffic.track(trafficKey(cur, login), counted)()
+	s.webhooks.login(connID, sshConn.User(), sshConn.RemoteAddr())
+	defer s.webhooks.logout(connID, sshConn.User(), sshConn.RemoteAddr(), connected)
+	disconnected := func() {
+		logger.Info("client disconnected", logging.EventKey, logging.EventDisconnect, "user", sshConn.User(), "remote", sshConn.RemoteAddr().String(),
+			"bytes_received", counted.received.Load(), "bytes_sent", counted.sent.Load(),
+			"duration", time.Since(connected).Round(time.Millisecond).String())
+	}
+
+	connCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go s.announceHostKeys(sshConn, logger)
+
+	if upstream := sshConn.Permissions.Extensions[permUpstream]; upstream != "" {
+		if cur.cfg.ClientAliveInterval > 0 {
+			go s.clientAlive(connCtx, sshConn, logger)
+		}
+		connSpan.set("tinyssh.upstream", upstream)
+		if err := s.handleGateway(connCtx, sshConn, channels, requests, login, upstream, logger); err != nil {
+			connSpan.fail(err)
+			logger.Warn("gateway failed", "user", sshConn.User(), "upstream", upstream, "err", err)
+		}
+		disconnected()
+		return nil
 	}
-	s.logger.Info("client connected", "user", sshConn.User(), "remote", sshConn.RemoteAddr().String())
 
-	go ssh.DiscardRequests(requests)
+	account, _ := cur.user(login)
+	fwd := newForwarder(s, sshConn, account, connSpan, logger)
+	defer fwd.closeAll()
+
+	global := &connRequests{srv: s, conn: sshConn, fwd: fwd, logger: logger}
+	go global.serve(connCtx, requests)
 
+	if cur.cfg.ClientAliveInterval > 0 {
+		go s.clientAlive(connCtx, sshConn, logger)
+	}
+
+	var sessions int
 	for newChannel := range channels {
-		if newChannel.ChannelType() != "session" {
+		switch newChannel.ChannelType() {
+		case "session":
+			if account.ForwardingOnly {
+				logger.Warn("session channel denied", "user", sshConn.User(), "reason", "forwarding only")
+				newChannel.Reject(ssh.Prohibited, "account is restricted to port forwarding")
+				continue
+			}
+			// Channel opens and global requests arrive on separate Go
+			// channels, so no-more-sessions may be seen before the session
+			// OpenSSH opened just ahead of it. Only sessions beyond the
+			// first are refused.
+			if global.noMoreSessions.Load() && sessions > 0 {
+				// Like OpenSSH, treat this as hostile and drop the connection.
+				logger.Warn("session channel after no-more-sessions", "user", sshConn.User())
+				newChannel.Reject(ssh.Prohibited, "no more sessions")
+				_ = sshConn.Close()
+				continue
+			}
+
+			channel, requests, err := newChannel.Accept()
+			if err != nil {
+				logger.Error("channel accept", "err", err)
+				continue
+			}
+			sessions++
+
+			counted := &countedChannel{Channel: s.throttleChannel(channel)}
+			handler := &sessionHandler{
+				srv:      s,
+				channel:  counted,
+				traffic:  counted,
+				requests: requests,
+				user:     sshConn.User(),
+				account:  account,
+				connID:   connID,
+				id:       fmt.Sprintf("%s.%d", connID, sessions),
+				logger:   logger,
+				span:     connSpan.child("ssh.session", spanKindServer),
+			}
+
+			go handler.handle(connCtx)
+		case "direct-tcpip":
+			if !fwd.permitted("direct-tcpip") {
+				newChannel.Reject(ssh.Prohibited, "port forwarding is disabled for this account")
+				continue
+			}
+			go fwd.handleDirect(connCtx, newChannel)
+		case "direct-streamlocal@openssh.com":
+			if !fwd.permitted("direct-streamlocal") {
+				newChannel.Reject(ssh.Prohibited, "port forwarding is disabled for this account")
+				continue
+			}
+			go fwd.handleDirectStreamLocal(connCtx, newChannel)
+		case "tun@openssh.com":
+			if !fwd.permitted("tun") {
+				newChannel.Reject(ssh.Prohibited, "tunnel forwarding is disabled for this account")
+				continue
+			}
+			go fwd.handleTunnel(newChannel)
+		default:
 			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
-			continue
 		}
+	}
+
+	disconnected()
+	return nil
+}
 
-		channel, requests, err := newChannel.Accept()
+// updateSSHConfig publishes a ServerConfig per listener offering the
+// current handshake host keys. Connections already in progress keep the
+// config they started with.
+func (s *Server) updateSSHConfig() {
+	hostKeys := s.keyring.handshake()
+	for _, l := range s.current.Load().listeners {
+		l.sshConfig.Store(l.serverConfig(s, hostKeys))
+	}
+}
+
+// loadFileHostKeys loads (or generates) every host_key_paths entry.
+func loadFileHostKeys(cfg *config.Config) ([]ssh.Signer, []string, error) {
+	passphrase, err := cfg.HostKeyPassphraseBytes()
+	if err != nil {
+		return nil, nil, err
+	}
+	var signers []ssh.Signer
+	for _, path := range cfg.HostKeyPaths {
+		signer, err := loadOrCreateHostKey(path, cfg.KeyTypeFor(path), passphrase)
 		if err != nil {
-			s.logger.Error("channel accept", "err", err)
-			continue
+			return nil, nil, fmt.Errorf("%s: %w", path, err)
 		}
+		signers = append(signers, signer)
+	}
+	return signers, cfg.HostKeyPaths, nil
+}
 
-		handler := &sessionHandler{
-			srv:      s,
-			channel:  channel,
-			requests: requests,
-			user:     sshConn.User(),
+// loadExternalHostKeys loads the host keys of cfg held by an agent,
+// hardware or a KMS, with a name for each to report problems with.
+func loadExternalHostKeys(cfg *config.Config) ([]ssh.Signer, []string, error) {
+	var externalSigners []ssh.Signer
+	var externalSources []string
+	if len(cfg.HostKeyAgent) > 0 {
+		agentSigners, err := loadAgentHostKeys(cfg.HostKeyAgentSocket, cfg.HostKeyAgent)
+		if err != nil {
+			return nil, nil, err
+		}
+		externalSigners = append(externalSigners, agentSigners...)
+		externalSources = append(externalSources, cfg.HostKeyAgent...)
+	}
+	if cfg.HostKeyPKCS11.Module != "" {
+		key, err := loadPKCS11HostKey(cfg.HostKeyPKCS11)
+		if err != nil {
+			return nil, nil, err
+		}
+		signer, err := hardwareSigner(key)
+		if err != nil {
+			return nil, nil, fmt.Errorf("pkcs11 host key: %w", err)
+		}
+		externalSigners = append(externalSigners, signer)
+		externalSources = append(externalSources, "pkcs11:"+cfg.HostKeyPKCS11.KeyLabel)
+	}
+	if cfg.HostKeyTPM.Handle != "" {
+		key, err := loadTPMHostKey(cfg.HostKeyTPM)
+		if err != nil {
+			return nil, nil, err
+		}
+		signer, err := hardwareSigner(key)
+		if err != nil {
+			return nil, nil, fmt.Errorf("tpm host key: %w", err)
 		}
+		externalSigners = append(externalSigners, signer)
+		externalSources = append(externalSources, "tpm:"+cfg.HostKeyTPM.Handle)
+	}
+	if cfg.HostKeyKMS.Provider != "" {
+		signer, err := loadKMSHostKey(cfg.HostKeyKMS)
+		if err != nil {
+			return nil, nil, err
+		}
+		externalSigners = append(externalSigners, signer)
+		externalSources = append(externalSources, cfg.HostKeyKMS.Provider+"-kms:"+cfg.HostKeyKMS.Key)
+	}
+	return externalSigners, externalSources, nil
+}
 
-		go handler.handle(ctx)
+// CheckHostKeys reads the host_key_paths files of cfg and applies the
+// checks New does, without generating missing files, which New would
+// create. Agent, hardware and KMS keys are not contacted.
+func CheckHostKeys(cfg *config.Config) error {
+	passphrase, err := cfg.HostKeyPassphraseBytes()
+	if err != nil {
+		return err
 	}
+	var signers []ssh.Signer
+	var sources []string
+	for _, path := range cfg.HostKeyPaths {
+		pemBytes, err := os.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("%s: read host key: %w", path, err)
+		}
+		signer, err := parseHostKey(pemBytes, passphrase)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		signers = append(signers, signer)
+		sources = append(sources, path)
+	}
+	return checkHostKeys(signers, sources, cfg.Policy())
+}
+
+// GenerateHostKeys creates the missing host_key_paths files of cfg as New
+// would and returns the SHA256 fingerprints of all of them, in order.
+func GenerateHostKeys(cfg *config.Config) ([]string, error) {
+	signers, _, err := loadFileHostKeys(cfg)
+	if err != nil {
+		return nil, err
+	}
+	fingerprints := make([]string, len(signers))
+	for i, signer := range signers {
+		fingerprints[i] = ssh.FingerprintSHA256(signer.PublicKey())
+	}
+	return fingerprints, nil
+}
 
-	s.logger.Info("client disconnected", "user", sshConn.User(), "remote", sshConn.RemoteAddr().String())
+// checkHostKeys rejects two host keys of the same type: AddHostKey keeps
+// one key per algorithm, so the second would silently replace the first.
+// It also enforces the crypto_policy host key requirements.
+func checkHostKeys(signers []ssh.Signer, sources []string, policy config.CryptoPolicy) error {
+	seen := make(map[string]string)
+	for i, signer := range signers {
+		keyType := signer.PublicKey().Type()
+		if other, ok := seen[keyType]; ok {
+			return fmt.Errorf("host keys %s and %s are both %s", other, sources[i], keyType)
+		}
+		seen[keyType] = sources[i]
+
+		if keyType == ssh.KeyAlgoDSA && policy.NoSHA1 {
+			return fmt.Errorf("host key %s: DSA keys are not allowed by crypto_policy", sources[i])
+		}
+		if bits := rsaBits(signer.PublicKey()); bits > 0 && bits < policy.MinRSABits {
+			return fmt.Errorf("host key %s: %d-bit RSA key is below the crypto_policy minimum of %d", sources[i], bits, policy.MinRSABits)
+		}
+	}
 	return nil
 }
 
-func loadOrCreateHostKey(path string) (ssh.Signer, error) {
+func rsaBits(key ssh.PublicKey) int {
+	if cryptoKey, ok := key.(ssh.CryptoPublicKey); ok {
+		if pub, ok := cryptoKey.CryptoPublicKey().(*rsa.PublicKey); ok {
+			return pub.N.BitLen()
+		}
+	}
+	return 0
+}
+
+// withoutSHA1 stops an RSA host key from signing key exchanges with
+// ssh-rsa, leaving the SHA-2 algorithms it supports.
+func withoutSHA1(signer ssh.Signer) ssh.Signer {
+	if signer.PublicKey().Type() != ssh.KeyAlgoRSA {
+		return signer
+	}
+	algSigner, ok := signer.(ssh.AlgorithmSigner)
+	if !ok {
+		return signer
+	}
+	algorithms := []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256}
+	if multi, ok := signer.(ssh.MultiAlgorithmSigner); ok {
+		algorithms = slices.DeleteFunc(slices.Clone(multi.Algorithms()), func(a string) bool {
+			return a == ssh.KeyAlgoRSA
+		})
+	}
+	restricted, err := ssh.NewSignerWithAlgorithms(algSigner, algorithms)
+	if err != nil {
+		return signer
+	}
+	return restricted
+}
+
+// loadOrCreateHostKey reads the host key at path, generating one of keyType
+// if it does not exist. Keys may be PEM (PKCS#1, PKCS#8, SEC1) or OpenSSH
+// format; encrypted keys are opened with passphrase, and generated keys are
+// encrypted with it when it is set.
+func loadOrCreateHostKey(path, keyType string, passphrase []byte) (ssh.Signer, error) {
 	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
 		return nil, fmt.Errorf("ensure host key directory: %w", err)
 	}
@@ -164,7 +673,7 @@ func loadOrCreateHostKey(path string) (ssh.Signer, error) {
 	pemBytes, err := os.ReadFile(path)
 	if err != nil {
 		if errors.Is(err, os.ErrNotExist) {
-			pemBytes, err = generateHostKey()
+			pemBytes, err = generateHostKey(keyType, passphrase)
 			if err != nil {
 				return nil, err
 			}
@@ -176,20 +685,69 @@ func loadOrCreateHostKey(path string) (ssh.Signer, error) {
 		}
 	}
 
+	return parseHostKey(pemBytes, passphrase)
+}
+
+// parseHostKey parses a host key, opening it with passphrase if it is
+// encrypted.
+func parseHostKey(pemBytes, passphrase []byte) (ssh.Signer, error) {
 	signer, err := ssh.ParsePrivateKey(pemBytes)
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		if passphrase == nil {
+			return nil, fmt.Errorf("host key is encrypted; set host_key_passphrase, host_key_passphrase_file or %s", config.HostKeyPassphraseEnv)
+		}
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(pemBytes, passphrase)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("parse host key: %w", err)
 	}
-
 	return signer, nil
 }
 
-func generateHostKey() ([]byte, error) {
-	key, err := rsa.GenerateKey(rand.Reader, 4096)
+// generateHostKey creates a PEM-encoded private key of the given
+// host_key_type. RSA keys are 4096 bits, which can take many seconds on
+// small boards; ed25519 is instant. With a passphrase the key is written
+// encrypted in OpenSSH format.
+func generateHostKey(keyType string, passphrase []byte) ([]byte, error) {
+	var key crypto.PrivateKey
+	var err error
+	switch keyType {
+	case config.HostKeyRSA:
+		key, err = rsa.GenerateKey(rand.Reader, 4096)
+	case config.HostKeyECDSA:
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	default:
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("generate rsa key: %w", err)
+		return nil, fmt.Errorf("generate %s key: %w", keyType, err)
 	}
 
-	block := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+	var block *pem.Block
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		if passphrase == nil {
+			block = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}
+		}
+	case *ecdsa.PrivateKey:
+		if passphrase == nil {
+			der, err := x509.MarshalECPrivateKey(k)
+			if err != nil {
+				return nil, fmt.Errorf("marshal ecdsa key: %w", err)
+			}
+			block = &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}
+		}
+	}
+	if block == nil {
+		if passphrase != nil {
+			block, err = ssh.MarshalPrivateKeyWithPassphrase(key, "", passphrase)
+		} else {
+			block, err = ssh.MarshalPrivateKey(key, "")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("marshal %s key: %w", keyType, err)
+		}
+	}
 	return pem.EncodeToMemory(block), nil
 }
@@ -5,143 +5,97 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"os"
 	"os/exec"
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/creack/pty"
 	"golang.org/x/crypto/ssh"
+
+	"github.com/dollarkillerx/tinyssh/internal/config"
+	"github.com/dollarkillerx/tinyssh/internal/logging"
 )
 
+// sessionHandler serves a single "session" channel. Every channel on a
+// connection gets its own handler, so multiplexed clients can run several
+// commands side by side, each with its own environment, PTY and lifetime.
 type sessionHandler struct {
 	srv      *Server
 	channel  ssh.Channel
 	requests <-chan *ssh.Request
 	user     string
+	account  config.User
+	connID   string
+	// id names the session in its audit events: the connection ID and
+	// the number of the session within the connection.
+	id     string
+	logger *slog.Logger
+	// span traces the session; nil while tracing is off.
+	span *span
+	// traffic counts the bytes of channel.
+	traffic *countedChannel
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu      sync.Mutex
+	running bool
+	env     []string
+	cmd     *exec.Cmd
+	ptmx    *os.File
+	output  *outputPump
+	record  *recording
+	wantPTY bool
+	term    string
+	cols    uint32
+	rows    uint32
+	// started and kind are set once a shell, command or subsystem starts;
+	// exitStatus once a command exits.
+	started    time.Time
+	kind       string
+	exitStatus *uint32
 }
 
+// handle processes session requests until the client closes the channel or
+// the parent context (the connection) is cancelled. Cancelling the session
+// terminates its command.
 func (h *sessionHandler) handle(ctx context.Context) {
+	h.ctx, h.cancel = context.WithCancel(ctx)
 	defer func() {
+		h.end()
+		h.span.finish()
+		h.cancel()
 		_ = h.channel.CloseWrite()
 		_ = h.channel.Close()
 	}()
 
-	env := append([]string(nil), os.Environ()...)
-	env = append(env, fmt.Sprintf("USER=%s", h.user))
-	env = append(env, fmt.Sprintf("LOGNAME=%s", h.user))
-	env = append(env, "HOME=/")
-	env = append(env, fmt.Sprintf("SHELL=%s", h.srv.cfg.Shell))
-
-	var (
-		mu       sync.Mutex
-		cmd      *exec.Cmd
-		ptmx     *os.File
-		wantPTY  bool
-		cols     uint32
-		rows     uint32
-		finished sync.Once
-	)
-
-	start := func(command string) error {
-		mu.Lock()
-		defer mu.Unlock()
-		if cmd != nil {
-			err := errors.New("session already running")
-			h.srv.logger.Warn("session start rejected", "user", h.user, "command", command, "err", err)
-			return err
-		}
-
-		args := []string{}
-		if command != "" {
-			args = append(args, "-c", command)
-		}
-
-		c := exec.CommandContext(ctx, h.srv.cfg.Shell, args...)
-		c.Env = append([]string(nil), env...)
-		c.Dir = "/"
-
-		started := false
-
-		if wantPTY {
-			var err error
-			ws := &pty.Winsize{}
-			if cols > 0 {
-				ws.Cols = uint16(cols)
-			}
-			if rows > 0 {
-				ws.Rows = uint16(rows)
-			}
-			if ws.Cols == 0 && ws.Rows == 0 {
-				ptmx, err = pty.Start(c)
-			} else {
-				ptmx, err = pty.StartWithSize(c, ws)
-			}
-			if err != nil {
-				h.srv.logger.Error("start pty shell failed", "user", h.user, "command", command, "err", err)
-				return err
-			}
-
-			go func() {
-				_, _ = io.Copy(h.channel, ptmx)
-			}()
-			go func() {
-				_, _ = io.Copy(ptmx, h.channel)
-			}()
-			started = true
-		} else {
-			c.Stdout = h.channel
-			c.Stderr = h.channel.Stderr()
-			stdin, err := c.StdinPipe()
-			if err != nil {
-				h.srv.logger.Error("allocate stdin pipe failed", "user", h.user, "command", command, "err", err)
-				return err
-			}
-			go func() {
-				_, _ = io.Copy(stdin, h.channel)
-				_ = stdin.Close()
-			}()
-		}
-
-		if !started {
-			if err := c.Start(); err != nil {
-				if ptmx != nil {
-					_ = ptmx.Close()
-					ptmx = nil
-				}
-				h.srv.logger.Error("launch shell failed", "user", h.user, "command", command, "shell", h.srv.cfg.Shell, "err", err)
-				return err
-			}
-		}
-
-		cmd = c
-
-		go func() {
-			<-ctx.Done()
-			mu.Lock()
-			if cmd != nil && cmd.Process != nil {
-				_ = cmd.Process.Signal(syscall.SIGTERM)
-			}
-			mu.Unlock()
-		}()
+	go func() {
+		// The requests channel only closes once the SSH channel does, so
+		// close it ourselves when the connection goes away.
+		<-h.ctx.Done()
+		_ = h.channel.Close()
+	}()
 
-		go func() {
-			err := c.Wait()
-			finished.Do(func() {
-				h.sendExitStatus(err)
-				if ptmx != nil {
-					_ = ptmx.Close()
-				}
-			})
-		}()
-
-		return nil
-	}
+	h.env = append([]string(nil), os.Environ()...)
+	h.env = append(h.env, fmt.Sprintf("USER=%s", h.user))
+	h.env = append(h.env, fmt.Sprintf("LOGNAME=%s", h.user))
+	h.env = append(h.env, "HOME=/")
+	h.env = append(h.env, fmt.Sprintf("SHELL=%s", h.srv.config().Shell))
+	h.env = append(h.env, fmt.Sprintf("TINYSSH_CONN_ID=%s", h.connID))
 
 	for req := range h.requests {
 		switch req.Type {
 		case "pty-req":
+			if h.restricted(req.Type) {
+				if req.WantReply {
+					req.Reply(false, nil)
+				}
+				continue
+			}
 			var payload struct {
 				Term   string
 				Cols   uint32
@@ -156,12 +110,16 @@ func (h *sessionHandler) handle(ctx context.Context) {
 				}
 				continue
 			}
-			wantPTY = true
-			cols = payload.Cols
-			rows = payload.Rows
+			h.span.set("tinyssh.session.pty", true, "tinyssh.session.term", payload.Term)
+			h.mu.Lock()
+			h.wantPTY = true
+			h.cols = payload.Cols
+			h.rows = payload.Rows
 			if payload.Term != "" {
-				env = append(env, fmt.Sprintf("TERM=%s", payload.Term))
+				h.env = append(h.env, fmt.Sprintf("TERM=%s", payload.Term))
+				h.term = payload.Term
 			}
+			h.mu.Unlock()
 			if req.WantReply {
 				req.Reply(true, nil)
 			}
@@ -177,7 +135,9 @@ func (h *sessionHandler) handle(ctx context.Context) {
 				continue
 			}
 			if payload.Key != "" {
-				env = append(env, fmt.Sprintf("%s=%s", payload.Key, payload.Value))
+				h.mu.Lock()
+				h.env = append(h.env, fmt.Sprintf("%s=%s", payload.Key, payload.Value))
+				h.mu.Unlock()
 				if req.WantReply {
 					req.Reply(true, nil)
 				}
@@ -185,46 +145,86 @@ func (h *sessionHandler) handle(ctx context.Context) {
 				req.Reply(false, nil)
 			}
 		case "window-change":
-			if ptmx != nil {
-				var payload struct {
-					Cols   uint32
-					Rows   uint32
-					Width  uint32
-					Height uint32
+			var payload struct {
+				Cols   uint32
+				Rows   uint32
+				Width  uint32
+				Height uint32
+			}
+			if err := ssh.Unmarshal(req.Payload, &payload); err == nil {
+				h.mu.Lock()
+				h.cols = payload.Cols
+				h.rows = payload.Rows
+				if h.ptmx != nil {
+					_ = pty.Setsize(h.ptmx, &pty.Winsize{Cols: uint16(h.cols), Rows: uint16(h.rows)})
 				}
-				if err := ssh.Unmarshal(req.Payload, &payload); err == nil {
-					cols = payload.Cols
-					rows = payload.Rows
-					_ = pty.Setsize(ptmx, &pty.Winsize{Cols: uint16(cols), Rows: uint16(rows)})
+				if h.record != nil {
+					h.record.resize(h.cols, h.rows)
 				}
+				h.mu.Unlock()
 			}
 			if req.WantReply {
 				req.Reply(true, nil)
 			}
 		case "shell":
-			err := start("")
+			if h.restricted(req.Type) {
+				if req.WantReply {
+					req.Reply(false, nil)
+				}
+				continue
+			}
+			err := h.start("")
+			h.span.set("tinyssh.session.type", "shell")
+			h.span.fail(err)
 			if req.WantReply {
 				req.Reply(err == nil, nil)
 			}
 			if err != nil {
-				h.srv.logger.Error("shell request failed", "user", h.user, "err", err)
+				h.logger.Error("shell request failed", "user", h.user, "err", err)
+			} else {
+				h.begin("shell")
 			}
 		case "exec":
 			var payload struct {
 				Command string
 			}
-			if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+			if err := ssh.Unmarshal(req.Payload, &payload); err != nil || h.restricted(req.Type) {
 				if req.WantReply {
 					req.Reply(false, nil)
 				}
 				continue
 			}
-			err := start(payload.Command)
+			err := h.start(payload.Command)
+			h.span.set("tinyssh.session.type", "exec", "tinyssh.session.command", payload.Command)
+			h.span.fail(err)
 			if req.WantReply {
 				req.Reply(err == nil, nil)
 			}
 			if err != nil {
-				h.srv.logger.Error("exec request failed", "user", h.user, "command", payload.Command, "err", err)
+				h.logger.Error("exec request failed", "user", h.user, "command", payload.Command, "err", err)
+			} else {
+				h.begin("exec", "command", payload.Command)
+			}
+		case "subsystem":
+			var payload struct {
+				Name string
+			}
+			if err := ssh.Unmarshal(req.Payload, &payload); err != nil || (payload.Name != "sftp" && h.restricted(req.Type)) {
+				if req.WantReply {
+					req.Reply(false, nil)
+				}
+				continue
+			}
+			err := h.startSubsystem(payload.Name)
+			h.span.set("tinyssh.session.type", "subsystem", "tinyssh.session.subsystem", payload.Name)
+			h.span.fail(err)
+			if req.WantReply {
+				req.Reply(err == nil, nil)
+			}
+			if err != nil {
+				h.logger.Error("subsystem request failed", "user", h.user, "subsystem", payload.Name, "err", err)
+			} else {
+				h.begin("subsystem", "subsystem", payload.Name)
 			}
 		case "signal":
 			var payload struct {
@@ -233,16 +233,20 @@ func (h *sessionHandler) handle(ctx context.Context) {
 			if err := ssh.Unmarshal(req.Payload, &payload); err == nil {
 				sig := sshSignalToOS(payload.Signal)
 				if sig != nil {
-					mu.Lock()
-					if cmd != nil && cmd.Process != nil {
-						_ = cmd.Process.Signal(sig)
+					h.mu.Lock()
+					if h.cmd != nil && h.cmd.Process != nil {
+						_ = h.cmd.Process.Signal(sig)
 					}
-					mu.Unlock()
+					h.mu.Unlock()
 				}
 			}
 			if req.WantReply {
 				req.Reply(true, nil)
 			}
+		case "keepalive@openssh.com":
+			if req.WantReply {
+				req.Reply(true, nil)
+			}
 		default:
 			if req.WantReply {
 				req.Reply(false, nil)
@@ -251,6 +255,222 @@ func (h *sessionHandler) handle(ctx context.Context) {
 	}
 }
 
+// restricted reports whether the account is barred from the given session
+// request type, logging the refusal.
+func (h *sessionHandler) restricted(kind string) bool {
+	if !h.account.SFTPOnly {
+		return false
+	}
+	h.logger.Warn("session request denied", "user", h.user, "request", kind, "reason", "sftp only")
+	return true
+}
+
+// start launches the configured shell, optionally running command, and wires
+// its I/O to the channel. Only one command may run per session.
+func (h *sessionHandler) start(command string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.running {
+		err := errors.New("session already running")
+		h.logger.Warn("session start rejected", "user", h.user, "command", command, "err", err)
+		return err
+	}
+
+	args := append([]string(nil), h.account.ShellArgs...)
+	if command != "" {
+		args = append(args, h.account.ShellCommandArgs...)
+		args = append(args, command)
+	}
+
+	name := h.srv.config().Shell
+	if wrapper := h.account.RunAsWrapper; len(wrapper) > 0 {
+		invocation := append([]string{name}, args...)
+		if wrapper[len(wrapper)-1] == "-c" {
+			invocation = []string{shellQuote(invocation)}
+		}
+		name = wrapper[0]
+		args = append(append([]string(nil), wrapper[1:]...), invocation...)
+	}
+
+	c := exec.CommandContext(h.ctx, name, args...)
+	c.Env = append([]string(nil), h.env...)
+	c.Dir = "/"
+	c.Cancel = func() error {
+		return c.Process.Signal(syscall.SIGTERM)
+	}
+	c.WaitDelay = 5 * time.Second
+
+	if h.wantPTY {
+		var err error
+		ws := &pty.Winsize{}
+		if h.cols > 0 {
+			ws.Cols = uint16(h.cols)
+		}
+		if h.rows > 0 {
+			ws.Rows = uint16(h.rows)
+		}
+		if ws.Cols == 0 && ws.Rows == 0 {
+			h.ptmx, err = pty.Start(c)
+		} else {
+			h.ptmx, err = pty.StartWithSize(c, ws)
+		}
+		if err != nil {
+			h.logger.Error("start pty shell failed", "user", h.user, "command", command, "err", err)
+			return err
+		}
+
+		var output io.Writer = h.channel
+		if cfg := h.srv.config(); cfg.Records(h.account) {
+			env := map[string]string{"SHELL": cfg.Shell, "TERM": h.term}
+			h.record, err = startRecording(cfg.Recording, h.user, h.connID, h.cols, h.rows, env, cfg.RecordsInput(h.account), h.logger)
+			if err != nil {
+				// The session goes ahead unrecorded rather than failing.
+				h.logger.Error("start recording failed", "user", h.user, "err", err)
+			} else {
+				h.logger.Info("recording session", "user", h.user, "path", h.record.path)
+				output = &recordedWriter{w: h.channel, record: h.record}
+			}
+		}
+		h.output = newOutputPump(h.ptmx, output, h.srv.config().SessionOutputBuffer, outputReadSize)
+		h.output.start()
+		var input io.Reader = h.channel
+		if h.record != nil && h.record.withInput {
+			input = &recordedReader{r: h.channel, record: h.record}
+		}
+		go func(ptmx *os.File) {
+			_, _ = io.Copy(ptmx, input)
+		}(h.ptmx)
+	} else {
+		c.Stdout = h.channel
+		c.Stderr = h.channel.Stderr()
+		stdin, err := c.StdinPipe()
+		if err != nil {
+			h.logger.Error("allocate stdin pipe failed", "user", h.user, "command", command, "err", err)
+			return err
+		}
+		if err := c.Start(); err != nil {
+			h.logger.Error("launch shell failed", "user", h.user, "command", command, "shell", h.srv.config().Shell, "err", err)
+			return err
+		}
+		go func() {
+			_, _ = io.Copy(stdin, h.channel)
+			_ = stdin.Close()
+		}()
+	}
+
+	h.cmd = c
+	h.running = true
+	go h.wait(c, h.ptmx, h.output, h.record)
+
+	return nil
+}
+
+// startSubsystem serves the named subsystem with a registered Go handler or,
+// failing that, with the command configured for it. Go handlers run as the
+// daemon's user, so accounts with a run_as_wrapper only get subsystems that
+// have a command, which runs through the wrapper.
+func (h *sessionHandler) startSubsystem(name string) error {
+	handler, ok := h.srv.subsystems[name]
+	if ok && len(h.account.RunAsWrapper) > 0 {
+		if _, configured := h.srv.config().Subsystems[name]; !configured {
+			return fmt.Errorf("subsystem %s runs in-process and cannot honour run_as_wrapper; configure an external command for it", name)
+		}
+		ok = false
+	}
+	if !ok {
+		command, ok := h.srv.config().Subsystems[name]
+		if !ok {
+			return fmt.Errorf("unknown subsystem %s", name)
+		}
+		return h.start(command)
+	}
+
+	h.mu.Lock()
+	if h.running {
+		h.mu.Unlock()
+		return errors.New("session already running")
+	}
+	h.running = true
+	h.mu.Unlock()
+
+	go func() {
+		err := handler(context.WithValue(h.ctx, sessionLoggerKey{}, h.logger), h.channel, h.user)
+		if err != nil {
+			h.span.fail(err)
+			h.logger.Warn("subsystem ended", "user", h.user, "subsystem", name, "err", err)
+		}
+		_ = h.channel.CloseWrite()
+		h.sendExitStatus(err)
+		_ = h.channel.Close()
+	}()
+
+	return nil
+}
+
+// outputDrainTimeout bounds how long a session waits, after its command
+// exited, for the PTY to reach EOF. A background process still holding the
+// terminal keeps it open indefinitely.
+const outputDrainTimeout = 2 * time.Second
+
+// wait reaps the command, flushes any pending output and the recording,
+// reports the exit status and closes the channel so the client's session
+// ends with the command.
+func (h *sessionHandler) wait(c *exec.Cmd, ptmx *os.File, output *outputPump, record *recording) {
+	err := c.Wait()
+	if output != nil {
+		timer := time.NewTimer(outputDrainTimeout)
+		select {
+		case <-output.done:
+		case <-timer.C:
+		}
+		timer.Stop()
+		output.stop()
+		output.wait()
+	}
+	if record != nil {
+		if err := record.close(); err != nil {
+			h.logger.Warn("close recording", "path", record.path, "err", err)
+		}
+		for _, path := range record.files {
+			h.srv.uploads.enqueue(path, record.user, record.start)
+		}
+	}
+	if ptmx != nil {
+		_ = ptmx.Close()
+	}
+
+	_ = h.channel.CloseWrite()
+	h.sendExitStatus(err)
+	_ = h.channel.Close()
+}
+
+// begin logs the start of the session's shell, command or subsystem;
+// attrs describe it.
+func (h *sessionHandler) begin(kind string, attrs ...any) {
+	h.mu.Lock()
+	h.started, h.kind = time.Now(), kind
+	h.mu.Unlock()
+	h.logger.Info("session started", append([]any{logging.EventKey, logging.EventSession,
+		"session", h.id, "user", h.user, "type", kind}, attrs...)...)
+}
+
+// end logs the end of a session that began.
+func (h *sessionHandler) end() {
+	h.mu.Lock()
+	started, kind, status := h.started, h.kind, h.exitStatus
+	h.mu.Unlock()
+	if started.IsZero() {
+		return
+	}
+	attrs := []any{logging.EventKey, logging.EventSessionEnd, "session", h.id, "user", h.user, "type", kind,
+		"duration", time.Since(started).Round(time.Millisecond).String(),
+		"bytes_received", h.traffic.received.Load(), "bytes_sent", h.traffic.sent.Load()}
+	if status != nil {
+		attrs = append(attrs, "exit_status", *status)
+	}
+	h.logger.Info("session ended", attrs...)
+}
+
 func (h *sessionHandler) sendExitStatus(err error) {
 	status := uint32(0)
 	if err != nil {
@@ -265,11 +485,25 @@ func (h *sessionHandler) sendExitStatus(err error) {
 		}
 	}
 
+	h.span.set("tinyssh.session.exit_status", int64(status))
+	h.mu.Lock()
+	h.exitStatus = &status
+	h.mu.Unlock()
 	_, _ = h.channel.SendRequest("exit-status", false, ssh.Marshal(struct {
 		Status uint32
 	}{Status: status}))
 }
 
+// shellQuote joins args into a single string that a POSIX shell splits back
+// into the same arguments.
+func shellQuote(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+	}
+	return strings.Join(quoted, " ")
+}
+
 func sshSignalToOS(signal string) os.Signal {
 	signal = strings.TrimPrefix(signal, "SIG")
 	switch signal {
@@ -0,0 +1,260 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/dollarkillerx/tinyssh/internal/logging"
+)
+
+// sessionLoggerKey carries the logger of the connection to subsystem
+// handlers, so their events can be tied to it.
+type sessionLoggerKey struct{}
+
+// sftpSubsystem serves the built-in SFTP server on a session channel. Files
+// are accessed with tinyssh's own privileges. Every file operation is
+// logged as an audit event with the user, the paths, the bytes transferred
+// and the result.
+func sftpSubsystem(ctx context.Context, channel ssh.Channel, user string) error {
+	logger, ok := ctx.Value(sessionLoggerKey{}).(*slog.Logger)
+	if !ok {
+		logger = slog.Default()
+	}
+	fs := &sftpFS{user: user, logger: logger}
+	srv := sftp.NewRequestServer(channel, sftp.Handlers{FileGet: fs, FilePut: fs, FileCmd: fs, FileList: fs}, sftp.WithStartDirectory("/"))
+
+	stop := context.AfterFunc(ctx, func() {
+		_ = srv.Close()
+	})
+	defer stop()
+
+	if err := srv.Serve(); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
+
+// sftpFS implements the SFTP requests on the local filesystem and logs
+// each one.
+type sftpFS struct {
+	user   string
+	logger *slog.Logger
+}
+
+// audit logs one SFTP operation on path and its result.
+func (fs *sftpFS) audit(op, path string, err error, attrs ...any) {
+	attrs = append([]any{logging.EventKey, logging.EventSFTP, "op", op, "user", fs.user, "path", path}, attrs...)
+	if err != nil {
+		fs.logger.Warn("sftp", append(attrs, "result", "error", "err", err)...)
+		return
+	}
+	fs.logger.Info("sftp", append(attrs, "result", "ok")...)
+}
+
+func (fs *sftpFS) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	return fs.open(r, os.O_RDONLY)
+}
+
+func (fs *sftpFS) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	return fs.open(r, os.O_WRONLY)
+}
+
+func (fs *sftpFS) OpenFile(r *sftp.Request) (sftp.WriterAtReaderAt, error) {
+	return fs.open(r, os.O_RDWR)
+}
+
+// open opens the file of r with mode and the creation flags of r. Append
+// is left out: clients give the offset of every write, and WriteAt fails
+// on files opened with O_APPEND.
+func (fs *sftpFS) open(r *sftp.Request, mode int) (*sftpFile, error) {
+	flags := r.Pflags()
+	if flags.Creat {
+		mode |= os.O_CREATE
+	}
+	if flags.Trunc {
+		mode |= os.O_TRUNC
+	}
+	if flags.Excl {
+		mode |= os.O_EXCL
+	}
+	perm := os.FileMode(0644)
+	if r.AttrFlags().Permissions {
+		perm = r.Attributes().FileMode().Perm()
+	}
+	f, err := os.OpenFile(r.Filepath, mode, perm)
+	access := "read"
+	switch mode & (os.O_WRONLY | os.O_RDWR) {
+	case os.O_WRONLY:
+		access = "write"
+	case os.O_RDWR:
+		access = "read-write"
+	}
+	fs.audit("open", r.Filepath, err, "access", access)
+	if err != nil {
+		return nil, err
+	}
+	return &sftpFile{File: f, fs: fs, access: access, start: time.Now()}, nil
+}
+
+// sftpFile is an open file that counts the bytes transferred, which are
+// logged when it is closed.
+type sftpFile struct {
+	*os.File
+	fs      *sftpFS
+	access  string
+	start   time.Time
+	read    atomic.Int64
+	written atomic.Int64
+}
+
+func (f *sftpFile) ReadAt(p []byte, off int64) (int, error) {
+	n, err := f.File.ReadAt(p, off)
+	f.read.Add(int64(n))
+	return n, err
+}
+
+func (f *sftpFile) WriteAt(p []byte, off int64) (int, error) {
+	n, err := f.File.WriteAt(p, off)
+	f.written.Add(int64(n))
+	return n, err
+}
+
+func (f *sftpFile) Close() error {
+	err := f.File.Close()
+	f.fs.audit("close", f.Name(), err, "access", f.access,
+		"bytes_read", f.read.Load(), "bytes_written", f.written.Load(),
+		"duration", time.Since(f.start).Round(time.Millisecond).String())
+	return err
+}
+
+func (fs *sftpFS) Filecmd(r *sftp.Request) error {
+	switch r.Method {
+	case "Setstat":
+		err := fs.setstat(r)
+		fs.audit("setstat", r.Filepath, err)
+		return err
+	case "Rename", "PosixRename":
+		err := os.Rename(r.Filepath, r.Target)
+		fs.audit("rename", r.Filepath, err, "target", r.Target)
+		return err
+	case "Rmdir":
+		info, err := os.Lstat(r.Filepath)
+		if err == nil && !info.IsDir() {
+			err = &os.PathError{Op: "rmdir", Path: r.Filepath, Err: errors.New("not a directory")}
+		}
+		if err == nil {
+			err = os.Remove(r.Filepath)
+		}
+		fs.audit("rmdir", r.Filepath, err)
+		return err
+	case "Remove":
+		err := os.Remove(r.Filepath)
+		fs.audit("remove", r.Filepath, err)
+		return err
+	case "Mkdir":
+		err := os.Mkdir(r.Filepath, 0755)
+		fs.audit("mkdir", r.Filepath, err)
+		return err
+	case "Link":
+		err := os.Link(r.Filepath, r.Target)
+		fs.audit("link", r.Target, err, "target", r.Filepath)
+		return err
+	case "Symlink":
+		// Filepath is the target and Target the new link.
+		err := os.Symlink(r.Filepath, r.Target)
+		fs.audit("symlink", r.Target, err, "target", r.Filepath)
+		return err
+	}
+	return sftp.ErrSSHFxOpUnsupported
+}
+
+// PosixRename is the posix-rename@openssh.com extension, which replaces an
+// existing target.
+func (fs *sftpFS) PosixRename(r *sftp.Request) error {
+	return fs.Filecmd(r)
+}
+
+// setstat applies the attributes of a Setstat request.
+func (fs *sftpFS) setstat(r *sftp.Request) error {
+	flags, attrs := r.AttrFlags(), r.Attributes()
+	if flags.Size {
+		if err := os.Truncate(r.Filepath, int64(attrs.Size)); err != nil {
+			return err
+		}
+	}
+	if flags.Permissions {
+		if err := os.Chmod(r.Filepath, attrs.FileMode().Perm()); err != nil {
+			return err
+		}
+	}
+	if flags.UidGid {
+		if err := os.Chown(r.Filepath, int(attrs.UID), int(attrs.GID)); err != nil {
+			return err
+		}
+	}
+	if flags.Acmodtime {
+		if err := os.Chtimes(r.Filepath, time.Unix(int64(attrs.Atime), 0), time.Unix(int64(attrs.Mtime), 0)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fs *sftpFS) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	switch r.Method {
+	case "List":
+		entries, err := os.ReadDir(r.Filepath)
+		fs.audit("list", r.Filepath, err)
+		if err != nil {
+			return nil, err
+		}
+		infos := make(listerAt, 0, len(entries))
+		for _, entry := range entries {
+			if info, err := entry.Info(); err == nil {
+				infos = append(infos, info)
+			}
+		}
+		return infos, nil
+	case "Stat":
+		info, err := os.Stat(r.Filepath)
+		if err != nil {
+			return nil, err
+		}
+		return listerAt{info}, nil
+	}
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+func (fs *sftpFS) Lstat(r *sftp.Request) (sftp.ListerAt, error) {
+	info, err := os.Lstat(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	return listerAt{info}, nil
+}
+
+func (fs *sftpFS) Readlink(path string) (string, error) {
+	return os.Readlink(path)
+}
+
+// listerAt serves directory listings and stat results from memory.
+type listerAt []os.FileInfo
+
+func (l listerAt) ListAt(dst []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(dst, l[offset:])
+	if n < len(dst) {
+		return n, io.EOF
+	}
+	return n, nil
+}
@@ -0,0 +1,25 @@
+//go:build !unix
+
+package server
+
+import "net"
+
+// socketPair connects two TCP sockets over loopback where unix socket
+// pairs are unavailable.
+func socketPair() (net.Conn, net.Conn, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer listener.Close()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		return nil, nil, err
+	}
+	server, err := listener.Accept()
+	if err != nil {
+		client.Close()
+		return nil, nil, err
+	}
+	return client, server, nil
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"fmt"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// controlListener applies the configured socket options to SSH listening
+// sockets before they are bound.
+func (s *Server) controlListener(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		if s.config().ReusePort {
+			if err := unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1); err != nil {
+				sockErr = fmt.Errorf("set SO_REUSEPORT: %w", err)
+				return
+			}
+		}
+		if s.config().BindInterface != "" {
+			if err := unix.BindToDevice(int(fd), s.config().BindInterface); err != nil {
+				sockErr = fmt.Errorf("bind to interface %s: %w", s.config().BindInterface, err)
+				return
+			}
+		}
+		sockErr = s.setBuffers(int(fd))
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// controlDial sets the tcp buffer sizes on forward sockets before they
+// connect.
+func (s *Server) controlDial(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = s.setBuffers(int(fd))
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// setBuffers sets SO_SNDBUF and SO_RCVBUF from the tcp options. Accepted
+// sockets inherit them from the listening socket.
+func (s *Server) setBuffers(fd int) error {
+	if size := s.config().TCP.SendBuffer; size > 0 {
+		if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_SNDBUF, size); err != nil {
+			return fmt.Errorf("set SO_SNDBUF: %w", err)
+		}
+	}
+	if size := s.config().TCP.ReceiveBuffer; size > 0 {
+		if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_RCVBUF, size); err != nil {
+			return fmt.Errorf("set SO_RCVBUF: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,24 @@
+//go:build !linux
+
+package server
+
+import (
+	"errors"
+	"syscall"
+)
+
+func (s *Server) controlListener(network, address string, c syscall.RawConn) error {
+	if s.config().ReusePort {
+		return errors.New("reuse_port is only supported on linux")
+	}
+	if s.config().BindInterface != "" {
+		return errors.New("bind_interface is only supported on linux")
+	}
+	return nil
+}
+
+// controlDial does nothing here; tuneTCP sets the buffer sizes once the
+// connection is up.
+func (s *Server) controlDial(network, address string, c syscall.RawConn) error {
+	return nil
+}
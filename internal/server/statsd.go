@@ -0,0 +1,142 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/dollarkillerx/tinyssh/internal/config"
+)
+
+// statsdPacketSize keeps each datagram within a typical MTU.
+const statsdPacketSize = 1432
+
+// pushStatsD sends the metrics of /metrics to the StatsD server of the
+// settings in effect every interval until ctx is done: the open
+// connections as a gauge and the counters as the increase since the
+// previous push. While no server is configured it only waits, so a reload
+// can turn pushing on.
+func (s *Server) pushStatsD(ctx context.Context) {
+	var (
+		last        map[string]uint64
+		conn        net.Conn
+		connAddress string
+	)
+	defer func() {
+		if conn != nil {
+			_ = conn.Close()
+		}
+	}()
+	for {
+		opts := s.config().StatsD
+		interval := 10 * time.Second
+		if opts.Interval > 0 {
+			interval = time.Duration(opts.Interval) * time.Second
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+		opts = s.config().StatsD
+		if !opts.Enabled() {
+			continue
+		}
+		if conn == nil || connAddress != opts.Address {
+			if conn != nil {
+				_ = conn.Close()
+			}
+			var err error
+			if conn, err = net.Dial("udp", opts.Address); err != nil {
+				s.logger.Warn("statsd", "address", opts.Address, "err", err)
+				conn = nil
+				continue
+			}
+			connAddress = opts.Address
+		}
+
+		counters := s.statsdCounters()
+		lines := []string{statsdLine(opts, "connections.open", "", s.connections.Load(), "g")}
+		for _, name := range slices.Sorted(maps.Keys(counters)) {
+			// Counters only grow, so the first push after startup sends
+			// everything counted so far.
+			delta := counters[name] - last[name]
+			if delta == 0 {
+				continue
+			}
+			name, tag, _ := strings.Cut(name, "|")
+			lines = append(lines, statsdLine(opts, name, tag, int64(delta), "c"))
+		}
+		last = counters
+		if err := sendStatsD(conn, lines); err != nil {
+			s.logger.Debug("statsd", "address", opts.Address, "err", err)
+		}
+	}
+}
+
+// statsdCounters returns the current counter values by metric name. Labels
+// follow the name after "|", as "key:value": the drop reason or the user.
+func (s *Server) statsdCounters() map[string]uint64 {
+	counters := map[string]uint64{
+		"connections.accepted": s.metrics.accepted.Load(),
+		"auth.failures":        s.metrics.authFailures.Load(),
+		"bytes.received":       s.metrics.received.Load(),
+		"bytes.sent":           s.metrics.sent.Load(),
+	}
+	for reason, n := range s.metrics.droppedSnapshot() {
+		counters["connections.dropped|reason:"+reason] = n
+	}
+	for _, t := range s.traffic.snapshot() {
+		counters["user.bytes.received|user:"+t.User] = t.BytesReceived
+		counters["user.bytes.sent|user:"+t.User] = t.BytesSent
+	}
+	return counters
+}
+
+// statsdLine formats one metric. A "key:value" label becomes a DogStatsD
+// tag or, for plain StatsD, the value becomes the last part of the name.
+func statsdLine(opts config.StatsDOptions, name, label string, value int64, kind string) string {
+	tags := opts.Tags
+	if label != "" {
+		if opts.DogStatsD {
+			tags = append(slices.Clip(tags), label)
+		} else {
+			_, v, _ := strings.Cut(label, ":")
+			name += "." + v
+		}
+	}
+	line := fmt.Sprintf("%s%s:%d|%s", opts.Prefix, name, value, kind)
+	if len(tags) > 0 {
+		line += "|#" + strings.Join(tags, ",")
+	}
+	return line
+}
+
+// sendStatsD writes lines to conn, as many per datagram as fit.
+func sendStatsD(conn net.Conn, lines []string) error {
+	var packet strings.Builder
+	flush := func() error {
+		if packet.Len() == 0 {
+			return nil
+		}
+		_, err := conn.Write([]byte(packet.String()))
+		packet.Reset()
+		return err
+	}
+	for _, line := range lines {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > statsdPacketSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	return flush()
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"time"
+)
+
+// ServeStdio serves a single SSH connection over stdin and stdout, as
+// started by inetd or an ssh ProxyCommand, using the settings of the first
+// listener. It returns once the connection closes.
+func (s *Server) ServeStdio(ctx context.Context) error {
+	s.updateSSHConfig()
+
+	conn := stdioConn()
+	go func() {
+		<-ctx.Done()
+		_ = conn.Close()
+	}()
+	return s.serveConn(ctx, conn, s.current.Load().listeners[0])
+}
+
+// stdioConn returns stdin as a network connection. inetd passes the
+// accepted socket itself, which keeps the client address; anything else
+// (pipes, a terminal) is wrapped as a connection without addresses.
+func stdioConn() net.Conn {
+	if conn, err := net.FileConn(os.Stdin); err == nil {
+		return conn
+	}
+	r, w := stdioFiles()
+	return &pipeConn{r: r, w: w}
+}
+
+// pipeConn is a net.Conn over a pair of pipes.
+type pipeConn struct {
+	r *os.File
+	w *os.File
+}
+
+func (c *pipeConn) Read(p []byte) (int, error)  { return c.r.Read(p) }
+func (c *pipeConn) Write(p []byte) (int, error) { return c.w.Write(p) }
+func (c *pipeConn) LocalAddr() net.Addr         { return stdioAddr{} }
+func (c *pipeConn) RemoteAddr() net.Addr        { return stdioAddr{} }
+
+func (c *pipeConn) Close() error {
+	return errors.Join(c.r.Close(), c.w.Close())
+}
+
+func (c *pipeConn) SetDeadline(t time.Time) error {
+	return errors.Join(c.r.SetReadDeadline(t), c.w.SetWriteDeadline(t))
+}
+func (c *pipeConn) SetReadDeadline(t time.Time) error  { return c.r.SetReadDeadline(t) }
+func (c *pipeConn) SetWriteDeadline(t time.Time) error { return c.w.SetWriteDeadline(t) }
+
+type stdioAddr struct{}
+
+func (stdioAddr) Network() string { return "stdio" }
+func (stdioAddr) String() string  { return "stdio" }
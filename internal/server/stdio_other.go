@@ -0,0 +1,9 @@
+//go:build !unix
+
+package server
+
+import "os"
+
+func stdioFiles() (*os.File, *os.File) {
+	return os.Stdin, os.Stdout
+}
@@ -0,0 +1,18 @@
+//go:build unix
+
+package server
+
+import (
+	"os"
+	"syscall"
+)
+
+// stdioFiles reopens stdin and stdout in non-blocking mode so they go
+// through the runtime poller: reads then honour deadlines, and a
+// non-blocking flag set by the other end of a shared pipe (as ssh does for
+// ProxyCommand) cannot surface as EAGAIN.
+func stdioFiles() (*os.File, *os.File) {
+	_ = syscall.SetNonblock(0, true)
+	_ = syscall.SetNonblock(1, true)
+	return os.NewFile(0, "stdin"), os.NewFile(1, "stdout")
+}
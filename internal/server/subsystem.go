@@ -0,0 +1,41 @@
+package server
+
+import (
+	"context"
+	"sync/atomic"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/dollarkillerx/tinyssh/internal/netconf"
+)
+
+// SubsystemHandler serves a subsystem requested on a session channel. It owns
+// the channel until it returns; a non-nil error is reported to the client as a
+// failed exit status.
+type SubsystemHandler func(ctx context.Context, channel ssh.Channel, user string) error
+
+// RegisterSubsystem installs a Go handler for the named subsystem. Handlers
+// take precedence over commands configured under "subsystems" and must be
+// registered before Run is called.
+func (s *Server) RegisterSubsystem(name string, handler SubsystemHandler) {
+	if s.subsystems == nil {
+		s.subsystems = make(map[string]SubsystemHandler)
+	}
+	s.subsystems[name] = handler
+}
+
+var netconfSessionID atomic.Uint32
+
+// NETCONFSubsystem returns a handler for the "netconf" subsystem that speaks
+// RFC 6242 framing and passes each RPC to handler.
+func NETCONFSubsystem(handler netconf.Handler, capabilities ...string) SubsystemHandler {
+	return NETCONFServerSubsystem(&netconf.Server{Capabilities: capabilities, Handler: handler})
+}
+
+// NETCONFServerSubsystem is NETCONFSubsystem for a netconf.Server set up by
+// the caller, e.g. with its own MaxMessageSize.
+func NETCONFServerSubsystem(srv *netconf.Server) SubsystemHandler {
+	return func(ctx context.Context, channel ssh.Channel, user string) error {
+		return srv.Serve(ctx, channel, netconfSessionID.Add(1))
+	}
+}
@@ -0,0 +1,28 @@
+package server
+
+import (
+	"net"
+
+	"github.com/dollarkillerx/tinyssh/internal/config"
+)
+
+// tuneTCP applies the tcp options to a connected socket; keep-alive settings
+// override forward_dial.keepalive.
+// Buffer sizes are also set before listening or dialing where the platform
+// allows, so that TCP window scaling takes them into account.
+func tuneTCP(conn net.Conn, opts config.TCPOptions) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	if keepAlive, ok := opts.KeepAlive(); ok {
+		_ = tcpConn.SetKeepAliveConfig(keepAlive)
+	}
+	_ = tcpConn.SetNoDelay(*opts.NoDelay)
+	if opts.SendBuffer > 0 {
+		_ = tcpConn.SetWriteBuffer(opts.SendBuffer)
+	}
+	if opts.ReceiveBuffer > 0 {
+		_ = tcpConn.SetReadBuffer(opts.ReceiveBuffer)
+	}
+}
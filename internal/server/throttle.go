@@ -0,0 +1,109 @@
+package server
+
+import (
+	"context"
+	"io"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/time/rate"
+)
+
+// newByteLimiter returns a token bucket allowing bytesPerSec bytes per second
+// with up to one second of burst, or nil when bytesPerSec is zero.
+func newByteLimiter(bytesPerSec int64) *rate.Limiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	burst := int(bytesPerSec)
+	if burst < 1024 {
+		burst = 1024
+	}
+	return rate.NewLimiter(rate.Limit(bytesPerSec), burst)
+}
+
+// throttledWriter delays writes so that they stay within every limiter.
+// Nil limiters are ignored.
+type throttledWriter struct {
+	w        io.Writer
+	limiters []*rate.Limiter
+}
+
+// throttle wraps w with the non-nil limiters, returning w unchanged when
+// there are none.
+func throttle(w io.Writer, limiters ...*rate.Limiter) io.Writer {
+	var active []*rate.Limiter
+	for _, l := range limiters {
+		if l != nil {
+			active = append(active, l)
+		}
+	}
+	if len(active) == 0 {
+		return w
+	}
+	return throttledWriter{w: w, limiters: active}
+}
+
+func (t throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		for _, l := range t.limiters {
+			if burst := l.Burst(); n > burst {
+				n = burst
+			}
+		}
+		for _, l := range t.limiters {
+			if err := l.WaitN(context.Background(), n); err != nil {
+				return written, err
+			}
+		}
+
+		m, err := t.w.Write(p[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// throttledChannel applies the server-wide ingress and egress limits to a
+// session channel, so every shell, command and subsystem shares them.
+type throttledChannel struct {
+	ssh.Channel
+	ingress *rate.Limiter
+	egress  *rate.Limiter
+}
+
+// throttleChannel wraps ch with the server-wide limits, returning it
+// unchanged when none are configured.
+func (s *Server) throttleChannel(ch ssh.Channel) ssh.Channel {
+	cur := s.current.Load()
+	if cur.ingress == nil && cur.egress == nil {
+		return ch
+	}
+	return &throttledChannel{Channel: ch, ingress: cur.ingress, egress: cur.egress}
+}
+
+func (c *throttledChannel) Read(p []byte) (int, error) {
+	if c.ingress != nil && len(p) > c.ingress.Burst() {
+		p = p[:c.ingress.Burst()]
+	}
+	n, err := c.Channel.Read(p)
+	if n > 0 && c.ingress != nil {
+		_ = c.ingress.WaitN(context.Background(), n)
+	}
+	return n, err
+}
+
+func (c *throttledChannel) Write(p []byte) (int, error) {
+	return throttle(c.Channel, c.egress).Write(p)
+}
+
+func (c *throttledChannel) Stderr() io.ReadWriter {
+	return struct {
+		io.Reader
+		io.Writer
+	}{c.Channel.Stderr(), throttle(c.Channel.Stderr(), c.egress)}
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+
+	"github.com/dollarkillerx/tinyssh/internal/config"
+)
+
+// tlsHandshakeTimeout bounds the TLS handshake on TLS listeners.
+const tlsHandshakeTimeout = 10 * time.Second
+
+// listenerTLSConfig returns the TLS configuration for a TLS listener.
+func listenerTLSConfig(l config.Listener) (*tls.Config, error) {
+	if l.TLSCert != "" {
+		cert, err := tls.LoadX509KeyPair(l.TLSCert, l.TLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("listener %s: load tls certificate: %w", l.Address, err)
+		}
+		return &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}, nil
+	}
+
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(l.ACME.CacheDir),
+		HostPolicy: autocert.HostWhitelist(l.ACME.Domains...),
+		Email:      l.ACME.Email,
+	}
+	if l.ACME.DirectoryURL != "" {
+		manager.Client = &acme.Client{DirectoryURL: l.ACME.DirectoryURL}
+	}
+	tlsCfg := manager.TLSConfig()
+	tlsCfg.MinVersion = tls.VersionTLS12
+	// Clients that send no SNI (e.g. a bare openssl s_client ProxyCommand)
+	// get the first domain's certificate.
+	tlsCfg.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if hello.ServerName == "" {
+			hello.ServerName = l.ACME.Domains[0]
+		}
+		return manager.GetCertificate(hello)
+	}
+	return tlsCfg, nil
+}
+
+// acceptTLS runs the server side of the TLS handshake on conn.
+func acceptTLS(ctx context.Context, conn net.Conn, tlsCfg *tls.Config) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, tlsHandshakeTimeout)
+	defer cancel()
+	tlsConn := tls.Server(conn, tlsCfg)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+	return tlsConn, nil
+}
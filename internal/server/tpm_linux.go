@@ -0,0 +1,96 @@
+//go:build linux
+
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/asn1"
+	"fmt"
+	"io"
+	"math/big"
+	"strconv"
+	"sync"
+
+	"github.com/google/go-tpm/legacy/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+
+	"github.com/dollarkillerx/tinyssh/internal/config"
+)
+
+// loadTPMHostKey opens the TPM and returns a signer for the persistent key
+// at the configured handle. The device stays open for the life of the
+// process.
+func loadTPMHostKey(cfg config.TPMKey) (crypto.Signer, error) {
+	handle, err := strconv.ParseUint(cfg.Handle, 0, 32)
+	if err != nil {
+		return nil, fmt.Errorf("tpm handle %q: %w", cfg.Handle, err)
+	}
+	rw, err := tpm2.OpenTPM(cfg.Device)
+	if err != nil {
+		return nil, fmt.Errorf("open tpm %s: %w", cfg.Device, err)
+	}
+	return newTPMSigner(rw, tpmutil.Handle(handle), cfg.Password)
+}
+
+func newTPMSigner(rw io.ReadWriter, handle tpmutil.Handle, password string) (crypto.Signer, error) {
+	public, _, _, err := tpm2.ReadPublic(rw, handle)
+	if err != nil {
+		return nil, fmt.Errorf("read tpm key 0x%x: %w", uint32(handle), err)
+	}
+	pub, err := public.Key()
+	if err != nil {
+		return nil, fmt.Errorf("tpm key 0x%x: %w", uint32(handle), err)
+	}
+	switch pub.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+	default:
+		return nil, fmt.Errorf("tpm key 0x%x: unsupported key type %T", uint32(handle), pub)
+	}
+	return &tpmSigner{rw: rw, handle: handle, password: password, pub: pub}, nil
+}
+
+var tpmHashes = map[crypto.Hash]tpm2.Algorithm{
+	crypto.SHA1:   tpm2.AlgSHA1,
+	crypto.SHA256: tpm2.AlgSHA256,
+	crypto.SHA384: tpm2.AlgSHA384,
+	crypto.SHA512: tpm2.AlgSHA512,
+}
+
+// tpmSigner is a crypto.Signer over a TPM-resident key. Commands to the
+// device are serialised.
+type tpmSigner struct {
+	mu       sync.Mutex
+	rw       io.ReadWriter
+	handle   tpmutil.Handle
+	password string
+	pub      crypto.PublicKey
+}
+
+func (s *tpmSigner) Public() crypto.PublicKey {
+	return s.pub
+}
+
+func (s *tpmSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	hash, ok := tpmHashes[opts.HashFunc()]
+	if !ok {
+		return nil, fmt.Errorf("tpm: unsupported hash %v", opts.HashFunc())
+	}
+	scheme := &tpm2.SigScheme{Alg: tpm2.AlgRSASSA, Hash: hash}
+	if _, ok := s.pub.(*ecdsa.PublicKey); ok {
+		scheme.Alg = tpm2.AlgECDSA
+	}
+
+	s.mu.Lock()
+	sig, err := tpm2.Sign(s.rw, s.handle, s.password, digest, nil, scheme)
+	s.mu.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("tpm sign: %w", err)
+	}
+
+	if sig.ECC != nil {
+		return asn1.Marshal(struct{ R, S *big.Int }{sig.ECC.R, sig.ECC.S})
+	}
+	return sig.RSA.Signature, nil
+}
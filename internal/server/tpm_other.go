@@ -0,0 +1,14 @@
+//go:build !linux
+
+package server
+
+import (
+	"crypto"
+	"errors"
+
+	"github.com/dollarkillerx/tinyssh/internal/config"
+)
+
+func loadTPMHostKey(cfg config.TPMKey) (crypto.Signer, error) {
+	return nil, errors.New("tpm host keys are only supported on linux")
+}
@@ -0,0 +1,304 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dollarkillerx/tinyssh/internal/config"
+)
+
+// Span kinds and status codes of the OTLP trace data model.
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+
+	spanStatusError = 2
+)
+
+const (
+	// tracingFlushInterval is how often finished spans are exported.
+	tracingFlushInterval = 5 * time.Second
+	// maxPendingSpans bounds the spans held for export; more are dropped
+	// while the collector is unreachable.
+	maxPendingSpans = 4096
+)
+
+var tracingClient = &http.Client{Timeout: 10 * time.Second}
+
+// tracer records spans of SSH activity and exports them in batches to the
+// OTLP/HTTP collector of the tracing settings in effect, encoded as JSON,
+// so no OpenTelemetry SDK is needed. The zero value is ready to use once
+// srv is set.
+type tracer struct {
+	srv *Server
+
+	mu      sync.Mutex
+	pending []*span
+	running bool
+	dropped int
+}
+
+// span is one timed operation. A nil *span, as returned while tracing is
+// off, ignores every call, so callers need not check.
+type span struct {
+	tracer   *tracer
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+	// connID tags the spans of a connection and is inherited by children.
+	connID string
+
+	mu      sync.Mutex
+	end     time.Time
+	attrs   []any
+	events  []spanEvent
+	errMsg  string
+	failed  bool
+	stopped bool
+}
+
+type spanEvent struct {
+	name  string
+	at    time.Time
+	attrs []any
+}
+
+// start begins a root span if tracing is on; attrs are key/value pairs as
+// for slog.
+func (t *tracer) start(name string, kind int, connID string, attrs ...any) *span {
+	if !t.srv.config().Tracing.Enabled() {
+		return nil
+	}
+	sp := &span{tracer: t, name: name, kind: kind, start: time.Now(), connID: connID, attrs: attrs}
+	_, _ = rand.Read(sp.traceID[:])
+	_, _ = rand.Read(sp.spanID[:])
+	return sp
+}
+
+// child begins a span within sp.
+func (sp *span) child(name string, kind int, attrs ...any) *span {
+	if sp == nil {
+		return nil
+	}
+	c := &span{tracer: sp.tracer, traceID: sp.traceID, parentID: sp.spanID, name: name, kind: kind, start: time.Now(), connID: sp.connID, attrs: attrs}
+	_, _ = rand.Read(c.spanID[:])
+	return c
+}
+
+// set adds attributes to sp.
+func (sp *span) set(attrs ...any) {
+	if sp == nil {
+		return
+	}
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	sp.attrs = append(sp.attrs, attrs...)
+}
+
+// event records a point in time within sp.
+func (sp *span) event(name string, attrs ...any) {
+	if sp == nil {
+		return
+	}
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	sp.events = append(sp.events, spanEvent{name: name, at: time.Now(), attrs: attrs})
+}
+
+// fail marks sp as failed with err; a nil err leaves it unchanged.
+func (sp *span) fail(err error) {
+	if sp == nil || err == nil {
+		return
+	}
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	sp.failed = true
+	sp.errMsg = err.Error()
+}
+
+// finish ends sp and queues it for export. Only the first call counts.
+func (sp *span) finish() {
+	if sp == nil {
+		return
+	}
+	sp.mu.Lock()
+	if sp.stopped {
+		sp.mu.Unlock()
+		return
+	}
+	sp.stopped = true
+	sp.end = time.Now()
+	sp.mu.Unlock()
+	sp.tracer.queue(sp)
+}
+
+func (t *tracer) queue(sp *span) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.pending) >= maxPendingSpans {
+		t.dropped++
+		return
+	}
+	t.pending = append(t.pending, sp)
+	if !t.running {
+		t.running = true
+		go t.run()
+	}
+}
+
+func (t *tracer) run() {
+	ticker := time.NewTicker(tracingFlushInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		t.flush()
+	}
+}
+
+// flush exports the spans finished so far.
+func (t *tracer) flush() {
+	t.mu.Lock()
+	batch, dropped := t.pending, t.dropped
+	t.pending, t.dropped = nil, 0
+	t.mu.Unlock()
+	if len(batch) == 0 {
+		return
+	}
+	opts := t.srv.config().Tracing
+	if !opts.Enabled() {
+		return
+	}
+	if dropped > 0 {
+		t.srv.logger.Warn("trace spans dropped", "count", dropped)
+	}
+	if err := exportSpans(opts, batch); err != nil {
+		t.srv.logger.Warn("export traces", "endpoint", opts.TracesURL(), "spans", len(batch), "err", err)
+	}
+}
+
+// exportSpans posts batch to the collector as an OTLP
+// ExportTraceServiceRequest in the JSON encoding.
+func exportSpans(opts config.TracingOptions, batch []*span) error {
+	spans := make([]map[string]any, 0, len(batch))
+	for _, sp := range batch {
+		spans = append(spans, sp.otlp())
+	}
+	body, err := json.Marshal(map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{
+				"attributes": otlpAttributes([]any{"service.name", opts.ServiceName}),
+			},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]any{"name": "github.com/dollarkillerx/tinyssh"},
+				"spans": spans,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), tracingClient.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, opts.TracesURL(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range opts.Headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := tracingClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// otlp returns sp in the OTLP JSON encoding, where IDs are hex and 64-bit
+// integers are strings.
+func (sp *span) otlp() map[string]any {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	attrs := sp.attrs
+	if sp.connID != "" {
+		attrs = append([]any{"tinyssh.conn_id", sp.connID}, attrs...)
+	}
+	out := map[string]any{
+		"traceId":           hex.EncodeToString(sp.traceID[:]),
+		"spanId":            hex.EncodeToString(sp.spanID[:]),
+		"name":              sp.name,
+		"kind":              sp.kind,
+		"startTimeUnixNano": strconv.FormatInt(sp.start.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(sp.end.UnixNano(), 10),
+		"attributes":        otlpAttributes(attrs),
+	}
+	if sp.parentID != [8]byte{} {
+		out["parentSpanId"] = hex.EncodeToString(sp.parentID[:])
+	}
+	if len(sp.events) > 0 {
+		events := make([]any, 0, len(sp.events))
+		for _, e := range sp.events {
+			events = append(events, map[string]any{
+				"name":         e.name,
+				"timeUnixNano": strconv.FormatInt(e.at.UnixNano(), 10),
+				"attributes":   otlpAttributes(e.attrs),
+			})
+		}
+		out["events"] = events
+	}
+	if sp.failed {
+		out["status"] = map[string]any{"code": spanStatusError, "message": sp.errMsg}
+	}
+	return out
+}
+
+// otlpAttributes converts key/value pairs to OTLP KeyValues.
+func otlpAttributes(pairs []any) []any {
+	attrs := make([]any, 0, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		key, ok := pairs[i].(string)
+		if !ok {
+			continue
+		}
+		var value map[string]any
+		switch v := pairs[i+1].(type) {
+		case string:
+			value = map[string]any{"stringValue": v}
+		case bool:
+			value = map[string]any{"boolValue": v}
+		case int:
+			value = map[string]any{"intValue": strconv.FormatInt(int64(v), 10)}
+		case int64:
+			value = map[string]any{"intValue": strconv.FormatInt(v, 10)}
+		case uint32:
+			value = map[string]any{"intValue": strconv.FormatUint(uint64(v), 10)}
+		case float64:
+			value = map[string]any{"doubleValue": v}
+		case error:
+			value = map[string]any{"stringValue": v.Error()}
+		default:
+			value = map[string]any{"stringValue": fmt.Sprint(v)}
+		}
+		attrs = append(attrs, map[string]any{"key": key, "value": value})
+	}
+	return attrs
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"io"
+	"maps"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/dollarkillerx/tinyssh/internal/config"
+)
+
+// UserTraffic is the SSH traffic of one user since the server started, as
+// reported by the admin API. Bytes count the whole connection, sessions
+// and forwards alike.
+type UserTraffic struct {
+	User          string `json:"user"`
+	Connections   int    `json:"connections"`
+	BytesReceived uint64 `json:"bytes_received"`
+	BytesSent     uint64 `json:"bytes_sent"`
+}
+
+// trafficAccounts totals the bytes of each user's connections: those that
+// ended, plus the running counts of those still open.
+type trafficAccounts struct {
+	mu    sync.Mutex
+	users map[string]*userTraffic
+}
+
+type userTraffic struct {
+	received, sent uint64
+	open           map[*countedConn]struct{}
+}
+
+// trafficKey is the name the traffic of login is accounted under: the
+// account it logged in as, without any @upstream of a gateway login. Logins
+// admitted by the wildcard user share one total under its name, so guessed
+// names cannot grow the accounts or the metrics without bound.
+func trafficKey(cur *settings, login string) string {
+	if _, ok := cur.users[login]; ok {
+		return login
+	}
+	return config.WildcardUser
+}
+
+// track counts conn towards user until the returned function is called,
+// when the connection ends.
+func (a *trafficAccounts) track(user string, conn *countedConn) func() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.users == nil {
+		a.users = make(map[string]*userTraffic)
+	}
+	u := a.users[user]
+	if u == nil {
+		u = &userTraffic{open: make(map[*countedConn]struct{})}
+		a.users[user] = u
+	}
+	u.open[conn] = struct{}{}
+	return func() {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		u.received += conn.received.Load()
+		u.sent += conn.sent.Load()
+		delete(u.open, conn)
+	}
+}
+
+// snapshot returns the totals of every user that connected, by name.
+func (a *trafficAccounts) snapshot() []UserTraffic {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	totals := make([]UserTraffic, 0, len(a.users))
+	for _, name := range slices.Sorted(maps.Keys(a.users)) {
+		u := a.users[name]
+		t := UserTraffic{User: name, Connections: len(u.open), BytesReceived: u.received, BytesSent: u.sent}
+		for conn := range u.open {
+			t.BytesReceived += conn.received.Load()
+			t.BytesSent += conn.sent.Load()
+		}
+		totals = append(totals, t)
+	}
+	return totals
+}
+
+// countedChannel counts the data of a session channel: received from the
+// client, and sent to it on stdout and stderr.
+type countedChannel struct {
+	ssh.Channel
+	received atomic.Uint64
+	sent     atomic.Uint64
+}
+
+func (c *countedChannel) Read(p []byte) (int, error) {
+	n, err := c.Channel.Read(p)
+	c.received.Add(uint64(n))
+	return n, err
+}
+
+func (c *countedChannel) Write(p []byte) (int, error) {
+	n, err := c.Channel.Write(p)
+	c.sent.Add(uint64(n))
+	return n, err
+}
+
+func (c *countedChannel) Stderr() io.ReadWriter {
+	stderr := c.Channel.Stderr()
+	return struct {
+		io.Reader
+		io.Writer
+	}{stderr, countingWriter[uint64]{w: stderr, n: &c.sent}}
+}
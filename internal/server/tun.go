@@ -0,0 +1,157 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/dollarkillerx/tinyssh/internal/logging"
+)
+
+// Parameters of the tun@openssh.com channel (OpenSSH PROTOCOL, section 2.3).
+const (
+	tunModePointToPoint = 1
+	tunModeEthernet     = 2
+	tunUnitAny          = 0x7fffffff
+)
+
+// Address families prefixed to each packet on the wire, using OpenBSD's
+// numbering whatever the platform.
+const (
+	tunAFInet  = 2
+	tunAFInet6 = 24
+)
+
+// handleTunnel serves a tun@openssh.com channel (ssh -w) by attaching it to
+// a tun device. Configuring the device's addresses and routes is left to the
+// administrator, as with OpenSSH.
+func (f *forwarder) handleTunnel(newChannel ssh.NewChannel) {
+	var payload struct {
+		Mode uint32
+		Unit uint32
+	}
+	if err := ssh.Unmarshal(newChannel.ExtraData(), &payload); err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, "invalid payload")
+		return
+	}
+	if payload.Mode != tunModePointToPoint {
+		newChannel.Reject(ssh.Prohibited, "only point-to-point tunnels are supported")
+		return
+	}
+
+	dev, name, err := openTun(payload.Unit)
+	if err != nil {
+		f.logger.Warn("tun open failed", "user", f.conn.User(), "unit", payload.Unit, "err", err)
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		_ = dev.Close()
+		f.logger.Error("channel accept", "err", err)
+		return
+	}
+	go ssh.DiscardRequests(requests)
+
+	f.logger.Info("tun forwarding", logging.EventKey, logging.EventForward, "user", f.conn.User(), "device", name)
+	t := f.srv.tunnels.add("tun", f.conn.User(), f.conn.RemoteAddr().String(), name)
+	defer f.srv.tunnels.remove(t)
+
+	cur := f.srv.current.Load()
+	toDev := throttle(countingWriter[int64]{w: dev, n: &t.bytesIn}, newByteLimiter(f.account.ForwardRateLimit), cur.ingress)
+	toChannel := throttle(countingWriter[int64]{w: channel, n: &t.bytesOut}, newByteLimiter(f.account.ForwardRateLimit), cur.egress)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		err := readTunPackets(dev, toChannel)
+		f.logger.Debug("tun device closed", "device", name, "err", err)
+		_ = channel.Close()
+	}()
+	go func() {
+		defer wg.Done()
+		err := readChannelPackets(channel, toDev)
+		f.logger.Debug("tun channel closed", "device", name, "err", err)
+		_ = dev.Close()
+	}()
+	wg.Wait()
+	f.logger.Info("tun forwarding ended", "user", f.conn.User(), "device", name)
+}
+
+// readTunPackets copies packets from the device to w, each prefixed with
+// its address family and written on its own so it leaves as one channel
+// data message.
+func readTunPackets(dev io.Reader, w io.Writer) error {
+	buf := make([]byte, 4+65535)
+	for {
+		n, err := dev.Read(buf[4:])
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			continue
+		}
+		switch buf[4] >> 4 {
+		case 4:
+			binary.BigEndian.PutUint32(buf, tunAFInet)
+		case 6:
+			binary.BigEndian.PutUint32(buf, tunAFInet6)
+		default:
+			continue
+		}
+		if _, err := w.Write(buf[:4+n]); err != nil {
+			return err
+		}
+	}
+}
+
+// readChannelPackets splits the channel's byte stream back into packets and
+// writes each to the device without its address family. x/crypto/ssh does
+// not preserve message boundaries, so packets are delimited using the
+// length in their IP header.
+func readChannelPackets(channel io.Reader, dev io.Writer) error {
+	r := bufio.NewReaderSize(channel, 4+65535)
+	buf := make([]byte, 65535)
+	for {
+		header, err := r.Peek(4 + 6)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+
+		var size int
+		switch ip := header[4:]; ip[0] >> 4 {
+		case 4:
+			size = int(binary.BigEndian.Uint16(ip[2:4]))
+		case 6:
+			size = 40 + int(binary.BigEndian.Uint16(ip[4:6]))
+		default:
+			return fmt.Errorf("unknown IP version %d", ip[0]>>4)
+		}
+		if size < 20 || size > len(buf) {
+			return fmt.Errorf("invalid packet size %d", size)
+		}
+
+		if _, err := r.Discard(4); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(r, buf[:size]); err != nil {
+			return err
+		}
+		// The kernel refuses packets while the interface is down; drop
+		// them like any network device would.
+		if _, err := dev.Write(buf[:size]); errors.Is(err, os.ErrClosed) {
+			return err
+		}
+	}
+}
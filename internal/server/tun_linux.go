@@ -0,0 +1,43 @@
+//go:build linux
+
+package server
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// openTun creates a tun device without packet information headers. unit
+// selects tunN; tunUnitAny lets the kernel pick. Requires CAP_NET_ADMIN.
+func openTun(unit uint32) (io.ReadWriteCloser, string, error) {
+	fd, err := unix.Open("/dev/net/tun", unix.O_RDWR|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, "", fmt.Errorf("open /dev/net/tun: %w", err)
+	}
+
+	name := "tun%d"
+	if unit != tunUnitAny {
+		name = fmt.Sprintf("tun%d", unit)
+	}
+	ifr, err := unix.NewIfreq(name)
+	if err != nil {
+		_ = unix.Close(fd)
+		return nil, "", err
+	}
+	ifr.SetUint16(unix.IFF_TUN | unix.IFF_NO_PI)
+	if err := unix.IoctlIfreq(fd, unix.TUNSETIFF, ifr); err != nil {
+		_ = unix.Close(fd)
+		return nil, "", fmt.Errorf("create %s: %w", name, err)
+	}
+
+	// Non-blocking so the runtime poller serves reads and Close interrupts
+	// them.
+	if err := unix.SetNonblock(fd, true); err != nil {
+		_ = unix.Close(fd)
+		return nil, "", err
+	}
+	return os.NewFile(uintptr(fd), "/dev/net/tun"), ifr.Name(), nil
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package server
+
+import (
+	"errors"
+	"io"
+)
+
+func openTun(unit uint32) (io.ReadWriteCloser, string, error) {
+	return nil, "", errors.New("tun devices are only supported on linux")
+}
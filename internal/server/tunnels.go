@@ -0,0 +1,105 @@
+package server
+
+import (
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TunnelInfo is a snapshot of one active forward, as reported by the admin
+// API.
+type TunnelInfo struct {
+	ID       uint64    `json:"id"`
+	Kind     string    `json:"kind"`
+	User     string    `json:"user"`
+	Remote   string    `json:"remote"`
+	Target   string    `json:"target"`
+	Started  time.Time `json:"started"`
+	Age      string    `json:"age"`
+	BytesIn  int64     `json:"bytes_in"`
+	BytesOut int64     `json:"bytes_out"`
+}
+
+// tunnel tracks an active forwarded channel or remote-forward listener.
+// BytesIn counts data sent by the client, BytesOut data sent to it.
+type tunnel struct {
+	id      uint64
+	kind    string
+	user    string
+	remote  string
+	target  string
+	started time.Time
+
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+}
+
+// tunnelRegistry holds every active tunnel of the server.
+type tunnelRegistry struct {
+	mu      sync.Mutex
+	nextID  uint64
+	tunnels map[uint64]*tunnel
+}
+
+func (r *tunnelRegistry) add(kind, user, remote, target string) *tunnel {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.tunnels == nil {
+		r.tunnels = make(map[uint64]*tunnel)
+	}
+	r.nextID++
+	t := &tunnel{
+		id:      r.nextID,
+		kind:    kind,
+		user:    user,
+		remote:  remote,
+		target:  target,
+		started: time.Now(),
+	}
+	r.tunnels[t.id] = t
+	return t
+}
+
+func (r *tunnelRegistry) remove(t *tunnel) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.tunnels, t.id)
+}
+
+// snapshot returns the active tunnels ordered by ID.
+func (r *tunnelRegistry) snapshot() []TunnelInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	infos := make([]TunnelInfo, 0, len(r.tunnels))
+	for _, t := range r.tunnels {
+		infos = append(infos, TunnelInfo{
+			ID:       t.id,
+			Kind:     t.kind,
+			User:     t.user,
+			Remote:   t.remote,
+			Target:   t.target,
+			Started:  t.started,
+			Age:      now.Sub(t.started).Truncate(time.Second).String(),
+			BytesIn:  t.bytesIn.Load(),
+			BytesOut: t.bytesOut.Load(),
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+// countingWriter adds the number of bytes written to w to n, an
+// atomic.Int64 or atomic.Uint64.
+type countingWriter[T int64 | uint64] struct {
+	w io.Writer
+	n interface{ Add(T) T }
+}
+
+func (c countingWriter[T]) Write(p []byte) (int, error) {
+	written, err := c.w.Write(p)
+	c.n.Add(T(written))
+	return written, err
+}
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dollarkillerx/tinyssh/internal/awsauth"
+	"github.com/dollarkillerx/tinyssh/internal/config"
+)
+
+// uploadTimeout bounds one upload attempt.
+const uploadTimeout = 10 * time.Minute
+
+// uploadAttempts is how often a file is tried before it is left on disk.
+const uploadAttempts = 5
+
+var uploadClient = &http.Client{Timeout: uploadTimeout}
+
+// uploadJob is a finished file to ship, with the session details its key
+// prefix is built from.
+type uploadJob struct {
+	path  string
+	user  string
+	start time.Time
+}
+
+// uploader ships finished files to the bucket of the upload settings in
+// effect, one at a time and in the background, so sessions never wait for
+// it. Files that cannot be uploaded stay on disk and are logged.
+type uploader struct {
+	srv   *Server
+	queue chan uploadJob
+	creds *cachedCredential[awsauth.Credentials]
+}
+
+func newUploader(s *Server) *uploader {
+	u := &uploader{
+		srv:   s,
+		queue: make(chan uploadJob, 256),
+		creds: &cachedCredential[awsauth.Credentials]{fetch: awsauth.FetchCredentials},
+	}
+	go u.run()
+	return u
+}
+
+// uploadLogUser is what {user} expands to in the keys of rotated logs.
+const uploadLogUser = "_log"
+
+// UploadLog schedules the upload of a rotated log file if uploads are
+// configured, with delete_after_upload applying to it as to recordings.
+// Its key prefix uses the time of rotation.
+func (s *Server) UploadLog(path string) {
+	s.uploads.enqueue(path, uploadLogUser, time.Now())
+}
+
+// enqueue schedules the upload of path if uploads are configured.
+func (u *uploader) enqueue(path, user string, start time.Time) {
+	if !u.srv.config().Upload.Enabled() {
+		return
+	}
+	select {
+	case u.queue <- uploadJob{path: path, user: user, start: start}:
+	default:
+		u.srv.logger.Warn("upload queue full, keeping file", "path", path)
+	}
+}
+
+func (u *uploader) run() {
+	for job := range u.queue {
+		opts := u.srv.config().Upload
+		key := uploadKey(opts.Prefix, job)
+		var err error
+		for attempt := range uploadAttempts {
+			if attempt > 0 {
+				time.Sleep(time.Duration(1<<attempt) * time.Second)
+			}
+			if err = u.put(opts, key, job.path); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			u.srv.logger.Error("upload failed, keeping file", "path", job.path, "bucket", opts.Bucket, "key", key, "err", err)
+			continue
+		}
+		u.srv.logger.Info("uploaded", "path", job.path, "bucket", opts.Bucket, "key", key)
+		if opts.DeleteAfterUpload {
+			if err := os.Remove(job.path); err != nil {
+				u.srv.logger.Warn("delete uploaded file", "path", job.path, "err", err)
+			}
+		}
+	}
+}
+
+// uploadKey expands the placeholders of prefix for job and appends the
+// file name.
+func uploadKey(prefix string, job uploadJob) string {
+	start := job.start.UTC()
+	key := strings.NewReplacer(
+		"{date}", start.Format("2006-01-02"),
+		"{year}", start.Format("2006"),
+		"{month}", start.Format("01"),
+		"{day}", start.Format("02"),
+		"{user}", recordingName(job.user),
+	).Replace(prefix)
+	return strings.TrimPrefix(key, "/") + filepath.Base(job.path)
+}
+
+// put uploads the file at path to key with a SigV4-signed PUT. The file is
+// read twice, to hash and to send it, so it is never held in memory.
+func (u *uploader) put(opts config.UploadOptions, key, path string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), uploadTimeout)
+	defer cancel()
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	size, err := io.Copy(hash, f)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	region := cmp.Or(opts.Region, awsauth.Region())
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, awsauth.S3ObjectURL(opts.Endpoint, region, opts.Bucket, key), f)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	creds, err := u.creds.get(ctx)
+	if err != nil {
+		return fmt.Errorf("aws credentials: %w", err)
+	}
+	header := http.Header{}
+	header.Set("Content-Type", "application/octet-stream")
+	awsauth.SignHash(header, http.MethodPut, req.URL, hex.EncodeToString(hash.Sum(nil)), creds, region, "s3", time.Now())
+	req.Header = header
+
+	resp, err := uploadClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
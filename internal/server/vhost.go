@@ -0,0 +1,204 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"sync"
+	"time"
+)
+
+// vhostPort is the bind port that turns a named remote forward into an HTTP
+// vhost: "ssh -R name:80:localhost:3000" is served as name.<domain>.
+const vhostPort = 80
+
+// vhostRouter maps vhost names to the virtual listeners of the forwards
+// serving them.
+type vhostRouter struct {
+	mu     sync.Mutex
+	routes map[string]*vhostListener
+}
+
+func (r *vhostRouter) listen(name string) (*vhostListener, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.routes == nil {
+		r.routes = make(map[string]*vhostListener)
+	}
+	if _, exists := r.routes[name]; exists {
+		return nil, fmt.Errorf("vhost %s is already served", name)
+	}
+	l := &vhostListener{
+		router: r,
+		name:   name,
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+	r.routes[name] = l
+	return l, nil
+}
+
+func (r *vhostRouter) lookup(name string) *vhostListener {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.routes[name]
+}
+
+func (r *vhostRouter) remove(l *vhostListener) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.routes[l.name] == l {
+		delete(r.routes, l.name)
+	}
+}
+
+// vhostListener is the virtual listener behind a vhost forward. Each
+// connection the front end proxies arrives through Accept as one end of a
+// pipe, so it is handed to the client like any other remote-forward
+// connection.
+type vhostListener struct {
+	router *vhostRouter
+	name   string
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (l *vhostListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *vhostListener) Close() error {
+	l.once.Do(func() {
+		close(l.closed)
+		l.router.remove(l)
+	})
+	return nil
+}
+
+func (l *vhostListener) Addr() net.Addr {
+	return vhostAddr(net.JoinHostPort(l.name, "80"))
+}
+
+// dial hands a new connection from origin to the forward and returns the
+// front end's side of it.
+func (l *vhostListener) dial(ctx context.Context, origin *net.TCPAddr) (net.Conn, error) {
+	if origin == nil {
+		origin = &net.TCPAddr{IP: net.IPv4zero}
+	}
+	local, remote := net.Pipe()
+	select {
+	case l.conns <- originConn{Conn: remote, origin: origin}:
+		return local, nil
+	case <-l.closed:
+	case <-ctx.Done():
+	}
+	_ = local.Close()
+	_ = remote.Close()
+	return nil, fmt.Errorf("vhost %s is not available", l.name)
+}
+
+type vhostAddr string
+
+func (a vhostAddr) Network() string { return "vhost" }
+func (a vhostAddr) String() string  { return string(a) }
+
+// originConn reports the HTTP client as the remote address of a pipe, so the
+// forwarded-tcpip channel carries the real origin.
+type originConn struct {
+	net.Conn
+	origin *net.TCPAddr
+}
+
+func (c originConn) RemoteAddr() net.Addr { return c.origin }
+
+type originKey struct{}
+
+// serveVHost runs the HTTP(S) front end on listener until ctx is cancelled.
+func (s *Server) serveVHost(ctx context.Context, listener net.Listener) {
+	s.logger.Info("vhost listening", "address", listener.Addr().String(), "domain", s.config().VHost.Domain)
+
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+			name, _, _ := net.SplitHostPort(addr)
+			l := s.vhosts.lookup(name)
+			if l == nil {
+				return nil, fmt.Errorf("vhost %s is not available", name)
+			}
+			origin, _ := ctx.Value(originKey{}).(*net.TCPAddr)
+			return l.dial(ctx, origin)
+		},
+		MaxIdleConnsPerHost: 16,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			name := pr.In.Context().Value(vhostNameKey{}).(string)
+			pr.Out.URL.Scheme = "http"
+			pr.Out.URL.Host = net.JoinHostPort(name, "80")
+			pr.SetXForwarded()
+		},
+		Transport: transport,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			s.logger.Debug("vhost proxy", "host", r.Host, "err", err)
+			http.Error(w, "tunnel unavailable", http.StatusBadGateway)
+		},
+	}
+
+	httpSrv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			name, ok := s.vhostName(r.Host)
+			if !ok || s.vhosts.lookup(name) == nil {
+				http.Error(w, "no tunnel for "+r.Host, http.StatusNotFound)
+				return
+			}
+			ctx := context.WithValue(r.Context(), vhostNameKey{}, name)
+			if origin, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+				ctx = context.WithValue(ctx, originKey{}, origin)
+			}
+			proxy.ServeHTTP(w, r.WithContext(ctx))
+		}),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = httpSrv.Shutdown(shutdownCtx)
+	}()
+
+	var err error
+	if s.config().VHost.TLSCert != "" {
+		err = httpSrv.ServeTLS(listener, s.config().VHost.TLSCert, s.config().VHost.TLSKey)
+	} else {
+		err = httpSrv.Serve(listener)
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		s.logger.Error("vhost stopped", "err", err)
+	}
+}
+
+type vhostNameKey struct{}
+
+// vhostName extracts the tunnel name from a Host header of the form
+// <name>.<domain>[:port].
+func (s *Server) vhostName(host string) (string, bool) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	name, ok := strings.CutSuffix(host, "."+s.config().VHost.Domain)
+	if !ok || !isReservationName(name) {
+		return "", false
+	}
+	return name, true
+}
@@ -0,0 +1,290 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dollarkillerx/tinyssh/internal/config"
+)
+
+const (
+	// webhookAttempts is how often a notification is tried before it is
+	// dropped.
+	webhookAttempts = 5
+	// maxKnownSources bounds the addresses remembered per user; the least
+	// recently seen are forgotten first.
+	maxKnownSources = 100
+	// maxFailureSources bounds the addresses whose failed logins are
+	// counted at once.
+	maxFailureSources = 10000
+)
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// webhookEvent is what a webhook is sent. Its fields are also what body
+// templates see.
+type webhookEvent struct {
+	Event    string    `json:"event"`
+	Time     time.Time `json:"time"`
+	Host     string    `json:"host"`
+	User     string    `json:"user,omitempty"`
+	Address  string    `json:"address,omitempty"`
+	ConnID   string    `json:"conn_id,omitempty"`
+	Duration string    `json:"duration,omitempty"`
+	Failures int       `json:"failures,omitempty"`
+	Message  string    `json:"message"`
+}
+
+type webhookJob struct {
+	endpoint config.Webhook
+	event    webhookEvent
+}
+
+// notifier sends webhook notifications in the background, one at a time,
+// so logins never wait for them. It counts failed logins per address and
+// remembers the addresses each user logged in from.
+type notifier struct {
+	srv   *Server
+	queue chan webhookJob
+	host  string
+
+	mu       sync.Mutex
+	failures map[string][]time.Time
+	// sources maps users to the addresses they logged in from and when,
+	// as last saved to sourcesPath.
+	sources     map[string]map[string]time.Time
+	sourcesPath string
+}
+
+func newNotifier(s *Server) *notifier {
+	host, _ := os.Hostname()
+	n := &notifier{srv: s, queue: make(chan webhookJob, 256), host: host, failures: make(map[string][]time.Time)}
+	go n.run()
+	return n
+}
+
+// login notifies of a login and, if the user logged in from other
+// addresses before but never from this one, of the new source.
+func (n *notifier) login(connID, user string, remote net.Addr) {
+	opts := n.srv.config().Webhooks
+	if !opts.Enabled() {
+		return
+	}
+	address := webhookAddress(remote)
+	n.send(opts, webhookEvent{Event: config.WebhookLogin, User: user, Address: address, ConnID: connID,
+		Message: fmt.Sprintf("%s logged in from %s", user, address)})
+	if n.newSource(opts, user, address) {
+		n.send(opts, webhookEvent{Event: config.WebhookNewSource, User: user, Address: address, ConnID: connID,
+			Message: fmt.Sprintf("%s logged in from new address %s", user, address)})
+	}
+}
+
+// logout notifies of the end of a connection that began at start.
+func (n *notifier) logout(connID, user string, remote net.Addr, start time.Time) {
+	opts := n.srv.config().Webhooks
+	if !opts.Enabled() {
+		return
+	}
+	address := webhookAddress(remote)
+	duration := time.Since(start).Round(time.Second)
+	n.send(opts, webhookEvent{Event: config.WebhookLogout, User: user, Address: address, ConnID: connID, Duration: duration.String(),
+		Message: fmt.Sprintf("%s from %s logged out after %s", user, address, duration)})
+}
+
+// authFailure counts a failed login from remote and notifies once the
+// failures within the window reach the threshold.
+func (n *notifier) authFailure(user string, remote net.Addr) {
+	opts := n.srv.config().Webhooks
+	if !opts.Enabled() {
+		return
+	}
+	address := webhookAddress(remote)
+	now := time.Now()
+	window := time.Duration(opts.AuthFailureWindow) * time.Second
+
+	n.mu.Lock()
+	if len(n.failures) >= maxFailureSources {
+		for a, times := range n.failures {
+			if now.Sub(times[len(times)-1]) > window {
+				delete(n.failures, a)
+			}
+		}
+	}
+	times := n.failures[address]
+	for len(times) > 0 && now.Sub(times[0]) > window {
+		times = times[1:]
+	}
+	times = append(times, now)
+	n.failures[address] = times
+	count := len(times)
+	n.mu.Unlock()
+
+	// Only the failure that reaches the threshold notifies, so an ongoing
+	// attack does not send one request per attempt.
+	if count == opts.AuthFailureThreshold {
+		n.send(opts, webhookEvent{Event: config.WebhookAuthFailures, User: user, Address: address, Failures: count,
+			Message: fmt.Sprintf("%d failed logins from %s within %s, the last as %s", count, address, window, user)})
+	}
+}
+
+// newSource records that user logged in from address and reports whether
+// that is new for a user with earlier logins. The first address of a user
+// is not reported, so turning webhooks on does not report every user.
+func (n *notifier) newSource(opts config.WebhookOptions, user, address string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.sources == nil || n.sourcesPath != opts.KnownSourcesPath {
+		n.sourcesPath = opts.KnownSourcesPath
+		n.sources = make(map[string]map[string]time.Time)
+		raw, err := os.ReadFile(n.sourcesPath)
+		if err == nil {
+			err = json.Unmarshal(raw, &n.sources)
+		}
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			n.srv.logger.Warn("load known sources", "path", n.sourcesPath, "err", err)
+		}
+	}
+
+	known := n.sources[user]
+	_, seen := known[address]
+	isNew := !seen && len(known) > 0
+	if known == nil {
+		known = make(map[string]time.Time)
+		n.sources[user] = known
+	}
+	known[address] = time.Now().UTC().Truncate(time.Second)
+	if len(known) > maxKnownSources {
+		oldest := slices.MinFunc(slices.Collect(maps.Keys(known)), func(a, b string) int {
+			return known[a].Compare(known[b])
+		})
+		delete(known, oldest)
+	}
+	if err := n.saveSourcesLocked(); err != nil {
+		n.srv.logger.Warn("save known sources", "path", n.sourcesPath, "err", err)
+	}
+	return isNew
+}
+
+// saveSourcesLocked writes the known sources atomically with owner-only
+// permissions.
+func (n *notifier) saveSourcesLocked() error {
+	raw, err := json.MarshalIndent(n.sources, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(n.sourcesPath), ".known-sources-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(raw, '\n')); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), n.sourcesPath)
+}
+
+// webhookAddress returns the IP address of remote, or all of it when it is
+// not a TCP address.
+func webhookAddress(remote net.Addr) string {
+	if ip, ok := addrIP(remote); ok {
+		return ip.String()
+	}
+	return remote.String()
+}
+
+// send queues event for every endpoint that wants it.
+func (n *notifier) send(opts config.WebhookOptions, event webhookEvent) {
+	event.Time = time.Now().UTC()
+	event.Host = n.host
+	for _, endpoint := range opts.Endpoints {
+		if !endpoint.Wants(event.Event) {
+			continue
+		}
+		select {
+		case n.queue <- webhookJob{endpoint: endpoint, event: event}:
+		default:
+			n.srv.logger.Warn("webhook queue full, dropping notification", "url", endpoint.URL, "event", event.Event)
+		}
+	}
+}
+
+func (n *notifier) run() {
+	for job := range n.queue {
+		var err error
+		for attempt := range webhookAttempts {
+			if attempt > 0 {
+				time.Sleep(time.Duration(1<<attempt) * time.Second)
+			}
+			if err = postWebhook(job.endpoint, job.event); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			n.srv.logger.Error("webhook failed", "url", job.endpoint.URL, "event", job.event.Event, "err", err)
+		}
+	}
+}
+
+// postWebhook sends event to endpoint in its format or template.
+func postWebhook(endpoint config.Webhook, event webhookEvent) error {
+	var body bytes.Buffer
+	contentType := "application/json"
+	switch {
+	case endpoint.Template != "":
+		tmpl, err := config.WebhookTemplate(endpoint.Template)
+		if err != nil {
+			return err
+		}
+		if err := tmpl.Execute(&body, event); err != nil {
+			return err
+		}
+		contentType = endpoint.ContentType
+	case endpoint.Format == config.WebhookSlack:
+		if err := json.NewEncoder(&body).Encode(map[string]string{"text": "tinyssh on " + event.Host + ": " + event.Message}); err != nil {
+			return err
+		}
+	default:
+		if err := json.NewEncoder(&body).Encode(event); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), webhookClient.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint.URL, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	for key, value := range endpoint.Headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
@@ -0,0 +1,270 @@
+package server
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// websocketGUID is appended to Sec-WebSocket-Key to form the accept value
+// (RFC 6455, section 1.3).
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket opcodes (RFC 6455, section 5.2).
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+// websocketHandshakeTimeout bounds how long a client may take to send its
+// upgrade request.
+const websocketHandshakeTimeout = 10 * time.Second
+
+// upgradeWebSocket reads the client's opening handshake from conn and
+// accepts it (RFC 6455, section 4.2) when it targets a URL under path.
+// Anything else is answered with an HTTP error and closed. Listeners call it
+// only for connections that passed admission, so refused addresses cannot
+// hold a header read open.
+func upgradeWebSocket(conn net.Conn, path string) (*wsConn, error) {
+	_ = conn.SetReadDeadline(time.Now().Add(websocketHandshakeTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	r := bufio.NewReader(conn)
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		return nil, fmt.Errorf("read upgrade request: %w", err)
+	}
+	status, err := checkWebSocketUpgrade(req)
+	if err == nil && !strings.HasPrefix(req.URL.Path, path) {
+		status, err = http.StatusNotFound, fmt.Errorf("path %s not served", req.URL.Path)
+	}
+	if err != nil {
+		fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\nSec-WebSocket-Version: 13\r\nContent-Length: 0\r\nConnection: close\r\n\r\n",
+			status, http.StatusText(status))
+		return nil, err
+	}
+	return acceptWebSocket(conn, r, req)
+}
+
+// checkWebSocketUpgrade validates an opening handshake, returning the HTTP
+// status to reject it with.
+func checkWebSocketUpgrade(req *http.Request) (int, error) {
+	switch {
+	case req.Method != http.MethodGet:
+		return http.StatusMethodNotAllowed, errors.New("not a GET request")
+	case !headerHasToken(req.Header, "Connection", "upgrade") || !headerHasToken(req.Header, "Upgrade", "websocket"):
+		return http.StatusUpgradeRequired, errors.New("not a websocket upgrade")
+	case req.Header.Get("Sec-WebSocket-Version") != "13":
+		return http.StatusUpgradeRequired, errors.New("unsupported websocket version")
+	case req.Header.Get("Sec-WebSocket-Key") == "":
+		return http.StatusBadRequest, errors.New("missing Sec-WebSocket-Key")
+	}
+	return 0, nil
+}
+
+// acceptWebSocket answers a validated handshake on conn, whose buffered
+// reader r may already hold the client's first frames.
+func acceptWebSocket(conn net.Conn, r *bufio.Reader, req *http.Request) (*wsConn, error) {
+	sum := sha1.Sum([]byte(req.Header.Get("Sec-WebSocket-Key") + websocketGUID))
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n"
+	if _, err := conn.Write([]byte(response)); err != nil {
+		return nil, err
+	}
+	return &wsConn{Conn: conn, r: r}, nil
+}
+
+// headerHasToken reports whether the comma-separated header name contains
+// token, compared case-insensitively.
+func headerHasToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, field := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(field), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wsConn carries a byte stream in WebSocket data frames. Incoming message
+// boundaries are ignored; each Write is sent as one binary frame.
+type wsConn struct {
+	net.Conn
+	r *bufio.Reader
+
+	// Read state for the data frame in progress.
+	remaining uint64
+	mask      [4]byte
+	maskPos   int
+	opcode    byte
+	fin       bool
+
+	writeMu sync.Mutex
+	closed  bool
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for c.remaining == 0 {
+		if err := c.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+	if uint64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.r.Read(p)
+	for i := range n {
+		p[i] ^= c.mask[c.maskPos&3]
+		c.maskPos++
+	}
+	c.remaining -= uint64(n)
+	return n, err
+}
+
+// nextFrame reads frame headers, answering control frames, until a data
+// frame starts.
+func (c *wsConn) nextFrame() error {
+	var header [2]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		return err
+	}
+	opcode := header[0] & 0x0f
+	if header[1]&0x80 == 0 {
+		return errors.New("websocket: unmasked client frame")
+	}
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if _, err := io.ReadFull(c.r, c.mask[:]); err != nil {
+		return err
+	}
+	c.maskPos = 0
+
+	switch opcode {
+	case wsContinuation, wsText, wsBinary:
+		c.remaining, c.opcode, c.fin = length, opcode, header[0]&0x80 != 0
+		return nil
+	case wsClose, wsPing, wsPong:
+		if length > 125 {
+			return errors.New("websocket: control frame too long")
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.r, payload); err != nil {
+			return err
+		}
+		for i := range payload {
+			payload[i] ^= c.mask[i&3]
+		}
+		switch opcode {
+		case wsClose:
+			// Echo the status code, then end the stream.
+			_ = c.writeFrame(wsClose, payload[:min(len(payload), 2)])
+			return io.EOF
+		case wsPing:
+			return c.writeFrame(wsPong, payload)
+		}
+		return nil
+	default:
+		return fmt.Errorf("websocket: unknown opcode %d", opcode)
+	}
+}
+
+// readMessage reads a whole data message of at most limit bytes and
+// returns its opcode (wsText or wsBinary). It must not be mixed with Read.
+func (c *wsConn) readMessage(limit int) (byte, []byte, error) {
+	var opcode byte
+	var msg []byte
+	for {
+		if err := c.nextFrame(); err != nil {
+			return 0, nil, err
+		}
+		if c.opcode != wsContinuation {
+			opcode = c.opcode
+		}
+		if uint64(len(msg))+c.remaining > uint64(limit) {
+			return 0, nil, errors.New("websocket: message too long")
+		}
+		frame := make([]byte, c.remaining)
+		if _, err := io.ReadFull(c.r, frame); err != nil {
+			return 0, nil, err
+		}
+		for i := range frame {
+			frame[i] ^= c.mask[i&3]
+		}
+		msg = append(msg, frame...)
+		c.remaining = 0
+		if c.fin {
+			return opcode, msg, nil
+		}
+	}
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	if err := c.writeFrame(wsBinary, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// writeFrame sends one unmasked, final frame.
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	frame := make([]byte, 0, 10+len(payload))
+	frame = append(frame, 0x80|opcode)
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, byte(n))
+	case n <= 0xffff:
+		frame = append(frame, 126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame = append(frame, 127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+	frame = append(frame, payload...)
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	_, err := c.Conn.Write(frame)
+	return err
+}
+
+// Close sends a normal closure frame before closing the connection.
+func (c *wsConn) Close() error {
+	_ = c.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+	_ = c.writeFrame(wsClose, []byte{0x03, 0xe8}) // 1000
+	c.writeMu.Lock()
+	c.closed = true
+	c.writeMu.Unlock()
+	return c.Conn.Close()
+}
@@ -0,0 +1,198 @@
+package server
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// webTerminalAssets locates the xterm.js files the terminal page loads.
+type webTerminalAssets struct {
+	XtermJS  string
+	XtermCSS string
+	FitJS    string
+}
+
+var xtermCDN = webTerminalAssets{
+	XtermJS:  "https://cdn.jsdelivr.net/npm/@xterm/xterm@5.5.0/lib/xterm.js",
+	XtermCSS: "https://cdn.jsdelivr.net/npm/@xterm/xterm@5.5.0/css/xterm.css",
+	FitJS:    "https://cdn.jsdelivr.net/npm/@xterm/addon-fit@0.10.0/lib/addon-fit.js",
+}
+
+//go:embed webterm.html
+var webTerminalHTML string
+
+var webTerminalPage = template.Must(template.New("webterm").Parse(webTerminalHTML))
+
+const (
+	// webTerminalLoginTimeout bounds how long the page may take to send
+	// the login message after connecting.
+	webTerminalLoginTimeout = time.Minute
+	// webTerminalMaxMessage caps one message from the browser, e.g. a
+	// large paste.
+	webTerminalMaxMessage = 1 << 20
+)
+
+// serveWebTerminal serves the terminal page and its WebSocket endpoint.
+func (s *Server) serveWebTerminal(ctx context.Context, listener net.Listener) {
+	opts := s.config().WebTerminal
+	assets := xtermCDN
+	mux := http.NewServeMux()
+	if opts.AssetsDir != "" {
+		assets = webTerminalAssets{XtermJS: "assets/xterm.js", XtermCSS: "assets/xterm.css", FitJS: "assets/addon-fit.js"}
+		mux.Handle("GET /assets/", http.StripPrefix("/assets/", http.FileServer(http.Dir(opts.AssetsDir))))
+	}
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("X-Frame-Options", "DENY")
+		_ = webTerminalPage.Execute(w, assets)
+	})
+	mux.HandleFunc("GET /ws", func(w http.ResponseWriter, r *http.Request) {
+		if status, err := checkWebSocketUpgrade(r); err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		conn, rw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		ws, err := acceptWebSocket(conn, rw.Reader, r)
+		if err != nil {
+			_ = conn.Close()
+			return
+		}
+		defer ws.Close()
+		if err := s.webTerminal(ctx, ws); err != nil {
+			s.logger.Warn("web terminal", "remote", ws.RemoteAddr().String(), "err", err)
+		}
+	})
+
+	httpSrv := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = httpSrv.Shutdown(shutdownCtx)
+	}()
+
+	s.logger.Info("web terminal listening", "address", listener.Addr().String())
+	var err error
+	if opts.TLSCert != "" {
+		err = httpSrv.ServeTLS(listener, opts.TLSCert, opts.TLSKey)
+	} else {
+		err = httpSrv.Serve(listener)
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		s.logger.Error("web terminal stopped", "err", err)
+	}
+}
+
+// webTerminal logs in with the credentials from the page's first message
+// and bridges ws to a shell. The login goes through an in-memory SSH
+// connection to this server, so authentication, admission limits and
+// per-user restrictions are exactly those of an SSH client connecting
+// from the browser's address to the first listener.
+func (s *Server) webTerminal(ctx context.Context, ws *wsConn) error {
+	var login struct {
+		User     string `json:"user"`
+		Password string `json:"password"`
+		Cols     int    `json:"cols"`
+		Rows     int    `json:"rows"`
+	}
+	_ = ws.SetReadDeadline(time.Now().Add(webTerminalLoginTimeout))
+	_, msg, err := ws.readMessage(webTerminalMaxMessage)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(msg, &login); err != nil {
+		return err
+	}
+	_ = ws.SetReadDeadline(time.Time{})
+
+	clientSide, serverSide, err := socketPair()
+	if err != nil {
+		return err
+	}
+	go func() {
+		conn := &addrConn{Conn: serverSide, remote: ws.RemoteAddr(), local: ws.LocalAddr()}
+		if err := s.handleConnection(ctx, conn, s.current.Load().listeners[0]); err != nil {
+			s.logger.Warn("connection ended", "remote", conn.RemoteAddr().String(), "err", err)
+		}
+	}()
+	sshConn, channels, requests, err := ssh.NewClientConn(clientSide, "web-terminal", &ssh.ClientConfig{
+		User: login.User,
+		Auth: []ssh.AuthMethod{ssh.Password(login.Password)},
+		// The server is this process at the other end of the pipe.
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		_ = clientSide.Close()
+		_ = ws.writeFrame(wsText, []byte("Login failed.\r\n"))
+		return nil
+	}
+	client := ssh.NewClient(sshConn, channels, requests)
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	session.Stdout = ws
+	session.Stderr = ws
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err := session.RequestPty("xterm-256color", max(login.Rows, 1), max(login.Cols, 1), ssh.TerminalModes{}); err != nil {
+		return err
+	}
+	if err := session.Shell(); err != nil {
+		return err
+	}
+	go func() {
+		_ = session.Wait()
+		_ = ws.Close()
+	}()
+
+	for {
+		opcode, msg, err := ws.readMessage(webTerminalMaxMessage)
+		if err != nil {
+			return nil
+		}
+		switch opcode {
+		case wsBinary:
+			if _, err := stdin.Write(msg); err != nil {
+				return nil
+			}
+		case wsText:
+			var size struct {
+				Cols int `json:"cols"`
+				Rows int `json:"rows"`
+			}
+			if json.Unmarshal(msg, &size) == nil && size.Cols > 0 && size.Rows > 0 {
+				_ = session.WindowChange(size.Rows, size.Cols)
+			}
+		}
+	}
+}
+
+// addrConn reports the given addresses instead of its own.
+type addrConn struct {
+	net.Conn
+	remote, local net.Addr
+}
+
+func (c *addrConn) RemoteAddr() net.Addr { return c.remote }
+func (c *addrConn) LocalAddr() net.Addr  { return c.local }
@@ -0,0 +1,96 @@
+// Package systemd implements the parts of the systemd service protocol
+// tinyssh uses: socket activation (sd_listen_fds) and state notification
+// (sd_notify), including watchdog keep-alives. Outside systemd every
+// function is a no-op.
+package systemd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd.
+const listenFDsStart = 3
+
+// Listeners returns the sockets passed by systemd socket activation, in
+// the order of the socket unit's Listen* lines. The LISTEN_* variables are
+// removed from the environment so user sessions do not inherit them.
+func Listeners() ([]net.Listener, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return nil, nil
+	}
+
+	listeners := make([]net.Listener, 0, count)
+	for fd := listenFDsStart; fd < listenFDsStart+count; fd++ {
+		file := os.NewFile(uintptr(fd), "systemd-socket-"+strconv.Itoa(fd))
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("systemd socket %d: %w", fd, err)
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+// Notifier sends service state changes to systemd.
+type Notifier struct {
+	socket   string
+	watchdog time.Duration
+}
+
+// NewNotifier reads NOTIFY_SOCKET and the watchdog settings and removes
+// them from the environment so user sessions cannot signal the service
+// manager. The returned Notifier does nothing when they are not set.
+func NewNotifier() *Notifier {
+	n := &Notifier{socket: os.Getenv("NOTIFY_SOCKET")}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	pid := os.Getenv("WATCHDOG_PID")
+	if err == nil && usec > 0 && (pid == "" || pid == strconv.Itoa(os.Getpid())) {
+		n.watchdog = time.Duration(usec) * time.Microsecond
+	}
+	os.Unsetenv("NOTIFY_SOCKET")
+	os.Unsetenv("WATCHDOG_USEC")
+	os.Unsetenv("WATCHDOG_PID")
+	return n
+}
+
+// Notify sends state, e.g. "READY=1" or "STOPPING=1", to systemd.
+func (n *Notifier) Notify(state string) error {
+	if n.socket == "" {
+		return nil
+	}
+	// A leading "@" selects the abstract namespace, as in systemd.
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: n.socket, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("sd_notify: %w", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("sd_notify: %w", err)
+	}
+	return nil
+}
+
+// WatchdogInterval returns how often the service must send "WATCHDOG=1",
+// or zero when the watchdog is disabled. It is half of WatchdogSec, as
+// recommended by sd_watchdog_enabled(3).
+func (n *Notifier) WatchdogInterval() time.Duration {
+	return n.watchdog / 2
+}